@@ -0,0 +1,253 @@
+// Package ambient embeds the naive virtual machine in Go programs.
+//
+// A Program is compiled once and can be run by any number of VMs, also
+// at once from several goroutines:
+//
+//	prog, err := ambient.Compile(strings.NewReader("psh 2 psh 3 sum out"))
+//	if err != nil {
+//		return err
+//	}
+//
+//	vm := ambient.NewVM(ambient.WithStdout(&out))
+//	err = vm.Run(ctx, prog)
+//
+// The stack of a VM is kept between runs: values pushed before Run are the
+// input of the program and the values it leaves are its result. Memory,
+// the call stack and the entities start empty on every run.
+package ambient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+	"github.com/jejikeh/ambient/vm"
+)
+
+// Errors a run can fail with, matched with errors.Is.
+var (
+	ErrStackUnderflow    error = vm.Error(vm.StackUnderflow)
+	ErrDivisionByZero    error = vm.Error(vm.DivisionByZero)
+	ErrAssertionFailed   error = vm.Error(vm.AssertionFailed)
+	ErrBudgetExceeded    error = vm.Error(vm.BudgetExceeded)
+	ErrIllegalMemory     error = vm.Error(vm.IllegalMemoryAccess)
+	ErrCallStackOverflow error = vm.Error(vm.CallStackOverflow)
+	ErrDeadlock          error = vm.Error(vm.Deadlock)
+)
+
+// checkEvery is the number of instructions run between two checks of the
+// context.
+const checkEvery = 1024
+
+// Program is a compiled program. It is not changed by running it.
+type Program struct {
+	program *vm.Program
+}
+
+func newProgram(instructions []token.Token) *Program {
+	return &Program{program: vm.NewProgram(instructions)}
+}
+
+// Compile compiles naive source. Files can not be included from a
+// reader, use CompileFile or CompileFS for programs which include others.
+func Compile(r io.Reader) (*Program, error) {
+	instructions, err := lexer.LoadReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(instructions), nil
+}
+
+// CompileFile compiles a naive source file and the files it includes.
+func CompileFile(path string) (*Program, error) {
+	instructions, err := lexer.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(instructions), nil
+}
+
+// CompileFS compiles a naive source file of fsys, such as an embed.FS,
+// and the files it includes.
+func CompileFS(fsys fs.FS, name string) (*Program, error) {
+	instructions, err := lexer.LoadFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(instructions), nil
+}
+
+// ReadProgram reads a program built with `ambient -build`.
+func ReadProgram(r io.Reader) (*Program, error) {
+	instructions, err := lexer.ReadTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(instructions), nil
+}
+
+// Option configures a VM.
+type Option func(*VM)
+
+// WithStdout sends what the program writes to w instead of os.Stdout.
+func WithStdout(w io.Writer) Option {
+	return func(v *VM) {
+		v.stdout = w
+	}
+}
+
+// WithStdin makes the program read from r. Without it, the input is
+// empty.
+func WithStdin(r io.Reader) Option {
+	return func(v *VM) {
+		v.stdin = r
+	}
+}
+
+// WithStepLimit stops runs after n instructions with ErrBudgetExceeded.
+func WithStepLimit(n int) Option {
+	return func(v *VM) {
+		v.stepLimit = n
+	}
+}
+
+// WithWorkers sets how many systems a `tick` runs at once, 0 for one per
+// CPU.
+func WithWorkers(n int) Option {
+	return func(v *VM) {
+		v.workers = n
+	}
+}
+
+// VM runs programs. It is not safe for concurrent use, run programs at
+// once on a VM each.
+type VM struct {
+	stdout    io.Writer
+	stdin     io.Reader
+	stepLimit int
+	workers   int
+
+	stack []int
+}
+
+func NewVM(opts ...Option) *VM {
+	v := &VM{stdout: os.Stdout, stepLimit: math.MaxInt}
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	return v
+}
+
+// Run runs a program from its start until it ends, fails, or ctx is done.
+func (v *VM) Run(ctx context.Context, p *Program) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	machine := vm.NewVirtualMachine()
+	machine.Program = p.program
+	machine.Stack = v.stack
+	machine.Output = v.stdout
+	machine.Input = v.stdin
+	machine.Workers = v.workers
+
+	// The program runs checkEvery instructions at a time, so that ctx is
+	// checked without leaving the compiled loop of the VM.
+	machine.Start(0, v.stepLimit)
+
+	err := machine.Continue(checkEvery)
+	for err == vm.BudgetExceeded && machine.Steps() < v.stepLimit && ctx.Err() == nil {
+		err = machine.Continue(checkEvery)
+	}
+
+	v.stack = machine.Stack
+
+	if err == vm.BudgetExceeded && machine.Steps() < v.stepLimit {
+		return ctx.Err()
+	}
+
+	if err == vm.Ok {
+		return ctx.Err()
+	}
+
+	return newRuntimeError(machine, err)
+}
+
+// Push pushes values onto the stack, the last one on top.
+func (v *VM) Push(values ...int) {
+	v.stack = append(v.stack, values...)
+}
+
+// Pop removes the top of the stack.
+func (v *VM) Pop() (int, error) {
+	if len(v.stack) == 0 {
+		return 0, ErrStackUnderflow
+	}
+
+	value := v.stack[len(v.stack)-1]
+	v.stack = v.stack[:len(v.stack)-1]
+
+	return value, nil
+}
+
+// Stack returns a copy of the stack, the top last.
+func (v *VM) Stack() []int {
+	return append([]int{}, v.stack...)
+}
+
+// RuntimeError is a run that failed at an instruction. Line and Column are
+// 1-based, File is only set for instructions of included files.
+type RuntimeError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+
+	err error
+}
+
+func newRuntimeError(machine *vm.VirtualMachine, err vm.Error) *RuntimeError {
+	e := &RuntimeError{Message: string(err), err: err}
+
+	if err == vm.AssertionFailed && machine.LastAssertion != nil {
+		e.File, e.Line, e.Column = machine.LastAssertion.File, machine.LastAssertion.Line, machine.LastAssertion.Column
+		e.Message = fmt.Sprintf("%s: %s", err, machine.LastAssertion.Message)
+		return e
+	}
+
+	if err == vm.Deadlock && machine.LastDeadlock != nil {
+		e.Message = machine.LastDeadlock.Error()
+	}
+
+	if ip := machine.InstructionPointer; ip >= 0 && ip < len(machine.Instructions) {
+		instruction := machine.Instructions[ip]
+		e.File, e.Line, e.Column = instruction.File, instruction.LineStart+1, instruction.CollumnStart+1
+	}
+
+	return e
+}
+
+func (e *RuntimeError) Error() string {
+	switch {
+	case e.Line == 0:
+		return e.Message
+	case e.File != "":
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,204 @@
+package ambient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compile(t *testing.T, source string) *Program {
+	prog, err := Compile(strings.NewReader(source))
+	require.NoError(t, err)
+
+	return prog
+}
+
+func TestRun(t *testing.T) {
+	var stdout bytes.Buffer
+	v := NewVM(WithStdout(&stdout))
+
+	// The stack is the input and the result of a run.
+	v.Push(2, 3)
+	require.NoError(t, v.Run(context.Background(), compile(t, "sum dupl 0 out")))
+
+	assert.Equal(t, "5", stdout.String())
+	assert.Equal(t, []int{5}, v.Stack())
+
+	value, err := v.Pop()
+	require.NoError(t, err)
+	assert.Equal(t, 5, value)
+
+	_, err = v.Pop()
+	assert.ErrorIs(t, err, ErrStackUnderflow)
+}
+
+func TestRun_SharedProgram(t *testing.T) {
+	prog := compile(t, "dupl 0 mul dupl 0 store 0")
+
+	var wg sync.WaitGroup
+	results := make([][]int, 64)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			v := NewVM()
+			v.Push(i)
+			assert.NoError(t, v.Run(context.Background(), prog))
+			results[i] = v.Stack()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, stack := range results {
+		assert.Equal(t, []int{i * i}, stack)
+	}
+}
+
+func TestRun_Stdin(t *testing.T) {
+	var stdout bytes.Buffer
+	v := NewVM(WithStdin(strings.NewReader("hi")), WithStdout(&stdout))
+
+	// Echo the input until its end.
+	prog := compile(t, `
+const EOF = -1
+:loop
+inc
+dupl 0
+psh EOF
+eq
+jif end
+pop
+outc
+jmp loop
+:end`)
+
+	require.NoError(t, v.Run(context.Background(), prog))
+	assert.Equal(t, "hi", stdout.String())
+}
+
+func TestRun_Errors(t *testing.T) {
+	v := NewVM(WithStdout(&bytes.Buffer{}))
+
+	err := v.Run(context.Background(), compile(t, "psh 1\npsh 0\ndiv"))
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+	assert.EqualError(t, err, "3:1: Division by zero")
+
+	var runtimeErr *RuntimeError
+	require.ErrorAs(t, err, &runtimeErr)
+	assert.Equal(t, 3, runtimeErr.Line)
+
+	err = NewVM().Run(context.Background(), compile(t, "psh 1 psh 2 assert_eq"))
+	assert.ErrorIs(t, err, ErrAssertionFailed)
+	assert.EqualError(t, err, "1:13: Assertion failed: expected 2, got 1")
+
+	err = NewVM(WithStepLimit(10)).Run(context.Background(), compile(t, ":loop jmp loop"))
+	assert.ErrorIs(t, err, ErrBudgetExceeded)
+
+	err = NewVM().Run(context.Background(), compile(t, "psh 0 chan_new\nrecv"))
+	assert.ErrorIs(t, err, ErrDeadlock)
+	assert.EqualError(t, err, "2:1: Deadlock: fiber 0 waits in recv on channel 0 at 2:1")
+}
+
+func TestRun_Context(t *testing.T) {
+	prog := compile(t, ":loop jmp loop")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, NewVM().Run(ctx, prog), context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, NewVM().Run(ctx, prog), context.DeadlineExceeded)
+}
+
+// BenchmarkRun runs a loop through Run and through the VM directly. Run
+// checks the context between chunks of the compiled loop, so both take
+// about the same time.
+func BenchmarkRun(b *testing.B) {
+	source := "psh 100000 :loop psh 1 sub dupl 0 psh 0 gt jif next jmp end :next pop jmp loop :end"
+	prog, err := Compile(strings.NewReader(source))
+	require.NoError(b, err)
+
+	b.Run("Run", func(b *testing.B) {
+		v := NewVM()
+		for i := 0; i < b.N; i++ {
+			if err := v.Run(context.Background(), prog); err != nil {
+				b.Fatal(err)
+			}
+
+			v.stack = v.stack[:0]
+		}
+	})
+
+	b.Run("ExecuteFrom", func(b *testing.B) {
+		machine := vm.NewVirtualMachine()
+		machine.Program = prog.program
+		for i := 0; i < b.N; i++ {
+			if err := machine.ExecuteFrom(0, math.MaxInt, nil); err != vm.Ok {
+				b.Fatal(err)
+			}
+
+			machine.Stack = machine.Stack[:0]
+		}
+	})
+}
+
+func TestCompile(t *testing.T) {
+	_, err := Compile(strings.NewReader("psh 1 /* never closed"))
+	assert.Error(t, err)
+
+	_, err = Compile(strings.NewReader(`include "lib.naive"`))
+	assert.EqualError(t, err, "1:1: include needs a file")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.naive"), []byte("export double\n:double\npsh 2\nmul\nret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.naive"), []byte("include \"lib.naive\"\npsh 21\ncall double"), 0o644))
+
+	prog, err := CompileFile(filepath.Join(dir, "main.naive"))
+	require.NoError(t, err)
+
+	v := NewVM()
+	require.NoError(t, v.Run(context.Background(), prog))
+	assert.Equal(t, []int{42}, v.Stack())
+}
+
+func TestRuntimeError_Unwrap(t *testing.T) {
+	err := NewVM().Run(context.Background(), compile(t, "sum"))
+	assert.True(t, errors.Is(err, ErrStackUnderflow))
+	assert.False(t, errors.Is(err, ErrDivisionByZero))
+}
+
+func TestCompileFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"naive/main.naive": {Data: []byte("include \"lib.naive\"\npsh 21\ncall double")},
+		"naive/lib.naive":  {Data: []byte("export double\n:double psh 2 mul ret")},
+	}
+
+	prog, err := CompileFS(fsys, "naive/main.naive")
+	require.NoError(t, err)
+
+	var binary bytes.Buffer
+	require.NoError(t, lexer.WriteTokens(&binary, prog.program.Instructions))
+
+	read, err := ReadProgram(&binary)
+	require.NoError(t, err)
+
+	v := NewVM()
+	require.NoError(t, v.Run(context.Background(), read))
+	assert.Equal(t, []int{42}, v.Stack())
+}
@@ -0,0 +1,31 @@
+package ambient_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jejikeh/ambient/ambient"
+)
+
+func Example() {
+	prog, err := ambient.Compile(strings.NewReader(`
+const BASE = 10
+psh BASE
+sum
+out`))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	vm := ambient.NewVM(ambient.WithStdout(os.Stdout))
+	vm.Push(32)
+
+	if err := vm.Run(context.Background(), prog); err != nil {
+		fmt.Println(err)
+	}
+
+	// Output: 42
+}
@@ -0,0 +1,349 @@
+// Package ecs is the entity component system runtime behind the entity,
+// comp and system declarations of .nai programs.
+//
+// Components are flat lists of int fields, the same values the VM works
+// with, stored in one sparse set per component. Systems run over every
+// entity which has all the components of their query.
+package ecs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Entity identifies an entity of a World. IDs are never reused, and
+// NoEntity is never returned by Spawn.
+type Entity uint32
+
+const NoEntity Entity = 0
+
+type ComponentID int
+
+type Component struct {
+	ID     ComponentID
+	Name   string
+	Fields int
+}
+
+// System runs Run once for every entity matching Query. A system with an
+// empty query runs once per update, with NoEntity. Access is what Run
+// uses besides the components of the query, for the Schedule.
+type System struct {
+	Name   string
+	Query  []ComponentID
+	Access Access
+	Run    func(e Entity) error
+}
+
+type World struct {
+	next Entity
+
+	alive map[Entity]string
+
+	components []Component
+	storages   []*storage
+	byName     map[string]ComponentID
+
+	systems []*System
+}
+
+func NewWorld() *World {
+	return &World{
+		alive:  make(map[Entity]string),
+		byName: make(map[string]ComponentID),
+	}
+}
+
+// RegisterComponent adds a component type with the given number of int
+// fields. Registering a name twice returns the existing component if it
+// has the same number of fields.
+func (w *World) RegisterComponent(name string, fields int) (ComponentID, error) {
+	if fields < 0 {
+		return 0, fmt.Errorf("component %s can not have %d fields", name, fields)
+	}
+
+	if id, ok := w.byName[name]; ok && name != "" {
+		if w.components[id].Fields != fields {
+			return 0, fmt.Errorf("component %s is already registered with %d fields", name, w.components[id].Fields)
+		}
+
+		return id, nil
+	}
+
+	id := ComponentID(len(w.components))
+	w.components = append(w.components, Component{ID: id, Name: name, Fields: fields})
+	w.storages = append(w.storages, newStorage(fields))
+
+	if name != "" {
+		w.byName[name] = id
+	}
+
+	return id, nil
+}
+
+func (w *World) Component(id ComponentID) (Component, bool) {
+	if id < 0 || int(id) >= len(w.components) {
+		return Component{}, false
+	}
+
+	return w.components[id], true
+}
+
+func (w *World) ComponentByName(name string) (ComponentID, bool) {
+	id, ok := w.byName[name]
+	return id, ok
+}
+
+func (w *World) Components() []Component {
+	return append([]Component(nil), w.components...)
+}
+
+// Spawn creates an entity with the given components, all fields set to 0.
+func (w *World) Spawn(name string, components ...ComponentID) (Entity, error) {
+	w.next++
+	e := w.next
+	w.alive[e] = name
+
+	for _, c := range components {
+		if err := w.Add(e, c); err != nil {
+			return e, err
+		}
+	}
+
+	return e, nil
+}
+
+func (w *World) Despawn(e Entity) {
+	if !w.Alive(e) {
+		return
+	}
+
+	for _, s := range w.storages {
+		s.remove(e)
+	}
+
+	delete(w.alive, e)
+}
+
+func (w *World) Alive(e Entity) bool {
+	_, ok := w.alive[e]
+	return ok
+}
+
+// Name returns the name given to Spawn.
+func (w *World) Name(e Entity) string {
+	return w.alive[e]
+}
+
+// Entities returns every alive entity, in the order they were spawned.
+func (w *World) Entities() []Entity {
+	entities := make([]Entity, 0, len(w.alive))
+	for e := range w.alive {
+		entities = append(entities, e)
+	}
+
+	sort.Slice(entities, func(i, j int) bool { return entities[i] < entities[j] })
+
+	return entities
+}
+
+func (w *World) storage(c ComponentID) (*storage, error) {
+	if c < 0 || int(c) >= len(w.storages) {
+		return nil, fmt.Errorf("unknown component %d", c)
+	}
+
+	return w.storages[c], nil
+}
+
+// Add attaches a component to an entity. Adding a component the entity
+// already has keeps its fields.
+func (w *World) Add(e Entity, c ComponentID) error {
+	if !w.Alive(e) {
+		return fmt.Errorf("entity %d is not alive", e)
+	}
+
+	s, err := w.storage(c)
+	if err != nil {
+		return err
+	}
+
+	s.add(e)
+
+	return nil
+}
+
+func (w *World) Remove(e Entity, c ComponentID) {
+	if s, err := w.storage(c); err == nil {
+		s.remove(e)
+	}
+}
+
+func (w *World) Has(e Entity, c ComponentID) bool {
+	s, err := w.storage(c)
+	if err != nil {
+		return false
+	}
+
+	return s.has(e)
+}
+
+// ComponentsOf returns the components of an entity, in registration order.
+func (w *World) ComponentsOf(e Entity) []ComponentID {
+	components := []ComponentID{}
+	for id, s := range w.storages {
+		if s.has(e) {
+			components = append(components, ComponentID(id))
+		}
+	}
+
+	return components
+}
+
+func (w *World) Get(e Entity, c ComponentID, field int) (int, error) {
+	values, err := w.fields(e, c, field)
+	if err != nil {
+		return 0, err
+	}
+
+	return values[field], nil
+}
+
+func (w *World) Set(e Entity, c ComponentID, field int, value int) error {
+	values, err := w.fields(e, c, field)
+	if err != nil {
+		return err
+	}
+
+	values[field] = value
+
+	return nil
+}
+
+// Fields returns a copy of every field of a component of an entity.
+func (w *World) Fields(e Entity, c ComponentID) ([]int, error) {
+	values, err := w.componentOf(e, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]int(nil), values...), nil
+}
+
+func (w *World) componentOf(e Entity, c ComponentID) ([]int, error) {
+	s, err := w.storage(c)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := s.get(e)
+	if !ok {
+		return nil, fmt.Errorf("entity %d has no component %s", e, w.components[c].Name)
+	}
+
+	return values, nil
+}
+
+func (w *World) fields(e Entity, c ComponentID, field int) ([]int, error) {
+	values, err := w.componentOf(e, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if field < 0 || field >= len(values) {
+		return nil, fmt.Errorf("component %s has no field %d", w.components[c].Name, field)
+	}
+
+	return values, nil
+}
+
+// Query returns the entities which have every one of the components, in
+// the order they were spawned.
+func (w *World) Query(components ...ComponentID) ([]Entity, error) {
+	if len(components) == 0 {
+		return w.Entities(), nil
+	}
+
+	// Iterating the smallest storage checks the fewest entities.
+	var smallest *storage
+	for _, c := range components {
+		s, err := w.storage(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if smallest == nil || len(s.dense) < len(smallest.dense) {
+			smallest = s
+		}
+	}
+
+	entities := []Entity{}
+	for _, e := range smallest.dense {
+		matches := true
+		for _, c := range components {
+			if !w.storages[c].has(e) {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			entities = append(entities, e)
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool { return entities[i] < entities[j] })
+
+	return entities, nil
+}
+
+func (w *World) AddSystem(system *System) error {
+	for _, c := range system.Query {
+		if _, err := w.storage(c); err != nil {
+			return fmt.Errorf("system %s: %w", system.Name, err)
+		}
+	}
+
+	w.systems = append(w.systems, system)
+
+	return nil
+}
+
+func (w *World) Systems() []*System {
+	return append([]*System(nil), w.systems...)
+}
+
+// Update runs every system once, in the order they were added, over the
+// entities matching its query at the time the system starts.
+func (w *World) Update() error {
+	for _, system := range w.systems {
+		if err := w.RunSystem(system); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *World) RunSystem(system *System) error {
+	if len(system.Query) == 0 {
+		return system.Run(NoEntity)
+	}
+
+	entities, err := w.Query(system.Query...)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entities {
+		// Entities despawned by an earlier run of this system are skipped.
+		if !w.Alive(e) {
+			continue
+		}
+
+		if err := system.Run(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
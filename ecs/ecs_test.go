@@ -0,0 +1,111 @@
+package ecs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorld_Components(t *testing.T) {
+	w := NewWorld()
+
+	position, err := w.RegisterComponent("position", 2)
+	require.NoError(t, err)
+
+	again, err := w.RegisterComponent("position", 2)
+	require.NoError(t, err)
+	assert.Equal(t, position, again)
+
+	_, err = w.RegisterComponent("position", 3)
+	assert.Error(t, err)
+
+	e, err := w.Spawn("cat", position)
+	require.NoError(t, err)
+	assert.NotEqual(t, NoEntity, e)
+	assert.Equal(t, "cat", w.Name(e))
+
+	require.NoError(t, w.Set(e, position, 1, 7))
+	fields, err := w.Fields(e, position)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 7}, fields)
+
+	_, err = w.Get(e, position, 2)
+	assert.Error(t, err)
+
+	w.Remove(e, position)
+	assert.False(t, w.Has(e, position))
+	_, err = w.Get(e, position, 0)
+	assert.Error(t, err)
+}
+
+func TestWorld_Query(t *testing.T) {
+	w := NewWorld()
+	position, _ := w.RegisterComponent("position", 1)
+	velocity, _ := w.RegisterComponent("velocity", 1)
+
+	first, _ := w.Spawn("first", position, velocity)
+	second, _ := w.Spawn("second", position)
+	third, _ := w.Spawn("third", velocity, position)
+
+	for _, e := range []Entity{first, second, third} {
+		require.NoError(t, w.Set(e, position, 0, int(e)*10))
+	}
+
+	moving, err := w.Query(position, velocity)
+	require.NoError(t, err)
+	assert.Equal(t, []Entity{first, third}, moving)
+
+	// Removing from the middle of a storage keeps the others' fields.
+	w.Despawn(first)
+	assert.False(t, w.Alive(first))
+
+	all, err := w.Query(position)
+	require.NoError(t, err)
+	assert.Equal(t, []Entity{second, third}, all)
+
+	x, err := w.Get(third, position, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int(third)*10, x)
+
+	_, err = w.Query(ComponentID(5))
+	assert.Error(t, err)
+}
+
+func TestWorld_Update(t *testing.T) {
+	w := NewWorld()
+	health, _ := w.RegisterComponent("health", 1)
+
+	a, _ := w.Spawn("a", health)
+	b, _ := w.Spawn("b", health)
+	w.Spawn("c")
+
+	ran := []string{}
+	require.NoError(t, w.AddSystem(&System{
+		Name:  "damage",
+		Query: []ComponentID{health},
+		Run: func(e Entity) error {
+			ran = append(ran, w.Name(e))
+			w.Despawn(b)
+			return nil
+		},
+	}))
+	require.NoError(t, w.AddSystem(&System{
+		Name: "global",
+		Run: func(e Entity) error {
+			assert.Equal(t, NoEntity, e)
+			ran = append(ran, "global")
+			return nil
+		},
+	}))
+
+	require.NoError(t, w.Update())
+	assert.Equal(t, []string{w.Name(a), "global"}, ran)
+
+	failure := errors.New("failure")
+	require.NoError(t, w.AddSystem(&System{Name: "failing", Run: func(Entity) error { return failure }}))
+	assert.ErrorIs(t, w.Update(), failure)
+
+	assert.Error(t, w.AddSystem(&System{Name: "unknown", Query: []ComponentID{9}}))
+}
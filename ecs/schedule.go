@@ -0,0 +1,162 @@
+package ecs
+
+import "sync"
+
+// Resource is a piece of state systems share. Components are resources,
+// and hosts can add their own kinds, like the memory cells of a VM.
+type Resource struct {
+	Kind string
+	ID   int
+}
+
+const ComponentResource = "component"
+
+func (c ComponentID) Resource() Resource {
+	return Resource{Kind: ComponentResource, ID: int(c)}
+}
+
+// Access lists the resources a system reads and writes while it runs.
+type Access struct {
+	Reads  []Resource
+	Writes []Resource
+	// Exclusive systems conflict with every other system, for example
+	// because they spawn entities or add components.
+	Exclusive bool
+}
+
+// Conflicts reports whether running two systems in a different order can
+// change what they do: one of them writes a resource the other uses.
+func (a Access) Conflicts(b Access) bool {
+	if a.Exclusive || b.Exclusive {
+		return true
+	}
+
+	return overlaps(a.Writes, b.Writes) || overlaps(a.Writes, b.Reads) || overlaps(a.Reads, b.Writes)
+}
+
+func overlaps(a []Resource, b []Resource) bool {
+	set := make(map[Resource]bool, len(a))
+	for _, r := range a {
+		set[r] = true
+	}
+
+	for _, r := range b {
+		if set[r] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// access is the declared access of a system, with the components of its
+// query read.
+func (s *System) access() Access {
+	access := s.Access
+	access.Reads = append([]Resource(nil), access.Reads...)
+	for _, c := range s.Query {
+		access.Reads = append(access.Reads, c.Resource())
+	}
+
+	return access
+}
+
+// Schedule is the dependency graph of the systems of a World, split into
+// stages. Systems of a stage do not conflict with each other and can run
+// concurrently. A system is in a later stage than every earlier system it
+// conflicts with, so running the stages in order does what running the
+// systems in order does.
+type Schedule struct {
+	Systems []*System
+	// DependsOn lists, for every system, the earlier systems it conflicts
+	// with.
+	DependsOn [][]int
+	// Stages lists the indexes of the systems of every stage, in order.
+	Stages [][]int
+}
+
+func (w *World) Schedule() *Schedule {
+	s := &Schedule{
+		Systems:   w.Systems(),
+		DependsOn: make([][]int, len(w.systems)),
+	}
+
+	accesses := make([]Access, len(s.Systems))
+	stages := make([]int, len(s.Systems))
+
+	for j, system := range s.Systems {
+		accesses[j] = system.access()
+
+		for i := 0; i < j; i++ {
+			if !accesses[i].Conflicts(accesses[j]) {
+				continue
+			}
+
+			s.DependsOn[j] = append(s.DependsOn[j], i)
+			stages[j] = max(stages[j], stages[i]+1)
+		}
+
+		if stages[j] == len(s.Stages) {
+			s.Stages = append(s.Stages, []int{})
+		}
+
+		s.Stages[stages[j]] = append(s.Stages[stages[j]], j)
+	}
+
+	return s
+}
+
+// RunStage calls run for every system of a stage, on at most workers
+// goroutines at once. It returns the index of the first system of the
+// stage which failed and its error, or -1 and nil. Every system of the
+// stage runs to the end, so which one is reported does not depend on the
+// number of workers.
+func (s *Schedule) RunStage(stage []int, workers int, run func(system int) error) (int, error) {
+	errs := make([]error, len(stage))
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+
+	for n := 0; n < max(1, min(workers, len(stage))); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				errs[k] = run(stage[k])
+			}
+		}()
+	}
+
+	for k := range stage {
+		jobs <- k
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	for k, err := range errs {
+		if err != nil {
+			return stage[k], err
+		}
+	}
+
+	return -1, nil
+}
+
+// UpdateParallel runs every system once, like Update, but runs the
+// systems of a stage concurrently. The Run functions of systems which do
+// not conflict must be safe to call at the same time.
+func (w *World) UpdateParallel(workers int) error {
+	s := w.Schedule()
+	for _, stage := range s.Stages {
+		_, err := s.RunStage(stage, workers, func(i int) error {
+			return w.RunSystem(s.Systems[i])
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
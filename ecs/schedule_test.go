@@ -0,0 +1,102 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorld_Schedule(t *testing.T) {
+	w := NewWorld()
+	position, _ := w.RegisterComponent("position", 1)
+	velocity, _ := w.RegisterComponent("velocity", 1)
+	health, _ := w.RegisterComponent("health", 1)
+
+	writes := func(c ComponentID) Access { return Access{Writes: []Resource{c.Resource()}} }
+
+	systems := []*System{
+		{Name: "move", Query: []ComponentID{position, velocity}, Access: writes(position)},
+		{Name: "heal", Query: []ComponentID{health}, Access: writes(health)},
+		{Name: "draw", Query: []ComponentID{position}},
+		{Name: "accelerate", Query: []ComponentID{velocity}, Access: writes(velocity)},
+		{Name: "report", Query: []ComponentID{health}},
+		{Name: "spawn", Access: Access{Exclusive: true}},
+		{Name: "log"},
+	}
+
+	for _, s := range systems {
+		require.NoError(t, w.AddSystem(s))
+	}
+
+	schedule := w.Schedule()
+	assert.Equal(t, [][]int{nil, nil, {0}, {0}, {1}, {0, 1, 2, 3, 4}, {5}}, schedule.DependsOn)
+	assert.Equal(t, [][]int{{0, 1}, {2, 3, 4}, {5}, {6}}, schedule.Stages)
+}
+
+func TestAccess_Conflicts(t *testing.T) {
+	a := Resource{Kind: "memory", ID: 1}
+	b := Resource{Kind: "memory", ID: 2}
+
+	assert.False(t, Access{Reads: []Resource{a}}.Conflicts(Access{Reads: []Resource{a}}))
+	assert.False(t, Access{Writes: []Resource{a}}.Conflicts(Access{Writes: []Resource{b}}))
+	assert.True(t, Access{Writes: []Resource{a}}.Conflicts(Access{Reads: []Resource{a}}))
+	assert.True(t, Access{Reads: []Resource{a}}.Conflicts(Access{Writes: []Resource{a}}))
+	assert.True(t, Access{}.Conflicts(Access{Exclusive: true}))
+
+	// Components and host resources with the same id are different.
+	assert.False(t, Access{Writes: []Resource{ComponentID(1).Resource()}}.Conflicts(Access{Reads: []Resource{a}}))
+}
+
+func TestWorld_UpdateParallel(t *testing.T) {
+	w := NewWorld()
+	counter, _ := w.RegisterComponent("counter", 1)
+	other, _ := w.RegisterComponent("other", 1)
+
+	for i := 0; i < 100; i++ {
+		w.Spawn("", counter, other)
+	}
+
+	increment := func(c ComponentID) func(Entity) error {
+		return func(e Entity) error {
+			value, err := w.Get(e, c, 0)
+			if err != nil {
+				return err
+			}
+
+			return w.Set(e, c, 0, value+1)
+		}
+	}
+
+	w.AddSystem(&System{Name: "a", Query: []ComponentID{counter}, Access: Access{Writes: []Resource{counter.Resource()}}, Run: increment(counter)})
+	w.AddSystem(&System{Name: "b", Query: []ComponentID{other}, Access: Access{Writes: []Resource{other.Resource()}}, Run: increment(other)})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, w.UpdateParallel(4))
+	}
+
+	for _, e := range w.Entities() {
+		for _, c := range []ComponentID{counter, other} {
+			value, err := w.Get(e, c, 0)
+			require.NoError(t, err)
+			assert.Equal(t, 10, value)
+		}
+	}
+}
+
+func TestSchedule_RunStageReportsFirstFailure(t *testing.T) {
+	s := &Schedule{}
+
+	for _, workers := range []int{1, 2, 8} {
+		failed, err := s.RunStage([]int{3, 5, 8, 9}, workers, func(i int) error {
+			if i >= 5 {
+				return assert.AnError
+			}
+
+			return nil
+		})
+
+		assert.Equal(t, 5, failed)
+		assert.Equal(t, assert.AnError, err)
+	}
+}
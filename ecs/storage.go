@@ -0,0 +1,62 @@
+package ecs
+
+// storage is a sparse set holding one component for many entities. The
+// fields of the entity at dense[i] are data[i*fields : (i+1)*fields].
+type storage struct {
+	fields int
+
+	sparse map[Entity]int
+	dense  []Entity
+	data   []int
+}
+
+func newStorage(fields int) *storage {
+	return &storage{
+		fields: fields,
+		sparse: make(map[Entity]int),
+	}
+}
+
+func (s *storage) has(e Entity) bool {
+	_, ok := s.sparse[e]
+	return ok
+}
+
+func (s *storage) add(e Entity) {
+	if s.has(e) {
+		return
+	}
+
+	s.sparse[e] = len(s.dense)
+	s.dense = append(s.dense, e)
+	s.data = append(s.data, make([]int, s.fields)...)
+}
+
+// remove moves the last entity into the hole, so the set stays packed.
+func (s *storage) remove(e Entity) {
+	i, ok := s.sparse[e]
+	if !ok {
+		return
+	}
+
+	last := len(s.dense) - 1
+	if i != last {
+		moved := s.dense[last]
+		s.dense[i] = moved
+		s.sparse[moved] = i
+		copy(s.data[i*s.fields:(i+1)*s.fields], s.data[last*s.fields:])
+	}
+
+	s.dense = s.dense[:last]
+	s.data = s.data[:last*s.fields]
+	delete(s.sparse, e)
+}
+
+func (s *storage) get(e Entity) ([]int, bool) {
+	i, ok := s.sparse[e]
+	if !ok {
+		return nil, false
+	}
+
+	return s.data[i*s.fields : (i+1)*s.fields], true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/nai"
+	"github.com/jejikeh/ambient/token"
+	"github.com/jejikeh/ambient/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the examples")
+
+const (
+	examplesFolder = "examples"
+	goldenFolder   = "testdata/golden"
+
+	// goldenBudget bounds the examples which loop forever.
+	goldenBudget = 1000
+)
+
+// TestExamples runs every program in examples/, naive or nai, through
+// the same steps as the Makefile targets (lex -> build -> dis -> run) and
+// compares the result against testdata/golden. Run `go test . -update`
+// to regenerate.
+func TestExamples(t *testing.T) {
+	programs := findExamples(t)
+	require.NotEmpty(t, programs)
+
+	for _, program := range programs {
+		program := program
+
+		t.Run(filepath.ToSlash(program), func(t *testing.T) {
+			actual := runExample(t, program)
+			goldenPath := filepath.Join(goldenFolder, strings.TrimPrefix(program, examplesFolder+string(filepath.Separator))+".golden")
+
+			if *update {
+				require.NoError(t, os.MkdirAll(filepath.Dir(goldenPath), os.ModePerm))
+				require.NoError(t, os.WriteFile(goldenPath, []byte(actual), 0o644))
+				return
+			}
+
+			expected, err := os.ReadFile(goldenPath)
+			require.NoError(t, err, "missing golden file, run `go test . -update`")
+			assert.Equal(t, string(expected), actual)
+		})
+	}
+}
+
+func findExamples(t *testing.T) []string {
+	programs := []string{}
+
+	err := filepath.WalkDir(examplesFolder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Folders written by the Makefile targets.
+		if d.IsDir() && (d.Name() == "binary" || d.Name() == "dis") {
+			return filepath.SkipDir
+		}
+
+		if !d.IsDir() && (filepath.Ext(path) == ".naive" || filepath.Ext(path) == ".nai") {
+			programs = append(programs, path)
+		}
+
+		return nil
+	})
+
+	require.NoError(t, err)
+
+	return programs
+}
+
+// loadExample lexes a naive program, or compiles a nai one, failing the
+// test on an error.
+func loadExample(t *testing.T, program string) []token.Token {
+	t.Helper()
+
+	if filepath.Ext(program) != ".nai" {
+		tokens, err := lexer.LoadFile(program)
+		require.NoError(t, err)
+
+		return tokens
+	}
+
+	file, err := nai.ParseFileFromPath(program)
+	require.NoError(t, err)
+
+	tokens, err := nai.CompileToTokens(file)
+	require.NoError(t, err)
+
+	return tokens
+}
+
+func runExample(t *testing.T, program string) string {
+	dir := t.TempDir()
+	binaryPath := filepath.Join(dir, "program")
+	disPath := filepath.Join(dir, "program.naive")
+
+	// lex + build
+	l := &lexer.Lexer{Tokens: loadExample(t, program)}
+	require.NoError(t, l.DumpTokensToBinary(binaryPath))
+
+	// dis
+	binary, err := lexer.NewLexerFromBinary(binaryPath)
+	require.NoError(t, err)
+	require.NoError(t, binary.DumpTokensToFile(disPath))
+	dis, err := os.ReadFile(disPath)
+	require.NoError(t, err)
+
+	// run
+	ambient := vm.NewVirtualMachine()
+	require.NoError(t, ambient.LoadNaiveFromSourceBinary(binaryPath))
+
+	var stdout bytes.Buffer
+	ambient.Output = &stdout
+	runErr := ambient.ExecuteFrom(0, goldenBudget, nil)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- stack --\n%v\n", ambient.Stack)
+	fmt.Fprintf(&b, "-- memory --\n%v\n", ambient.Memory)
+	fmt.Fprintf(&b, "-- error --\n%s\n", runErr)
+	fmt.Fprintf(&b, "-- stopped --\nat %d after %d steps\n", ambient.InstructionPointer, ambient.Steps())
+	fmt.Fprintf(&b, "-- stdout --\n%s", stdout.String())
+	fmt.Fprintf(&b, "-- dis --\n%s", dis)
+
+	return b.String()
+}
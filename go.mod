@@ -2,11 +2,13 @@ module github.com/jejikeh/ambient
 
 go 1.21.0
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/fatih/color v1.15.0
+	github.com/stretchr/testify v1.8.4
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fatih/color v1.15.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
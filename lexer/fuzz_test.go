@@ -0,0 +1,82 @@
+package lexer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exampleSources returns the naive programs in examples/ as seed corpus.
+func exampleSources(f *testing.F) [][]byte {
+	sources := [][]byte{}
+
+	err := filepath.WalkDir("../examples", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".naive" {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		sources = append(sources, content)
+		return nil
+	})
+
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	return sources
+}
+
+func FuzzLex(f *testing.F) {
+	log.SetOutput(io.Discard)
+
+	for _, source := range exampleSources(f) {
+		f.Add(string(source))
+	}
+
+	f.Add(": label")
+	f.Add("/* unterminated")
+	f.Add("psh")
+
+	f.Fuzz(func(t *testing.T, source string) {
+		tokens, err := NewLexer(source).Lex()
+		if err != nil {
+			return
+		}
+
+		if len(tokens) == 0 {
+			t.Fatal("expected at least the end of file token")
+		}
+	})
+}
+
+func FuzzDecodeTokens(f *testing.F) {
+	log.SetOutput(io.Discard)
+
+	for _, source := range exampleSources(f) {
+		tokens, err := NewLexer(string(source)).Lex()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		var buff bytes.Buffer
+		if err := gob.NewEncoder(&buff).Encode(tokens); err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(buff.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		DecodeTokens(content)
+	})
+}
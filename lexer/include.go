@@ -0,0 +1,390 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/jejikeh/ambient/token"
+)
+
+// unit is one file of a program, without its directives.
+type unit struct {
+	path string
+	// file is what the tokens of the unit carry in token.File.
+	file   string
+	tokens []token.Token
+
+	// labels maps the labels of the file to their index in tokens.
+	labels  map[string]int
+	exports []token.Token
+
+	offset int
+}
+
+// files reads the files of a program.
+type files interface {
+	open(name string) (io.ReadCloser, error)
+	// key names a file the same way however it is reached, to notice a
+	// file included twice.
+	key(name string) (string, error)
+	// resolve returns the file named by an include in the file from.
+	resolve(from, name string) string
+}
+
+// osFiles reads files from the operating system.
+type osFiles struct{}
+
+func (osFiles) open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFiles) key(name string) (string, error) {
+	return filepath.Abs(name)
+}
+
+func (osFiles) resolve(from, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(filepath.Dir(from), name)
+}
+
+// fsFiles reads files from a file system, where names are slash
+// separated and rooted at the file system.
+type fsFiles struct {
+	fsys fs.FS
+}
+
+func (f fsFiles) open(name string) (io.ReadCloser, error) {
+	return f.fsys.Open(name)
+}
+
+func (fsFiles) key(name string) (string, error) {
+	return path.Clean(name), nil
+}
+
+func (fsFiles) resolve(from, name string) string {
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(strings.TrimPrefix(name, "/"))
+	}
+
+	return path.Join(path.Dir(from), name)
+}
+
+type loader struct {
+	files files
+
+	units []*unit
+	// loaded holds the units by key, so a file included twice is only
+	// added once.
+	loaded map[string]*unit
+}
+
+func newLoader(files files) *loader {
+	return &loader{files: files, loaded: make(map[string]*unit)}
+}
+
+// LoadFile lexes a file and every file it includes into one program.
+//
+// `include "path"` adds another file, relative to the including one, and
+// `export label` makes a label of a file reachable by name from every other
+// file. All other labels are private to their file, and an identifier is
+// resolved against the labels of its own file before the exported ones.
+// Each file ends with its own end of file token, so running off the end of
+// one never falls into the next.
+func LoadFile(path string) ([]token.Token, error) {
+	return newLoader(osFiles{}).program(path)
+}
+
+// LoadFS is LoadFile for a file of fsys, such as an embed.FS. Included
+// paths are slash separated, a leading slash starts at the root of fsys.
+func LoadFS(fsys fs.FS, name string) ([]token.Token, error) {
+	return newLoader(fsFiles{fsys}).program(name)
+}
+
+// LoadSource lexes a program held in memory. It can not include files,
+// use LoadFS for programs which include others.
+func LoadSource(source []byte) ([]token.Token, error) {
+	return loadStandalone(NewLexerFromBytes(source))
+}
+
+// LoadReader is LoadSource for the source read from r. The source is
+// lexed as it is read.
+func LoadReader(r io.Reader) ([]token.Token, error) {
+	return loadStandalone(NewLexerFromReader(r))
+}
+
+func loadStandalone(l *Lexer) ([]token.Token, error) {
+	tokens, err := l.Lex()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		if t.Kind == token.Include || t.Kind == token.Export {
+			return nil, errorAt("", t, "%s needs a file", t.Name)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (l *loader) program(name string) ([]token.Token, error) {
+	err := l.load(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.link()
+}
+
+// ExportedLabels returns the labels a file and the files it includes
+// export, by name. The tokens carry the file they are declared in.
+func ExportedLabels(path string) (map[string]token.Token, error) {
+	l := newLoader(osFiles{})
+
+	err := l.load(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]token.Token)
+	for _, u := range l.units {
+		for _, e := range u.exports {
+			if index, ok := u.labels[e.Name]; ok {
+				label := u.tokens[index]
+				label.File = u.path
+				labels[e.Name] = label
+			}
+		}
+	}
+
+	return labels, nil
+}
+
+// Discover returns every file under the given paths whose name ends with
+// suffix. Paths naming a file are returned as is.
+func Discover(suffix string, paths ...string) ([]string, error) {
+	files := []string{}
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, root)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !d.IsDir() && strings.HasSuffix(path, suffix) {
+				files = append(files, path)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// position formats the 1-based position of a token in a file.
+func position(path string, t token.Token) string {
+	return fmt.Sprintf("%s:%d:%d", path, t.LineStart+1, t.CollumnStart+1)
+}
+
+// Error is an error at a token of a file. File is empty when the source
+// does not come from a file.
+type Error struct {
+	File    string
+	Token   token.Token
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Token.LineStart+1, e.Token.CollumnStart+1, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", position(e.File, e.Token), e.Message)
+}
+
+func errorAt(path string, t token.Token, format string, args ...any) error {
+	return &Error{File: path, Token: t, Message: fmt.Sprintf(format, args...)}
+}
+
+func (l *loader) load(path string, including []string) error {
+	key, err := l.files.key(path)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range including {
+		if p == key {
+			cycle := []string{}
+			for _, p := range append(including[i:], key) {
+				cycle = append(cycle, l.loaded[p].path)
+			}
+
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	if _, ok := l.loaded[key]; ok {
+		return nil
+	}
+
+	f, err := l.files.open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	u := &unit{path: path, labels: make(map[string]int)}
+	if len(l.units) > 0 {
+		u.file = path
+	}
+
+	l.units = append(l.units, u)
+	l.loaded[key] = u
+
+	// The tokens go to the unit as they are lexed, include and export
+	// wait for the token after them. Macros and constants belong to the
+	// file declaring them.
+	var directive *token.Token
+	err = newExpander(path).expandStream(NewLexerFromReader(f), func(t token.Token) error {
+		t.File = u.file
+
+		if directive != nil {
+			d := *directive
+			directive = nil
+
+			return l.directive(u, key, including, d, t)
+		}
+
+		switch t.Kind {
+		case token.Include, token.Export:
+			directive = &t
+			return nil
+
+		case token.String:
+			return errorAt(path, t, "unexpected string %q", t.StringValue)
+
+		case token.Label:
+			u.labels[t.Name] = len(u.tokens)
+		}
+
+		u.tokens = append(u.tokens, t)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if directive != nil {
+		return l.directive(u, key, including, *directive, token.Token{Kind: token.EndOfLine})
+	}
+
+	return nil
+}
+
+// directive runs the include or export d of the unit u, with the token
+// after it.
+func (l *loader) directive(u *unit, key string, including []string, d token.Token, t token.Token) error {
+	if d.Kind == token.Export {
+		if t.Kind != token.Identifier {
+			return errorAt(u.path, d, "export expects a label")
+		}
+
+		u.exports = append(u.exports, t)
+		return nil
+	}
+
+	if t.Kind != token.String {
+		return errorAt(u.path, d, "include expects a path")
+	}
+
+	return l.load(l.files.resolve(u.path, t.StringValue), append(including, key))
+}
+
+// link resolves the identifiers and places the units one after another.
+func (l *loader) link() ([]token.Token, error) {
+	exports := make(map[string]int)
+	exportedBy := make(map[string]string)
+
+	offset := 0
+	for _, u := range l.units {
+		u.offset = offset
+		offset += len(u.tokens)
+	}
+
+	for _, u := range l.units {
+		for _, e := range u.exports {
+			index, ok := u.labels[e.Name]
+			if !ok {
+				return nil, errorAt(u.path, e, "export of undeclared label %s", e.Name)
+			}
+
+			if other, ok := exportedBy[e.Name]; ok && other != u.path {
+				return nil, errorAt(u.path, e, "label %s is already exported by %s", e.Name, other)
+			}
+
+			exports[e.Name] = u.offset + index
+			exportedBy[e.Name] = u.path
+		}
+	}
+
+	for _, u := range l.units {
+		for i := range u.tokens {
+			t := &u.tokens[i]
+			if t.Kind != token.Identifier {
+				continue
+			}
+
+			if index, ok := u.labels[t.Name]; ok {
+				t.IntegerValue = u.offset + index
+			} else if index, ok := exports[t.Name]; ok {
+				t.IntegerValue = index
+			} else {
+				color.Set(color.FgHiRed)
+				log.Printf("Label [%s] (%s) not found! Default to -1\n", t.Name, position(u.path, *t))
+				color.Unset()
+				t.IntegerValue = -1
+			}
+		}
+	}
+
+	// A program of one file is its tokens, others are copied one unit
+	// after another, each let go once it is copied.
+	if len(l.units) == 1 {
+		return l.units[0].tokens, nil
+	}
+
+	program := make([]token.Token, 0, offset)
+	for _, u := range l.units {
+		program = append(program, u.tokens...)
+		u.tokens = nil
+	}
+
+	return program, nil
+}
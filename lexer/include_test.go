@@ -0,0 +1,264 @@
+package lexer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	return dir
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.naive": `include "lib/math.naive"
+include "lib/math.naive"
+psh 2
+psh 3
+call add
+jmp done
+:done`,
+		"lib/math.naive": `export add
+:add
+sum
+jmp done
+:done
+ret`,
+	})
+
+	program, err := LoadFile(filepath.Join(dir, "main.naive"))
+	require.NoError(t, err)
+
+	// main.naive, its end of file, then math.naive included once.
+	kinds := []token.Kind{}
+	for _, tok := range program {
+		kinds = append(kinds, tok.Kind)
+	}
+
+	assert.Equal(t, []token.Kind{
+		token.Push, token.Number, token.Push, token.Number, token.Call, token.Identifier, token.Jump, token.Identifier, token.Label, token.EndOfLine,
+		token.Label, token.Sum, token.Jump, token.Identifier, token.Label, token.Return, token.EndOfLine,
+	}, kinds)
+
+	// Both files declare done, each jump goes to its own.
+	assert.Equal(t, 10, program[5].IntegerValue)
+	assert.Equal(t, 8, program[7].IntegerValue)
+	assert.Equal(t, 14, program[13].IntegerValue)
+
+	assert.Empty(t, program[0].File)
+	assert.Equal(t, filepath.Join(dir, "lib", "math.naive"), program[11].File)
+	assert.Equal(t, 2, program[11].LineStart)
+}
+
+func TestLoadFile_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "Cycle",
+			files: map[string]string{
+				"main.naive": `include "a.naive"`,
+				"a.naive":    `include "b.naive"`,
+				"b.naive":    `include "a.naive"`,
+			},
+			err: "include cycle: DIR/a.naive -> DIR/b.naive -> DIR/a.naive",
+		},
+		{
+			name:  "Missing path",
+			files: map[string]string{"main.naive": "psh 1\ninclude psh"},
+			err:   "DIR/main.naive:2:1: include expects a path",
+		},
+		{
+			name:  "Export of undeclared label",
+			files: map[string]string{"main.naive": "export add\n:sum"},
+			err:   "DIR/main.naive:1:8: export of undeclared label add",
+		},
+		{
+			name: "Exported twice",
+			files: map[string]string{
+				"main.naive": "include \"a.naive\"\nexport add\n:add",
+				"a.naive":    "export add\n:add",
+			},
+			err: "DIR/a.naive:1:8: label add is already exported by DIR/main.naive",
+		},
+		{
+			name: "Lex error in included file",
+			files: map[string]string{
+				"main.naive": `include "a.naive"`,
+				"a.naive":    "psh 1 /* never closed",
+			},
+			err: "DIR/a.naive: expected end of block comment",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, test.files)
+
+			_, err := LoadFile(filepath.Join(dir, "main.naive"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), strings.ReplaceAll(filepath.FromSlash(test.err), "DIR", dir))
+		})
+	}
+}
+
+func TestExportedLabels(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"math.naive":  "include \"stack.naive\"\nexport add\n:add sum ret\n:private ret",
+		"stack.naive": "export swap\n:swap ret",
+	})
+
+	labels, err := ExportedLabels(filepath.Join(dir, "math.naive"))
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+
+	assert.Equal(t, filepath.Join(dir, "stack.naive"), labels["swap"].File)
+	assert.Equal(t, 2, labels["add"].LineStart)
+}
+
+func TestDiscover(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"math.naive":      "ret",
+		"math_test.naive": "ret",
+		"notes.txt":       "",
+	})
+
+	files, err := Discover(".naive", dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{filepath.Join(dir, "math.naive"), filepath.Join(dir, "math_test.naive")}, files)
+
+	// A file is returned even when it does not end with the suffix.
+	files, err = Discover("_test.naive", filepath.Join(dir, "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "notes.txt")}, files)
+
+	_, err = Discover(".naive", filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestLexer_makeString(t *testing.T) {
+	l := NewLexer(`"lib/a \"b\".naive" psh`)
+
+	tok, err := l.composeNewToken()
+	require.NoError(t, err)
+	assert.Equal(t, token.Kind(token.String), tok.Kind)
+	assert.Equal(t, `lib/a "b".naive`, tok.StringValue)
+	assert.Equal(t, `"lib/a \"b\".naive"`, tok.DetectMyString())
+
+	_, err = NewLexer("\"unterminated\npsh").composeNewToken()
+	assert.Error(t, err)
+}
+
+func TestLoadFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/main.naive":     {Data: []byte("include \"lib/math.naive\"\ninclude \"/shared/io.naive\"\npsh 2\ncall double")},
+		"app/lib/math.naive": {Data: []byte("include \"../../shared/io.naive\"\nexport double\n:double psh 2 mul ret")},
+		"shared/io.naive":    {Data: []byte("export print\n:print out ret")},
+		"cycle/a.naive":      {Data: []byte(`include "b.naive"`)},
+		"cycle/b.naive":      {Data: []byte(`include "a.naive"`)},
+		"broken/main.naive":  {Data: []byte(`include "missing.naive"`)},
+	}
+
+	program, err := LoadFS(fsys, "app/main.naive")
+	require.NoError(t, err)
+
+	files := []string{}
+	for _, tok := range program {
+		if tok.Kind == token.EndOfLine {
+			files = append(files, tok.File)
+		}
+	}
+
+	// shared/io.naive is reached twice, by two different paths.
+	assert.Equal(t, []string{"", "app/lib/math.naive", "shared/io.naive"}, files)
+	assert.Equal(t, 5, program[3].IntegerValue)
+
+	_, err = LoadFS(fsys, "cycle/a.naive")
+	assert.EqualError(t, err, "include cycle: cycle/a.naive -> cycle/b.naive -> cycle/a.naive")
+
+	_, err = LoadFS(fsys, "broken/main.naive")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLoadSource(t *testing.T) {
+	program, err := LoadSource([]byte("psh 1\njmp end\n:end"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, program[3].IntegerValue)
+
+	_, err = LoadReader(strings.NewReader("psh 1\nexport end\n:end"))
+	assert.EqualError(t, err, "2:1: export needs a file")
+}
+
+func TestReadTokens(t *testing.T) {
+	program, err := LoadSource([]byte("psh 1\njmp end\n:end"))
+	require.NoError(t, err)
+
+	var buff bytes.Buffer
+	require.NoError(t, WriteTokens(&buff, program))
+
+	decoded, err := DecodeTokens(buff.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, program, decoded)
+
+	read, err := ReadTokens(&buff)
+	require.NoError(t, err)
+	assert.Equal(t, program, read)
+
+	_, err = ReadTokens(strings.NewReader("not a program"))
+	assert.Error(t, err)
+}
+
+func TestDumpTokensToBinary(t *testing.T) {
+	program, err := LoadSource([]byte("psh 1\njmp end\n:end"))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "out", "program.bin")
+	require.NoError(t, (&Lexer{Tokens: program}).DumpTokensToBinary(path))
+
+	l, err := NewLexerFromBinary(path)
+	require.NoError(t, err)
+	assert.Equal(t, program, l.Tokens)
+
+	dir := writeFiles(t, map[string]string{"source.naive": "psh 1"})
+
+	// Failures are returned instead of exiting.
+	_, err = NewLexerFromBinary(filepath.Join(dir, "source.naive"))
+	assert.ErrorContains(t, err, "decoding instructions")
+
+	_, err = NewLexerFromBinary(filepath.Join(dir, "missing.bin"))
+	assert.Error(t, err)
+
+	_, err = NewLexerFromSource(filepath.Join(dir, "missing.naive"))
+	assert.Error(t, err)
+
+	// The source file is read as it is lexed, and closed at its end.
+	source, err := NewLexerFromSource(filepath.Join(dir, "source.naive"))
+	require.NoError(t, err)
+	require.NotNil(t, source.file)
+
+	tokens, err := source.Lex()
+	require.NoError(t, err)
+	assert.Len(t, tokens, 3)
+	assert.Nil(t, source.file)
+
+	assert.Error(t, l.DumpTokensToFile(filepath.Join(dir, "source.naive", "dis.naive")))
+}
@@ -1,9 +1,11 @@
 package lexer
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,86 +18,152 @@ import (
 	"github.com/jejikeh/ambient/token"
 )
 
-// @IMPORTANT: The InputCursor is the current position in the InputSource - 1
-
+// Lexer reads naive source from an io.RuneScanner one rune at a time, so
+// the source is never held in memory as a whole.
 type Lexer struct {
-	CurrentLineNumber                  int
-	CurrentLineExternalFileErrorReport int
-	CurrentLineCharacterIndex          int
+	CurrentLineNumber         int
+	CurrentLineCharacterIndex int
 
-	Tokens      []token.Token
-	TokenCursor int
+	Tokens []token.Token
 
-	InputSource []rune
+	// InputCursor counts the runes eaten from the input.
 	InputCursor int
 
 	TotalLinesProcessed int
+
+	// KeepComments makes the lexer emit comments as token.Comment tokens
+	// instead of skipping them. Programs must drop them with
+	// StripComments before they run.
+	KeepComments bool
+	// KeepMacros leaves const and macro declarations and their uses as
+	// they are written, for tools working on the source instead of the
+	// program. Identifiers are not resolved then, as they may name
+	// constants and macros.
+	KeepMacros bool
+
+	input io.RuneScanner
+	// ahead holds the runes peeked at but not eaten yet.
+	ahead []rune
+	// last is the last eaten rune, for throwBackOneCharacter.
+	last    rune
+	readErr error
+	// text collects the eaten runes while a comment is made.
+	text *strings.Builder
+
+	// err is the error Next stopped at, done is set once it returned the
+	// end of file token.
+	err  error
+	done bool
+
+	// file is the file NewLexerFromSource opened.
+	file *os.File
 }
 
 func NewLexer(source string) *Lexer {
-	return &Lexer{InputSource: []rune(source)}
+	return NewLexerFromRuneScanner(strings.NewReader(source))
+}
+
+// NewLexerFromBytes returns a lexer for naive source held in memory.
+func NewLexerFromBytes(source []byte) *Lexer {
+	return NewLexerFromRuneScanner(bytes.NewReader(source))
+}
+
+// NewLexerFromReader returns a lexer for the naive source read from r. r
+// is buffered unless it is an io.RuneScanner already.
+func NewLexerFromReader(r io.Reader) *Lexer {
+	if scanner, ok := r.(io.RuneScanner); ok {
+		return NewLexerFromRuneScanner(scanner)
+	}
+
+	return NewLexerFromRuneScanner(bufio.NewReader(r))
+}
+
+// NewLexerFromRuneScanner returns a lexer reading the source from r as it
+// goes. Only the runes of the current token are read ahead.
+func NewLexerFromRuneScanner(r io.RuneScanner) *Lexer {
+	return &Lexer{input: r}
 }
 
-func NewLexerFromSource(filepath string) *Lexer {
-	content, err := os.ReadFile(filepath)
+// NewLexerFromSource returns a lexer reading the file at filepath as it
+// goes. The file is closed once Next returns its last token or an error,
+// or by Close.
+func NewLexerFromSource(filepath string) (*Lexer, error) {
+	f, err := os.Open(filepath)
 	if err != nil {
-		color.Set(color.FgHiRed)
-		defer color.Unset()
-		log.Fatalf("Error reading file: [%v]\n", err)
+		return nil, err
 	}
 
-	return &Lexer{
-		InputSource: []rune(string(content)),
+	l := NewLexerFromReader(f)
+	l.file = f
+
+	return l, nil
+}
+
+// Close closes the file of a lexer made by NewLexerFromSource, for
+// callers which stop before the end of it.
+func (l *Lexer) Close() error {
+	if l.file == nil {
+		return nil
 	}
+
+	f := l.file
+	l.file = nil
+
+	return f.Close()
 }
 
-func NewLexerFromBinary(filepath string) *Lexer {
-	return &Lexer{
-		Tokens: loadFromBinary(filepath),
+// NewLexerFromBinary returns a lexer holding the tokens of the binary
+// file at filepath, written by DumpTokensToBinary.
+func NewLexerFromBinary(filepath string) (*Lexer, error) {
+	tokens, err := loadFromBinary(filepath)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Lexer{Tokens: tokens}, nil
 }
 
-func (l *Lexer) DumpTokensToBinary(outputPath string) {
+// DumpTokensToBinary writes the tokens to outputPath in the format read
+// by NewLexerFromBinary, creating its directory.
+func (l *Lexer) DumpTokensToBinary(outputPath string) error {
 	err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	f, err := os.Create(outputPath)
-
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	defer f.Close()
 
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-	err = enc.Encode(l.Tokens)
-
+	err = WriteTokens(f, l.Tokens)
 	if err != nil {
-		log.Fatal("Error encoding instructions: ", err)
+		return fmt.Errorf("encoding instructions: %w", err)
 	}
 
 	log.Printf("Dumped %d tokens to [%s]\n", len(l.Tokens), outputPath)
 
-	_, err = f.Write(buff.Bytes())
-	if err != nil {
-		log.Fatal(err)
-	}
+	return f.Close()
 }
 
-func (l *Lexer) DumpTokensToFile(outputPath string) {
+// WriteTokens writes tokens in the binary format read by ReadTokens.
+func WriteTokens(w io.Writer, tokens []token.Token) error {
+	return gob.NewEncoder(w).Encode(tokens)
+}
+
+// DumpTokensToFile writes the tokens to outputPath as naive source, one
+// per line, creating its directory.
+func (l *Lexer) DumpTokensToFile(outputPath string) error {
 	err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	f, err := os.Create(outputPath)
-
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	defer f.Close()
@@ -103,50 +171,126 @@ func (l *Lexer) DumpTokensToFile(outputPath string) {
 	for _, t := range l.Tokens {
 		_, err := f.Write([]byte(t.DetectMyString() + "\n"))
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
-}
 
-func loadFromBinary(sourcePath string) []token.Token {
-	var tokens []token.Token
+	return f.Close()
+}
 
+func loadFromBinary(sourcePath string) ([]token.Token, error) {
 	content, err := os.ReadFile(sourcePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	dec := gob.NewDecoder(bytes.NewBuffer(content))
-	err = dec.Decode(&tokens)
+	tokens, err := DecodeTokens(content)
 	if err != nil {
-		log.Fatal("Error decoding instructions: ", err)
+		return nil, fmt.Errorf("decoding instructions: %w", err)
 	}
 
-	return tokens
+	return tokens, nil
 }
 
-func (l *Lexer) Tokenize() []token.Token {
+// ReadTokens reads a program written by WriteTokens.
+func ReadTokens(r io.Reader) ([]token.Token, error) {
+	var tokens []token.Token
+
+	err := gob.NewDecoder(r).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// DecodeTokens decodes a program written by WriteTokens.
+func DecodeTokens(content []byte) ([]token.Token, error) {
+	return ReadTokens(bytes.NewReader(content))
+}
+
+// Lex tokenizes the whole input, resolving the identifiers to the index
+// of their label. The tokens are expanded as they are read, and only the
+// identifiers are gone over again once every label is known.
+func (l *Lexer) Lex() ([]token.Token, error) {
 	tokens := []token.Token{}
 
-	for {
-		t, err := l.composeNewToken()
-		if err != nil {
-			color.Set(color.FgHiRed)
-			defer color.Unset()
+	if l.KeepMacros {
+		for {
+			t, err := l.Next()
+			if err == io.EOF {
+				return tokens, nil
+			}
+
+			if err != nil {
+				return nil, err
+			}
 
-			log.Fatalf("Error: %s\n", err)
+			tokens = append(tokens, t)
 		}
+	}
 
-		tokens = append(tokens, t)
+	labels := make(map[string]int)
+	identifiers := []int{}
 
-		if t.Kind == token.EndOfLine {
-			break
+	// Labels are indexed as the tokens come, as if comments were
+	// stripped, which is how the program runs.
+	index := 0
+	err := newExpander("").expandStream(l, func(t token.Token) error {
+		switch t.Kind {
+		case token.Label:
+			labels[t.Name] = index
+		case token.Identifier:
+			identifiers = append(identifiers, len(tokens))
+		}
+
+		if t.Kind != token.Comment {
+			index++
 		}
+
+		tokens = append(tokens, t)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	tokens = l.resolveLabelIdentifierDeclaration(tokens)
+	resolveIdentifiers(tokens, identifiers, labels)
 
-	return tokens
+	return tokens, nil
+}
+
+// Next returns the next token of the input as it is written: identifiers
+// are not resolved and macros are not expanded. The last token is a
+// token.EndOfLine, after it Next returns io.EOF.
+func (l *Lexer) Next() (token.Token, error) {
+	if l.err != nil {
+		return token.Token{}, l.err
+	}
+
+	if l.done {
+		return token.Token{}, io.EOF
+	}
+
+	t, err := l.composeNewToken()
+	if err == nil {
+		err = l.readErr
+	}
+
+	if err != nil {
+		l.err = err
+		l.Close()
+
+		return t, err
+	}
+
+	l.done = t.Kind == token.EndOfLine
+	if l.done {
+		l.Close()
+	}
+
+	return t, nil
 }
 
 func PrintDebugTokens(tokens []token.Token) {
@@ -157,34 +301,45 @@ func PrintDebugTokens(tokens []token.Token) {
 	}
 }
 
-// @todo: refactor this please
-func (l *Lexer) resolveLabelIdentifierDeclaration(tokens []token.Token) []token.Token {
-	labelIndexs := make(map[string]int)
-	newTokens := []token.Token{}
+// resolveIdentifiers sets the identifiers at the given indexes to the
+// index of their label in place.
+func resolveIdentifiers(tokens []token.Token, identifiers []int, labels map[string]int) {
+	for _, i := range identifiers {
+		t := &tokens[i]
 
-	// @todo: remove two loops
-	for i, t := range tokens {
-		if t.Kind == token.Label {
-			labelIndexs[t.Name] = i
+		if label, ok := labels[t.Name]; ok {
+			t.IntegerValue = label
+			continue
 		}
+
+		color.Set(color.FgHiRed)
+		log.Printf("Label [%s] (%d:%d) not found! Default to -1\n", t.Name, t.LineStart, t.LineEnd)
+		color.Unset()
+		t.IntegerValue = -1
 	}
+}
 
-	for _, t := range tokens {
-		if t.Kind == token.Identifier {
-			if label, ok := labelIndexs[t.Name]; ok {
-				t.IntegerValue = label
-			} else {
-				color.Set(color.FgHiRed)
-				defer color.Unset()
-				log.Printf("Label [%s] (%d:%d) not found! Default to -1\n", t.Name, t.LineStart, t.LineEnd)
-				t.IntegerValue = -1
+// peekAt returns the rune offset runes after the cursor, reading it from
+// the input if needed.
+func (l *Lexer) peekAt(offset int) (rune, bool) {
+	for len(l.ahead) <= offset {
+		if l.input == nil || l.readErr != nil {
+			return -1, false
+		}
+
+		c, _, err := l.input.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				l.readErr = err
 			}
+
+			return -1, false
 		}
 
-		newTokens = append(newTokens, t)
+		l.ahead = append(l.ahead, c)
 	}
 
-	return newTokens
+	return l.ahead[offset], true
 }
 
 // eatCharacter just increments the InputCursor by 1
@@ -192,30 +347,40 @@ func (l *Lexer) resolveLabelIdentifierDeclaration(tokens []token.Token) []token.
 // Also increments the CurrentLineCharacterIndex and another
 // line counters for error reporting and other things
 func (l *Lexer) eatCharacter() {
-	if l.InputCursor >= len(l.InputSource) {
+	c, ok := l.peekAt(0)
+	if !ok {
 		return
 	}
 
-	if l.InputSource[l.InputCursor] == '\n' {
+	l.ahead = l.ahead[:copy(l.ahead, l.ahead[1:])]
+	l.last = c
+	l.InputCursor++
+
+	if l.text != nil {
+		l.text.WriteRune(c)
+	}
+
+	if c == '\n' {
 		l.CurrentLineNumber++
 		l.TotalLinesProcessed++
 		l.CurrentLineCharacterIndex = 0
+		return
 	}
 
-	l.InputCursor++
 	l.CurrentLineCharacterIndex++
 }
 
 func (l *Lexer) peekNextCharacter() (rune, error) {
-	if l.InputCursor >= len(l.InputSource) {
+	c, ok := l.peekAt(0)
+	if !ok {
 		return -1, fmt.Errorf(`unexpected end of file!
 		Current cursor: [%d]
 		Source length: [%d]
 		Current line: [%d]
-		Current column: [%d]`, l.InputCursor, len(l.InputSource), l.CurrentLineNumber, l.CurrentLineCharacterIndex)
+		Current column: [%d]`, l.InputCursor, l.InputCursor+len(l.ahead), l.CurrentLineNumber, l.CurrentLineCharacterIndex)
 	}
 
-	return l.InputSource[l.InputCursor], nil
+	return c, nil
 }
 
 func (l *Lexer) peekNextCharacterIgnoringRunes(r rune) (rune, error) {
@@ -258,6 +423,7 @@ func (l *Lexer) setEndOfToken(t *token.Token) {
 func (l *Lexer) throwBackOneCharacter() {
 	common.AssertIfNot(l.InputCursor > 0)
 
+	l.ahead = append([]rune{l.last}, l.ahead...)
 	l.InputCursor--
 	l.CurrentLineCharacterIndex--
 }
@@ -366,6 +532,100 @@ func (l *Lexer) makeNumber() (token.Token, error) {
 	return *t, nil
 }
 
+// startsComment reports whether the cursor is at `//` or `/*`.
+func (l *Lexer) startsComment() bool {
+	next, ok := l.peekAt(1)
+
+	return ok && (next == '/' || next == '*')
+}
+
+func (l *Lexer) makeOperator() token.Token {
+	t := &token.Token{}
+	t.Kind = token.Operator
+
+	l.setStartOfToken(t)
+	t.SetIndentValue(string(l.ahead[0]))
+	l.eatCharacter()
+	l.setEndOfToken(t)
+
+	return *t
+}
+
+// makeString reads a string on a single line. A backslash escapes the
+// character after it.
+func (l *Lexer) makeString() (token.Token, error) {
+	t := &token.Token{}
+	t.Kind = token.String
+
+	l.setStartOfToken(t)
+	l.eatCharacter()
+
+	strBuilder := strings.Builder{}
+
+	for {
+		c, err := l.peekNextCharacter()
+		if err != nil || c == '\n' {
+			return *t, fmt.Errorf("expected end of string, but got end of line (%d:%d)", l.CurrentLineNumber, l.CurrentLineCharacterIndex)
+		}
+
+		l.eatCharacter()
+
+		if c == '"' {
+			break
+		}
+
+		if c == '\\' {
+			c, err = l.peekNextCharacter()
+			if err != nil || c == '\n' {
+				continue
+			}
+
+			l.eatCharacter()
+		}
+
+		strBuilder.WriteRune(c)
+	}
+
+	t.StringValue = strBuilder.String()
+	l.setEndOfToken(t)
+
+	return *t, nil
+}
+
+// makeComment eats a comment and returns it as a token spanning it, its
+// delimiters included.
+func (l *Lexer) makeComment() (token.Token, error) {
+	t := &token.Token{}
+	t.Kind = token.Comment
+
+	l.setStartOfToken(t)
+
+	l.text = &strings.Builder{}
+	defer func() { l.text = nil }()
+
+	err := l.eatInputDueToBlockComment()
+	if err != nil {
+		return *t, err
+	}
+
+	t.StringValue = l.text.String()
+	l.setEndOfToken(t)
+
+	return *t, nil
+}
+
+// StripComments returns the tokens without the comments, ready to run.
+func StripComments(tokens []token.Token) []token.Token {
+	stripped := make([]token.Token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Kind != token.Comment {
+			stripped = append(stripped, t)
+		}
+	}
+
+	return stripped
+}
+
 // @todo: test all the error cases
 func (l *Lexer) eatInputDueToBlockComment() error {
 	c, err := l.peekNextCharacter()
@@ -423,6 +683,8 @@ func (l *Lexer) eatUntilCharacterCombo(r1, r2 rune) error {
 	}
 }
 
+// eatUntilNewLine eats the rest of the line, leaving the new line itself
+// to the whitespace that follows.
 func (l *Lexer) eatUntilNewLine() {
 	for {
 		c, err := l.peekNextCharacter()
@@ -431,7 +693,6 @@ func (l *Lexer) eatUntilNewLine() {
 		}
 
 		if c == '\n' {
-			l.eatCharacter()
 			return
 		}
 
@@ -457,12 +718,20 @@ func (l *Lexer) composeNewToken() (token.Token, error) {
 			}
 		}
 
+		if c == '/' && !l.startsComment() {
+			return l.makeOperator(), nil
+		}
+
 		if c == '/' {
-			err = l.eatInputDueToBlockComment()
+			comment, err := l.makeComment()
 			if err != nil {
 				return *t, err
 			}
 
+			if l.KeepComments {
+				return comment, nil
+			}
+
 			continue
 		}
 
@@ -488,6 +757,14 @@ func (l *Lexer) composeNewToken() (token.Token, error) {
 			return l.makeIdentifierOrKeyword()
 		}
 
+		if c == '"' {
+			return l.makeString()
+		}
+
+		if token.IsOperator(c) {
+			return l.makeOperator(), nil
+		}
+
 		if token.IsPartOfNumber(c) {
 			return l.makeNumber()
 		} else {
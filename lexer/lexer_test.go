@@ -1,8 +1,12 @@
 package lexer
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/jejikeh/ambient/common"
 	"github.com/jejikeh/ambient/token"
@@ -10,9 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestResolveLabelIdentifierDeclaration(t *testing.T) {
-	lexer := Lexer{}
-
+func TestResolveIdentifiers(t *testing.T) {
 	// Test case 1: No label tokens
 	tokens := []token.Token{
 		{Kind: token.Identifier, TokenValue: token.TokenValue{IndentValue: token.IndentValue{Name: "x"}}},
@@ -24,8 +26,8 @@ func TestResolveLabelIdentifierDeclaration(t *testing.T) {
 		{Kind: token.Identifier, TokenValue: token.TokenValue{IndentValue: token.IndentValue{Name: "y"}, IntegerValue: -1}},
 		{Kind: token.Identifier, TokenValue: token.TokenValue{IndentValue: token.IndentValue{Name: "z"}, IntegerValue: -1}},
 	}
-	result := lexer.resolveLabelIdentifierDeclaration(tokens)
-	assert.Equal(t, expected, result, "Failed test case 1")
+	resolveIdentifiers(tokens, []int{0, 1, 2}, map[string]int{})
+	assert.Equal(t, expected, tokens, "Failed test case 1")
 
 	// Test case 2: With label tokens
 	tokens = []token.Token{
@@ -46,8 +48,8 @@ func TestResolveLabelIdentifierDeclaration(t *testing.T) {
 		{Kind: token.Identifier, TokenValue: token.TokenValue{IndentValue: token.IndentValue{Name: "label2"}, IntegerValue: -1}},
 		{Kind: token.Identifier, TokenValue: token.TokenValue{IndentValue: token.IndentValue{Name: "h"}, IntegerValue: -1}},
 	}
-	result = lexer.resolveLabelIdentifierDeclaration(tokens)
-	assert.Equal(t, expected, result, "Failed test case 2")
+	resolveIdentifiers(tokens, []int{1, 2, 3, 4, 5, 6}, map[string]int{"label1": 0})
+	assert.Equal(t, expected, tokens, "Failed test case 2")
 }
 
 func TestLexer_peekNextCharacterIgnoringRunes(t *testing.T) {
@@ -347,3 +349,130 @@ func TestLexer_composeNewToken(t *testing.T) {
 		})
 	}
 }
+
+func TestLexer_KeepComments(t *testing.T) {
+	source := "// head\n:start psh 1 /* one\ntwo */ jmp start // tail"
+
+	l := NewLexer(source)
+	l.KeepComments = true
+	tokens, err := l.Lex()
+	require.NoError(t, err)
+
+	comments := []token.Token{}
+	for _, tok := range tokens {
+		if tok.Kind == token.Comment {
+			comments = append(comments, tok)
+		}
+	}
+
+	require.Len(t, comments, 3)
+
+	assert.Equal(t, "// head", comments[0].StringValue)
+	assert.Equal(t, []int{0, 0, 0, 7}, []int{comments[0].LineStart, comments[0].CollumnStart, comments[0].LineEnd, comments[0].CollumnEnd})
+
+	assert.Equal(t, "/* one\ntwo */", comments[1].StringValue)
+	assert.Equal(t, []int{1, 13, 2, 6}, []int{comments[1].LineStart, comments[1].CollumnStart, comments[1].LineEnd, comments[1].CollumnEnd})
+
+	assert.Equal(t, "// tail", comments[2].StringValue)
+	assert.Equal(t, []int{2, 17, 2, 24}, []int{comments[2].LineStart, comments[2].CollumnStart, comments[2].LineEnd, comments[2].CollumnEnd})
+
+	// Without comments the program is the one a plain lexer produces,
+	// labels included.
+	program, err := NewLexer(source).Lex()
+	require.NoError(t, err)
+	assert.Equal(t, program, StripComments(tokens))
+}
+
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+
+	return n, err
+}
+
+func TestLexer_Next(t *testing.T) {
+	l := NewLexer("psh 1 // one\n:loop jmp loop")
+
+	kinds := []token.Kind{}
+	for {
+		tok, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		kinds = append(kinds, tok.Kind)
+
+		if tok.Kind == token.Identifier {
+			assert.Zero(t, tok.IntegerValue, "Next does not resolve identifiers")
+		}
+	}
+
+	assert.Equal(t, []token.Kind{token.Push, token.Number, token.Label, token.Jump, token.Identifier, token.EndOfLine}, kinds)
+
+	_, err := l.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLexer_NextReadError(t *testing.T) {
+	boom := errors.New("boom")
+	l := NewLexerFromReader(io.MultiReader(strings.NewReader("psh 1 "), iotest.ErrReader(boom)))
+
+	tok, err := l.Next()
+	require.NoError(t, err)
+	assert.Equal(t, token.Kind(token.Push), tok.Kind)
+
+	_, err = l.Next()
+	require.NoError(t, err)
+
+	_, err = l.Next()
+	assert.ErrorIs(t, err, boom)
+
+	_, err = l.Next()
+	assert.ErrorIs(t, err, boom, "the error sticks")
+}
+
+func TestLexer_NextReadsIncrementally(t *testing.T) {
+	source := strings.Repeat("psh 1 psh 2 sum pop\n", 100000)
+	input := &countingReader{r: strings.NewReader(source)}
+
+	l := NewLexerFromReader(input)
+	for i := 0; i < 10; i++ {
+		_, err := l.Next()
+		require.NoError(t, err)
+	}
+
+	assert.Less(t, input.read, len(source)/100)
+
+	tokens := 10
+	for {
+		_, err := l.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		tokens++
+	}
+
+	assert.Equal(t, 100000*6+1, tokens)
+	assert.Equal(t, len(source), input.read)
+}
+
+func TestLex_Reader(t *testing.T) {
+	source := "psh 3\n:loop\npsh 1 sub\ndupl 0 psh 0 gt jif loop // count down"
+
+	fromString, err := NewLexer(source).Lex()
+	require.NoError(t, err)
+
+	fromReader, err := NewLexerFromReader(iotest.OneByteReader(strings.NewReader(source))).Lex()
+	require.NoError(t, err)
+
+	assert.Equal(t, fromString, fromReader)
+	assert.Equal(t, 2, fromReader[12].IntegerValue)
+}
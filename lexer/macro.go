@@ -0,0 +1,534 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// MaxMacroDepth is how deep macros may expand inside each other, which
+// stops macros that expand themselves.
+const MaxMacroDepth = 64
+
+type macro struct {
+	name   string
+	params []string
+	body   []token.Token
+
+	// expansions counts the uses of the macro, to name the labels of each
+	// one apart.
+	expansions int
+}
+
+// expander replaces constants by their values and macro uses by their
+// bodies. Both have to be declared before they are used.
+type expander struct {
+	// path names the file in errors, if there is one.
+	path string
+
+	consts map[string]int
+	macros map[string]*macro
+	depth  int
+}
+
+func newExpander(path string) *expander {
+	return &expander{path: path, consts: make(map[string]int), macros: make(map[string]*macro)}
+}
+
+func (e *expander) errorf(t token.Token, format string, args ...any) error {
+	return errorAt(e.path, t, format, args...)
+}
+
+// stream is what the expander reads tokens from: a lexer, or the tokens
+// of a macro body or argument. Only the few tokens the expander looks
+// ahead at are held.
+type stream struct {
+	read  func() (token.Token, error)
+	ahead []token.Token
+	// err is the error read stopped at, other than io.EOF.
+	err error
+}
+
+func lexerStream(l *Lexer) *stream {
+	return &stream{read: l.Next}
+}
+
+func sliceStream(tokens []token.Token) *stream {
+	return &stream{ahead: tokens}
+}
+
+// peek returns the token offset tokens ahead, reading it if needed. It
+// returns false past the last token.
+func (s *stream) peek(offset int) (token.Token, bool) {
+	for len(s.ahead) <= offset {
+		if s.read == nil || s.err != nil {
+			return token.Token{}, false
+		}
+
+		t, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+
+			return token.Token{}, false
+		}
+
+		s.ahead = append(s.ahead, t)
+	}
+
+	return s.ahead[offset], true
+}
+
+// next returns the next token and moves past it. The tokens read ahead
+// are moved down, so that the lexer's ones fit in the same array.
+func (s *stream) next() (token.Token, bool) {
+	t, ok := s.peek(0)
+	if !ok {
+		return t, false
+	}
+
+	if s.read == nil {
+		s.ahead = s.ahead[1:]
+	} else {
+		s.ahead = s.ahead[:copy(s.ahead, s.ahead[1:])]
+	}
+
+	return t, true
+}
+
+// isOperator reports whether the next token is operator.
+func (s *stream) isOperator(operator string) bool {
+	t, ok := s.peek(0)
+	return ok && is(t, operator)
+}
+
+// expandStream expands the tokens read by the lexer, handing each one to
+// emit as soon as it is expanded. An error of the lexer comes before the
+// ones it causes, such as a macro cut short.
+func (e *expander) expandStream(l *Lexer, emit func(token.Token) error) error {
+	s := lexerStream(l)
+
+	err := e.expand(s, nil, emit)
+	if s.err != nil && e.path != "" {
+		return fmt.Errorf("%s: %w", e.path, s.err)
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+
+	return err
+}
+
+// expand expands the tokens of s into emit. The tokens of a macro body
+// take the position of site, the outermost use of the macro, so errors
+// point to it.
+func (e *expander) expand(s *stream, site *token.Token, emit func(token.Token) error) error {
+	for {
+		t, ok := s.next()
+		if !ok {
+			return nil
+		}
+
+		switch t.Kind {
+		case token.Const:
+			if err := e.defineConst(s, t); err != nil {
+				return err
+			}
+
+			continue
+
+		case token.Macro:
+			if err := e.defineMacro(s, t); err != nil {
+				return err
+			}
+
+			continue
+
+		case token.EndMacro:
+			return e.errorf(at(t, site), "endmacro without macro")
+
+		case token.Operator:
+			return e.errorf(at(t, site), "unexpected %s", t.Name)
+
+		case token.Identifier:
+			if value, ok := e.consts[t.Name]; ok {
+				t = number(t, value)
+				break
+			}
+
+			m, ok := e.macros[t.Name]
+			if !ok {
+				break
+			}
+
+			if err := e.call(m, s, t, site, emit); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := emit(at(t, site)); err != nil {
+			return err
+		}
+	}
+}
+
+// at moves a token to the use of the macro it was expanded from.
+func at(t token.Token, site *token.Token) token.Token {
+	if site == nil {
+		return t
+	}
+
+	t.LineStart, t.CollumnStart = site.LineStart, site.CollumnStart
+	t.LineEnd, t.CollumnEnd = site.LineEnd, site.CollumnEnd
+
+	return t
+}
+
+func number(t token.Token, value int) token.Token {
+	t.Kind = token.Number
+	t.SetIndentValue(strconv.Itoa(value))
+	t.IntegerValue = value
+
+	return t
+}
+
+func is(t token.Token, operator string) bool {
+	return t.Kind == token.Operator && t.Name == operator
+}
+
+// declare checks that a const or macro name is not taken yet.
+func (e *expander) declare(name token.Token) error {
+	if _, ok := e.consts[name.Name]; ok {
+		return e.errorf(name, "%s is already declared as a const", name.Name)
+	}
+
+	if _, ok := e.macros[name.Name]; ok {
+		return e.errorf(name, "%s is already declared as a macro", name.Name)
+	}
+
+	return nil
+}
+
+// defineConst reads `NAME = expression` after the const t.
+func (e *expander) defineConst(s *stream, t token.Token) error {
+	name, ok := s.next()
+	if !ok || name.Kind != token.Identifier {
+		return e.errorf(t, "const expects a name")
+	}
+
+	if equal, ok := s.next(); !ok || !is(equal, "=") {
+		return e.errorf(name, "const %s expects =", name.Name)
+	}
+
+	p := &expressionParser{e: e, s: s, last: name}
+	value, err := p.parse()
+	if err != nil {
+		return err
+	}
+
+	if err := e.declare(name); err != nil {
+		return err
+	}
+
+	e.consts[name.Name] = value
+
+	return nil
+}
+
+// defineMacro reads a macro after the macro t, up to its `endmacro`.
+func (e *expander) defineMacro(s *stream, t token.Token) error {
+	name, ok := s.next()
+	if !ok || name.Kind != token.Identifier {
+		return e.errorf(t, "macro expects a name")
+	}
+
+	if err := e.declare(name); err != nil {
+		return err
+	}
+
+	m := &macro{name: name.Name}
+
+	if s.isOperator("(") {
+		s.next()
+
+		for !s.isOperator(")") {
+			param, ok := s.next()
+			if !ok || param.Kind != token.Identifier {
+				return e.errorf(name, "macro %s expects a parameter name", name.Name)
+			}
+
+			m.params = append(m.params, param.Name)
+
+			if s.isOperator(",") {
+				s.next()
+			}
+		}
+
+		s.next()
+	}
+
+	for {
+		t, ok := s.next()
+		if !ok {
+			return e.errorf(name, "macro %s has no endmacro", m.name)
+		}
+
+		switch t.Kind {
+		case token.EndMacro:
+			e.macros[m.name] = m
+			return nil
+
+		case token.Macro:
+			return e.errorf(t, "macro inside macro %s", m.name)
+
+		case token.Comment:
+			continue
+		}
+
+		m.body = append(m.body, t)
+	}
+}
+
+// call expands the use of a macro, reading its arguments from s. When the
+// use is in the body of another macro, its arguments are moved to the site
+// of that one too.
+func (e *expander) call(m *macro, s *stream, use token.Token, site *token.Token, emit func(token.Token) error) error {
+	outer := site
+	if site == nil {
+		site = &use
+	}
+
+	args := [][]token.Token{}
+
+	if s.isOperator("(") {
+		s.next()
+
+		arg := []token.Token{}
+		depth := 0
+
+	arguments:
+		for {
+			t, ok := s.peek(0)
+			if !ok || t.Kind == token.EndOfLine {
+				return e.errorf(*site, "macro %s expects )", m.name)
+			}
+
+			s.next()
+
+			switch {
+			case t.Kind == token.Comment:
+				continue
+			case depth == 0 && is(t, ")"):
+				if len(arg) > 0 || len(args) > 0 {
+					args = append(args, arg)
+				}
+
+				break arguments
+			case depth == 0 && is(t, ","):
+				args = append(args, arg)
+				arg = []token.Token{}
+				continue
+			case is(t, "("):
+				depth++
+			case is(t, ")"):
+				depth--
+			}
+
+			arg = append(arg, at(t, outer))
+		}
+	}
+
+	if len(args) != len(m.params) {
+		return e.errorf(*site, "macro %s expects %d arguments, got %d", m.name, len(m.params), len(args))
+	}
+
+	values := make(map[string]token.Token, len(args))
+	for j, arg := range args {
+		value, err := e.argument(m, arg, *site)
+		if err != nil {
+			return err
+		}
+
+		values[m.params[j]] = value
+	}
+
+	if e.depth >= MaxMacroDepth {
+		return e.errorf(*site, "macro %s expands too deep, does it use itself?", m.name)
+	}
+
+	m.expansions++
+
+	// Every use gets its own copy of the labels declared in the body.
+	// Their names can not clash with the labels of the file, which have
+	// no dots.
+	locals := make(map[string]string)
+	for _, t := range m.body {
+		if t.Kind == token.Label {
+			locals[t.Name] = fmt.Sprintf("%s.%s.%d", m.name, t.Name, m.expansions)
+		}
+	}
+
+	body := make([]token.Token, 0, len(m.body))
+	for _, t := range m.body {
+		if value, ok := values[t.Name]; ok && t.Kind == token.Identifier {
+			body = append(body, value)
+			continue
+		}
+
+		if local, ok := locals[t.Name]; ok && (t.Kind == token.Label || t.Kind == token.Identifier) {
+			t.SetIndentValue(local)
+		}
+
+		body = append(body, t)
+	}
+
+	e.depth++
+	err := e.expand(sliceStream(body), site, emit)
+	e.depth--
+
+	return err
+}
+
+// argument turns the tokens of an argument into the token it stands for.
+// A single token is used as is, anything longer has to be a constant
+// expression.
+func (e *expander) argument(m *macro, arg []token.Token, site token.Token) (token.Token, error) {
+	if len(arg) == 0 {
+		return token.Token{}, e.errorf(site, "macro %s has an empty argument", m.name)
+	}
+
+	if len(arg) == 1 && arg[0].Kind != token.Operator {
+		return arg[0], nil
+	}
+
+	s := sliceStream(arg)
+	p := &expressionParser{e: e, s: s}
+	value, err := p.parse()
+	if err != nil {
+		return token.Token{}, err
+	}
+
+	if t, ok := s.peek(0); ok {
+		return token.Token{}, e.errorf(t, "unexpected %s in argument of %s", t.Name, m.name)
+	}
+
+	return number(arg[0], value), nil
+}
+
+// expressionParser evaluates constant expressions of numbers and
+// constants with `+ - * /` and parentheses.
+type expressionParser struct {
+	e *expander
+	s *stream
+	// last is the last token read, errors at the end of the expression
+	// point to it.
+	last token.Token
+}
+
+func (p *expressionParser) parse() (int, error) {
+	return p.binary(0)
+}
+
+func (p *expressionParser) skipComments() {
+	for t, ok := p.s.peek(0); ok && t.Kind == token.Comment; t, ok = p.s.peek(0) {
+		p.s.next()
+	}
+}
+
+var precedence = map[string]int{"+": 1, "-": 1, "*": 2, "/": 2}
+
+func (p *expressionParser) binary(min int) (int, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		p.skipComments()
+
+		operator, ok := p.s.peek(0)
+		if !ok || operator.Kind != token.Operator {
+			break
+		}
+
+		level, ok := precedence[operator.Name]
+		if !ok || level <= min {
+			break
+		}
+
+		p.s.next()
+		p.last = operator
+
+		right, err := p.binary(level)
+		if err != nil {
+			return 0, err
+		}
+
+		switch operator.Name {
+		case "+":
+			left += right
+		case "-":
+			left -= right
+		case "*":
+			left *= right
+		case "/":
+			if right == 0 {
+				return 0, p.e.errorf(operator, "division by zero")
+			}
+
+			left /= right
+		}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) unary() (int, error) {
+	p.skipComments()
+
+	t, ok := p.s.next()
+	if !ok {
+		return 0, p.e.errorf(p.last, "expected a value after %s", p.last.Name)
+	}
+
+	p.last = t
+
+	switch {
+	case t.Kind == token.Number:
+		return t.IntegerValue, nil
+
+	case t.Kind == token.Identifier:
+		value, ok := p.e.consts[t.Name]
+		if !ok {
+			return 0, p.e.errorf(t, "%s is not a const", t.Name)
+		}
+
+		return value, nil
+
+	case t.Kind == token.Operator && t.Name == "-":
+		value, err := p.unary()
+		return -value, err
+
+	case t.Kind == token.Operator && t.Name == "(":
+		value, err := p.binary(0)
+		if err != nil {
+			return 0, err
+		}
+
+		if !p.s.isOperator(")") {
+			return 0, p.e.errorf(t, "expected )")
+		}
+
+		p.last, _ = p.s.next()
+
+		return value, nil
+	}
+
+	return 0, p.e.errorf(t, "expected a value, got %s", t.DetectMyString())
+}
@@ -0,0 +1,159 @@
+package lexer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLex_Const(t *testing.T) {
+	tokens, err := NewLexer("const A = 2 * (3 + 4) - 1\nconst B = -A / 2\npsh A psh B").Lex()
+	require.NoError(t, err)
+
+	require.Len(t, tokens, 5)
+	assert.Equal(t, token.Kind(token.Number), tokens[1].Kind)
+	assert.Equal(t, 13, tokens[1].IntegerValue)
+	assert.Equal(t, -6, tokens[3].IntegerValue)
+	assert.Equal(t, "-6", tokens[3].Name)
+}
+
+func TestLex_Macro(t *testing.T) {
+	source := `const TWO = 2
+macro repeat(n, body)
+psh n
+:loop
+call body
+psh 1
+sub
+dupl 0
+psh 0
+gt
+jif loop
+endmacro
+
+repeat(TWO, greet)
+repeat(TWO + 1, greet)
+jmp done
+:greet
+ret
+:done`
+
+	tokens, err := NewLexer(source).Lex()
+	require.NoError(t, err)
+
+	labels := map[string]int{}
+	for i, tok := range tokens {
+		if tok.Kind == token.Label {
+			labels[tok.Name] = i
+		}
+
+		assert.NotEqual(t, token.Kind(token.Operator), tok.Kind)
+	}
+
+	// Each use has its own loop.
+	require.Contains(t, labels, "repeat.loop.1")
+	require.Contains(t, labels, "repeat.loop.2")
+
+	first, second := labels["repeat.loop.1"], labels["repeat.loop.2"]
+	assert.Equal(t, 2, tokens[first-1].IntegerValue)
+	assert.Equal(t, 3, tokens[second-1].IntegerValue)
+	assert.Equal(t, labels["greet"], tokens[first+2].IntegerValue)
+	assert.Equal(t, first, tokens[first+12].IntegerValue, "each jif goes back to its own loop")
+	assert.Equal(t, second, tokens[second+12].IntegerValue)
+
+	// Expanded tokens point at the use of the macro.
+	assert.Equal(t, 13, tokens[first].LineStart)
+	assert.Equal(t, 14, tokens[second].LineStart)
+}
+
+func TestLex_MacroWithoutParameters(t *testing.T) {
+	tokens, err := NewLexer("macro two psh 2 endmacro two two()").Lex()
+	require.NoError(t, err)
+
+	kinds := []token.Kind{}
+	for _, tok := range tokens {
+		kinds = append(kinds, tok.Kind)
+	}
+
+	assert.Equal(t, []token.Kind{token.Push, token.Number, token.Push, token.Number, token.EndOfLine}, kinds)
+}
+
+func TestLex_MacroErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"Argument count", "macro add(a, b) psh a psh b sum endmacro\npsh 1\nadd(1)", "3:1: macro add expects 2 arguments, got 1"},
+		{"Recursive", "macro loop loop endmacro\nloop", "2:1: macro loop expands too deep, does it use itself?"},
+		{"Nested use", "macro inner(a) psh a endmacro\nmacro outer inner(1, 2) endmacro\n\nouter", "4:1: macro inner expects 1 arguments, got 2"},
+		{"No endmacro", "macro open psh 1", "1:7: macro open has no endmacro"},
+		{"Endmacro without macro", "psh 1 endmacro", "1:7: endmacro without macro"},
+		{"Unknown const", "const A = B + 1", "1:11: B is not a const"},
+		{"Division by zero", "const A = 1 / 0", "1:13: division by zero"},
+		{"Const twice", "const A = 1\nconst A = 2", "2:7: A is already declared as a const"},
+		{"Stray operator", "psh 1 = 2", "1:7: unexpected ="},
+		{"Missing parenthesis", "macro m(a) psh a endmacro m(1", "1:27: macro m expects )"},
+		{"Nested unknown const", "macro inner(a) psh a endmacro\nmacro outer inner(B + 1) endmacro\n\nouter", "4:1: B is not a const"},
+		{"Nested stray argument", "macro inner(a) psh a endmacro\nmacro outer inner(1 2) endmacro\n\nouter", "4:1: unexpected 2 in argument of inner"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewLexer(test.source).Lex()
+			require.Error(t, err)
+			assert.EqualError(t, err, test.err)
+
+			var lexErr *Error
+			assert.ErrorAs(t, err, &lexErr)
+		})
+	}
+}
+
+func TestLex_KeepMacros(t *testing.T) {
+	l := NewLexer("const A = 1\npsh A")
+	l.KeepMacros = true
+
+	tokens, err := l.Lex()
+	require.NoError(t, err)
+
+	var names bytes.Buffer
+	for _, tok := range tokens {
+		names.WriteString(tok.Name + " ")
+	}
+
+	assert.Equal(t, "const A = 1 psh A  ", names.String())
+}
+
+func TestExpandStream_EmitsAsItReads(t *testing.T) {
+	source := "const N = 2\nmacro twice(x)\npsh x psh x\nendmacro\n" + strings.Repeat("twice(N) sum pop\n", 100000)
+	input := &countingReader{r: strings.NewReader(source)}
+
+	stop := errors.New("stop")
+	emitted := []token.Token{}
+
+	err := newExpander("").expandStream(NewLexerFromReader(input), func(t token.Token) error {
+		emitted = append(emitted, t)
+		if len(emitted) == 8 {
+			return stop
+		}
+
+		return nil
+	})
+
+	require.ErrorIs(t, err, stop)
+	assert.Less(t, input.read, len(source)/100)
+
+	kinds := []token.Kind{}
+	for _, t := range emitted {
+		kinds = append(kinds, t.Kind)
+	}
+
+	assert.Equal(t, []token.Kind{token.Push, token.Number, token.Push, token.Number, token.Sum, token.Pop, token.Push, token.Number}, kinds)
+	assert.Equal(t, 2, emitted[1].IntegerValue)
+}
@@ -0,0 +1,205 @@
+package lsp
+
+import (
+	"fmt"
+
+	"github.com/jejikeh/ambient/nai"
+)
+
+type naiDocument struct {
+	file *nai.File
+	// info is nil when the file could not be parsed.
+	info        *nai.Info
+	diagnostics []Diagnostic
+
+	// lines holds the offset of the start of every line.
+	lines []int
+}
+
+func spanRange(s nai.Span) Range {
+	return Range{
+		Start: Position{Line: s.Start.Line - 1, Character: s.Start.Column - 1},
+		End:   Position{Line: s.End.Line - 1, Character: s.End.Column - 1},
+	}
+}
+
+func newNaiDocument(path string, text string) *naiDocument {
+	d := &naiDocument{lines: []int{0}}
+	for i, r := range []rune(text) {
+		if r == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+
+	file, err := nai.ParseFile(path, text)
+	d.file = file
+	if err == nil {
+		d.info, err = nai.Check(file)
+	}
+
+	if list, ok := err.(nai.ErrorList); ok {
+		for _, e := range list {
+			message := e.Message
+			if e.Suggestion != "" {
+				message += fmt.Sprintf(" (did you mean %s?)", e.Suggestion)
+			}
+
+			d.diagnostics = append(d.diagnostics, Diagnostic{
+				Range:    spanRange(e.Span),
+				Severity: SeverityError,
+				Source:   "ambient",
+				Message:  message,
+			})
+		}
+	}
+
+	return d
+}
+
+func (d *naiDocument) Diagnostics() []Diagnostic {
+	return append([]Diagnostic{}, d.diagnostics...)
+}
+
+// symbolAt returns the symbol declared or used by the name at p.
+func (d *naiDocument) symbolAt(p Position) (*nai.Ident, *nai.Symbol) {
+	if d.info == nil {
+		return nil, nil
+	}
+
+	for _, names := range []map[*nai.Ident]*nai.Symbol{d.info.Uses, d.info.Defs} {
+		for ident, symbol := range names {
+			if spanRange(ident.Span).contains(p) {
+				return ident, symbol
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (d *naiDocument) Definition(p Position) (Range, bool) {
+	_, symbol := d.symbolAt(p)
+	if symbol == nil || symbol.Kind == nai.BuiltinSymbol {
+		return Range{}, false
+	}
+
+	return spanRange(symbol.Span), true
+}
+
+func (d *naiDocument) Hover(p Position) (*Hover, bool) {
+	ident, symbol := d.symbolAt(p)
+	if symbol == nil {
+		return nil, false
+	}
+
+	r := spanRange(ident.Span)
+
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: describeSymbol(symbol)}, Range: &r}, true
+}
+
+func describeSymbol(s *nai.Symbol) string {
+	switch s.Kind {
+	case nai.DeclSymbol:
+		return fmt.Sprintf("```nai\n%s :: %s\n```", s.Name, s.Type)
+	case nai.MethodSymbol:
+		return fmt.Sprintf("```nai\n%s\n```\nmethod of `%s`", nai.RoutineLabel(s.Decl.Name.Name, s.Name), s.Decl.Name.Name)
+	case nai.FieldSymbol:
+		return fmt.Sprintf("```nai\n%s %s\n```\nfield of `%s`", s.Type, s.Name, s.Decl.Name.Name)
+	case nai.BuiltinSymbol:
+		return fmt.Sprintf("```nai\n%s(...)\n```\nbuiltin", s.Name)
+	}
+
+	return fmt.Sprintf("```nai\n%s %s\n```\n%s", s.Type, s.Name, s.Kind)
+}
+
+// Completion returns the names visible at p.
+func (d *naiDocument) Completion(p Position) []CompletionItem {
+	items := []CompletionItem{}
+	if d.info == nil {
+		return items
+	}
+
+	scope := d.info.Universe.Innermost(nai.Pos{Line: p.Line + 1, Column: p.Character + 1, Offset: d.offset(p)})
+	for _, name := range scope.Names(nil) {
+		symbol := scope.Lookup(name)
+
+		item := CompletionItem{Label: name, Detail: string(symbol.Kind)}
+		switch symbol.Kind {
+		case nai.DeclSymbol:
+			item.Kind = CompletionClass
+		case nai.MethodSymbol, nai.BuiltinSymbol:
+			item.Kind = CompletionMethod
+		case nai.FieldSymbol:
+			item.Kind = CompletionField
+		default:
+			item.Kind = CompletionVariable
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// offset returns the offset of p in runes, which is what scopes are
+// compared by.
+func (d *naiDocument) offset(p Position) int {
+	if p.Line < 0 || len(d.lines) == 0 {
+		return 0
+	}
+
+	line := min(p.Line, len(d.lines)-1)
+
+	return d.lines[line] + p.Character
+}
+
+func (d *naiDocument) Symbols() []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	if d.file == nil {
+		return symbols
+	}
+
+	for _, decl := range d.file.Decls {
+		symbol := DocumentSymbol{
+			Name:           decl.Name.Name,
+			Detail:         string(decl.Kind),
+			Kind:           declSymbolKind(decl.Kind),
+			Range:          spanRange(decl.Span),
+			SelectionRange: spanRange(decl.Name.Span),
+		}
+
+		for _, field := range decl.Fields {
+			symbol.Children = append(symbol.Children, DocumentSymbol{
+				Name:           field.Name.Name,
+				Detail:         field.Type.Name,
+				Kind:           SymbolField,
+				Range:          spanRange(field.Span),
+				SelectionRange: spanRange(field.Name.Span),
+			})
+		}
+
+		for _, method := range decl.Methods {
+			symbol.Children = append(symbol.Children, DocumentSymbol{
+				Name:           method.Name.Name,
+				Kind:           SymbolMethod,
+				Range:          spanRange(method.Span),
+				SelectionRange: spanRange(method.Name.Span),
+			})
+		}
+
+		symbols = append(symbols, symbol)
+	}
+
+	return symbols
+}
+
+func declSymbolKind(kind nai.Kind) SymbolKind {
+	switch kind {
+	case nai.Entity:
+		return SymbolObject
+	case nai.Comp:
+		return SymbolStruct
+	}
+
+	return SymbolClass
+}
@@ -0,0 +1,285 @@
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+)
+
+type naiveDocument struct {
+	tokens      []token.Token
+	diagnostics []Diagnostic
+
+	// labels maps every label to its declaration. Like the lexer, the
+	// last declaration of a label wins.
+	labels map[string]token.Token
+	// docs holds the comments written right above a label declaration.
+	docs map[string]string
+	// exports holds the labels exported by the included files.
+	exports map[string]token.Token
+}
+
+func tokenRange(t token.Token) Range {
+	return Range{
+		Start: Position{Line: t.LineStart, Character: t.CollumnStart},
+		End:   Position{Line: t.LineEnd, Character: t.CollumnEnd},
+	}
+}
+
+func newNaiveDocument(path string, text string) *naiveDocument {
+	d := &naiveDocument{labels: make(map[string]token.Token), docs: make(map[string]string), exports: make(map[string]token.Token)}
+
+	l := lexer.NewLexer(text)
+	l.KeepComments = true
+	tokens, err := l.Lex()
+	if err != nil {
+		// The lexer stops where it failed, macros and constants fail at
+		// the token they are about.
+		at := Position{Line: l.CurrentLineNumber, Character: l.CurrentLineCharacterIndex}
+		r := Range{Start: at, End: at}
+		message, _, _ := strings.Cut(err.Error(), "\n")
+
+		var lexErr *lexer.Error
+		if errors.As(err, &lexErr) {
+			r = tokenRange(lexErr.Token)
+			message = lexErr.Message
+		}
+
+		d.diagnostics = append(d.diagnostics, Diagnostic{
+			Range:    r,
+			Severity: SeverityError,
+			Source:   "ambient",
+			Message:  message,
+		})
+
+		return d
+	}
+
+	d.collectDocs(tokens)
+
+	// The end of file token has no position.
+	tokens = lexer.StripComments(tokens)
+	d.tokens = tokens[:len(tokens)-1]
+
+	for _, t := range d.tokens {
+		if t.Kind != token.Label {
+			continue
+		}
+
+		if previous, ok := d.labels[t.Name]; ok {
+			d.warn(tokenRange(t), "label %s is already declared at line %d, jumps go to this one", t.Name, previous.LineStart+1)
+		}
+
+		d.labels[t.Name] = t
+	}
+
+	for i, t := range d.tokens {
+		if t.Kind == token.Include && i+1 < len(d.tokens) && d.tokens[i+1].Kind == token.String {
+			d.include(path, d.tokens[i+1])
+		}
+	}
+
+	for i, t := range d.tokens {
+		_, exported := d.exports[t.Name]
+		if t.Kind == token.Identifier && t.IntegerValue < 0 && !exported {
+			d.error(tokenRange(t), "undefined label: %s", t.Name)
+		}
+
+		effect, ok := token.EffectOf(t.Kind)
+		if !ok || effect.Operand == "" {
+			continue
+		}
+
+		if i+1 >= len(d.tokens) || !validOperand(t.Kind, d.tokens[i+1].Kind) {
+			d.error(tokenRange(t), "%s expects %s", t.Name, effect.Operand)
+		}
+	}
+
+	return d
+}
+
+func validOperand(instruction token.Kind, operand token.Kind) bool {
+	if instruction == token.Include {
+		return operand == token.String
+	}
+
+	return operand == token.Number || operand == token.Identifier
+}
+
+// include adds the labels exported by an included file, read from disk
+// relative to the document.
+func (d *naiveDocument) include(path string, included token.Token) {
+	file := included.StringValue
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(path), file)
+	}
+
+	labels, err := lexer.ExportedLabels(file)
+	if err != nil {
+		d.error(tokenRange(included), "%s", err)
+		return
+	}
+
+	for name, label := range labels {
+		d.exports[name] = label
+	}
+}
+
+// collectDocs keeps the comments on the lines right above every label
+// declaration, the way doc comments go above Go declarations.
+func (d *naiveDocument) collectDocs(tokens []token.Token) {
+	for i, t := range tokens {
+		if t.Kind != token.Label {
+			continue
+		}
+
+		doc := []string{}
+		line := t.LineStart
+		for j := i - 1; j >= 0 && tokens[j].Kind == token.Comment && tokens[j].LineEnd == line-1; j-- {
+			// A comment trailing an instruction documents that instead.
+			if j > 0 && tokens[j-1].LineEnd == tokens[j].LineStart {
+				break
+			}
+
+			doc = append([]string{commentText(tokens[j].StringValue)}, doc...)
+			line = tokens[j].LineStart
+		}
+
+		d.docs[t.Name] = strings.Join(doc, "\n")
+	}
+}
+
+// commentText strips the delimiters of a comment.
+func commentText(comment string) string {
+	if text, ok := strings.CutPrefix(comment, "//"); ok {
+		return strings.TrimSpace(text)
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(comment, "/*"), "*/"))
+}
+
+func (d *naiveDocument) error(r Range, format string, args ...any) {
+	d.diagnostics = append(d.diagnostics, Diagnostic{Range: r, Severity: SeverityError, Source: "ambient", Message: fmt.Sprintf(format, args...)})
+}
+
+func (d *naiveDocument) warn(r Range, format string, args ...any) {
+	d.diagnostics = append(d.diagnostics, Diagnostic{Range: r, Severity: SeverityWarning, Source: "ambient", Message: fmt.Sprintf(format, args...)})
+}
+
+func (d *naiveDocument) Diagnostics() []Diagnostic {
+	return append([]Diagnostic{}, d.diagnostics...)
+}
+
+func (d *naiveDocument) tokenAt(p Position) (token.Token, bool) {
+	for _, t := range d.tokens {
+		if tokenRange(t).contains(p) {
+			return t, true
+		}
+	}
+
+	return token.Token{}, false
+}
+
+func (d *naiveDocument) Definition(p Position) (Range, bool) {
+	t, ok := d.tokenAt(p)
+	if !ok || (t.Kind != token.Identifier && t.Kind != token.Label) {
+		return Range{}, false
+	}
+
+	label, ok := d.labels[t.Name]
+	if !ok {
+		return Range{}, false
+	}
+
+	return tokenRange(label), true
+}
+
+func (d *naiveDocument) Hover(p Position) (*Hover, bool) {
+	t, ok := d.tokenAt(p)
+	if !ok {
+		return nil, false
+	}
+
+	r := tokenRange(t)
+
+	if effect, ok := token.EffectOf(t.Kind); ok {
+		return &Hover{Contents: MarkupContent{Kind: "markdown", Value: describeEffect(t.Name, effect)}, Range: &r}, true
+	}
+
+	if t.Kind == token.Identifier || t.Kind == token.Label {
+		label, ok := d.labels[t.Name]
+		if !ok {
+			label, ok = d.exports[t.Name]
+			if !ok {
+				return nil, false
+			}
+
+			value := fmt.Sprintf("label `%s`, exported by %s:%d", t.Name, label.File, label.LineStart+1)
+			return &Hover{Contents: MarkupContent{Kind: "markdown", Value: value}, Range: &r}, true
+		}
+
+		value := fmt.Sprintf("label `%s`, declared at line %d", t.Name, label.LineStart+1)
+		if doc := d.docs[t.Name]; doc != "" {
+			value += "\n\n" + doc
+		}
+
+		return &Hover{Contents: MarkupContent{Kind: "markdown", Value: value}, Range: &r}, true
+	}
+
+	return nil, false
+}
+
+func describeEffect(mnemonic string, effect token.Effect) string {
+	signature := mnemonic
+	if effect.Operand != "" {
+		signature += " " + effect.Operand
+	}
+
+	return fmt.Sprintf("```naive\n%s\n```\n`( %s )`\n\n%s", signature, effect.Stack, effect.Doc)
+}
+
+func (d *naiveDocument) Completion(p Position) []CompletionItem {
+	items := []CompletionItem{}
+
+	for _, name := range token.Keywords() {
+		kind, _ := token.LookupKeyword(name)
+		effect, _ := token.EffectOf(kind)
+
+		items = append(items, CompletionItem{
+			Label:         name,
+			Kind:          CompletionKeyword,
+			Detail:        "( " + effect.Stack + " )",
+			Documentation: effect.Doc,
+		})
+	}
+
+	for _, s := range d.Symbols() {
+		items = append(items, CompletionItem{Label: s.Name, Kind: CompletionReference, Detail: "label"})
+	}
+
+	return items
+}
+
+// Symbols returns the labels, in the order they are declared.
+func (d *naiveDocument) Symbols() []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+
+	for _, t := range d.tokens {
+		if t.Kind != token.Label || d.labels[t.Name] != t {
+			continue
+		}
+
+		symbols = append(symbols, DocumentSymbol{
+			Name:           t.Name,
+			Kind:           SymbolFunction,
+			Range:          tokenRange(t),
+			SelectionRange: tokenRange(t),
+		})
+	}
+
+	return symbols
+}
@@ -0,0 +1,274 @@
+// Package lsp is a language server for .naive and .nai files, spoken over
+// stdio by `ambient lsp`.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// document is an open file, analyzed every time it changes.
+type document interface {
+	Diagnostics() []Diagnostic
+	Definition(p Position) (Range, bool)
+	Hover(p Position) (*Hover, bool)
+	Completion(p Position) []CompletionItem
+	Symbols() []DocumentSymbol
+}
+
+type Server struct {
+	reader *bufio.Reader
+	writer io.Writer
+
+	documents map[string]document
+
+	shutdown bool
+}
+
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{
+		reader:    bufio.NewReader(r),
+		writer:    w,
+		documents: make(map[string]document),
+	}
+}
+
+// Serve answers requests until the client sends `exit` or closes the
+// input.
+func (s *Server) Serve() error {
+	for {
+		content, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var m message
+		if err := json.Unmarshal(content, &m); err != nil {
+			if err := s.replyError(nil, codeParseError, err.Error()); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if m.Method == "exit" {
+			return nil
+		}
+
+		if err := s.handle(&m); err != nil {
+			return err
+		}
+	}
+}
+
+// read returns the content of the next message, framed by a
+// Content-Length header.
+func (s *Server) read() ([]byte, error) {
+	length := -1
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length: %w", err)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, content); err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (s *Server) write(m *message) error {
+	m.JSONRPC = "2.0"
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(content), content)
+
+	return err
+}
+
+func (s *Server) reply(id *json.RawMessage, result any) error {
+	content, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return s.write(&message{ID: id, Result: content})
+}
+
+func (s *Server) replyError(id *json.RawMessage, code int, text string) error {
+	return s.write(&message{ID: id, Error: &responseError{Code: code, Message: text}})
+}
+
+func (s *Server) notify(method string, params any) error {
+	content, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return s.write(&message{Method: method, Params: content})
+}
+
+func (s *Server) handle(m *message) error {
+	// Notifications have no id and get no reply.
+	if m.ID == nil {
+		return s.handleNotification(m)
+	}
+
+	if s.shutdown {
+		return s.replyError(m.ID, codeInvalidRequest, "server is shutting down")
+	}
+
+	var position TextDocumentPositionParams
+
+	switch m.Method {
+	case "initialize":
+		return s.reply(m.ID, InitializeResult{
+			ServerInfo: ServerInfo{Name: "ambient"},
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:       1,
+				DefinitionProvider:     true,
+				HoverProvider:          true,
+				CompletionProvider:     CompletionOptions{TriggerCharacters: []string{".", ":"}},
+				DocumentSymbolProvider: true,
+			},
+		})
+
+	case "shutdown":
+		s.shutdown = true
+		return s.reply(m.ID, nil)
+
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		if err := json.Unmarshal(m.Params, &position); err != nil {
+			return s.replyError(m.ID, codeInvalidParams, err.Error())
+		}
+
+		doc, ok := s.documents[position.TextDocument.URI]
+		if !ok {
+			return s.reply(m.ID, nil)
+		}
+
+		return s.reply(m.ID, answerAt(doc, m.Method, position))
+
+	case "textDocument/documentSymbol":
+		var params DocumentSymbolParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return s.replyError(m.ID, codeInvalidParams, err.Error())
+		}
+
+		doc, ok := s.documents[params.TextDocument.URI]
+		if !ok {
+			return s.reply(m.ID, []DocumentSymbol{})
+		}
+
+		return s.reply(m.ID, doc.Symbols())
+	}
+
+	return s.replyError(m.ID, codeMethodNotFound, "method not found: "+m.Method)
+}
+
+func answerAt(doc document, method string, params TextDocumentPositionParams) any {
+	switch method {
+	case "textDocument/definition":
+		if r, ok := doc.Definition(params.Position); ok {
+			return Location{URI: params.TextDocument.URI, Range: r}
+		}
+
+	case "textDocument/hover":
+		if hover, ok := doc.Hover(params.Position); ok {
+			return hover
+		}
+
+	case "textDocument/completion":
+		return doc.Completion(params.Position)
+	}
+
+	return nil
+}
+
+func (s *Server) handleNotification(m *message) error {
+	switch m.Method {
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil
+		}
+
+		return s.open(params.TextDocument.URI, params.TextDocument.Text)
+
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := json.Unmarshal(m.Params, &params); err != nil || len(params.ContentChanges) == 0 {
+			return nil
+		}
+
+		// The server asks for full syncs, so the last change is the
+		// whole document.
+		return s.open(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil
+		}
+
+		delete(s.documents, params.TextDocument.URI)
+
+		return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	}
+
+	return nil
+}
+
+// open analyzes the text of a document and publishes its diagnostics.
+func (s *Server) open(uri string, text string) error {
+	path := uri
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		path = u.Path
+	}
+
+	var doc document
+	if filepath.Ext(path) == ".nai" {
+		doc = newNaiDocument(path, text)
+	} else {
+		doc = newNaiveDocument(path, text)
+	}
+
+	s.documents[uri] = doc
+
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: doc.Diagnostics()})
+}
@@ -0,0 +1,227 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type session struct {
+	t     *testing.T
+	input bytes.Buffer
+	id    int
+}
+
+func (s *session) send(method string, params any, request bool) {
+	m := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+	if request {
+		s.id++
+		m["id"] = s.id
+	}
+
+	content, err := json.Marshal(m)
+	require.NoError(s.t, err)
+
+	fmt.Fprintf(&s.input, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+// run serves everything sent so far and returns the messages written
+// back, by method for notifications and by id for responses.
+func (s *session) run() map[string]json.RawMessage {
+	log.SetOutput(io.Discard)
+
+	var output bytes.Buffer
+	require.NoError(s.t, NewServer(&s.input, &output).Serve())
+
+	messages := map[string]json.RawMessage{}
+	reader := &Server{reader: bufio.NewReader(&output)}
+	for {
+		content, err := reader.read()
+		if err == io.EOF {
+			return messages
+		}
+
+		require.NoError(s.t, err)
+
+		var m message
+		require.NoError(s.t, json.Unmarshal(content, &m))
+
+		switch {
+		case m.Method != "":
+			messages[m.Method] = m.Params
+		case m.Error != nil:
+			messages[string(*m.ID)] = json.RawMessage(fmt.Sprintf("%q", m.Error.Message))
+		default:
+			messages[string(*m.ID)] = m.Result
+		}
+	}
+}
+
+func at(uri string, line int, character int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: Position{Line: line, Character: character}}
+}
+
+func decode[T any](t *testing.T, content json.RawMessage) T {
+	var value T
+	require.NoError(t, json.Unmarshal(content, &value))
+
+	return value
+}
+
+func TestServer_Naive(t *testing.T) {
+	const uri = "file:///tmp/fib.naive"
+	s := &session{t: t}
+
+	s.send("initialize", map[string]any{}, true)
+	s.send("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, Text: "psh 1\njif hello\njmp missing\n:hello\npsh"}}, false)
+	s.send("textDocument/definition", at(uri, 1, 5), true)
+	s.send("textDocument/hover", at(uri, 0, 1), true)
+	s.send("textDocument/completion", at(uri, 4, 0), true)
+	s.send("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, true)
+	s.send("shutdown", nil, true)
+	s.send("exit", nil, false)
+
+	messages := s.run()
+
+	initialize := decode[InitializeResult](t, messages["1"])
+	assert.True(t, initialize.Capabilities.HoverProvider)
+
+	diagnostics := decode[PublishDiagnosticsParams](t, messages["textDocument/publishDiagnostics"])
+	require.Len(t, diagnostics.Diagnostics, 2)
+	assert.Equal(t, "undefined label: missing", diagnostics.Diagnostics[0].Message)
+	assert.Equal(t, Range{Start: Position{Line: 2, Character: 4}, End: Position{Line: 2, Character: 11}}, diagnostics.Diagnostics[0].Range)
+	assert.Equal(t, "psh expects value", diagnostics.Diagnostics[1].Message)
+
+	definition := decode[Location](t, messages["2"])
+	assert.Equal(t, Location{URI: uri, Range: Range{Start: Position{Line: 3, Character: 1}, End: Position{Line: 3, Character: 6}}}, definition)
+
+	hover := decode[Hover](t, messages["3"])
+	assert.Contains(t, hover.Contents.Value, "( -- value )")
+	assert.Contains(t, hover.Contents.Value, "Push a value onto the stack.")
+
+	completion := decode[[]CompletionItem](t, messages["4"])
+	labels := []string{}
+	for _, item := range completion {
+		labels = append(labels, item.Label)
+	}
+
+	assert.Contains(t, labels, "psh")
+	assert.Contains(t, labels, "assert_eq")
+	assert.Contains(t, labels, "hello")
+
+	symbols := decode[[]DocumentSymbol](t, messages["5"])
+	require.Len(t, symbols, 1)
+	assert.Equal(t, "hello", symbols[0].Name)
+
+	assert.Equal(t, "null", string(messages["6"]))
+}
+
+func TestServer_Nai(t *testing.T) {
+	const uri = "file:///tmp/hello.nai"
+	source := `e_cat :: entity {
+    c_hello;
+}
+
+c_hello :: comp {
+    string msg = "hello";
+
+    say() {
+        int times = 1;
+        println(msg);
+    }
+}
+
+[c_hello]
+s_printer :: system {
+    update() {
+        c_hello.sayy();
+    }
+}`
+
+	s := &session{t: t}
+	s.send("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, Text: source}}, false)
+	s.send("textDocument/definition", at(uri, 9, 17), true)
+	s.send("textDocument/hover", at(uri, 1, 6), true)
+	s.send("textDocument/completion", at(uri, 9, 8), true)
+	s.send("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, true)
+	s.send("textDocument/formatting", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, true)
+	s.send("exit", nil, false)
+
+	messages := s.run()
+
+	diagnostics := decode[PublishDiagnosticsParams](t, messages["textDocument/publishDiagnostics"])
+	require.Len(t, diagnostics.Diagnostics, 1)
+	assert.Equal(t, "c_hello has no method sayy (did you mean say?)", diagnostics.Diagnostics[0].Message)
+	assert.Equal(t, Position{Line: 16, Character: 16}, diagnostics.Diagnostics[0].Range.Start)
+
+	definition := decode[Location](t, messages["1"])
+	assert.Equal(t, Position{Line: 5, Character: 11}, definition.Range.Start)
+
+	hover := decode[Hover](t, messages["2"])
+	assert.Contains(t, hover.Contents.Value, "c_hello :: comp")
+
+	completion := decode[[]CompletionItem](t, messages["3"])
+	labels := []string{}
+	for _, item := range completion {
+		labels = append(labels, item.Label)
+	}
+
+	assert.Contains(t, labels, "times")
+	assert.Contains(t, labels, "msg")
+	assert.Contains(t, labels, "s_printer")
+
+	symbols := decode[[]DocumentSymbol](t, messages["4"])
+	require.Len(t, symbols, 3)
+	assert.Equal(t, SymbolStruct, symbols[1].Kind)
+	require.Len(t, symbols[1].Children, 2)
+	assert.Equal(t, "msg", symbols[1].Children[0].Name)
+
+	assert.Equal(t, `"method not found: textDocument/formatting"`, string(messages["5"]))
+}
+
+func TestNaiveDocument_LabelDocs(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	d := newNaiveDocument("/tmp/add.naive", "psh 1 // not a doc\n// Adds one.\n/* Leaves the sum. */\n:add psh 1 sum\njmp add")
+
+	hover, ok := d.Hover(Position{Line: 4, Character: 5})
+	require.True(t, ok)
+	assert.Equal(t, "label `add`, declared at line 4\n\nAdds one.\nLeaves the sum.", hover.Contents.Value)
+	assert.Empty(t, d.Diagnostics())
+}
+
+func TestNaiveDocument_Include(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "math.naive"), []byte("export add\n:add sum ret"), 0o644))
+
+	d := newNaiveDocument(filepath.Join(dir, "main.naive"), "include \"math.naive\"\ninclude \"missing.naive\"\npsh 1 psh 2 call add")
+
+	diagnostics := d.Diagnostics()
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, 1, diagnostics[0].Range.Start.Line)
+	assert.Contains(t, diagnostics[0].Message, "missing.naive")
+
+	hover, ok := d.Hover(Position{Line: 2, Character: 18})
+	require.True(t, ok)
+	assert.Equal(t, "label `add`, exported by "+filepath.Join(dir, "math.naive")+":2", hover.Contents.Value)
+}
+
+func TestNaiveDocument_MacroError(t *testing.T) {
+	d := newNaiveDocument("/tmp/macro.naive", "macro add(a, b) psh a psh b sum endmacro\n  add(1)")
+
+	diagnostics := d.Diagnostics()
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, "macro add expects 2 arguments, got 1", diagnostics[0].Message)
+	assert.Equal(t, Range{Start: Position{Line: 1, Character: 2}, End: Position{Line: 1, Character: 5}}, diagnostics[0].Range)
+}
@@ -1,30 +1,78 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
 
 	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/lsp"
+	"github.com/jejikeh/ambient/nai"
+	"github.com/jejikeh/ambient/naivefmt"
+	"github.com/jejikeh/ambient/naiveopt"
+	"github.com/jejikeh/ambient/naivetest"
+	"github.com/jejikeh/ambient/token"
 	"github.com/jejikeh/ambient/vm"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test":
+			testCommand(os.Args[2:])
+			return
+		case "lsp":
+			lspCommand()
+			return
+		case "fmt":
+			fmtCommand(os.Args[2:])
+			return
+		}
+	}
+
 	debugFlag := flag.Bool("debug", false, "Debug")
 
 	sourcePath := flag.String("i", "", "Source file")
 	outputPath := flag.String("o", "", "Output file")
 
+	// Optimization
+	optimize := optimizationFlags{
+		flag.Bool("O0", false, "Do not optimize the program (default)"),
+		flag.Bool("O1", false, "Fold constants, thread jumps and remove dead code"),
+		flag.Bool("O2", false, "Optimize like -O1 and fuse instructions"),
+	}
+
 	// Build Command
 	buildCommand := flag.Bool("build", false, "Build binary")
-	defer buildBinary(buildCommand, sourcePath, outputPath, debugFlag)
+	defer buildBinary(buildCommand, sourcePath, outputPath, debugFlag, optimize)
 
 	// Disassemble Command
 	disassembleCommand := flag.Bool("dis", false, "Disassemble binary")
-	defer dissembleBinary(disassembleCommand, sourcePath, outputPath)
+	expandFlag := flag.Bool("expand", false, "Disassemble superinstructions as the instructions they replace")
+	defer dissembleBinary(disassembleCommand, sourcePath, outputPath, expandFlag)
 
 	// Run Command
-	runCommand := flag.Bool("run", false, "Run binary")
-	binaryFlag := flag.Bool("x", false, "Binary flag")
-	defer runBinary(runCommand, binaryFlag, sourcePath, debugFlag)
+	run := runOptions{
+		run:              flag.Bool("run", false, "Run binary"),
+		binary:           flag.Bool("x", false, "Binary flag"),
+		source:           sourcePath,
+		limit:            flag.Int("limit", 100, "Maximum number of executed instructions, -1 for no limit"),
+		debug:            debugFlag,
+		profile:          flag.Bool("profile", false, "Print a hot-spot profile after run"),
+		pprofPath:        flag.String("pprof", "", "Write a pprof profile of the run to file"),
+		cover:            flag.Bool("cover", false, "Print a coverage summary after run"),
+		coverProfilePath: flag.String("coverprofile", "", "Write an LCOV coverage report of the run to file"),
+		workers:          flag.Int("workers", 0, "Number of systems run at once by tick, 0 for one per CPU"),
+		verify:           flag.Bool("verify", false, "Verify the program before run and run it without per-step checks"),
+		snapshotPath:     flag.String("snapshot", "", "Write a snapshot of the run to file when it stops, for -resume"),
+		resumePath:       flag.String("resume", "", "Continue the run saved in a snapshot file"),
+		optimize:         optimize,
+	}
+	defer runBinary(run)
 
 	// Lexer Command
 	lexerFlag := flag.Bool("lex", false, "Lexer file")
@@ -33,51 +81,228 @@ func main() {
 	flag.Parse()
 }
 
-func dissembleBinary(disassembleFlag *bool, source *string, output *string) {
+func dissembleBinary(disassembleFlag *bool, source *string, output *string, expand *bool) {
 	if !*disassembleFlag {
 		return
 	}
 
-	l := lexer.NewLexerFromBinary(*source)
+	l, err := lexer.NewLexerFromBinary(*source)
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	if *expand {
+		l.Tokens = naiveopt.Expand(l.Tokens)
+	}
 
 	if *output == "" {
 		l.DebugTokensToNaive()
 		return
 	}
 
-	l.DumpTokensToFile(*output)
+	if err := l.DumpTokensToFile(*output); err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+}
+
+// optimizationFlags are -O0, -O1 and -O2, the highest one set wins.
+type optimizationFlags [3]*bool
+
+func (o optimizationFlags) level() naiveopt.Level {
+	for level := len(o) - 1; level > 0; level-- {
+		if *o[level] {
+			return naiveopt.Level(level)
+		}
+	}
+
+	return naiveopt.O0
+}
+
+// optimizeProgram optimizes a program assembled from source.
+func optimizeProgram(program []token.Token, optimize optimizationFlags) []token.Token {
+	level := optimize.level()
+	if level == naiveopt.O0 {
+		return program
+	}
+
+	optimized := naiveopt.Program(program, level)
+	log.Printf("Optimized %d tokens to %d at -O%d\n", len(program), len(optimized), level)
+
+	return optimized
+}
+
+// runOptions are the flags of the run command. They are read once the
+// flags are parsed.
+type runOptions struct {
+	run, binary      *bool
+	source           *string
+	limit            *int
+	debug            *bool
+	profile          *bool
+	pprofPath        *string
+	cover            *bool
+	coverProfilePath *string
+	workers          *int
+	verify           *bool
+	snapshotPath     *string
+	resumePath       *string
+	optimize         optimizationFlags
 }
 
-func runBinary(runFlag *bool, binaryFlag *bool, source *string, debug *bool) {
-	if !*runFlag {
+func runBinary(o runOptions) {
+	if !*o.run {
 		return
 	}
 
 	ambient := vm.NewVirtualMachine()
+	ambient.Workers = *o.workers
+	ambient.Input = os.Stdin
 
-	if *binaryFlag {
-		ambient.LoadNaiveFromSourceBinary(*source)
-	} else {
-		ambient.LoadNaiveFromSourceFile(*source)
+	switch {
+	case *o.binary:
+		if err := ambient.LoadNaiveFromSourceBinary(*o.source); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	case filepath.Ext(*o.source) == ".nai":
+		ambient.LoadProgram(optimizeProgram(compileNaiFile(*o.source), o.optimize))
+	default:
+		ambient.LoadProgram(optimizeProgram(loadNaiveFile(*o.source), o.optimize))
 	}
 
-	if *debug {
+	if *o.verify {
+		if err := ambient.Verify(); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	}
+
+	if *o.resumePath != "" {
+		resumeRun(ambient, *o.resumePath)
+	}
+
+	if *o.profile || *o.pprofPath != "" {
+		ambient.EnableProfiling()
+		defer writeProfile(ambient, *o.profile, *o.pprofPath, *o.source)
+	}
+
+	if *o.cover || *o.coverProfilePath != "" {
+		ambient.EnableCoverage()
+		defer writeCoverage(ambient, *o.coverProfilePath, *o.source)
+	}
+
+	if *o.debug {
 		ambient.PrintInstructions()
-		ambient.Execute(100, true)
+		ambient.Execute(*o.limit, true)
 		ambient.PrintStack()
+	} else {
+		ambient.Execute(*o.limit, false)
+	}
+
+	if *o.snapshotPath != "" {
+		writeSnapshot(ambient, *o.snapshotPath)
+	}
+}
+
+// resumeRun restores a run saved by -snapshot, which must come from the
+// same program.
+func resumeRun(ambient *vm.VirtualMachine, resumePath string) {
+	content, err := os.ReadFile(resumePath)
+	if err == nil {
+		err = ambient.Restore(content)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %s: %s\n", resumePath, err)
+	}
+}
+
+func writeSnapshot(ambient *vm.VirtualMachine, snapshotPath string) {
+	content, err := ambient.Snapshot()
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(snapshotPath), os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(snapshotPath, content, 0o644)
+	if err != nil {
+		log.Fatal("Error writing snapshot: ", err)
+	}
+
+	log.Printf("Wrote snapshot to [%s]\n", snapshotPath)
+}
+
+func writeProfile(ambient *vm.VirtualMachine, report bool, pprofPath string, source string) {
+	if report {
+		ambient.Profiler.WriteReport(os.Stdout, ambient.Instructions)
+	}
+
+	if pprofPath == "" {
 		return
 	}
 
-	ambient.Execute(100, false)
+	err := os.MkdirAll(filepath.Dir(pprofPath), os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(pprofPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	err = ambient.Profiler.WritePprof(f, ambient.Instructions, source)
+	if err != nil {
+		log.Fatal("Error writing pprof profile: ", err)
+	}
+
+	log.Printf("Wrote pprof profile to [%s]\n", pprofPath)
+}
+
+func writeCoverage(ambient *vm.VirtualMachine, coverProfilePath string, source string) {
+	ambient.Coverage.WriteSummary(os.Stdout, ambient.Instructions)
+
+	if coverProfilePath == "" {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(coverProfilePath), os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(coverProfilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	err = ambient.Coverage.WriteLCOV(f, ambient.Instructions, source)
+	if err != nil {
+		log.Fatal("Error writing coverage report: ", err)
+	}
+
+	log.Printf("Wrote coverage report to [%s]\n", coverProfilePath)
 }
 
-func buildBinary(binaryFlag *bool, source *string, output *string, debug *bool) {
+func buildBinary(binaryFlag *bool, source *string, output *string, debug *bool, optimize optimizationFlags) {
 	if !*binaryFlag {
 		return
 	}
 
-	l := lexer.NewLexerFromSource(*source)
-	l.Tokens = l.Tokenize()
+	var l *lexer.Lexer
+	if filepath.Ext(*source) == ".nai" {
+		l = &lexer.Lexer{Tokens: compileNaiFile(*source)}
+	} else {
+		l = &lexer.Lexer{Tokens: loadNaiveFile(*source)}
+	}
+
+	l.Tokens = optimizeProgram(l.Tokens, optimize)
 
 	v := vm.NewVirtualMachine()
 	v.LoadProgram(l.Tokens)
@@ -86,7 +311,23 @@ func buildBinary(binaryFlag *bool, source *string, output *string, debug *bool)
 		v.PrintInstructions()
 	}
 
-	l.DumpTokensToBinary(*output)
+	if err := l.DumpTokensToBinary(*output); err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+}
+
+func compileNaiFile(source string) []token.Token {
+	file, err := nai.ParseFileFromPath(source)
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	tokens, err := nai.CompileToTokens(file)
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	return tokens
 }
 
 func lexerFile(lexerFlag *bool, source *string) {
@@ -94,7 +335,160 @@ func lexerFile(lexerFlag *bool, source *string) {
 		return
 	}
 
-	l := lexer.NewLexerFromSource(*source)
-	tokens := l.Tokenize()
-	lexer.PrintDebugTokens(tokens)
+	if filepath.Ext(*source) == ".nai" {
+		lexNaiFile(*source)
+		return
+	}
+
+	lexer.PrintDebugTokens(loadNaiveFile(*source))
+}
+
+func loadNaiveFile(source string) []token.Token {
+	tokens, err := lexer.LoadFile(source)
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	return tokens
+}
+
+func lexNaiFile(source string) {
+	content, err := os.ReadFile(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := nai.Tokenize(string(content))
+
+	log.Println("Tokens:")
+	for i, t := range tokens {
+		log.Printf("[%d] %s (%s)\n", i, t, t.Span)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file, err := nai.ParseFile(source, string(content))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = nai.Check(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func testCommand(args []string) {
+	testFlags := flag.NewFlagSet("test", flag.ExitOnError)
+	verbose := testFlags.Bool("v", false, "Print passing tests too")
+	testFlags.Parse(args)
+
+	paths := testFlags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := naivetest.Discover(paths...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	summary := naivetest.RunFiles(os.Stdout, files, *verbose)
+	summary.Print(os.Stdout)
+
+	if summary.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func lspCommand() {
+	err := lsp.NewServer(os.Stdin, os.Stdout).Serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func fmtCommand(args []string) {
+	fmtFlags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fmtFlags.Bool("w", false, "Write the result to the source file instead of stdout")
+	list := fmtFlags.Bool("l", false, "List files whose formatting differs")
+	diff := fmtFlags.Bool("d", false, "Print diffs instead of rewriting files")
+	fmtFlags.Parse(args)
+
+	if fmtFlags.NArg() == 0 {
+		if *write {
+			log.Fatal("Error: can not use -w with standard input")
+		}
+
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := formatSource("<standard input>", src, *list, *diff, false); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		return
+	}
+
+	files, err := naivefmt.Discover(fmtFlags.Args()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err == nil {
+			err = formatSource(file, src, *list, *diff, *write)
+		}
+
+		if err != nil {
+			log.Printf("Error: %s: %s\n", file, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// formatSource formats one file like gofmt. Without -l, -d or -w the
+// formatted source goes to stdout.
+func formatSource(name string, src []byte, list bool, diff bool, write bool) error {
+	formatted, err := naivefmt.Source(src)
+	if err != nil {
+		return err
+	}
+
+	changed := !bytes.Equal(src, formatted)
+
+	if list && changed {
+		fmt.Println(name)
+	}
+
+	if write && changed {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(name, formatted, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if diff && changed {
+		os.Stdout.Write(naivefmt.Diff(name, src, formatted))
+	}
+
+	if !list && !write && !diff {
+		os.Stdout.Write(formatted)
+	}
+
+	return nil
 }
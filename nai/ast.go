@@ -0,0 +1,204 @@
+package nai
+
+// Node is implemented by every part of the syntax tree.
+type Node interface {
+	NodeSpan() Span
+}
+
+type File struct {
+	Name  string
+	Decls []*Decl
+}
+
+type Ident struct {
+	Name string
+	Span Span
+}
+
+func (i *Ident) NodeSpan() Span { return i.Span }
+
+// Attribute is a `[name, ...]` list written before a declaration. For
+// systems it is the query of components the system runs over.
+type Attribute struct {
+	Names []*Ident
+	Span  Span
+}
+
+func (a *Attribute) NodeSpan() Span { return a.Span }
+
+// Decl is a top level `name :: entity|comp|system { ... }` declaration.
+type Decl struct {
+	Name       *Ident
+	Kind       Kind
+	Attributes []*Attribute
+
+	Fields  []*Field
+	Methods []*Method
+	// Components lists the `comp_name;` members, which attach components
+	// to an entity.
+	Components []*Ident
+
+	Span Span
+}
+
+func (d *Decl) NodeSpan() Span { return d.Span }
+
+// Query returns the names listed in every attribute of the declaration.
+func (d *Decl) Query() []*Ident {
+	names := []*Ident{}
+	for _, a := range d.Attributes {
+		names = append(names, a.Names...)
+	}
+
+	return names
+}
+
+type Field struct {
+	Type  *Ident
+	Name  *Ident
+	Value Expr
+	Span  Span
+}
+
+func (f *Field) NodeSpan() Span { return f.Span }
+
+type Param struct {
+	Type *Ident
+	Name *Ident
+}
+
+type Method struct {
+	Name   *Ident
+	Params []*Param
+	Body   *Block
+	Span   Span
+}
+
+func (m *Method) NodeSpan() Span { return m.Span }
+
+type Block struct {
+	Stmts []Stmt
+	Span  Span
+}
+
+func (b *Block) NodeSpan() Span { return b.Span }
+
+// Statements
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+type ExprStmt struct {
+	X Expr
+}
+
+// VarStmt declares a local variable: `int x = 1;`.
+type VarStmt struct {
+	Type  *Ident
+	Name  *Ident
+	Value Expr
+	Span  Span
+}
+
+type AssignStmt struct {
+	Target Expr
+	Value  Expr
+	Span   Span
+}
+
+type ReturnStmt struct {
+	Value Expr
+	Span  Span
+}
+
+type IfStmt struct {
+	Cond Expr
+	Then *Block
+	Else *Block
+	Span Span
+}
+
+type WhileStmt struct {
+	Cond Expr
+	Body *Block
+	Span Span
+}
+
+func (s *ExprStmt) NodeSpan() Span   { return s.X.NodeSpan() }
+func (s *VarStmt) NodeSpan() Span    { return s.Span }
+func (s *AssignStmt) NodeSpan() Span { return s.Span }
+func (s *ReturnStmt) NodeSpan() Span { return s.Span }
+func (s *IfStmt) NodeSpan() Span     { return s.Span }
+func (s *WhileStmt) NodeSpan() Span  { return s.Span }
+
+func (*ExprStmt) stmtNode()   {}
+func (*VarStmt) stmtNode()    {}
+func (*AssignStmt) stmtNode() {}
+func (*ReturnStmt) stmtNode() {}
+func (*IfStmt) stmtNode()     {}
+func (*WhileStmt) stmtNode()  {}
+
+// Expressions
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type NameExpr struct {
+	Name *Ident
+}
+
+type NumberLit struct {
+	Value int
+	Span  Span
+}
+
+type StringLit struct {
+	Value string
+	Span  Span
+}
+
+type CallExpr struct {
+	Callee Expr
+	Args   []Expr
+	Span   Span
+}
+
+// SelectorExpr is a field access: `X.Sel`.
+type SelectorExpr struct {
+	X    Expr
+	Sel  *Ident
+	Span Span
+}
+
+type BinaryExpr struct {
+	Op   Kind
+	X    Expr
+	Y    Expr
+	Span Span
+}
+
+type UnaryExpr struct {
+	Op   Kind
+	X    Expr
+	Span Span
+}
+
+func (e *NameExpr) NodeSpan() Span     { return e.Name.Span }
+func (e *NumberLit) NodeSpan() Span    { return e.Span }
+func (e *StringLit) NodeSpan() Span    { return e.Span }
+func (e *CallExpr) NodeSpan() Span     { return e.Span }
+func (e *SelectorExpr) NodeSpan() Span { return e.Span }
+func (e *BinaryExpr) NodeSpan() Span   { return e.Span }
+func (e *UnaryExpr) NodeSpan() Span    { return e.Span }
+
+func (*NameExpr) exprNode()     {}
+func (*NumberLit) exprNode()    {}
+func (*StringLit) exprNode()    {}
+func (*CallExpr) exprNode()     {}
+func (*SelectorExpr) exprNode() {}
+func (*BinaryExpr) exprNode()   {}
+func (*UnaryExpr) exprNode()    {}
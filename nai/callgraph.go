@@ -0,0 +1,102 @@
+package nai
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Methods get a fixed frame, so a method must not be called while it
+// runs. The call graph finds the calls which would do it.
+
+// call is a call from the method named Caller to the method named
+// Callee, both named `decl.method`.
+type call struct {
+	Caller string
+	Callee string
+	Span   Span
+}
+
+type callGraph struct {
+	calls map[string][]call
+	// methods keeps the callers in the order they were added, so cycles
+	// are found in source order.
+	methods []string
+}
+
+// methodName names a method of decl for the call graph.
+func methodName(decl *Decl, method *Method) string {
+	return decl.Name.Name + "." + method.Name.Name
+}
+
+func newCallGraph() *callGraph {
+	return &callGraph{calls: make(map[string][]call)}
+}
+
+func (g *callGraph) add(caller string, callee string, span Span) {
+	if _, ok := g.calls[caller]; !ok {
+		g.methods = append(g.methods, caller)
+	}
+
+	g.calls[caller] = append(g.calls[caller], call{Caller: caller, Callee: callee, Span: span})
+}
+
+// cycles returns the cycles of calls, each in the order the calls are
+// made, the last one calling the method the first one is made from.
+func (g *callGraph) cycles() [][]call {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+	path := []call{}
+	cycles := [][]call{}
+
+	var visit func(method string)
+	visit = func(method string) {
+		state[method] = visiting
+
+		for _, c := range g.calls[method] {
+			switch state[c.Callee] {
+			case unvisited:
+				path = append(path, c)
+				visit(c.Callee)
+				path = path[:len(path)-1]
+
+			case visiting:
+				start := len(path)
+				for start > 0 && path[start-1].Callee != c.Callee {
+					start--
+				}
+
+				cycle := append(append([]call{}, path[start:]...), c)
+				cycles = append(cycles, cycle)
+			}
+		}
+
+		state[method] = visited
+	}
+
+	for _, method := range g.methods {
+		if state[method] == unvisited {
+			visit(method)
+		}
+	}
+
+	return cycles
+}
+
+// describeCycle lists the calls of a cycle with where they are made.
+func describeCycle(cycle []call) string {
+	if len(cycle) == 1 {
+		return fmt.Sprintf("%s calls itself at %s", cycle[0].Caller, cycle[0].Span)
+	}
+
+	calls := make([]string, 0, len(cycle))
+	for _, c := range cycle {
+		calls = append(calls, fmt.Sprintf("%s calls %s at %s", c.Caller, c.Callee, c.Span))
+	}
+
+	return strings.Join(calls, ", ")
+}
@@ -0,0 +1,444 @@
+package nai
+
+// The checker resolves every name of a file and checks the types of its
+// fields, variables and calls before it is compiled. Scopes nest as
+//
+//	universe: builtins and declarations
+//	└── declaration: fields and methods
+//	    └── method: parameters
+//	        └── block: variables, and nested blocks
+//
+// A variable can not be declared twice in a method, even in different
+// blocks of it, since the compiler gives each name of a method one cell.
+// For the same reason methods can not call themselves, directly or
+// through other methods.
+
+// Info is what the checker learns about a file.
+type Info struct {
+	Universe *Scope
+	Scopes   map[*Decl]*Scope
+	// Defs maps the name of every declared symbol to it.
+	Defs map[*Ident]*Symbol
+	// Uses maps every name which refers to a symbol to it.
+	Uses map[*Ident]*Symbol
+	// Types holds the type of every expression whose type is known.
+	Types map[Expr]string
+}
+
+var builtinFunctions = []string{"print", "println"}
+
+type checker struct {
+	info   *Info
+	errors ErrorList
+
+	decl   *Decl
+	method *Method
+	scope  *Scope
+
+	calls *callGraph
+}
+
+// Check resolves and type checks file. The returned Info is filled as far
+// as the checker got, even when there are errors.
+func Check(file *File) (*Info, error) {
+	c := &checker{
+		info: &Info{
+			Universe: NewScope(nil, Span{}),
+			Scopes:   make(map[*Decl]*Scope),
+			Defs:     make(map[*Ident]*Symbol),
+			Uses:     make(map[*Ident]*Symbol),
+			Types:    make(map[Expr]string),
+		},
+		calls: newCallGraph(),
+	}
+
+	c.checkFile(file)
+
+	return c.info, c.errors.Err()
+}
+
+func (c *checker) declare(scope *Scope, name *Ident, symbol *Symbol) {
+	symbol.Name = name.Name
+	symbol.Span = name.Span
+
+	if existing := scope.Insert(symbol); existing != nil {
+		c.errors.Add(name.Span, "%s is already declared at %s", name.Name, existing.Span)
+		return
+	}
+
+	c.info.Defs[name] = symbol
+}
+
+func (c *checker) checkFile(file *File) {
+	for _, name := range builtinFunctions {
+		c.info.Universe.Insert(&Symbol{Name: name, Kind: BuiltinSymbol})
+	}
+
+	for _, decl := range file.Decls {
+		c.declare(c.info.Universe, decl.Name, &Symbol{Kind: DeclSymbol, Type: string(decl.Kind), Decl: decl})
+	}
+
+	// Members are declared before any body is checked, so bodies can
+	// refer to members of declarations which come later.
+	for _, decl := range file.Decls {
+		scope := NewScope(c.info.Universe, decl.Span)
+		c.info.Scopes[decl] = scope
+
+		for _, field := range decl.Fields {
+			c.checkType(field.Type)
+			c.declare(scope, field.Name, &Symbol{Kind: FieldSymbol, Type: field.Type.Name, Decl: decl})
+		}
+
+		for _, method := range decl.Methods {
+			c.declare(scope, method.Name, &Symbol{Kind: MethodSymbol, Decl: decl, Method: method})
+		}
+	}
+
+	for _, decl := range file.Decls {
+		c.checkDecl(decl)
+	}
+
+	for _, cycle := range c.calls.cycles() {
+		c.errors.Add(cycle[0].Span, "recursive call: %s; methods can not be recursive", describeCycle(cycle))
+	}
+}
+
+func (c *checker) checkDecl(decl *Decl) {
+	c.decl = decl
+	c.method = nil
+	c.scope = c.info.Scopes[decl]
+
+	for _, attribute := range decl.Attributes {
+		if decl.Kind != System {
+			c.errors.Add(attribute.Span, "only systems can have a query")
+			continue
+		}
+
+		for _, name := range attribute.Names {
+			c.component(name)
+		}
+	}
+
+	attached := map[string]bool{}
+	for _, name := range decl.Components {
+		if c.component(name) == nil {
+			continue
+		}
+
+		if attached[name.Name] {
+			c.errors.Add(name.Span, "%s is attached more than once", name.Name)
+		}
+
+		attached[name.Name] = true
+	}
+
+	for _, field := range decl.Fields {
+		if field.Value != nil {
+			c.checkAssignable(field.Value, field.Type.Name)
+		}
+	}
+
+	for _, method := range decl.Methods {
+		c.checkMethod(method)
+	}
+}
+
+// component resolves the name of a component of a query or an entity.
+func (c *checker) component(name *Ident) *Decl {
+	symbol := c.resolve(name)
+	if symbol == nil {
+		return nil
+	}
+
+	if symbol.Kind != DeclSymbol || symbol.Decl.Kind != Comp {
+		c.errors.AddSuggestion(name.Span, name.Name, c.info.Universe.Names(isComponent), "%s is not a component", name.Name)
+		return nil
+	}
+
+	return symbol.Decl
+}
+
+func isComponent(s *Symbol) bool {
+	return s.Kind == DeclSymbol && s.Decl.Kind == Comp
+}
+
+func (c *checker) checkType(typ *Ident) {
+	if builtinTypes[typ.Name] {
+		return
+	}
+
+	candidates := []string{TypeBool, TypeInt, TypeString}
+	c.errors.AddSuggestion(typ.Span, typ.Name, candidates, "unknown type %s", typ.Name)
+}
+
+func (c *checker) checkMethod(method *Method) {
+	c.method = method
+	c.scope = NewScope(c.info.Scopes[c.decl], method.Span)
+
+	for _, param := range method.Params {
+		c.checkType(param.Type)
+		c.declare(c.scope, param.Name, &Symbol{Kind: ParamSymbol, Type: param.Type.Name, Decl: c.decl, Method: method})
+	}
+
+	c.checkBlock(method.Body)
+
+	c.method = nil
+	c.scope = c.info.Scopes[c.decl]
+}
+
+func (c *checker) checkBlock(block *Block) {
+	outer := c.scope
+	c.scope = NewScope(outer, block.Span)
+
+	for _, stmt := range block.Stmts {
+		c.checkStmt(stmt)
+	}
+
+	c.scope = outer
+}
+
+func (c *checker) checkStmt(stmt Stmt) {
+	switch s := stmt.(type) {
+	case *ExprStmt:
+		c.checkExpr(s.X)
+
+	case *VarStmt:
+		c.checkType(s.Type)
+		if s.Value != nil {
+			c.checkAssignable(s.Value, s.Type.Name)
+		}
+
+		// Variables live as long as their method, so they can not
+		// shadow a parameter or a variable of an enclosing block.
+		if existing := c.scope.Lookup(s.Name.Name); existing != nil && existing.Method == c.method && existing.Kind != MethodSymbol {
+			c.errors.Add(s.Name.Span, "%s is already declared at %s", s.Name.Name, existing.Span)
+			return
+		}
+
+		c.declare(c.scope, s.Name, &Symbol{Kind: LocalSymbol, Type: s.Type.Name, Decl: c.decl, Method: c.method})
+
+	case *AssignStmt:
+		target := c.checkExpr(s.Target)
+
+		switch s.Target.(type) {
+		case *NameExpr, *SelectorExpr:
+		default:
+			c.errors.Add(s.Target.NodeSpan(), "can not assign to this expression")
+			return
+		}
+
+		c.checkAssignable(s.Value, target)
+
+	case *ReturnStmt:
+		if s.Value != nil {
+			c.checkExpr(s.Value)
+		}
+
+	case *IfStmt:
+		c.checkCondition(s.Cond)
+		c.checkBlock(s.Then)
+		if s.Else != nil {
+			c.checkBlock(s.Else)
+		}
+
+	case *WhileStmt:
+		c.checkCondition(s.Cond)
+		c.checkBlock(s.Body)
+	}
+}
+
+func (c *checker) checkCondition(cond Expr) {
+	if typ := c.checkExpr(cond); typ == TypeString {
+		c.errors.Add(cond.NodeSpan(), "can not use %s value as condition", typ)
+	}
+}
+
+// checkAssignable checks x and that its value can be stored as expected.
+func (c *checker) checkAssignable(x Expr, expected string) {
+	if actual := c.checkExpr(x); !assignable(actual, expected) {
+		c.errors.Add(x.NodeSpan(), "can not use %s value as %s", actual, expected)
+	}
+}
+
+// resolve looks name up from the current scope and records its use.
+func (c *checker) resolve(name *Ident) *Symbol {
+	symbol := c.scope.Lookup(name.Name)
+	if symbol == nil {
+		c.errors.AddSuggestion(name.Span, name.Name, c.scope.Names(nil), "undefined: %s", name.Name)
+		return nil
+	}
+
+	c.info.Uses[name] = symbol
+
+	return symbol
+}
+
+// member looks up a field or a method of the declaration owner refers to.
+func (c *checker) member(owner Expr, sel *Ident, kind SymbolKind) *Symbol {
+	name, ok := owner.(*NameExpr)
+	if !ok {
+		c.errors.Add(owner.NodeSpan(), "only members of declarations can be selected")
+		return nil
+	}
+
+	symbol := c.resolve(name.Name)
+	if symbol == nil {
+		return nil
+	}
+
+	if symbol.Kind != DeclSymbol {
+		c.errors.Add(name.Name.Span, "only members of declarations can be selected")
+		return nil
+	}
+
+	scope := c.info.Scopes[symbol.Decl]
+	member := scope.Symbols[sel.Name]
+	if member == nil || member.Kind != kind {
+		candidates := scope.Names(func(s *Symbol) bool { return s.Kind == kind && s.Decl == symbol.Decl })
+		c.errors.AddSuggestion(sel.Span, sel.Name, candidates, "%s has no %s %s", name.Name.Name, kind, sel.Name)
+		return nil
+	}
+
+	c.info.Uses[sel] = member
+
+	return member
+}
+
+// checkExpr checks x and returns its type, or an empty string when it is
+// not known.
+func (c *checker) checkExpr(x Expr) string {
+	typ := c.typeOf(x)
+	if typ != "" {
+		c.info.Types[x] = typ
+	}
+
+	return typ
+}
+
+func (c *checker) typeOf(x Expr) string {
+	switch e := x.(type) {
+	case *NumberLit:
+		return TypeInt
+
+	case *StringLit:
+		return TypeString
+
+	case *NameExpr:
+		symbol := c.resolve(e.Name)
+		if symbol == nil {
+			return ""
+		}
+
+		if !symbol.IsValue() {
+			c.errors.Add(e.Name.Span, "%s is a %s, not a value", e.Name.Name, symbol.Kind)
+			return ""
+		}
+
+		return symbol.Type
+
+	case *SelectorExpr:
+		field := c.member(e.X, e.Sel, FieldSymbol)
+		if field == nil {
+			return ""
+		}
+
+		// Components are only reachable through the entity a system runs
+		// for, which has every component of its query.
+		if c.decl.Kind == System && field.Decl.Kind == Comp && !c.queries(field.Decl) {
+			c.errors.Add(e.Span, "%s is not in the query of %s", field.Decl.Name.Name, c.decl.Name.Name)
+		}
+
+		return field.Type
+
+	case *UnaryExpr:
+		c.checkAssignable(e.X, TypeInt)
+		return TypeInt
+
+	case *BinaryExpr:
+		c.checkAssignable(e.X, TypeInt)
+		c.checkAssignable(e.Y, TypeInt)
+
+		switch e.Op {
+		case Equal, NotEqual, Less, Greater:
+			return TypeBool
+		}
+
+		return TypeInt
+
+	case *CallExpr:
+		c.checkCall(e)
+	}
+
+	return ""
+}
+
+func (c *checker) queries(comp *Decl) bool {
+	for _, name := range c.decl.Query() {
+		if name.Name == comp.Name.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *checker) checkCall(call *CallExpr) {
+	var method *Symbol
+
+	switch callee := call.Callee.(type) {
+	case *NameExpr:
+		symbol := c.resolve(callee.Name)
+		if symbol == nil {
+			break
+		}
+
+		switch symbol.Kind {
+		case BuiltinSymbol:
+			for _, arg := range call.Args {
+				c.checkExpr(arg)
+			}
+
+			return
+
+		case MethodSymbol:
+			method = symbol
+
+		default:
+			c.errors.Add(callee.Name.Span, "%s is a %s, not a method", callee.Name.Name, symbol.Kind)
+		}
+
+	case *SelectorExpr:
+		method = c.member(callee.X, callee.Sel, MethodSymbol)
+
+		// Like its fields, the methods of a component run on the entity
+		// a system runs for.
+		if method != nil && c.decl.Kind == System && method.Decl.Kind == Comp && !c.queries(method.Decl) {
+			c.errors.Add(callee.Span, "%s is not in the query of %s", method.Decl.Name.Name, c.decl.Name.Name)
+		}
+
+	default:
+		c.errors.Add(call.Callee.NodeSpan(), "can not call this expression")
+	}
+
+	if method == nil {
+		for _, arg := range call.Args {
+			c.checkExpr(arg)
+		}
+
+		return
+	}
+
+	if c.method != nil {
+		c.calls.add(methodName(c.decl, c.method), methodName(method.Decl, method.Method), call.Span)
+	}
+
+	params := method.Method.Params
+	if len(call.Args) != len(params) {
+		c.errors.Add(call.Span, "%s expects %d arguments, got %d", method.Name, len(params), len(call.Args))
+		return
+	}
+
+	for i, arg := range call.Args {
+		c.checkAssignable(arg, params[i].Type.Name)
+	}
+}
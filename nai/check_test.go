@@ -0,0 +1,145 @@
+package nai
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck_HelloWorld(t *testing.T) {
+	file, err := ParseFileFromPath("../examples/nai/hello_world.nai")
+	require.NoError(t, err)
+
+	info, err := Check(file)
+	require.NoError(t, err)
+
+	hello := file.Decls[1]
+	msg := info.Defs[hello.Fields[0].Name]
+	require.NotNil(t, msg)
+	assert.Equal(t, FieldSymbol, msg.Kind)
+	assert.Equal(t, TypeString, msg.Type)
+
+	// println(msg) refers to the field.
+	call := hello.Methods[0].Body.Stmts[0].(*ExprStmt).X.(*CallExpr)
+	arg := call.Args[0].(*NameExpr)
+	assert.Same(t, msg, info.Uses[arg.Name])
+	assert.Equal(t, TypeString, info.Types[arg])
+
+	// The query of s_printer refers to the component.
+	printer := file.Decls[2]
+	assert.Same(t, info.Defs[hello.Name], info.Uses[printer.Query()[0]])
+
+	scope := info.Universe.Innermost(arg.Name.Span.Start)
+	assert.Same(t, msg, scope.Lookup("msg"))
+}
+
+func TestCheck_Errors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected []string
+	}{
+		"Duplicate declaration": {
+			source:   "c :: comp { }\nc :: system { }",
+			expected: []string{"2:1: c is already declared at 1:1"},
+		},
+		"Duplicate member": {
+			source:   "c :: comp { int x; x() { } }",
+			expected: []string{"1:20: x is already declared at 1:17"},
+		},
+		"Duplicate variable": {
+			source:   "c :: comp { f(int a) { if a { int a = 1; } } }",
+			expected: []string{"1:35: a is already declared at 1:19"},
+		},
+		"Unknown component in query": {
+			source:   "c_hello_world :: comp { }\n[c_hello_wrld]\ns :: system { }",
+			expected: []string{"2:2: undefined: c_hello_wrld (did you mean c_hello_world?)"},
+		},
+		"Query of a non component": {
+			source:   "c_position :: comp { }\ne_position :: entity { }\n[e_position]\ns :: system { }",
+			expected: []string{"3:2: e_position is not a component (did you mean c_position?)"},
+		},
+		"Query of a comp": {
+			source:   "[c]\nc :: comp { }",
+			expected: []string{"1:1: only systems can have a query"},
+		},
+		"Component attached twice": {
+			source:   "c :: comp { }\ne :: entity { c; c; }",
+			expected: []string{"2:18: c is attached more than once"},
+		},
+		"Field initializer": {
+			source:   "c :: comp { string msg = 1 + 2; bool ok = \"yes\"; }",
+			expected: []string{"1:26: can not use int value as string", "1:43: can not use string value as bool"},
+		},
+		"Unknown type": {
+			source:   "c :: comp { strin msg; }",
+			expected: []string{"1:13: unknown type strin (did you mean string?)"},
+		},
+		"Near miss name": {
+			source:   "c :: comp { string message; f() { println(mesage); } }",
+			expected: []string{"1:43: undefined: mesage (did you mean message?)"},
+		},
+		"Near miss member": {
+			source:   "c :: comp { string message; }\ne :: entity { f() { println(c.mesage); } }",
+			expected: []string{"2:31: c has no field mesage (did you mean message?)"},
+		},
+		"Method argument": {
+			source:   "c :: comp { f(int a, string b) { } g() { f(\"a\", 1); } }",
+			expected: []string{"1:44: can not use string value as int", "1:49: can not use int value as string"},
+		},
+		"Method as value": {
+			source:   "c :: comp { f() { int x = f; } }",
+			expected: []string{"1:27: f is a method, not a value"},
+		},
+		"Field as method": {
+			source:   "c :: comp { int x; f() { x(); } }",
+			expected: []string{"1:26: x is a field, not a method"},
+		},
+		"String condition": {
+			source:   "c :: comp { f() { while \"yes\" { } } }",
+			expected: []string{"1:25: can not use string value as condition"},
+		},
+		"Component outside of query": {
+			source:   "c :: comp { int x; }\ns :: system { update() { println(c.x); } }",
+			expected: []string{"2:34: c is not in the query of s"},
+		},
+		"Method outside of query": {
+			source:   "c :: comp { f() { } }\ns :: system { update() { c.f(); } }",
+			expected: []string{"2:26: c is not in the query of s"},
+		},
+		"Recursion": {
+			source:   "c :: comp { f() { f(); } }",
+			expected: []string{"1:19: recursive call: c.f calls itself at 1:19; methods can not be recursive"},
+		},
+		"Mutual recursion": {
+			source:   "c :: comp { f() { g(); } g() { h(); } h() { f(); } }",
+			expected: []string{"1:19: recursive call: c.f calls c.g at 1:19, c.g calls c.h at 1:32, c.h calls c.f at 1:45; methods can not be recursive"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			file, err := ParseFile("check.nai", tc.source)
+			require.NoError(t, err)
+
+			_, err = Check(file)
+			require.Error(t, err)
+
+			messages := []string{}
+			for _, e := range err.(ErrorList) {
+				messages = append(messages, e.Error())
+			}
+
+			assert.Equal(t, tc.expected, messages)
+		})
+	}
+}
+
+func TestClosest(t *testing.T) {
+	candidates := []string{"message", "println", "print"}
+
+	assert.Equal(t, "message", closest("mesage", candidates))
+	assert.Equal(t, "print", closest("prnt", candidates))
+	assert.Equal(t, "", closest("x", candidates))
+	assert.Equal(t, "", closest("missing", candidates))
+}
@@ -0,0 +1,709 @@
+package nai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+)
+
+// The compiler lowers a .nai file to naive assembly:
+//
+//   - every field of an entity or a system, parameter and local variable
+//     gets a fixed memory cell, read with `load` and written with `store`;
+//   - fields of components live in the ecs.World of the VM, and are read
+//     with `getf` and written with `setf` on the current entity: the one
+//     being spawned, or the one a system runs for;
+//   - string literals live in a data area, stored as their length followed
+//     by their characters, and string values are the address of that data;
+//   - every method becomes a routine labeled `<decl>__<method>`, called with
+//     `call` and left with `ret`. Arguments are passed on the stack and
+//     every method leaves exactly one value on the stack, 0 unless it
+//     returns something else;
+//   - the entry point writes the string data, initializes every field,
+//     registers the components, spawns the entities and registers the
+//     `update` method of every system, then runs the systems once with
+//     `tick`. Declarations are referred to by a label named after them.
+//
+// Since frames are static, methods can not be recursive: the checker
+// reports every cycle of calls before the file is compiled.
+
+const (
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeString = "string"
+
+	// UpdateMethod is the method of a system called by the entry point.
+	UpdateMethod = "update"
+
+	endLabel = "__end"
+)
+
+var builtinTypes = map[string]bool{
+	TypeInt:    true,
+	TypeBool:   true,
+	TypeString: true,
+}
+
+type slot struct {
+	Address int
+	Type    string
+	// Field is set for fields of components, whose Address is the field
+	// id used by `getf` and `setf`.
+	Field bool
+}
+
+type routine struct {
+	Decl   *Decl
+	Method *Method
+	Label  string
+}
+
+type Compiler struct {
+	file *File
+
+	// out is where emit writes to, either entry or routines.
+	out      *strings.Builder
+	entry    strings.Builder
+	routines strings.Builder
+
+	memory int
+	labels int
+	// componentFields counts the field ids given to components so far.
+	componentFields int
+
+	decls   map[string]*Decl
+	fields  map[string]map[string]*slot
+	methods map[string]map[string]*routine
+	strings map[string]int
+	// initializers holds the code initializing the fields of every
+	// component.
+	initializers map[string]string
+	// literals keeps the strings in the order they were allocated.
+	literals []string
+
+	// Scope of the method being compiled.
+	decl   *Decl
+	locals map[string]*slot
+
+	Errors ErrorList
+}
+
+func NewCompiler(file *File) *Compiler {
+	return &Compiler{
+		file:    file,
+		decls:   make(map[string]*Decl),
+		fields:  make(map[string]map[string]*slot),
+		methods: make(map[string]map[string]*routine),
+		strings: make(map[string]int),
+
+		initializers: make(map[string]string),
+	}
+}
+
+// Compile checks file and returns its naive assembly.
+func Compile(file *File) (string, error) {
+	if _, err := Check(file); err != nil {
+		return "", err
+	}
+
+	c := NewCompiler(file)
+
+	return c.compileFile(), c.Errors.Err()
+}
+
+// CompileToTokens compiles file and assembles the result into a program
+// which can be loaded into a vm.VirtualMachine or dumped to a binary.
+func CompileToTokens(file *File) ([]token.Token, error) {
+	source, err := Compile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return lexer.NewLexer(source).Lex()
+}
+
+// CompileSource parses and compiles a .nai source.
+func CompileSource(name string, source string) ([]token.Token, error) {
+	file, err := ParseFile(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return CompileToTokens(file)
+}
+
+// RoutineLabel is the label of the routine compiled from a method.
+func RoutineLabel(decl string, method string) string {
+	return decl + "__" + method
+}
+
+func (c *Compiler) emit(format string, args ...any) {
+	fmt.Fprintf(c.out, format+"\n", args...)
+}
+
+func (c *Compiler) comment(node Node) {
+	c.emit("// %s:%s", c.file.Name, node.NodeSpan().Start)
+}
+
+func (c *Compiler) newLabel(hint string) string {
+	c.labels++
+	return fmt.Sprintf("__%s_%d", hint, c.labels)
+}
+
+func (c *Compiler) emitLoad(s *slot) {
+	if s.Field {
+		c.emit("getf %d", s.Address)
+		return
+	}
+
+	c.emit("load %d", s.Address)
+}
+
+func (c *Compiler) emitStore(s *slot) {
+	if s.Field {
+		c.emit("setf %d", s.Address)
+		return
+	}
+
+	c.emit("store %d", s.Address)
+}
+
+func (c *Compiler) allocate(cells int) int {
+	address := c.memory
+	c.memory += cells
+
+	return address
+}
+
+func (c *Compiler) compileFile() string {
+	c.declare()
+
+	// Components are initialized every time they are attached, so their
+	// initializers are compiled once and copied after every `attach`.
+	for _, decl := range c.file.Decls {
+		if decl.Kind == Comp {
+			initializer := strings.Builder{}
+			c.out = &initializer
+			c.compileFieldValues(decl)
+			c.initializers[decl.Name.Name] = initializer.String()
+		}
+	}
+
+	c.out = &c.entry
+	for _, decl := range c.file.Decls {
+		if decl.Kind != Comp {
+			c.compileFieldValues(decl)
+		}
+	}
+
+	for _, decl := range c.file.Decls {
+		if decl.Kind == Comp {
+			c.comment(decl)
+			c.emit("psh %d", len(decl.Fields))
+			c.emit("comp %s", decl.Name.Name)
+		}
+	}
+
+	for _, decl := range c.file.Decls {
+		if decl.Kind == Entity {
+			c.compileSpawn(decl)
+		}
+	}
+
+	for _, decl := range c.file.Decls {
+		if decl.Kind == System {
+			c.compileSystem(decl)
+		}
+	}
+
+	c.emit("tick")
+	c.emit("jmp %s", endLabel)
+
+	c.out = &c.routines
+	for _, decl := range c.file.Decls {
+		c.emit(":%s", decl.Name.Name)
+	}
+
+	for _, decl := range c.file.Decls {
+		for _, method := range decl.Methods {
+			c.compileMethod(decl, c.methods[decl.Name.Name][method.Name.Name])
+		}
+	}
+
+	c.emit(":%s", endLabel)
+
+	// The string data is only known once everything is compiled, but has
+	// to be written before the entry runs.
+	data := strings.Builder{}
+	c.out = &data
+	c.emit("// %s: data", c.file.Name)
+	for _, literal := range c.literals {
+		address := c.strings[literal]
+		runes := []rune(literal)
+
+		c.emit("psh %d", len(runes))
+		c.emit("store %d", address)
+		for i, r := range runes {
+			c.emit("psh %d", r)
+			c.emit("store %d", address+1+i)
+		}
+	}
+
+	c.emit("// %s: entry", c.file.Name)
+
+	return data.String() + c.entry.String() + c.routines.String()
+}
+
+// compileFieldValues stores the initial value of every field of decl
+// which has one.
+func (c *Compiler) compileFieldValues(decl *Decl) {
+	c.decl = decl
+	c.locals = map[string]*slot{}
+
+	for _, field := range decl.Fields {
+		if field.Value == nil {
+			continue
+		}
+
+		s := c.fields[decl.Name.Name][field.Name.Name]
+
+		c.comment(field)
+		c.compileExpr(field.Value, s.Type)
+		c.emitStore(s)
+	}
+}
+
+// component returns the component declaration called name, reporting an
+// error at name when there is none.
+func (c *Compiler) component(name *Ident) *Decl {
+	decl, ok := c.decls[name.Name]
+	if !ok {
+		c.Errors.Add(name.Span, "undefined: %s", name.Name)
+		return nil
+	}
+
+	if decl.Kind != Comp {
+		c.Errors.Add(name.Span, "%s is not a component", name.Name)
+		return nil
+	}
+
+	return decl
+}
+
+// compileSpawn spawns the entity and attaches its components, with their
+// fields initialized.
+func (c *Compiler) compileSpawn(decl *Decl) {
+	c.comment(decl)
+	c.emit("entity %s", decl.Name.Name)
+
+	for _, name := range decl.Components {
+		comp := c.component(name)
+		if comp == nil {
+			continue
+		}
+
+		c.emit("attach %s", comp.Name.Name)
+		c.out.WriteString(c.initializers[comp.Name.Name])
+	}
+}
+
+// compileSystem registers the `update` method of a system to run over the
+// entities having every component of its query.
+func (c *Compiler) compileSystem(decl *Decl) {
+	r, ok := c.methods[decl.Name.Name][UpdateMethod]
+	if !ok {
+		return
+	}
+
+	c.comment(decl)
+
+	query := decl.Query()
+	for _, name := range query {
+		if comp := c.component(name); comp != nil {
+			c.emit("psh %s", comp.Name.Name)
+		}
+	}
+
+	c.emit("psh %d", len(query))
+	c.emit("system %s", r.Label)
+}
+
+// declare allocates the storage of every field and names every routine,
+// so methods can refer to declarations which come later in the file.
+func (c *Compiler) declare() {
+	for _, decl := range c.file.Decls {
+		name := decl.Name.Name
+		if _, ok := c.decls[name]; ok {
+			c.Errors.Add(decl.Name.Span, "%s is declared more than once", name)
+			continue
+		}
+
+		c.decls[name] = decl
+		c.fields[name] = map[string]*slot{}
+		c.methods[name] = map[string]*routine{}
+
+		for _, field := range decl.Fields {
+			if !builtinTypes[field.Type.Name] {
+				c.Errors.Add(field.Type.Span, "unknown type %s", field.Type.Name)
+			}
+
+			s := &slot{Type: field.Type.Name, Field: decl.Kind == Comp}
+			if s.Field {
+				s.Address = c.componentFields
+				c.componentFields++
+			} else {
+				s.Address = c.allocate(1)
+			}
+
+			c.fields[name][field.Name.Name] = s
+		}
+
+		for _, method := range decl.Methods {
+			c.methods[name][method.Name.Name] = &routine{
+				Decl:   decl,
+				Method: method,
+				Label:  RoutineLabel(name, method.Name.Name),
+			}
+		}
+	}
+}
+
+func (c *Compiler) compileMethod(decl *Decl, r *routine) {
+	c.decl = decl
+	c.locals = map[string]*slot{}
+
+	c.emit("")
+	c.comment(r.Method)
+	c.emit(":%s", r.Label)
+
+	// Arguments were pushed left to right, so the last one is on top.
+	params := r.Method.Params
+	for i := len(params) - 1; i >= 0; i-- {
+		s := c.declareLocal(params[i].Type, params[i].Name)
+		c.emit("store %d", s.Address)
+	}
+
+	c.compileBlock(r.Method.Body)
+
+	c.emit("psh 0")
+	c.emit("ret")
+}
+
+func (c *Compiler) declareLocal(typ *Ident, name *Ident) *slot {
+	if !builtinTypes[typ.Name] {
+		c.Errors.Add(typ.Span, "unknown type %s", typ.Name)
+	}
+
+	s := &slot{Address: c.allocate(1), Type: typ.Name}
+	c.locals[name.Name] = s
+
+	return s
+}
+
+func (c *Compiler) compileBlock(block *Block) {
+	for _, stmt := range block.Stmts {
+		c.compileStmt(stmt)
+	}
+}
+
+func (c *Compiler) compileStmt(stmt Stmt) {
+	c.comment(stmt)
+
+	switch s := stmt.(type) {
+	case *ExprStmt:
+		c.compileExpr(s.X, "")
+		c.emit("pop")
+
+	case *VarStmt:
+		local := c.declareLocal(s.Type, s.Name)
+		if s.Value == nil {
+			return
+		}
+
+		c.compileExpr(s.Value, local.Type)
+		c.emit("store %d", local.Address)
+
+	case *AssignStmt:
+		target := c.resolveSlot(s.Target)
+		if target == nil {
+			return
+		}
+
+		c.compileExpr(s.Value, target.Type)
+		c.emitStore(target)
+
+	case *ReturnStmt:
+		if s.Value == nil {
+			c.emit("psh 0")
+		} else {
+			c.compileExpr(s.Value, "")
+		}
+
+		c.emit("ret")
+
+	case *IfStmt:
+		then, end := c.newLabel("then"), c.newLabel("end_if")
+
+		c.compileCondition(s.Cond)
+		c.emit("jif %s", then)
+		c.emit("pop")
+		if s.Else != nil {
+			c.compileBlock(s.Else)
+		}
+
+		c.emit("jmp %s", end)
+		c.emit(":%s", then)
+		c.emit("pop")
+		c.compileBlock(s.Then)
+		c.emit(":%s", end)
+
+	case *WhileStmt:
+		top, body, end := c.newLabel("while"), c.newLabel("do"), c.newLabel("end_while")
+
+		c.emit(":%s", top)
+		c.compileCondition(s.Cond)
+		c.emit("jif %s", body)
+		c.emit("pop")
+		c.emit("jmp %s", end)
+		c.emit(":%s", body)
+		c.emit("pop")
+		c.compileBlock(s.Body)
+		c.emit("jmp %s", top)
+		c.emit(":%s", end)
+	}
+}
+
+// compileCondition leaves 1 on the stack when cond is true and 0
+// otherwise, since `jif` only jumps on 1.
+func (c *Compiler) compileCondition(cond Expr) {
+	c.compileExpr(cond, "")
+
+	if b, ok := cond.(*BinaryExpr); ok {
+		switch b.Op {
+		case Equal, NotEqual, Less, Greater:
+			return
+		}
+	}
+
+	c.emit("psh 0")
+	c.emit("eq")
+	c.emit("psh 0")
+	c.emit("eq")
+}
+
+// resolveSlot returns the storage of a local variable, a field of the
+// current declaration or a `decl.field` selector.
+func (c *Compiler) resolveSlot(x Expr) *slot {
+	switch e := x.(type) {
+	case *NameExpr:
+		if s, ok := c.locals[e.Name.Name]; ok {
+			return s
+		}
+
+		if s, ok := c.fields[c.decl.Name.Name][e.Name.Name]; ok {
+			return s
+		}
+
+		c.Errors.Add(e.Name.Span, "undefined: %s", e.Name.Name)
+
+	case *SelectorExpr:
+		owner, ok := e.X.(*NameExpr)
+		if !ok {
+			c.Errors.Add(e.Span, "only fields of declarations can be selected")
+			return nil
+		}
+
+		fields, ok := c.fields[owner.Name.Name]
+		if !ok {
+			c.Errors.Add(owner.Name.Span, "undefined: %s", owner.Name.Name)
+			return nil
+		}
+
+		if s, ok := fields[e.Sel.Name]; ok {
+			return s
+		}
+
+		c.Errors.Add(e.Sel.Span, "%s has no field %s", owner.Name.Name, e.Sel.Name)
+
+	default:
+		c.Errors.Add(x.NodeSpan(), "can not assign to this expression")
+	}
+
+	return nil
+}
+
+// typeOf returns the type of an expression, as far as the compiler needs
+// it, or an empty string when it is not known.
+func (c *Compiler) typeOf(x Expr) string {
+	switch e := x.(type) {
+	case *StringLit:
+		return TypeString
+	case *NumberLit, *UnaryExpr, *BinaryExpr:
+		return TypeInt
+	case *NameExpr, *SelectorExpr:
+		if s := c.resolveSlotQuietly(e); s != nil {
+			return s.Type
+		}
+	}
+
+	return ""
+}
+
+func (c *Compiler) resolveSlotQuietly(x Expr) *slot {
+	errors := len(c.Errors)
+	s := c.resolveSlot(x)
+	c.Errors = c.Errors[:errors]
+
+	return s
+}
+
+// stringData returns the address of the data of a string literal.
+func (c *Compiler) stringData(value string) int {
+	if address, ok := c.strings[value]; ok {
+		return address
+	}
+
+	address := c.allocate(len([]rune(value)) + 1)
+	c.strings[value] = address
+	c.literals = append(c.literals, value)
+
+	return address
+}
+
+// assignable reports whether a value of type actual can be stored as
+// expected. bool and int share their representation.
+func assignable(actual string, expected string) bool {
+	if actual == "" || expected == "" || actual == expected {
+		return true
+	}
+
+	return actual != TypeString && expected != TypeString
+}
+
+// compileExpr leaves the value of x on the stack. expected is the type
+// the value is stored as, or empty when it does not matter.
+func (c *Compiler) compileExpr(x Expr, expected string) {
+	if actual := c.typeOf(x); !assignable(actual, expected) {
+		c.Errors.Add(x.NodeSpan(), "can not use %s value as %s", actual, expected)
+	}
+
+	switch e := x.(type) {
+	case *NumberLit:
+		c.emit("psh %d", e.Value)
+
+	case *StringLit:
+		c.emit("psh %d", c.stringData(e.Value))
+
+	case *NameExpr, *SelectorExpr:
+		if s := c.resolveSlot(e); s != nil {
+			c.emitLoad(s)
+		}
+
+	case *UnaryExpr:
+		c.emit("psh 0")
+		c.compileExpr(e.X, TypeInt)
+		c.emit("sub")
+
+	case *BinaryExpr:
+		c.compileExpr(e.X, TypeInt)
+		c.compileExpr(e.Y, TypeInt)
+
+		switch e.Op {
+		case Plus:
+			c.emit("sum")
+		case Minus:
+			c.emit("sub")
+		case Star:
+			c.emit("mul")
+		case Slash:
+			c.emit("div")
+		case Equal:
+			c.emit("eq")
+		case NotEqual:
+			c.emit("eq")
+			c.emit("psh 0")
+			c.emit("eq")
+		case Less:
+			c.emit("lt")
+		case Greater:
+			c.emit("gt")
+		}
+
+	case *CallExpr:
+		c.compileCall(e)
+	}
+}
+
+func (c *Compiler) compileCall(call *CallExpr) {
+	var r *routine
+
+	switch callee := call.Callee.(type) {
+	case *NameExpr:
+		name := callee.Name.Name
+		if name == "print" || name == "println" {
+			c.compileBuiltinPrint(call, name == "println")
+			return
+		}
+
+		r = c.methods[c.decl.Name.Name][name]
+		if r == nil {
+			c.Errors.Add(callee.Name.Span, "undefined: %s", name)
+			return
+		}
+
+	case *SelectorExpr:
+		owner, ok := callee.X.(*NameExpr)
+		if !ok || c.methods[owner.Name.Name] == nil {
+			c.Errors.Add(callee.X.NodeSpan(), "only methods of declarations can be called")
+			return
+		}
+
+		r = c.methods[owner.Name.Name][callee.Sel.Name]
+		if r == nil {
+			c.Errors.Add(callee.Sel.Span, "%s has no method %s", owner.Name.Name, callee.Sel.Name)
+			return
+		}
+
+	default:
+		c.Errors.Add(call.Callee.NodeSpan(), "can not call this expression")
+		return
+	}
+
+	if len(call.Args) != len(r.Method.Params) {
+		c.Errors.Add(call.Span, "%s expects %d arguments, got %d", r.Method.Name.Name, len(r.Method.Params), len(call.Args))
+		return
+	}
+
+	for i, arg := range call.Args {
+		c.compileExpr(arg, r.Method.Params[i].Type.Name)
+	}
+
+	c.emit("call %s", r.Label)
+}
+
+// compileBuiltinPrint writes every argument, separated by spaces. Like
+// every call it leaves 0 on the stack.
+func (c *Compiler) compileBuiltinPrint(call *CallExpr, newLine bool) {
+	for i, arg := range call.Args {
+		if i > 0 {
+			c.emit("psh %d", ' ')
+			c.emit("outc")
+		}
+
+		c.compileExpr(arg, "")
+		if c.typeOf(arg) == TypeString {
+			c.emit("outs")
+		} else {
+			c.emit("out")
+		}
+	}
+
+	if newLine {
+		c.emit("psh %d", '\n')
+		c.emit("outc")
+	}
+
+	c.emit("psh 0")
+}
@@ -0,0 +1,181 @@
+package nai
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jejikeh/ambient/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func run(t *testing.T, source string) string {
+	program, err := CompileSource("test.nai", source)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	v := vm.NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(program)
+
+	require.Equal(t, vm.Error(vm.Ok), v.ExecuteFrom(0, 100000, nil))
+	assert.Empty(t, v.Stack, "every statement should leave the stack balanced")
+
+	return out.String()
+}
+
+func TestCompile_HelloECS(t *testing.T) {
+	file, err := ParseFileFromPath("../examples/nai/hello_ecs.nai")
+	require.NoError(t, err)
+
+	source, err := Compile(file)
+	require.NoError(t, err)
+	assert.Contains(t, source, ":c_hello_world__say")
+	assert.Contains(t, source, "system s_printer__update")
+
+	program, err := CompileToTokens(file)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	v := vm.NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(program)
+	v.Execute(-1, false)
+
+	assert.Equal(t, "hello world\n", out.String())
+}
+
+func TestCompile_Statements(t *testing.T) {
+	out := run(t, `e_main :: entity {
+	c_counter;
+}
+
+c_counter :: comp {
+	int count = 2;
+
+	add(int by) {
+		count = count + by;
+		return count;
+	}
+}
+
+[c_counter]
+s_main :: system {
+	update() {
+		int i = 0;
+		while i < 3 {
+			c_counter.add(i);
+			i = i + 1;
+		}
+
+		println(c_counter.count, -1 * 7, 9 / 3 - 1);
+
+		if c_counter.count == 5 {
+			println("five");
+		} else if c_counter.count > 5 {
+			println("more", c_counter.count);
+		} else {
+			println("less");
+		}
+
+		c_counter.count = 0;
+		if c_counter.count { println("unreachable"); }
+		if c_counter.count != 1 { print("done"); }
+	}
+}`)
+
+	assert.Equal(t, "5 -7 2\nfive\ndone", out)
+}
+
+func TestCompile_Entities(t *testing.T) {
+	out := run(t, `e_first :: entity {
+	c_position;
+	c_velocity;
+}
+
+e_second :: entity {
+	c_position;
+}
+
+c_position :: comp {
+	int x = 10;
+}
+
+c_velocity :: comp {
+	int dx = 5;
+}
+
+[c_position, c_velocity]
+s_move :: system {
+	update() {
+		c_position.x = c_position.x + c_velocity.dx;
+	}
+}
+
+[c_position]
+s_print :: system {
+	int seen = 0;
+
+	update() {
+		seen = seen + 1;
+		println(seen, c_position.x);
+	}
+}`)
+
+	assert.Equal(t, "1 15\n2 10\n", out)
+}
+
+func TestCompile_Errors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected string
+	}{
+		"Undefined name": {
+			source:   "s :: system { update() { println(missing); } }",
+			expected: "1:34: undefined: missing",
+		},
+		"Unknown type": {
+			source:   "c :: comp { float x; }",
+			expected: "1:13: unknown type float",
+		},
+		"Mismatched type": {
+			source:   "c :: comp { int x = \"hi\"; }",
+			expected: "1:21: can not use string value as int",
+		},
+		"Wrong argument count": {
+			source:   "c :: comp { f(int a) { } g() { f(); } }",
+			expected: "1:32: f expects 1 arguments, got 0",
+		},
+		"Unknown component": {
+			source:   "e :: entity { c_missing; }",
+			expected: "1:15: undefined: c_missing",
+		},
+		"Query of a system": {
+			source:   "e :: entity { }\n[e]\ns :: system { update() { } }",
+			expected: "2:2: e is not a component",
+		},
+		"Unknown method": {
+			source:   "c :: comp { g() { c.f(); } }",
+			expected: "1:21: c has no method f",
+		},
+		"Recursion": {
+			source:   "c :: comp { fib(int n) { if n < 2 { return n; } return fib(n - 1) + fib(n - 2); } }",
+			expected: "1:56: recursive call: c.fib calls itself at 1:56; methods can not be recursive",
+		},
+		"Mutual recursion": {
+			source:   "c :: comp { f() { d.g(); } }\nd :: comp { g() { c.f(); } }",
+			expected: "1:19: recursive call: c.f calls d.g at 1:19, d.g calls c.f at 2:19; methods can not be recursive",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			file, err := ParseFile("errors.nai", tc.source)
+			require.NoError(t, err)
+
+			_, err = Compile(file)
+			require.Error(t, err)
+			assert.Equal(t, tc.expected, err.(ErrorList)[0].Error())
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package nai
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error is a diagnostic attached to a span of the source. Suggestion is
+// the name the source most likely meant, when there is one.
+type Error struct {
+	Span       Span
+	Message    string
+	Suggestion string
+}
+
+func (e *Error) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("%s: %s (did you mean %s?)", e.Span.Start, e.Message, e.Suggestion)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Span.Start, e.Message)
+}
+
+// ErrorList collects every error found in a source, in order.
+type ErrorList []*Error
+
+func (l *ErrorList) Add(span Span, format string, args ...any) {
+	*l = append(*l, &Error{Span: span, Message: fmt.Sprintf(format, args...)})
+}
+
+// AddSuggestion adds an error suggesting the closest of candidates to
+// name, if any of them is close enough.
+func (l *ErrorList) AddSuggestion(span Span, name string, candidates []string, format string, args ...any) {
+	l.Add(span, format, args...)
+	(*l)[len(*l)-1].Suggestion = closest(name, candidates)
+}
+
+func (l ErrorList) Error() string {
+	messages := make([]string, 0, len(l))
+	for _, e := range l {
+		messages = append(messages, e.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Err returns nil when the list is empty, so it can be returned as error.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+
+	return l
+}
+
+// closest returns the candidate with the smallest edit distance to name,
+// or an empty string when every candidate differs in more than a third
+// of name.
+func closest(name string, candidates []string) string {
+	best, bestDistance := "", len([]rune(name))/3+1
+	for _, candidate := range candidates {
+		if candidate == name {
+			continue
+		}
+
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(y)]
+}
@@ -0,0 +1,257 @@
+package nai
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+type Lexer struct {
+	source []rune
+	pos    Pos
+
+	Errors ErrorList
+}
+
+func NewLexer(source string) *Lexer {
+	return &Lexer{
+		source: []rune(source),
+		pos:    Pos{Line: 1, Column: 1},
+	}
+}
+
+// Tokenize returns every token of the source, ending with EndOfFile.
+// Characters which do not start a token are reported as errors and
+// returned as Illegal tokens.
+func Tokenize(source string) ([]Token, error) {
+	l := NewLexer(source)
+	tokens := []Token{}
+
+	for {
+		t := l.Next()
+		tokens = append(tokens, t)
+
+		if t.Kind == EndOfFile {
+			break
+		}
+	}
+
+	return tokens, l.Errors.Err()
+}
+
+func (l *Lexer) peek(offset int) rune {
+	i := l.pos.Offset + offset
+	if i >= len(l.source) {
+		return 0
+	}
+
+	return l.source[i]
+}
+
+func (l *Lexer) eat() rune {
+	c := l.source[l.pos.Offset]
+	l.pos.Offset++
+
+	if c == '\n' {
+		l.pos.Line++
+		l.pos.Column = 1
+	} else {
+		l.pos.Column++
+	}
+
+	return c
+}
+
+func (l *Lexer) atEnd() bool {
+	return l.pos.Offset >= len(l.source)
+}
+
+// skipWhitespaceAndComments eats everything up to the next token.
+func (l *Lexer) skipWhitespaceAndComments() {
+	for !l.atEnd() {
+		c := l.peek(0)
+
+		switch {
+		case unicode.IsSpace(c):
+			l.eat()
+
+		case c == '/' && l.peek(1) == '/':
+			for !l.atEnd() && l.peek(0) != '\n' {
+				l.eat()
+			}
+
+		case c == '/' && l.peek(1) == '*':
+			start := l.pos
+			l.eat()
+			l.eat()
+
+			for !l.atEnd() && !(l.peek(0) == '*' && l.peek(1) == '/') {
+				l.eat()
+			}
+
+			if l.atEnd() {
+				l.Errors.Add(Span{Start: start, End: l.pos}, "unterminated block comment")
+				return
+			}
+
+			l.eat()
+			l.eat()
+
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) Next() Token {
+	l.skipWhitespaceAndComments()
+
+	start := l.pos
+	if l.atEnd() {
+		return Token{Kind: EndOfFile, Span: Span{Start: start, End: start}}
+	}
+
+	c := l.peek(0)
+
+	switch {
+	case token.IsStartOfIdentifier(c):
+		return l.identifierOrKeyword()
+	case unicode.IsDigit(c):
+		return l.number()
+	case c == '"':
+		return l.string()
+	}
+
+	kind := Illegal
+
+	// Two character punctuation has to be matched first.
+	switch string([]rune{c, l.peek(1)}) {
+	case "::":
+		kind = DoubleColon
+	case "==":
+		kind = Equal
+	case "!=":
+		kind = NotEqual
+	}
+
+	if kind != Illegal {
+		l.eat()
+		l.eat()
+		return Token{Kind: kind, Text: string(kind), Span: Span{Start: start, End: l.pos}}
+	}
+
+	switch c {
+	case ':':
+		kind = Colon
+	case ';':
+		kind = Semicolon
+	case ',':
+		kind = Comma
+	case '.':
+		kind = Dot
+	case '=':
+		kind = Assign
+	case '{':
+		kind = LeftBrace
+	case '}':
+		kind = RightBrace
+	case '(':
+		kind = LeftParen
+	case ')':
+		kind = RightParen
+	case '[':
+		kind = LeftBracket
+	case ']':
+		kind = RightBracket
+	case '+':
+		kind = Plus
+	case '-':
+		kind = Minus
+	case '*':
+		kind = Star
+	case '/':
+		kind = Slash
+	case '<':
+		kind = Less
+	case '>':
+		kind = Greater
+	}
+
+	l.eat()
+	t := Token{Kind: kind, Text: string(c), Span: Span{Start: start, End: l.pos}}
+
+	if kind == Illegal {
+		l.Errors.Add(t.Span, "unexpected character %q", c)
+	}
+
+	return t
+}
+
+func (l *Lexer) identifierOrKeyword() Token {
+	start := l.pos
+	b := strings.Builder{}
+
+	for !l.atEnd() && token.IsPartOfIdentifier(l.peek(0)) {
+		b.WriteRune(l.eat())
+	}
+
+	t := Token{Kind: Identifier, Text: b.String(), Span: Span{Start: start, End: l.pos}}
+	if kind, ok := keywords[t.Text]; ok {
+		t.Kind = kind
+	}
+
+	return t
+}
+
+func (l *Lexer) number() Token {
+	start := l.pos
+	b := strings.Builder{}
+
+	for !l.atEnd() && unicode.IsDigit(l.peek(0)) {
+		b.WriteRune(l.eat())
+	}
+
+	return Token{Kind: Number, Text: b.String(), Span: Span{Start: start, End: l.pos}}
+}
+
+func (l *Lexer) string() Token {
+	start := l.pos
+	b := strings.Builder{}
+
+	// Opening quote.
+	l.eat()
+
+	for {
+		if l.atEnd() || l.peek(0) == '\n' {
+			span := Span{Start: start, End: l.pos}
+			l.Errors.Add(span, "unterminated string literal")
+			return Token{Kind: String, Text: b.String(), Span: span}
+		}
+
+		c := l.eat()
+		if c == '"' {
+			break
+		}
+
+		if c == '\\' && !l.atEnd() {
+			escaped := l.eat()
+			switch escaped {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case '"', '\\':
+				b.WriteRune(escaped)
+			default:
+				l.Errors.Add(Span{Start: start, End: l.pos}, "unknown escape sequence \\%c", escaped)
+			}
+
+			continue
+		}
+
+		b.WriteRune(c)
+	}
+
+	return Token{Kind: String, Text: b.String(), Span: Span{Start: start, End: l.pos}}
+}
@@ -0,0 +1,50 @@
+package nai
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func kinds(tokens []Token) []Kind {
+	result := make([]Kind, 0, len(tokens))
+	for _, t := range tokens {
+		result = append(result, t.Kind)
+	}
+
+	return result
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := Tokenize(`[c_hello] s :: system { // comment
+	/* block */ string msg = "hi \"you\"\n"; a.b(1) == 2 != 3; }`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Kind{
+		LeftBracket, Identifier, RightBracket, Identifier, DoubleColon, System, LeftBrace,
+		Identifier, Identifier, Assign, String, Semicolon,
+		Identifier, Dot, Identifier, LeftParen, Number, RightParen, Equal, Number, NotEqual, Number, Semicolon,
+		RightBrace, EndOfFile,
+	}, kinds(tokens))
+
+	assert.Equal(t, "hi \"you\"\n", tokens[10].Text)
+	assert.Equal(t, Span{Start: Pos{Offset: 48, Line: 2, Column: 14}, End: Pos{Offset: 54, Line: 2, Column: 20}}, tokens[7].Span)
+}
+
+func TestTokenize_Errors(t *testing.T) {
+	tests := map[string]string{
+		"Illegal character":    "a $ b",
+		"Unterminated string":  `"hello`,
+		"Unterminated comment": "/* hello",
+		"Unknown escape":       `"\q"`,
+	}
+
+	for name, source := range tests {
+		t.Run(name, func(t *testing.T) {
+			tokens, err := Tokenize(source)
+			assert.Error(t, err)
+			assert.Equal(t, EndOfFile, tokens[len(tokens)-1].Kind)
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package nai
+
+import (
+	"os"
+	"strconv"
+)
+
+// Grammar:
+//
+//	file       = { decl } .
+//	decl       = { attribute } ident "::" ( "entity" | "comp" | "system" ) "{" { member } "}" .
+//	attribute  = "[" ident { "," ident } "]" .
+//	member     = ident ";" | ident ident [ "=" expr ] ";" | ident "(" [ params ] ")" block .
+//	params     = ident ident { "," ident ident } .
+//	block      = "{" { stmt } "}" .
+//	stmt       = ident ident [ "=" expr ] ";" | "return" [ expr ] ";" | if | "while" expr block
+//	           | expr [ "=" expr ] ";" .
+//	if         = "if" expr block [ "else" ( block | if ) ] .
+//	expr       = additive { ( "==" | "!=" | "<" | ">" ) additive } .
+//	additive   = term { ( "+" | "-" ) term } .
+//	term       = unary { ( "*" | "/" ) unary } .
+//	unary      = "-" unary | postfix .
+//	postfix    = primary { "(" [ expr { "," expr } ] ")" | "." ident } .
+//	primary    = ident | number | string | "(" expr ")" .
+
+type Parser struct {
+	tokens []Token
+	cursor int
+
+	Errors ErrorList
+}
+
+// bailout unwinds the parser to the enclosing declaration after an error.
+type bailout struct{}
+
+func NewParser(tokens []Token) *Parser {
+	return &Parser{tokens: tokens}
+}
+
+// ParseFile tokenizes and parses source. The returned file holds every
+// declaration which could be parsed, even when an error is returned.
+func ParseFile(name string, source string) (*File, error) {
+	tokens, lexErr := Tokenize(source)
+
+	p := NewParser(tokens)
+	if list, ok := lexErr.(ErrorList); ok {
+		p.Errors = append(p.Errors, list...)
+	}
+
+	file := p.Parse()
+	file.Name = name
+
+	return file, p.Errors.Err()
+}
+
+func ParseFileFromPath(path string) (*File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseFile(path, string(content))
+}
+
+func (p *Parser) Parse() *File {
+	file := &File{}
+
+	for p.peek().Kind != EndOfFile {
+		if decl := p.parseDeclOrSync(); decl != nil {
+			file.Decls = append(file.Decls, decl)
+		}
+	}
+
+	return file
+}
+
+func (p *Parser) parseDeclOrSync() (decl *Decl) {
+	start := p.cursor
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+
+			// Always make progress, even when the declaration failed on
+			// its first token.
+			if p.cursor == start {
+				p.next()
+			}
+
+			decl = nil
+			p.synchronize()
+		}
+	}()
+
+	return p.parseDecl()
+}
+
+// synchronize skips tokens up to the start of the next declaration.
+func (p *Parser) synchronize() {
+	// The name of the next declaration could have been consumed as a
+	// member of an unterminated one.
+	if p.peek().Kind == DoubleColon && p.cursor > 0 && p.tokens[p.cursor-1].Kind == Identifier {
+		p.cursor--
+		return
+	}
+
+	for {
+		t := p.peek()
+		if t.Kind == EndOfFile || t.Kind == LeftBracket {
+			return
+		}
+
+		if t.Kind == Identifier && p.peekAt(1).Kind == DoubleColon {
+			return
+		}
+
+		p.next()
+	}
+}
+
+func (p *Parser) peek() Token {
+	return p.peekAt(0)
+}
+
+func (p *Parser) peekAt(offset int) Token {
+	i := p.cursor + offset
+	if i >= len(p.tokens) {
+		last := Pos{}
+		if len(p.tokens) > 0 {
+			last = p.tokens[len(p.tokens)-1].Span.End
+		}
+
+		return Token{Kind: EndOfFile, Span: Span{Start: last, End: last}}
+	}
+
+	return p.tokens[i]
+}
+
+func (p *Parser) next() Token {
+	t := p.peek()
+	if p.cursor < len(p.tokens) {
+		p.cursor++
+	}
+
+	return t
+}
+
+// previousEnd is the end of the last consumed token.
+func (p *Parser) previousEnd() Pos {
+	if p.cursor == 0 || len(p.tokens) == 0 {
+		return Pos{Line: 1, Column: 1}
+	}
+
+	return p.tokens[p.cursor-1].Span.End
+}
+
+func (p *Parser) fail(span Span, format string, args ...any) {
+	p.Errors.Add(span, format, args...)
+	panic(bailout{})
+}
+
+func (p *Parser) expect(kind Kind, context string) Token {
+	t := p.peek()
+	if t.Kind != kind {
+		p.fail(t.Span, "expected %s %s, got %s", describe(Token{Kind: kind}), context, describe(t))
+	}
+
+	return p.next()
+}
+
+func (p *Parser) accept(kind Kind) bool {
+	if p.peek().Kind == kind {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func (p *Parser) ident(context string) *Ident {
+	t := p.expect(Identifier, context)
+	return &Ident{Name: t.Text, Span: t.Span}
+}
+
+func describe(t Token) string {
+	switch t.Kind {
+	case EndOfFile:
+		return "end of file"
+	case Identifier:
+		if t.Text == "" {
+			return "identifier"
+		}
+
+		return "identifier " + strconv.Quote(t.Text)
+	case Number:
+		return "number " + t.Text
+	case String:
+		return "string " + strconv.Quote(t.Text)
+	}
+
+	return strconv.Quote(string(t.Kind))
+}
+
+func (p *Parser) parseDecl() *Decl {
+	decl := &Decl{}
+	start := p.peek().Span.Start
+
+	for p.peek().Kind == LeftBracket {
+		decl.Attributes = append(decl.Attributes, p.parseAttribute())
+	}
+
+	decl.Name = p.ident("at the start of a declaration")
+	p.expect(DoubleColon, "after declaration name")
+
+	kind := p.next()
+	switch kind.Kind {
+	case Entity, Comp, System:
+		decl.Kind = kind.Kind
+	default:
+		p.fail(kind.Span, "expected entity, comp or system after \"::\", got %s", describe(kind))
+	}
+
+	p.expect(LeftBrace, "to open the "+string(decl.Kind)+" body")
+
+	for p.peek().Kind != RightBrace {
+		if p.peek().Kind == EndOfFile {
+			p.fail(p.peek().Span, "expected \"}\" to close %s %q, got end of file", decl.Kind, decl.Name.Name)
+		}
+
+		p.parseMember(decl)
+	}
+
+	p.expect(RightBrace, "to close the "+string(decl.Kind)+" body")
+	decl.Span = Span{Start: start, End: p.previousEnd()}
+
+	return decl
+}
+
+func (p *Parser) parseAttribute() *Attribute {
+	start := p.expect(LeftBracket, "to open an attribute").Span.Start
+	attribute := &Attribute{}
+
+	attribute.Names = append(attribute.Names, p.ident("in attribute"))
+	for p.accept(Comma) {
+		attribute.Names = append(attribute.Names, p.ident("in attribute"))
+	}
+
+	p.expect(RightBracket, "to close the attribute")
+	attribute.Span = Span{Start: start, End: p.previousEnd()}
+
+	return attribute
+}
+
+func (p *Parser) parseMember(decl *Decl) {
+	first := p.ident("at the start of a member")
+
+	switch p.peek().Kind {
+	case Semicolon:
+		p.next()
+		decl.Components = append(decl.Components, first)
+
+	case LeftParen:
+		decl.Methods = append(decl.Methods, p.parseMethod(first))
+
+	case Identifier:
+		field := &Field{Type: first, Name: p.ident("as field name")}
+		if p.accept(Assign) {
+			field.Value = p.parseExpr()
+		}
+
+		p.expect(Semicolon, "after field declaration")
+		field.Span = Span{Start: first.Span.Start, End: p.previousEnd()}
+		decl.Fields = append(decl.Fields, field)
+
+	default:
+		t := p.peek()
+		p.fail(t.Span, "expected field, method or component after %q, got %s", first.Name, describe(t))
+	}
+}
+
+func (p *Parser) parseMethod(name *Ident) *Method {
+	method := &Method{Name: name}
+	p.expect(LeftParen, "to open the parameter list")
+
+	if p.peek().Kind != RightParen {
+		for {
+			param := &Param{Type: p.ident("as parameter type")}
+			param.Name = p.ident("as parameter name")
+			method.Params = append(method.Params, param)
+
+			if !p.accept(Comma) {
+				break
+			}
+		}
+	}
+
+	p.expect(RightParen, "to close the parameter list")
+	method.Body = p.parseBlock()
+	method.Span = Span{Start: name.Span.Start, End: p.previousEnd()}
+
+	return method
+}
+
+func (p *Parser) parseBlock() *Block {
+	start := p.expect(LeftBrace, "to open a block").Span.Start
+	block := &Block{}
+
+	for p.peek().Kind != RightBrace {
+		if p.peek().Kind == EndOfFile {
+			p.fail(p.peek().Span, "expected \"}\" to close the block, got end of file")
+		}
+
+		block.Stmts = append(block.Stmts, p.parseStmt())
+	}
+
+	p.next()
+	block.Span = Span{Start: start, End: p.previousEnd()}
+
+	return block
+}
+
+func (p *Parser) parseStmt() Stmt {
+	t := p.peek()
+
+	switch t.Kind {
+	case Return:
+		p.next()
+		s := &ReturnStmt{}
+		if p.peek().Kind != Semicolon {
+			s.Value = p.parseExpr()
+		}
+
+		p.expect(Semicolon, "after return")
+		s.Span = Span{Start: t.Span.Start, End: p.previousEnd()}
+		return s
+
+	case If:
+		return p.parseIf()
+
+	case While:
+		p.next()
+		s := &WhileStmt{Cond: p.parseExpr()}
+		s.Body = p.parseBlock()
+		s.Span = Span{Start: t.Span.Start, End: p.previousEnd()}
+		return s
+
+	case Identifier:
+		if p.peekAt(1).Kind == Identifier {
+			s := &VarStmt{Type: p.ident("as variable type")}
+			s.Name = p.ident("as variable name")
+			if p.accept(Assign) {
+				s.Value = p.parseExpr()
+			}
+
+			p.expect(Semicolon, "after variable declaration")
+			s.Span = Span{Start: t.Span.Start, End: p.previousEnd()}
+			return s
+		}
+	}
+
+	x := p.parseExpr()
+	if p.accept(Assign) {
+		s := &AssignStmt{Target: x, Value: p.parseExpr()}
+		p.expect(Semicolon, "after assignment")
+		s.Span = Span{Start: t.Span.Start, End: p.previousEnd()}
+		return s
+	}
+
+	p.expect(Semicolon, "after expression")
+
+	return &ExprStmt{X: x}
+}
+
+func (p *Parser) parseIf() *IfStmt {
+	start := p.expect(If, "").Span.Start
+	s := &IfStmt{Cond: p.parseExpr()}
+	s.Then = p.parseBlock()
+
+	if p.accept(Else) {
+		if p.peek().Kind == If {
+			nested := p.parseIf()
+			s.Else = &Block{Stmts: []Stmt{nested}, Span: nested.Span}
+		} else {
+			s.Else = p.parseBlock()
+		}
+	}
+
+	s.Span = Span{Start: start, End: p.previousEnd()}
+
+	return s
+}
+
+var binaryPrecedence = map[Kind]int{
+	Equal:    1,
+	NotEqual: 1,
+	Less:     1,
+	Greater:  1,
+	Plus:     2,
+	Minus:    2,
+	Star:     3,
+	Slash:    3,
+}
+
+func (p *Parser) parseExpr() Expr {
+	return p.parseBinary(1)
+}
+
+// parseBinary parses left associative binary expressions whose operators
+// bind at least as tight as precedence.
+func (p *Parser) parseBinary(precedence int) Expr {
+	x := p.parseUnary()
+
+	for {
+		op := p.peek()
+		opPrecedence, ok := binaryPrecedence[op.Kind]
+		if !ok || opPrecedence < precedence {
+			return x
+		}
+
+		p.next()
+		y := p.parseBinary(opPrecedence + 1)
+		x = &BinaryExpr{Op: op.Kind, X: x, Y: y, Span: Span{Start: x.NodeSpan().Start, End: y.NodeSpan().End}}
+	}
+}
+
+func (p *Parser) parseUnary() Expr {
+	t := p.peek()
+	if t.Kind == Minus {
+		p.next()
+		x := p.parseUnary()
+		return &UnaryExpr{Op: Minus, X: x, Span: Span{Start: t.Span.Start, End: x.NodeSpan().End}}
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *Parser) parsePostfix() Expr {
+	x := p.parsePrimary()
+
+	for {
+		switch p.peek().Kind {
+		case LeftParen:
+			p.next()
+			call := &CallExpr{Callee: x}
+
+			if p.peek().Kind != RightParen {
+				for {
+					call.Args = append(call.Args, p.parseExpr())
+					if !p.accept(Comma) {
+						break
+					}
+				}
+			}
+
+			p.expect(RightParen, "to close the argument list")
+			call.Span = Span{Start: x.NodeSpan().Start, End: p.previousEnd()}
+			x = call
+
+		case Dot:
+			p.next()
+			sel := p.ident("after \".\"")
+			x = &SelectorExpr{X: x, Sel: sel, Span: Span{Start: x.NodeSpan().Start, End: sel.Span.End}}
+
+		default:
+			return x
+		}
+	}
+}
+
+func (p *Parser) parsePrimary() Expr {
+	t := p.next()
+
+	switch t.Kind {
+	case Identifier:
+		return &NameExpr{Name: &Ident{Name: t.Text, Span: t.Span}}
+
+	case Number:
+		value, err := strconv.Atoi(t.Text)
+		if err != nil {
+			p.fail(t.Span, "invalid number %s: %v", t.Text, err)
+		}
+
+		return &NumberLit{Value: value, Span: t.Span}
+
+	case String:
+		return &StringLit{Value: t.Text, Span: t.Span}
+
+	case LeftParen:
+		x := p.parseExpr()
+		p.expect(RightParen, "to close the parenthesized expression")
+		return x
+	}
+
+	p.fail(t.Span, "expected expression, got %s", describe(t))
+	return nil
+}
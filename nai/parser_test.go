@@ -0,0 +1,130 @@
+package nai
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFile_HelloWorld(t *testing.T) {
+	file, err := ParseFileFromPath("../examples/nai/hello_world.nai")
+	require.NoError(t, err)
+	require.Len(t, file.Decls, 3)
+
+	cat := file.Decls[0]
+	assert.Equal(t, "e_cat", cat.Name.Name)
+	assert.Equal(t, Entity, cat.Kind)
+
+	hello := file.Decls[1]
+	assert.Equal(t, "c_hello_world", hello.Name.Name)
+	assert.Equal(t, Comp, hello.Kind)
+	require.Len(t, hello.Fields, 1)
+	assert.Equal(t, "string", hello.Fields[0].Type.Name)
+	assert.Equal(t, "msg", hello.Fields[0].Name.Name)
+	assert.Equal(t, &StringLit{Value: "hello world", Span: Span{
+		Start: Pos{Offset: 63, Line: 6, Column: 18},
+		End:   Pos{Offset: 76, Line: 6, Column: 31},
+	}}, hello.Fields[0].Value)
+
+	require.Len(t, hello.Methods, 1)
+	say := hello.Methods[0]
+	assert.Equal(t, "say", say.Name.Name)
+	require.Len(t, say.Body.Stmts, 1)
+
+	call := say.Body.Stmts[0].(*ExprStmt).X.(*CallExpr)
+	assert.Equal(t, "println", call.Callee.(*NameExpr).Name.Name)
+	assert.Equal(t, "msg", call.Args[0].(*NameExpr).Name.Name)
+	assert.Equal(t, 9, call.Span.Start.Line)
+
+	printer := file.Decls[2]
+	assert.Equal(t, System, printer.Kind)
+	require.Len(t, printer.Query(), 1)
+	assert.Equal(t, "c_hello_world", printer.Query()[0].Name)
+	assert.Equal(t, 13, printer.Span.Start.Line)
+}
+
+func TestParseFile_Statements(t *testing.T) {
+	file, err := ParseFile("stmts.nai", `c :: comp {
+	int n = 1 + 2 * 3;
+	e_cat;
+	step(int by) {
+		int next = -n + by;
+		if next > 10 { n = 0; } else if next == 5 { return; } else { self.n = next; }
+		while n < 3 { n = n + 1; }
+		return n;
+	}
+}`)
+	require.NoError(t, err)
+
+	c := file.Decls[0]
+	require.Len(t, c.Components, 1)
+
+	sum := c.Fields[0].Value.(*BinaryExpr)
+	assert.Equal(t, Plus, sum.Op)
+	assert.Equal(t, Star, sum.Y.(*BinaryExpr).Op)
+
+	step := c.Methods[0]
+	require.Len(t, step.Params, 1)
+	assert.Equal(t, "by", step.Params[0].Name.Name)
+
+	stmts := step.Body.Stmts
+	require.Len(t, stmts, 4)
+	assert.IsType(t, &VarStmt{}, stmts[0])
+	assert.IsType(t, &UnaryExpr{}, stmts[0].(*VarStmt).Value.(*BinaryExpr).X)
+
+	ifStmt := stmts[1].(*IfStmt)
+	assert.IsType(t, &IfStmt{}, ifStmt.Else.Stmts[0])
+	assert.IsType(t, &SelectorExpr{}, ifStmt.Else.Stmts[0].(*IfStmt).Else.Stmts[0].(*AssignStmt).Target)
+
+	assert.IsType(t, &WhileStmt{}, stmts[2])
+	assert.IsType(t, &ReturnStmt{}, stmts[3])
+}
+
+func TestParseFile_Errors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected string
+		decls    int
+	}{
+		"Missing double colon": {
+			source:   "e_cat entity {}\nc :: comp {}",
+			expected: `1:7: expected "::" after declaration name, got "entity"`,
+			decls:    1,
+		},
+		"Unknown declaration kind": {
+			source:   "e_cat :: thing {}",
+			expected: `1:10: expected entity, comp or system after "::", got identifier "thing"`,
+		},
+		"Missing semicolon": {
+			source:   "c :: comp { string msg = \"hi\" }\ns :: system {}",
+			expected: `1:31: expected ";" after field declaration, got "}"`,
+			decls:    1,
+		},
+		"Unterminated declaration": {
+			source:   "c :: comp {\nstring msg;\ns :: system {}",
+			expected: `3:3: expected field, method or component after "s", got "::"`,
+			decls:    1,
+		},
+		"Bad attribute": {
+			source:   "[] s :: system {}",
+			expected: `1:2: expected identifier in attribute, got "]"`,
+			decls:    1,
+		},
+		"Missing expression": {
+			source:   "c :: comp { say() { println(; } }",
+			expected: `1:29: expected expression, got ";"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			file, err := ParseFile("errors.nai", tc.source)
+			require.Error(t, err)
+
+			list := err.(ErrorList)
+			assert.Equal(t, tc.expected, list[0].Error())
+			assert.Len(t, file.Decls, tc.decls)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package nai
+
+import "sort"
+
+type SymbolKind string
+
+const (
+	DeclSymbol    SymbolKind = "declaration"
+	FieldSymbol   SymbolKind = "field"
+	MethodSymbol  SymbolKind = "method"
+	ParamSymbol   SymbolKind = "parameter"
+	LocalSymbol   SymbolKind = "variable"
+	BuiltinSymbol SymbolKind = "builtin"
+)
+
+// Symbol is a named thing of a .nai program.
+type Symbol struct {
+	Name string
+	Kind SymbolKind
+	// Type is the type of fields, parameters and variables, and the kind
+	// of declarations.
+	Type string
+	// Decl is the declaration the symbol is, or is a member of. It is nil
+	// for builtins.
+	Decl *Decl
+	// Method is set for methods, parameters and variables.
+	Method *Method
+	// Span is the span of the name where the symbol is declared.
+	Span Span
+}
+
+// IsValue reports whether the symbol can be used in an expression.
+func (s *Symbol) IsValue() bool {
+	return s.Kind == FieldSymbol || s.Kind == ParamSymbol || s.Kind == LocalSymbol
+}
+
+// Scope maps names to symbols. Lookups which fail in a scope continue in
+// its parent.
+type Scope struct {
+	Parent   *Scope
+	Children []*Scope
+	Symbols  map[string]*Symbol
+	Span     Span
+}
+
+func NewScope(parent *Scope, span Span) *Scope {
+	s := &Scope{
+		Parent:  parent,
+		Symbols: make(map[string]*Symbol),
+		Span:    span,
+	}
+
+	if parent != nil {
+		parent.Children = append(parent.Children, s)
+	}
+
+	return s
+}
+
+// Insert adds a symbol to the scope. If the name is already declared in
+// this scope, the existing symbol is returned and nothing is added.
+func (s *Scope) Insert(symbol *Symbol) *Symbol {
+	if existing, ok := s.Symbols[symbol.Name]; ok {
+		return existing
+	}
+
+	s.Symbols[symbol.Name] = symbol
+
+	return nil
+}
+
+func (s *Scope) Lookup(name string) *Symbol {
+	for scope := s; scope != nil; scope = scope.Parent {
+		if symbol, ok := scope.Symbols[name]; ok {
+			return symbol
+		}
+	}
+
+	return nil
+}
+
+// Names returns the names visible from the scope which match keep, in
+// alphabetical order.
+func (s *Scope) Names(keep func(*Symbol) bool) []string {
+	seen := map[string]bool{}
+	names := []string{}
+
+	for scope := s; scope != nil; scope = scope.Parent {
+		for name, symbol := range scope.Symbols {
+			if seen[name] {
+				continue
+			}
+
+			seen[name] = true
+			if keep == nil || keep(symbol) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Innermost returns the deepest scope containing pos.
+func (s *Scope) Innermost(pos Pos) *Scope {
+	for _, child := range s.Children {
+		if child.Span.Start.Offset <= pos.Offset && pos.Offset <= child.Span.End.Offset {
+			return child.Innermost(pos)
+		}
+	}
+
+	return s
+}
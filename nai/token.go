@@ -0,0 +1,96 @@
+package nai
+
+import "fmt"
+
+// Pos is a position in a .nai source. Line and Column are 1-based,
+// Offset is the 0-based index of the rune in the source.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Span covers the source from Start up to, but not including, End.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+func (s Span) String() string {
+	return s.Start.String()
+}
+
+type Kind string
+
+const (
+	Illegal   Kind = "ILLEGAL"
+	EndOfFile Kind = "EOF"
+
+	Identifier Kind = "IDENTIFIER"
+	Number     Kind = "NUMBER"
+	String     Kind = "STRING"
+
+	DoubleColon Kind = "::"
+	Colon       Kind = ":"
+	Semicolon   Kind = ";"
+	Comma       Kind = ","
+	Dot         Kind = "."
+	Assign      Kind = "="
+
+	LeftBrace    Kind = "{"
+	RightBrace   Kind = "}"
+	LeftParen    Kind = "("
+	RightParen   Kind = ")"
+	LeftBracket  Kind = "["
+	RightBracket Kind = "]"
+
+	Plus     Kind = "+"
+	Minus    Kind = "-"
+	Star     Kind = "*"
+	Slash    Kind = "/"
+	Equal    Kind = "=="
+	NotEqual Kind = "!="
+	Less     Kind = "<"
+	Greater  Kind = ">"
+
+	Entity Kind = "entity"
+	Comp   Kind = "comp"
+	System Kind = "system"
+	Return Kind = "return"
+	If     Kind = "if"
+	Else   Kind = "else"
+	While  Kind = "while"
+)
+
+var keywords = map[string]Kind{
+	"entity": Entity,
+	"comp":   Comp,
+	"system": System,
+	"return": Return,
+	"if":     If,
+	"else":   Else,
+	"while":  While,
+}
+
+type Token struct {
+	Kind Kind
+	// Text is the identifier or number as written, or the unquoted value
+	// of a string literal.
+	Text string
+	Span Span
+}
+
+func (t Token) String() string {
+	switch t.Kind {
+	case Identifier, Number:
+		return fmt.Sprintf("%s [%s]", t.Kind, t.Text)
+	case String:
+		return fmt.Sprintf("%s [%q]", t.Kind, t.Text)
+	}
+
+	return string(t.Kind)
+}
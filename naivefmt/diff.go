@@ -0,0 +1,135 @@
+package naivefmt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change.
+const diffContext = 3
+
+type edit struct {
+	// kind is ' ' for a kept line, '-' for a removed and '+' for an added
+	// one.
+	kind byte
+	text string
+}
+
+// Diff returns a unified diff from a to b, or nil when they are equal.
+func Diff(name string, a []byte, b []byte) []byte {
+	if string(a) == string(b) {
+		return nil
+	}
+
+	edits := lineEdits(splitLines(string(a)), splitLines(string(b)))
+
+	out := strings.Builder{}
+	fmt.Fprintf(&out, "--- %s.orig\n+++ %s\n", name, name)
+
+	for i := 0; i < len(edits); {
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// A hunk goes from the change to diffContext kept lines after the
+		// last change that is close enough to be joined with it.
+		start := max(i-diffContext, 0)
+		end := i
+		for kept := 0; end < len(edits) && kept <= 2*diffContext; end++ {
+			if edits[end].kind == ' ' {
+				kept++
+			} else {
+				kept = 0
+			}
+		}
+
+		for end > i && edits[end-1].kind == ' ' {
+			end--
+		}
+
+		end = min(end+diffContext, len(edits))
+
+		writeHunk(&out, edits, start, end)
+		i = end
+	}
+
+	return []byte(out.String())
+}
+
+func writeHunk(out *strings.Builder, edits []edit, start int, end int) {
+	// Lines are numbered from 1 in both files.
+	aLine, bLine := 1, 1
+	for _, e := range edits[:start] {
+		if e.kind != '+' {
+			aLine++
+		}
+
+		if e.kind != '-' {
+			bLine++
+		}
+	}
+
+	aCount, bCount := 0, 0
+	for _, e := range edits[start:end] {
+		if e.kind != '+' {
+			aCount++
+		}
+
+		if e.kind != '-' {
+			bCount++
+		}
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount)
+	for _, e := range edits[start:end] {
+		fmt.Fprintf(out, "%c%s\n", e.kind, e.text)
+	}
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// lineEdits turns a into b along their longest common subsequence of lines.
+func lineEdits(a []string, b []string) []edit {
+	// common[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	edits := []edit{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+
+	return edits
+}
@@ -0,0 +1,288 @@
+// Package naivefmt formats naive assembly canonically, like `ambient fmt`.
+//
+// Labels are written `:label` flush left, every instruction goes on its own
+// indented line together with its operand, runs of blank lines collapse to
+// one and trailing comments of consecutive lines are aligned. Comments are
+// kept where they are. Constant and macro declarations stay flush left on
+// a line of their own.
+package naivefmt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+)
+
+const (
+	FileExtension = ".naive"
+
+	// Indent is written before every line that is not flush left.
+	Indent = "    "
+)
+
+// line is one line of formatted output. Lines holding only a comment have
+// no code.
+type line struct {
+	// flush is set for lines that are not indented.
+	flush   bool
+	code    string
+	comment string
+
+	// blank is set when an empty line goes before this one.
+	blank bool
+}
+
+// Source formats naive source code. It fails if the source does not lex.
+func Source(src []byte) ([]byte, error) {
+	l := lexer.NewLexer(string(src))
+	l.KeepComments = true
+	l.KeepMacros = true
+
+	tokens, err := l.Lex()
+	if err != nil {
+		return nil, err
+	}
+
+	// The end of file token has no position.
+	tokens = tokens[:len(tokens)-1]
+
+	out := []line{}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		blank, sameLine := false, false
+		if i > 0 {
+			blank = t.LineStart-tokens[i-1].LineEnd > 1
+			sameLine = t.LineStart == tokens[i-1].LineEnd
+		}
+
+		if t.Kind == token.Comment {
+			if sameLine {
+				last := &out[len(out)-1]
+				last.comment = strings.TrimSpace(last.comment + " " + t.StringValue)
+				continue
+			}
+
+			// A comment of its own is indented like the line after it.
+			out = append(out, line{flush: beforeFlushLeft(tokens[i+1:]), comment: t.StringValue, blank: blank})
+			continue
+		}
+
+		current := line{flush: flushLeft(t.Kind), code: t.Name, blank: blank}
+		if t.Kind == token.Label {
+			current.code = ":" + t.Name
+		}
+
+		// Declarations and macro uses keep their operands on one line.
+		end := i + 1
+		switch {
+		case t.Kind == token.Const:
+			end = expressionEnd(tokens, min(i+3, len(tokens)))
+		case t.Kind == token.Macro:
+			end = parenthesesEnd(tokens, min(i+2, len(tokens)))
+		case t.Kind == token.Identifier:
+			end = parenthesesEnd(tokens, i+1)
+		}
+
+		effect, ok := token.EffectOf(t.Kind)
+		switch {
+		case end > i+1:
+			current.code = join(tokens[i:end])
+			i = end - 1
+
+		case ok && effect.Operand != "":
+			// Comments between an instruction and its operand end up
+			// after both.
+			operand := i + 1
+			for operand < len(tokens) && tokens[operand].Kind == token.Comment {
+				operand++
+			}
+
+			if operand < len(tokens) && isOperand(tokens[operand]) {
+				comments := []string{}
+				for _, c := range tokens[i+1 : operand] {
+					comments = append(comments, c.StringValue)
+				}
+
+				current.code += " " + operandString(tokens[operand])
+				current.comment = strings.Join(comments, " ")
+				i = operand
+			}
+		}
+
+		out = append(out, current)
+	}
+
+	return render(out), nil
+}
+
+func isOperand(t token.Token) bool {
+	return t.Kind == token.Number || t.Kind == token.Identifier || t.Kind == token.String
+}
+
+func operandString(t token.Token) string {
+	if t.Kind == token.String {
+		return token.Quote(t.StringValue)
+	}
+
+	return t.Name
+}
+
+// expressionEnd returns the index after the constant expression starting
+// at start.
+func expressionEnd(tokens []token.Token, start int) int {
+	end := start
+	for end < len(tokens) && tokens[end].Kind != token.Comment {
+		previous := tokens[end-1]
+		afterOperator := previous.Kind == token.Operator && previous.Name != ")"
+
+		if end > start && !afterOperator && tokens[end].Kind != token.Operator {
+			break
+		}
+
+		end++
+	}
+
+	return end
+}
+
+// parenthesesEnd returns the index after the parentheses opening at start,
+// or start if there are none.
+func parenthesesEnd(tokens []token.Token, start int) int {
+	if start >= len(tokens) || tokens[start].Kind != token.Operator || tokens[start].Name != "(" {
+		return start
+	}
+
+	depth := 0
+	for end := start; end < len(tokens) && tokens[end].Kind != token.Comment; end++ {
+		switch {
+		case tokens[end].Kind != token.Operator:
+		case tokens[end].Name == "(":
+			depth++
+		case tokens[end].Name == ")":
+			depth--
+		}
+
+		if depth == 0 {
+			return end + 1
+		}
+	}
+
+	return start
+}
+
+// join writes tokens on one line: parentheses hug what they hold, commas
+// are followed by a space and everything else is spaced apart.
+func join(tokens []token.Token) string {
+	b := strings.Builder{}
+
+	for i, t := range tokens {
+		if i > 0 && spaced(tokens[:i], t) {
+			b.WriteString(" ")
+		}
+
+		b.WriteString(operandString(t))
+	}
+
+	return b.String()
+}
+
+func spaced(before []token.Token, t token.Token) bool {
+	previous := before[len(before)-1]
+
+	switch {
+	case t.Kind == token.Operator && (t.Name == ")" || t.Name == ","):
+		return false
+	case previous.Kind == token.Operator && previous.Name == "(":
+		return false
+	case previous.Kind == token.Operator && previous.Name == "-":
+		// Unary minus, after another operator or the start of a value.
+		if len(before) == 1 {
+			return false
+		}
+
+		operand := before[len(before)-2]
+		return operand.Kind != token.Operator || operand.Name == ")"
+	case t.Kind == token.Operator && t.Name == "(":
+		// A macro is used or declared as name(...).
+		return previous.Kind == token.Operator
+	}
+
+	return true
+}
+
+// beforeFlushLeft reports whether the next token that is not a comment
+// starts a line flush left, or there is none.
+func beforeFlushLeft(tokens []token.Token) bool {
+	for _, t := range tokens {
+		if t.Kind != token.Comment {
+			return flushLeft(t.Kind)
+		}
+	}
+
+	return true
+}
+
+// flushLeft reports whether the lines starting with a kind of token are
+// not indented: labels and the declarations of constants and macros.
+func flushLeft(kind token.Kind) bool {
+	return kind == token.Label || kind == token.Const || kind == token.Macro || kind == token.EndMacro
+}
+
+// render writes the lines, aligning the trailing comments of consecutive
+// lines that have one.
+func render(lines []line) []byte {
+	b := strings.Builder{}
+
+	for i := 0; i < len(lines); {
+		// The run of lines having both code and a trailing comment.
+		end := i + 1
+		width := len([]rune(prefix(lines[i])))
+		if lines[i].code != "" && lines[i].comment != "" {
+			for end < len(lines) && lines[end].code != "" && lines[end].comment != "" && !lines[end].blank {
+				width = max(width, len([]rune(prefix(lines[end]))))
+				end++
+			}
+		}
+
+		for _, l := range lines[i:end] {
+			if l.blank {
+				b.WriteString("\n")
+			}
+
+			code := prefix(l)
+			switch {
+			case l.code == "":
+				b.WriteString(code + l.comment)
+			case l.comment == "":
+				b.WriteString(code)
+			default:
+				fmt.Fprintf(&b, "%-*s %s", width, code, l.comment)
+			}
+
+			b.WriteString("\n")
+		}
+
+		i = end
+	}
+
+	return []byte(b.String())
+}
+
+// prefix returns the indented code of a line.
+func prefix(l line) string {
+	if l.flush {
+		return l.code
+	}
+
+	return Indent + l.code
+}
+
+// Discover returns every naive source file under the given paths. Paths
+// naming a file are returned as is.
+func Discover(paths ...string) ([]string, error) {
+	return lexer.Discover(FileExtension, paths...)
+}
@@ -0,0 +1,114 @@
+package naivefmt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "Instructions",
+			source:   "psh 1 psh\n2 sum",
+			expected: "    psh 1\n    psh 2\n    sum\n",
+		},
+		{
+			name:     "Labels",
+			source:   "  : start psh 1\n:end jmp start",
+			expected: ":start\n    psh 1\n:end\n    jmp start\n",
+		},
+		{
+			name:     "Blank lines",
+			source:   "\n\npsh 1\n\n\n\npsh 2\n\n",
+			expected: "    psh 1\n\n    psh 2\n",
+		},
+		{
+			name:     "Trailing comments",
+			source:   "psh 1 // one\npsh 22 // two\nsum\npsh 3 /* three */",
+			expected: "    psh 1  // one\n    psh 22 // two\n    sum\n    psh 3 /* three */\n",
+		},
+		{
+			name:     "Leading comments",
+			source:   "// head\n\n:main\n  // push\n psh 1\n// tail",
+			expected: "// head\n\n:main\n    // push\n    psh 1\n// tail\n",
+		},
+		{
+			name:     "Comment before operand",
+			source:   "psh /* one */ 1",
+			expected: "    psh 1 /* one */\n",
+		},
+		{
+			name:     "Macros",
+			source:   "// Sum.\nconst  N=2*(3+ -1)\nmacro add ( a,b ) psh a psh b sum endmacro\n  add( 1 , -N) // c",
+			expected: "// Sum.\nconst N = 2 * (3 + -1)\nmacro add(a, b)\n    psh a\n    psh b\n    sum\nendmacro\n    add(1, -N) // c\n",
+		},
+		{
+			name:     "Empty",
+			source:   "",
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := Source([]byte(test.source))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(actual))
+
+			again, err := Source(actual)
+			require.NoError(t, err)
+			assert.Equal(t, string(actual), string(again), "formatting is not idempotent")
+		})
+	}
+}
+
+func TestSource_KeepsTokens(t *testing.T) {
+	files, err := Discover("../examples")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		formatted, err := Source(src)
+		require.NoError(t, err, file)
+
+		before, err := lexer.LoadSource(src)
+		require.NoError(t, err, file)
+		after, err := lexer.LoadSource(formatted)
+		require.NoError(t, err, file)
+		require.Len(t, after, len(before), file)
+
+		for i := range before {
+			assert.Equal(t, before[i].Kind, after[i].Kind, file)
+			assert.Equal(t, before[i].Name, after[i].Name, file)
+		}
+	}
+}
+
+func TestSource_Error(t *testing.T) {
+	_, err := Source([]byte("psh 1 /* never closed"))
+	assert.Error(t, err)
+}
+
+func TestDiff(t *testing.T) {
+	assert.Nil(t, Diff("a.naive", []byte("sum\n"), []byte("sum\n")))
+
+	expected := `--- a.naive.orig
++++ a.naive
+@@ -1,2 +1,2 @@
+-psh 1
++    psh 1
+ :end
+`
+	assert.Equal(t, expected, string(Diff("a.naive", []byte("psh 1\n:end\n"), []byte("    psh 1\n:end\n"))))
+}
@@ -0,0 +1,588 @@
+// Package naiveopt optimizes assembled naive programs with peephole
+// passes, like `ambient -build -O2`.
+//
+// The passes run on the resolved program, once files are included and
+// macros and labels are expanded, before it is run or written as a
+// binary:
+//
+//   - O1 folds constant arithmetic and branches, threads jumps which lead
+//     to other jumps, and removes unreachable code and unused labels. It
+//     selects the superinstructions for the pairs loops are made of:
+//     `psh N sum` becomes `addi N`, `eq jif label` becomes `jeq label` and
+//     `dupl 1 dupl 1` becomes `dup2`.
+//   - O2 also fuses runs of instructions into fewer ones, like
+//     `addi 2 addi 3` into `addi 5`, and drops the ones which do nothing,
+//     like `psh 0 sum`.
+//
+// Expand turns the superinstructions back into the pairs they stand for.
+//
+// Every instruction keeps the position of the source it comes from, a
+// folded one the position of the first instruction folded into it, so
+// errors, the profiler and the coverage still point to the source. The
+// references to labels are relocated. A program with an operand the passes
+// do not understand, like a jump to a number, is left as it is.
+package naiveopt
+
+import (
+	"strconv"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// Level is how hard the program is optimized.
+type Level int
+
+const (
+	// O0 leaves the program as it is.
+	O0 Level = iota
+	// O1 folds constants, threads jumps, removes dead code and selects
+	// superinstructions.
+	O1
+	// O2 also fuses instructions.
+	O2
+)
+
+// maxRounds bounds how many times the passes run. Each round can open new
+// chances for the others, but programs settle in a few.
+const maxRounds = 16
+
+// instruction is an instruction with its operand, a label or an end of
+// file.
+type instruction struct {
+	token.Token
+	operand    token.Token
+	hasOperand bool
+
+	// address is where the instruction was in the input program. The
+	// references to labels point to the address of the label until the
+	// program is laid out again.
+	address int
+}
+
+// Program returns the program optimized at level. The program passed in is
+// not changed.
+func Program(program []token.Token, level Level) []token.Token {
+	if level <= O0 {
+		return program
+	}
+
+	instructions, ok := decode(program)
+	if !ok {
+		return program
+	}
+
+	for round := 0; round < maxRounds; round++ {
+		changed := false
+
+		for _, pass := range []func([]instruction, Level) ([]instruction, bool){
+			removeUnusedLabels, fold, threadJumps, removeDeadCode,
+		} {
+			var passChanged bool
+			instructions, passChanged = pass(instructions, level)
+			changed = changed || passChanged
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return encode(instructions)
+}
+
+// decode splits the program into instructions. It fails on tokens which
+// are not instructions of a resolved program, and on references which do
+// not point to a label.
+func decode(program []token.Token) ([]instruction, bool) {
+	instructions := make([]instruction, 0, len(program))
+
+	for i := 0; i < len(program); i++ {
+		in := instruction{Token: program[i], address: i}
+
+		switch in.Kind {
+		case token.Label, token.EndOfLine:
+
+		case token.Include, token.Export, token.Const, token.Macro, token.EndMacro:
+			return nil, false
+
+		default:
+			effect, ok := token.EffectOf(in.Kind)
+			if !ok {
+				return nil, false
+			}
+
+			if effect.Operand == "" {
+				break
+			}
+
+			if i+1 >= len(program) {
+				return nil, false
+			}
+
+			i++
+			in.operand, in.hasOperand = program[i], true
+
+			switch in.operand.Kind {
+			case token.Identifier:
+				target := in.operand.IntegerValue
+				if target >= len(program) || (target >= 0 && program[target].Kind != token.Label) {
+					return nil, false
+				}
+
+			case token.Number:
+				if effect.Operand == "label" {
+					return nil, false
+				}
+
+			default:
+				return nil, false
+			}
+		}
+
+		instructions = append(instructions, in)
+	}
+
+	return instructions, true
+}
+
+// encode lays the instructions out again and relocates the references to
+// labels.
+func encode(instructions []instruction) []token.Token {
+	addresses := make(map[int]int)
+
+	address := 0
+	for _, in := range instructions {
+		if in.Kind == token.Label {
+			addresses[in.address] = address
+		}
+
+		address++
+		if in.hasOperand {
+			address++
+		}
+	}
+
+	program := make([]token.Token, 0, address)
+	for _, in := range instructions {
+		program = append(program, in.Token)
+
+		if !in.hasOperand {
+			continue
+		}
+
+		operand := in.operand
+		if target, ok := reference(in); ok {
+			operand.IntegerValue = addresses[target]
+		}
+
+		program = append(program, operand)
+	}
+
+	return program
+}
+
+// reference returns the address of the label the operand of an
+// instruction names.
+func reference(in instruction) (int, bool) {
+	if !in.hasOperand || in.operand.Kind != token.Identifier || in.operand.IntegerValue < 0 {
+		return 0, false
+	}
+
+	return in.operand.IntegerValue, true
+}
+
+// labels maps the addresses of the labels to their index.
+func labels(instructions []instruction) map[int]int {
+	indexes := make(map[int]int)
+	for i, in := range instructions {
+		if in.Kind == token.Label {
+			indexes[in.address] = i
+		}
+	}
+
+	return indexes
+}
+
+func isFlow(kind token.Kind) bool {
+	switch kind {
+	case token.Jump, token.JumpIfTrue, token.JumpIfEqual, token.Call:
+		return true
+	}
+
+	return false
+}
+
+// removeUnusedLabels removes the labels nothing refers to.
+func removeUnusedLabels(instructions []instruction, _ Level) ([]instruction, bool) {
+	used := make(map[int]bool)
+	for _, in := range instructions {
+		if target, ok := reference(in); ok {
+			used[target] = true
+		}
+	}
+
+	kept := instructions[:0:0]
+	for _, in := range instructions {
+		if in.Kind != token.Label || used[in.address] {
+			kept = append(kept, in)
+		}
+	}
+
+	return kept, len(kept) != len(instructions)
+}
+
+// fold replaces runs of instructions by fewer ones computing the same.
+// Labels split runs, as something may jump between the instructions.
+func fold(instructions []instruction, level Level) ([]instruction, bool) {
+	folded := make([]instruction, 0, len(instructions))
+	changed := false
+
+	for _, in := range instructions {
+		folded = append(folded, in)
+
+		for {
+			var ok bool
+			if folded, ok = reduce(folded, level); !ok {
+				break
+			}
+
+			changed = true
+		}
+	}
+
+	return folded, changed
+}
+
+// reduce folds the instructions at the end of folded, if it can.
+func reduce(folded []instruction, level Level) ([]instruction, bool) {
+	n := len(folded)
+	at := func(i int) instruction {
+		return folded[n-i]
+	}
+
+	// psh a psh b op -> psh (a op b)
+	if n >= 3 && isNumber(at(3)) && isNumber(at(2)) {
+		if value, ok := evaluate(at(1).Kind, at(3).operand.IntegerValue, at(2).operand.IntegerValue); ok {
+			return append(folded[:n-3], withValue(at(3), value)), true
+		}
+	}
+
+	// psh x pop ->
+	if n >= 2 && at(2).Kind == token.Push && at(1).Kind == token.Pop {
+		return folded[:n-2], true
+	}
+
+	// psh 1 jif l -> psh 1 jmp l, psh 0 jif l -> psh 0
+	if n >= 2 && isNumber(at(2)) && at(1).Kind == token.JumpIfTrue {
+		if at(2).operand.IntegerValue != 1 {
+			return folded[:n-1], true
+		}
+
+		folded[n-1] = withKind(at(1), token.Jump)
+		return folded, true
+	}
+
+	// psh a addi b -> psh a+b
+	if n >= 2 && isNumber(at(2)) && at(1).Kind == token.AddImmediate {
+		return append(folded[:n-2], withValue(at(2), at(2).operand.IntegerValue+at(1).operand.IntegerValue)), true
+	}
+
+	// psh 0 sum ->, psh 1 mul ->
+	if level >= O2 && n >= 2 && isNumber(at(2)) && isIdentity(at(1).Kind, at(2).operand.IntegerValue) {
+		return folded[:n-2], true
+	}
+
+	// psh n sum -> addi n, psh n sub -> addi -n
+	if n >= 2 && isNumber(at(2)) && (at(1).Kind == token.Sum || at(1).Kind == token.Subtract) {
+		value := at(2).operand.IntegerValue
+		if at(1).Kind == token.Subtract {
+			value = -value
+		}
+
+		return append(folded[:n-2], withValue(withKind(at(2), token.AddImmediate), value)), true
+	}
+
+	// eq jif l -> jeq l
+	if n >= 2 && at(2).Kind == token.Equal && at(1).Kind == token.JumpIfTrue {
+		jeq := withKind(at(2), token.JumpIfEqual)
+		jeq.operand, jeq.hasOperand = at(1).operand, at(1).hasOperand
+
+		return append(folded[:n-2], jeq), true
+	}
+
+	// dupl 1 dupl 1 -> dup2
+	if n >= 2 && isDuplicate(at(2), 1) && isDuplicate(at(1), 1) {
+		dup2 := withKind(at(2), token.DuplicatePair)
+		dup2.operand, dup2.hasOperand = token.Token{}, false
+
+		return append(folded[:n-2], dup2), true
+	}
+
+	if level < O2 {
+		return folded, false
+	}
+
+	// addi 0 ->
+	if n >= 1 && at(1).Kind == token.AddImmediate && at(1).operand.IntegerValue == 0 {
+		return folded[:n-1], true
+	}
+
+	// addi a addi b -> addi a+b
+	if n >= 2 && at(2).Kind == token.AddImmediate && at(1).Kind == token.AddImmediate {
+		return append(folded[:n-2], withValue(at(2), at(2).operand.IntegerValue+at(1).operand.IntegerValue)), true
+	}
+
+	// dupl 0 pop ->
+	if n >= 2 && isDuplicate(at(2), 0) && at(1).Kind == token.Pop {
+		return folded[:n-2], true
+	}
+
+	// psh a mul psh b mul -> psh a*b mul
+	if n >= 4 && isNumber(at(4)) && isNumber(at(2)) && at(3).Kind == token.Multiply && at(1).Kind == token.Multiply {
+		a, b := at(4).operand.IntegerValue, at(2).operand.IntegerValue
+		return append(folded[:n-4], withValue(at(4), a*b), at(3)), true
+	}
+
+	return folded, false
+}
+
+// isNumber reports whether an instruction pushes a number. Pushed labels
+// are not numbers, their address changes with the layout.
+func isNumber(in instruction) bool {
+	return in.Kind == token.Push && in.operand.Kind == token.Number
+}
+
+// isDuplicate reports whether an instruction is `dupl offset`.
+func isDuplicate(in instruction, offset int) bool {
+	return in.Kind == token.Duplicate && in.operand.Kind == token.Number && in.operand.IntegerValue == offset
+}
+
+// evaluate computes a op b. Division by zero is not folded, so that it
+// still fails when it runs.
+func evaluate(kind token.Kind, a, b int) (int, bool) {
+	switch kind {
+	case token.Sum:
+		return a + b, true
+	case token.Subtract:
+		return a - b, true
+	case token.Multiply:
+		return a * b, true
+	case token.Divide:
+		if b == 0 {
+			return 0, false
+		}
+
+		return a / b, true
+	case token.Equal:
+		return boolToInt(a == b), true
+	case token.Less:
+		return boolToInt(a < b), true
+	case token.Greater:
+		return boolToInt(a > b), true
+	}
+
+	return 0, false
+}
+
+// isIdentity reports whether applying op with value leaves the top of the
+// stack as it is.
+func isIdentity(kind token.Kind, value int) bool {
+	switch kind {
+	case token.Sum, token.Subtract:
+		return value == 0
+	case token.Multiply, token.Divide:
+		return value == 1
+	}
+
+	return false
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// withValue returns the push with another value, at the same position.
+func withValue(in instruction, value int) instruction {
+	in.operand.Kind = token.Number
+	in.operand.SetIndentValue(strconv.Itoa(value))
+	in.operand.IntegerValue = value
+
+	return in
+}
+
+// withKind returns the instruction as another one, at the same position.
+func withKind(in instruction, kind token.Kind) instruction {
+	in.Kind = kind
+	in.SetIndentValue(in.DetectMyString())
+
+	return in
+}
+
+// threadJumps points jumps and calls leading to a jump straight to its
+// target, turns jumps to a return into returns, and removes jumps to the
+// next instruction.
+func threadJumps(instructions []instruction, _ Level) ([]instruction, bool) {
+	indexes := labels(instructions)
+	changed := false
+
+	// first returns the index of the first instruction which is not a
+	// label from i.
+	first := func(i int) int {
+		for i < len(instructions) && instructions[i].Kind == token.Label {
+			i++
+		}
+
+		return i
+	}
+
+	threaded := make([]instruction, 0, len(instructions))
+	for i, in := range instructions {
+		target, ok := reference(in)
+		if !ok || !isFlow(in.Kind) {
+			threaded = append(threaded, in)
+			continue
+		}
+
+		visited := map[int]bool{target: true}
+		for {
+			next := first(indexes[target])
+			if next >= len(instructions) || instructions[next].Kind != token.Jump {
+				break
+			}
+
+			further, ok := reference(instructions[next])
+			if !ok || visited[further] {
+				break
+			}
+
+			visited[further] = true
+			target = further
+		}
+
+		if target != in.operand.IntegerValue {
+			label := instructions[indexes[target]]
+			in.operand.SetIndentValue(label.Name)
+			in.operand.IntegerValue = target
+			changed = true
+		}
+
+		if in.Kind == token.Jump {
+			next := first(indexes[target])
+
+			if next == first(i+1) {
+				changed = true
+				continue
+			}
+
+			if next < len(instructions) && instructions[next].Kind == token.Return {
+				ret := withKind(in, token.Return)
+				ret.operand, ret.hasOperand = token.Token{}, false
+				threaded = append(threaded, ret)
+				changed = true
+				continue
+			}
+		}
+
+		threaded = append(threaded, in)
+	}
+
+	return threaded, changed
+}
+
+// removeDeadCode removes the instructions no path from the start of the
+// program reaches. Labels used as values, by `system` or `psh` for
+// example, start paths too, and are kept with the ends of files.
+func removeDeadCode(instructions []instruction, _ Level) ([]instruction, bool) {
+	indexes := labels(instructions)
+	reachable := make([]bool, len(instructions))
+	used := make(map[int]bool)
+	pending := []int{0}
+
+	for _, in := range instructions {
+		if target, ok := reference(in); ok {
+			used[target] = true
+
+			if !isFlow(in.Kind) {
+				pending = append(pending, indexes[target])
+			}
+		}
+	}
+
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for i < len(instructions) && !reachable[i] {
+			reachable[i] = true
+			in := instructions[i]
+
+			target, ok := reference(in)
+			if ok && isFlow(in.Kind) {
+				pending = append(pending, indexes[target])
+			}
+
+			switch in.Kind {
+			case token.Jump, token.Return, token.EndOfLine:
+				i = len(instructions)
+			default:
+				i++
+			}
+		}
+	}
+
+	kept := instructions[:0:0]
+	for i, in := range instructions {
+		if reachable[i] || in.Kind == token.EndOfLine || (in.Kind == token.Label && used[in.address]) {
+			kept = append(kept, in)
+		}
+	}
+
+	return kept, len(kept) != len(instructions)
+}
+
+// Expand replaces the superinstructions of a program by the instructions
+// they stand for, like the disassembler shows them with -expand. The
+// expanded instructions keep the position of the superinstruction. A
+// program the passes do not understand is left as it is.
+func Expand(program []token.Token) []token.Token {
+	instructions, ok := decode(program)
+	if !ok {
+		return program
+	}
+
+	expanded := make([]instruction, 0, len(instructions))
+	for _, in := range instructions {
+		switch in.Kind {
+		case token.AddImmediate:
+			push, sum := withKind(in, token.Push), withKind(in, token.Sum)
+			if in.operand.IntegerValue < 0 {
+				push, sum = withValue(push, -in.operand.IntegerValue), withKind(in, token.Subtract)
+			}
+
+			sum.operand, sum.hasOperand = token.Token{}, false
+			expanded = append(expanded, push, sum)
+
+		case token.JumpIfEqual:
+			eq := withKind(in, token.Equal)
+			eq.operand, eq.hasOperand = token.Token{}, false
+
+			expanded = append(expanded, eq, withKind(in, token.JumpIfTrue))
+
+		case token.DuplicatePair:
+			dupl := withKind(in, token.Duplicate)
+			dupl.operand, dupl.hasOperand = in.Token, true
+			dupl = withValue(dupl, 1)
+
+			expanded = append(expanded, dupl, dupl)
+
+		default:
+			expanded = append(expanded, in)
+		}
+	}
+
+	return encode(expanded)
+}
@@ -0,0 +1,201 @@
+package naiveopt
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/nai"
+	"github.com/jejikeh/ambient/token"
+	"github.com/jejikeh/ambient/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// render writes a program back as source, with labels by name.
+func render(program []token.Token) string {
+	words := []string{}
+	for _, t := range program {
+		switch t.Kind {
+		case token.Label:
+			words = append(words, ":"+t.Name)
+		case token.Identifier:
+			words = append(words, t.Name)
+		case token.EndOfLine:
+		default:
+			words = append(words, t.DetectMyString())
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+func TestProgram(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  Level
+		source string
+		want   string
+	}{
+		{"O0", O0, "psh 1 psh 1 sum", "psh 1 psh 1 sum"},
+		{"Constant folding", O1, "psh 1 psh 1 sum psh 3 mul psh 4 gt", "psh 1"},
+		{"Division by zero is not folded", O1, "psh 1 psh 0 div", "psh 1 psh 0 div"},
+		{"Pushed labels are not folded", O1, "psh l psh 1 mul :l", "psh l psh 1 mul :l"},
+		{"Push then pop", O1, "psh 1 psh 2 pop", "psh 1"},
+		{"Branch folding", O1, "psh 0 jif a psh 1 jif b :a out :b out", "psh 0 psh 1 out"},
+		{"Labels split runs", O1, "psh 1 :l psh 2 mul jmp l", "psh 1 :l psh 2 mul jmp l"},
+		{"Jump threading", O1, "jif a out :a jmp b :b jmp c :c psh 1 jmp a", "jif c out :c psh 1 jmp c"},
+		{"Jump to the next instruction", O1, "psh 1 jmp next :next out", "psh 1 out"},
+		{"Jump to a return", O1, "call f out :f psh 1 jif end jmp end :end ret", "call f out :f psh 1 ret"},
+		{"Dead code", O1, "psh 1 jmp end psh 2 out :end", "psh 1"},
+		{"Unused labels", O1, "psh x :unused psh 2 :x", "psh x psh 2 :x"},
+		{"Labels used as values are kept", O1, "psh 0 system s jmp end :s ret :end", "psh 0 system s jmp end :s ret :end"},
+		{"Endless loop", O1, ":l jmp l", ":l jmp l"},
+		{"Calls come back", O1, "call f jmp end :f psh 1 ret :end", "call f jmp end :f psh 1 ret :end"},
+		{"Identity is removed at O2", O2, "dupl 0 psh 0 sum psh 1 mul", "dupl 0"},
+		{"Identity is kept at O1", O1, "dupl 0 psh 1 mul", "dupl 0 psh 1 mul"},
+		{"Fusion", O2, "dupl 0 psh 2 sum psh 3 sum psh 2 mul psh 4 mul psh 1 sub psh 2 sub", "dupl 0 addi 5 psh 8 mul addi -3"},
+		{"Duplicate then pop", O2, "psh 1 dupl 0 pop", "psh 1"},
+		{"Add immediate", O1, "dupl 0 psh 2 sum psh 3 sub", "dupl 0 addi 2 addi -3"},
+		{"Add immediate of a push", O1, "psh 1 dupl 0 psh 2 sum", "psh 1 dupl 0 addi 2"},
+		{"Add zero is removed at O2", O2, "dupl 0 psh 2 sum psh 2 sub", "dupl 0"},
+		{"Jump if equal", O1, ":l dupl 0 psh 3 eq jif l out", ":l dupl 0 psh 3 jeq l out"},
+		{"Jump if equal across a label", O1, "eq :l jif l", "eq :l jif l"},
+		{"Duplicate pair", O1, "psh 1 psh 2 dupl 1 dupl 1 sum", "psh 1 psh 2 dup2 sum"},
+		{"Duplicate pair of other offsets", O1, "dupl 1 dupl 0", "dupl 1 dupl 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := lexer.NewLexer(test.source).Lex()
+			require.NoError(t, err)
+
+			optimized := Program(program, test.level)
+			assert.Equal(t, test.want, render(optimized))
+
+			// The labels are relocated.
+			for _, tok := range optimized {
+				if tok.Kind == token.Identifier && tok.IntegerValue >= 0 {
+					require.Less(t, tok.IntegerValue, len(optimized))
+					assert.Equal(t, token.Kind(token.Label), optimized[tok.IntegerValue].Kind)
+					assert.Equal(t, tok.Name, optimized[tok.IntegerValue].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestProgram_SourceMap(t *testing.T) {
+	program, err := lexer.NewLexer("dupl 0\npsh 1\npsh 2\nsum\nsum\njmp end\n:end\nout").Lex()
+	require.NoError(t, err)
+
+	optimized := Program(program, O2)
+	require.Equal(t, "dupl 0 addi 3 out", render(optimized))
+
+	// The folded instruction keeps the position of the first push, the
+	// rest keep their own.
+	assert.Equal(t, 1, optimized[2].LineStart)
+	assert.Equal(t, 1, optimized[3].LineStart)
+	assert.Equal(t, 7, optimized[4].LineStart)
+}
+
+func TestExpand(t *testing.T) {
+	program, err := lexer.NewLexer("dupl 0\naddi 2\n:l\ndup2\njeq l\nout").Lex()
+	require.NoError(t, err)
+
+	expanded := Expand(program)
+	require.Equal(t, "dupl 0 psh 2 sum :l dupl 1 dupl 1 eq jif l out", render(expanded))
+
+	// The expanded instructions keep the position of the superinstruction.
+	assert.Equal(t, 1, expanded[2].LineStart)
+	assert.Equal(t, 1, expanded[4].LineStart)
+	assert.Equal(t, 3, expanded[8].LineStart)
+	assert.Equal(t, 4, expanded[11].LineStart)
+
+	// The label is relocated.
+	assert.Equal(t, 5, expanded[12].IntegerValue)
+
+	// Expanding gives back what the optimizer was given.
+	source, err := lexer.NewLexer(":l dupl 0 psh 2 sum psh 1 sub dupl 1 dupl 1 eq jif l out").Lex()
+	require.NoError(t, err)
+	assert.Equal(t, render(source), render(Expand(Program(source, O1))))
+}
+
+func TestProgram_LeavesUnknownPrograms(t *testing.T) {
+	// A jump to a number can not be relocated.
+	program, err := lexer.NewLexer("psh 1 psh 1 sum jmp 0").Lex()
+	require.NoError(t, err)
+	assert.Equal(t, program, Program(program, O2))
+
+	program, err = lexer.NewLexer("psh").Lex()
+	require.NoError(t, err)
+	assert.Equal(t, program, Program(program, O2))
+
+	input := append([]token.Token{}, program...)
+	Program(program, O2)
+	assert.Equal(t, input, program, "the program is not changed")
+}
+
+type result struct {
+	Stack  []int
+	Memory []int
+	Output string
+	Err    vm.Error
+}
+
+func run(program []token.Token) result {
+	var out bytes.Buffer
+
+	v := vm.NewVirtualMachine()
+	v.Output = &out
+	v.Workers = 1
+	v.LoadProgram(program)
+	err := v.ExecuteFrom(0, 1000000, nil)
+
+	return result{Stack: v.Stack, Memory: v.Memory, Output: out.String(), Err: err}
+}
+
+// TestProgram_Examples checks that the examples do the same at every
+// level.
+func TestProgram_Examples(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	err := filepath.WalkDir("../examples", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		var program []token.Token
+		switch filepath.Ext(path) {
+		case ".naive":
+			program, err = lexer.LoadFile(path)
+		case ".nai":
+			var file *nai.File
+			if file, err = nai.ParseFileFromPath(path); err == nil {
+				program, err = nai.CompileToTokens(file)
+			}
+		default:
+			return nil
+		}
+
+		require.NoError(t, err, path)
+
+		want := run(program)
+		for _, level := range []Level{O1, O2} {
+			optimized := Program(program, level)
+			assert.Equal(t, want, run(optimized), "%s at O%d", path, level)
+			assert.LessOrEqual(t, len(optimized), len(program))
+		}
+
+		return nil
+	})
+
+	require.NoError(t, err)
+}
@@ -0,0 +1,174 @@
+// Package naivetest discovers and runs tests written in naive assembly.
+//
+// A test file is any file ending in `_test.naive`. Every label starting
+// with `test_` declares a test, which runs from its label until the next
+// test label or the end of the file, in a fresh VirtualMachine.
+package naivetest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+	"github.com/jejikeh/ambient/vm"
+)
+
+const (
+	FileSuffix = "_test.naive"
+	TestPrefix = "test_"
+
+	// DefaultBudget is the number of instructions a single test may run
+	// before it is considered stuck.
+	DefaultBudget = 100000
+)
+
+type Result struct {
+	File     string
+	Name     string
+	Passed   bool
+	Err      error
+	Duration time.Duration
+}
+
+type Summary struct {
+	Results []Result
+	Passed  int
+	Failed  int
+}
+
+// Discover returns every test file under the given paths. Paths naming a
+// file are returned as is.
+func Discover(paths ...string) ([]string, error) {
+	return lexer.Discover(FileSuffix, paths...)
+}
+
+// Tests returns the test labels of a program in the order they are
+// declared, with IntegerValue set to the address of each label. Tests of
+// included files are left to their own test files.
+func Tests(program []token.Token) []token.Token {
+	tests := []token.Token{}
+
+	for i, t := range program {
+		if t.Kind == token.Label && t.File == "" && strings.HasPrefix(t.Name, TestPrefix) {
+			t.IntegerValue = i
+			tests = append(tests, t)
+		}
+	}
+
+	return tests
+}
+
+// RunProgram runs every test of an already tokenized program.
+func RunProgram(file string, program []token.Token, budget int) []Result {
+	tests := Tests(program)
+
+	// Instructions jump past labels, so a test ends once it reaches the
+	// first instruction of another test.
+	isTestStart := make(map[int]bool, len(tests))
+	for _, t := range tests {
+		isTestStart[firstInstruction(program, t.IntegerValue)] = true
+	}
+
+	results := make([]Result, 0, len(tests))
+	for _, t := range tests {
+		results = append(results, runTest(file, program, t, budget, isTestStart))
+	}
+
+	return results
+}
+
+// firstInstruction returns the address of the first instruction from the
+// label at address on.
+func firstInstruction(program []token.Token, address int) int {
+	for address < len(program) && program[address].Kind == token.Label {
+		address++
+	}
+
+	return address
+}
+
+func runTest(file string, program []token.Token, test token.Token, budget int, isTestStart map[int]bool) Result {
+	result := Result{File: file, Name: test.Name}
+
+	ambient := vm.NewVirtualMachine()
+	ambient.LoadProgram(program)
+
+	first := firstInstruction(program, test.IntegerValue)
+
+	start := time.Now()
+	err := ambient.ExecuteFrom(test.IntegerValue, budget, func(address int) bool {
+		return isTestStart[address] && address != first
+	})
+	result.Duration = time.Since(start)
+
+	switch {
+	case err == vm.AssertionFailed:
+		result.Err = ambient.LastAssertion
+	case err != vm.Ok:
+		instruction := token.Token{}
+		if ambient.InstructionPointer >= 0 && ambient.InstructionPointer < len(program) {
+			instruction = program[ambient.InstructionPointer]
+		}
+
+		if instruction.File != "" {
+			result.Err = fmt.Errorf("%s at %s:%d:%d", err, instruction.File, instruction.LineStart+1, instruction.CollumnStart+1)
+			break
+		}
+
+		result.Err = fmt.Errorf("%s at %d:%d", err, instruction.LineStart+1, instruction.CollumnStart+1)
+	default:
+		result.Passed = true
+	}
+
+	return result
+}
+
+// RunFiles runs the tests of every file and prints a line per test to w.
+// Passing tests are only printed when verbose is set.
+func RunFiles(w io.Writer, files []string, verbose bool) Summary {
+	summary := Summary{}
+
+	for _, file := range files {
+		program, err := lexer.LoadFile(file)
+		if err != nil {
+			summary.Failed++
+			summary.Results = append(summary.Results, Result{File: file, Err: err})
+			fmt.Fprintf(w, "--- FAIL: %s\n", file)
+			fmt.Fprintf(w, "	%v\n", err)
+			continue
+		}
+
+		results := RunProgram(file, program, DefaultBudget)
+
+		for _, r := range results {
+			summary.Results = append(summary.Results, r)
+
+			if r.Passed {
+				summary.Passed++
+				if verbose {
+					fmt.Fprintf(w, "--- PASS: %s %s (%s)\n", r.File, r.Name, r.Duration)
+				}
+
+				continue
+			}
+
+			summary.Failed++
+			fmt.Fprintf(w, "--- FAIL: %s %s (%s)\n", r.File, r.Name, r.Duration)
+			fmt.Fprintf(w, "	%s: %v\n", r.File, r.Err)
+		}
+	}
+
+	return summary
+}
+
+func (s Summary) Print(w io.Writer) {
+	status := "PASS"
+	if s.Failed > 0 {
+		status = "FAIL"
+	}
+
+	fmt.Fprintf(w, "%s: %d passed, %d failed, %d total\n", status, s.Passed, s.Failed, s.Passed+s.Failed)
+}
@@ -0,0 +1,102 @@
+package naivetest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunProgram(t *testing.T) {
+	source := `psh 100
+:test_passes
+psh 1
+psh 1
+assert_eq
+:helper
+psh 1
+assert
+:test_fails
+psh 1
+psh 2
+assert_eq
+:test_underflows
+sum`
+
+	program, err := lexer.LoadSource([]byte(source))
+	require.NoError(t, err)
+
+	results := RunProgram("math_test.naive", program, DefaultBudget)
+	require.Len(t, results, 3)
+
+	assert.Equal(t, "test_passes", results[0].Name)
+	assert.True(t, results[0].Passed)
+	assert.NoError(t, results[0].Err)
+
+	assert.Equal(t, "test_fails", results[1].Name)
+	assert.False(t, results[1].Passed)
+
+	var assertion *vm.AssertionError
+	require.ErrorAs(t, results[1].Err, &assertion)
+	assert.Equal(t, 12, assertion.Line)
+	assert.Equal(t, 1, assertion.Column)
+	assert.Equal(t, "expected 2, got 1", assertion.Message)
+
+	assert.False(t, results[2].Passed)
+	assert.EqualError(t, results[2].Err, "Stack underflow at 14:1")
+}
+
+func TestRunProgram_Budget(t *testing.T) {
+	program, err := lexer.LoadSource([]byte(":test_loop jmp test_loop"))
+	require.NoError(t, err)
+
+	results := RunProgram("loop_test.naive", program, 10)
+	require.Len(t, results, 1)
+
+	assert.False(t, results[0].Passed)
+	assert.ErrorContains(t, results[0].Err, string(vm.BudgetExceeded))
+}
+
+func TestDiscover(t *testing.T) {
+	files, err := Discover("../examples")
+	require.NoError(t, err)
+
+	assert.Contains(t, files, "../examples/tests/math_test.naive")
+	for _, f := range files {
+		assert.NotEqual(t, "../examples/fib.naive", f)
+	}
+}
+
+func TestRunFiles_Include(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "check.naive")
+	require.NoError(t, os.WriteFile(lib, []byte("export check\n:check\nassert\nret\n:test_private\nret"), 0o644))
+
+	file := filepath.Join(dir, "check_test.naive")
+	require.NoError(t, os.WriteFile(file, []byte("include \"check.naive\"\n:test_passes\npsh 1\ncall check\n:test_fails\npsh 0\ncall check"), 0o644))
+
+	var output bytes.Buffer
+	summary := RunFiles(&output, []string{file}, false)
+
+	// Tests of the included file are not run.
+	require.Len(t, summary.Results, 2)
+	assert.True(t, summary.Results[0].Passed)
+	assert.False(t, summary.Results[1].Passed)
+	assert.EqualError(t, summary.Results[1].Err, "Assertion failed at "+lib+":3:1: expected true, got 0")
+}
+
+func TestRunFiles_IncludeError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "missing_test.naive")
+	require.NoError(t, os.WriteFile(file, []byte("include \"missing.naive\""), 0o644))
+
+	var output bytes.Buffer
+	summary := RunFiles(&output, []string{file}, false)
+
+	assert.Equal(t, 1, summary.Failed)
+	assert.Contains(t, output.String(), "missing.naive")
+}
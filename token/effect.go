@@ -0,0 +1,102 @@
+package token
+
+import "sort"
+
+// Effect describes what an instruction does to the stack, in the
+// `before -- after` notation with the top of the stack on the right.
+type Effect struct {
+	// Operand names the operand following the instruction, if it has one.
+	Operand string
+	Stack   string
+
+	Pops   int
+	Pushes int
+	// Variable is set when the instruction pops more than Pops values,
+	// depending on the values on the stack.
+	Variable bool
+
+	Doc string
+}
+
+var effects = map[Kind]Effect{
+	Push:      {Operand: "value", Stack: "-- value", Pushes: 1, Doc: "Push a value onto the stack."},
+	Duplicate: {Operand: "offset", Stack: "x ... -- x ... x", Pushes: 1, Doc: "Push a copy of the value offset values below the top of the stack."},
+
+	Sum:      {Stack: "a b -- a+b", Pops: 2, Pushes: 1, Doc: "Add the top two values on the stack."},
+	Subtract: {Stack: "a b -- a-b", Pops: 2, Pushes: 1, Doc: "Subtract the top of the stack from the value below it."},
+	Multiply: {Stack: "a b -- a*b", Pops: 2, Pushes: 1, Doc: "Multiply the top two values on the stack."},
+	Divide:   {Stack: "a b -- a/b", Pops: 2, Pushes: 1, Doc: "Divide the value below the top of the stack by the top."},
+
+	Jump:       {Operand: "label", Stack: "--", Doc: "Jump to a label."},
+	JumpIfTrue: {Operand: "label", Stack: "c -- c", Pops: 1, Pushes: 1, Doc: "Jump to a label if the top of the stack is 1. The value stays on the stack."},
+
+	AddImmediate:  {Operand: "value", Stack: "a -- a+value", Pops: 1, Pushes: 1, Doc: "Add value to the top of the stack, like `psh value sum`."},
+	JumpIfEqual:   {Operand: "label", Stack: "a b -- a==b", Pops: 2, Pushes: 1, Doc: "Compare the top two values like `eq`, then jump to a label if they are equal, like `eq jif label`."},
+	DuplicatePair: {Stack: "a b -- a b a b", Pops: 2, Pushes: 4, Doc: "Push a copy of the top two values, like `dupl 1 dupl 1`."},
+
+	Equal:   {Stack: "a b -- a==b", Pops: 2, Pushes: 1, Doc: "Push 1 if the top two values are equal, 0 otherwise."},
+	Less:    {Stack: "a b -- a<b", Pops: 2, Pushes: 1, Doc: "Push 1 if a is less than b, 0 otherwise."},
+	Greater: {Stack: "a b -- a>b", Pops: 2, Pushes: 1, Doc: "Push 1 if a is greater than b, 0 otherwise."},
+
+	Assert:      {Stack: "c --", Pops: 1, Doc: "Fail if the top of the stack is 0."},
+	AssertEqual: {Stack: "actual expected --", Pops: 2, Doc: "Fail if the top two values differ."},
+
+	Pop: {Stack: "x --", Pops: 1, Doc: "Remove the top of the stack."},
+
+	Load:  {Operand: "address", Stack: "-- memory[address]", Pushes: 1, Doc: "Push the value of a memory cell."},
+	Store: {Operand: "address", Stack: "x --", Pops: 1, Doc: "Pop the top of the stack into a memory cell."},
+
+	Call:   {Operand: "label", Stack: "--", Doc: "Call the routine at a label. It comes back after `ret`."},
+	Return: {Stack: "--", Doc: "Return after the last `call`."},
+
+	Output:          {Stack: "x --", Pops: 1, Doc: "Write the top of the stack as a decimal number."},
+	OutputCharacter: {Stack: "c --", Pops: 1, Doc: "Write the top of the stack as a character."},
+	OutputString:    {Stack: "address --", Pops: 1, Doc: "Write the string stored at address: its length, then one character per cell."},
+
+	InputCharacter: {Stack: "-- c", Pushes: 1, Doc: "Push the next byte of the input, or -1 at its end."},
+
+	Component: {Operand: "label", Stack: "fields --", Pops: 1, Doc: "Register a component named after the label, with the given number of fields."},
+	Entity:    {Operand: "label", Stack: "--", Doc: "Spawn an entity named after the label and make it the current entity."},
+	Attach:    {Operand: "label", Stack: "--", Doc: "Attach the component of the label to the current entity."},
+	System:    {Operand: "label", Stack: "component... n --", Pops: 1, Variable: true, Doc: "Register the routine at the label as a system over the entities having the n components."},
+	Tick:      {Stack: "--", Doc: "Run every system once."},
+	GetField:  {Operand: "field", Stack: "-- value", Pushes: 1, Doc: "Push a field of the current entity."},
+	SetField:  {Operand: "field", Stack: "value --", Pops: 1, Doc: "Pop the top of the stack into a field of the current entity."},
+
+	Spawn:      {Operand: "label", Stack: "argument --", Pops: 1, Doc: "Start a fiber at the label, with the argument alone on its stack. The fiber ends when the label returns."},
+	Yield:      {Stack: "--", Doc: "Let the next fiber run."},
+	ChannelNew: {Stack: "capacity -- channel", Pops: 1, Pushes: 1, Doc: "Make a channel buffering capacity values. With a capacity of 0, `send` waits for a `recv`."},
+	Send:       {Stack: "channel value --", Pops: 2, Doc: "Send a value on a channel, waiting while its buffer is full."},
+	Receive:    {Stack: "channel -- value", Pops: 1, Pushes: 1, Doc: "Receive a value from a channel, waiting while there is none."},
+
+	Include: {Operand: "path", Stack: "--", Doc: "Directive: add the labels exported by another file, relative to this one, to the program."},
+	Export:  {Operand: "label", Stack: "--", Doc: "Directive: make a label of this file reachable by name from every other file of the program."},
+
+	Const:    {Operand: "name = expression", Stack: "--", Doc: "Directive: name the value of a constant expression. Every later use of the name is replaced by the value."},
+	Macro:    {Operand: "name(parameters)", Stack: "--", Doc: "Directive: define a macro, up to `endmacro`. Every later `name(arguments)` is replaced by its body, with its own copy of the labels it declares."},
+	EndMacro: {Stack: "--", Doc: "Directive: end the body of a macro."},
+}
+
+// EffectOf returns the stack effect of an instruction.
+func EffectOf(kind Kind) (Effect, bool) {
+	effect, ok := effects[kind]
+	return effect, ok
+}
+
+// Keywords returns every mnemonic, sorted.
+func Keywords() []string {
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// LookupKeyword returns the kind of the instruction of a mnemonic.
+func LookupKeyword(name string) (Kind, bool) {
+	kind, ok := keywords[name]
+	return kind, ok
+}
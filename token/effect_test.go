@@ -0,0 +1,20 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEffectOf_EveryKeyword(t *testing.T) {
+	for _, name := range Keywords() {
+		kind, ok := LookupKeyword(name)
+		assert.True(t, ok, name)
+
+		effect, ok := EffectOf(kind)
+		if assert.True(t, ok, "%s has no stack effect", name) {
+			assert.NotEmpty(t, effect.Stack, name)
+			assert.NotEmpty(t, effect.Doc, name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package token
 import (
 	"fmt"
 	"log"
+	"strings"
 	"unicode"
 
 	"github.com/jejikeh/ambient/common"
@@ -30,6 +31,10 @@ type Token struct {
 
 	LineEnd    int
 	CollumnEnd int
+
+	// File is the path of the file an included token comes from. It is
+	// empty for the tokens of the file being compiled.
+	File string
 }
 
 type Kind string
@@ -50,12 +55,64 @@ const (
 	Jump       = "JUMP"
 	JumpIfTrue = "JUMP_IF_TRUE"
 
+	// Superinstructions do the work of a common run of instructions in a
+	// single one.
+	AddImmediate  = "ADD_IMMEDIATE"
+	JumpIfEqual   = "JUMP_IF_EQUAL"
+	DuplicatePair = "DUPLICATE_PAIR"
+
 	Equal = "EQUAL"
 
+	Assert      = "ASSERT"
+	AssertEqual = "ASSERT_EQUAL"
+
+	Pop = "POP"
+
+	Less    = "LESS"
+	Greater = "GREATER"
+
+	Load  = "LOAD"
+	Store = "STORE"
+
+	Call   = "CALL"
+	Return = "RETURN"
+
+	Output          = "OUTPUT"
+	OutputCharacter = "OUTPUT_CHARACTER"
+	OutputString    = "OUTPUT_STRING"
+
+	InputCharacter = "INPUT_CHARACTER"
+
+	Component = "COMPONENT"
+	Entity    = "ENTITY"
+	Attach    = "ATTACH"
+	System    = "SYSTEM"
+	Tick      = "TICK"
+	GetField  = "GET_FIELD"
+	SetField  = "SET_FIELD"
+
+	// Fibers are green threads, run one at a time, which talk over
+	// channels. `spawn` starts one.
+	Spawn      = "SPAWN"
+	Yield      = "YIELD"
+	ChannelNew = "CHANNEL_NEW"
+	Send       = "SEND"
+	Receive    = "RECEIVE"
+
+	Include = "INCLUDE"
+	Export  = "EXPORT"
+
+	Const    = "CONST"
+	Macro    = "MACRO"
+	EndMacro = "END_MACRO"
+	// Operator is one of `= ( ) , + - * /`, held in Name.
+	Operator = "OPERATOR"
+
 	EndOfLine = "END_OF_FILE"
 
 	Identifier = "IDENTIFIER"
 	Number     = "NUMBER"
+	String     = "STRING"
 )
 
 var keywords = map[string]Kind{
@@ -68,6 +125,51 @@ var keywords = map[string]Kind{
 	"jmp":  Jump,
 	"jif":  JumpIfTrue,
 	"eq":   Equal,
+
+	"addi": AddImmediate,
+	"jeq":  JumpIfEqual,
+	"dup2": DuplicatePair,
+
+	"assert":    Assert,
+	"assert_eq": AssertEqual,
+
+	"pop": Pop,
+
+	"lt": Less,
+	"gt": Greater,
+
+	"load":  Load,
+	"store": Store,
+
+	"call": Call,
+	"ret":  Return,
+
+	"out":  Output,
+	"outc": OutputCharacter,
+	"outs": OutputString,
+
+	"inc": InputCharacter,
+
+	"comp":   Component,
+	"entity": Entity,
+	"attach": Attach,
+	"system": System,
+	"tick":   Tick,
+	"getf":   GetField,
+	"setf":   SetField,
+
+	"spawn":    Spawn,
+	"yield":    Yield,
+	"chan_new": ChannelNew,
+	"send":     Send,
+	"recv":     Receive,
+
+	"include": Include,
+	"export":  Export,
+
+	"const":    Const,
+	"macro":    Macro,
+	"endmacro": EndMacro,
 }
 
 var keywordsReverse = map[Kind]string{
@@ -80,6 +182,51 @@ var keywordsReverse = map[Kind]string{
 	Jump:       "jmp",
 	JumpIfTrue: "jif",
 	Equal:      "eq",
+
+	AddImmediate:  "addi",
+	JumpIfEqual:   "jeq",
+	DuplicatePair: "dup2",
+
+	Assert:      "assert",
+	AssertEqual: "assert_eq",
+
+	Pop: "pop",
+
+	Less:    "lt",
+	Greater: "gt",
+
+	Load:  "load",
+	Store: "store",
+
+	Call:   "call",
+	Return: "ret",
+
+	Output:          "out",
+	OutputCharacter: "outc",
+	OutputString:    "outs",
+
+	InputCharacter: "inc",
+
+	Component: "comp",
+	Entity:    "entity",
+	Attach:    "attach",
+	System:    "system",
+	Tick:      "tick",
+	GetField:  "getf",
+	SetField:  "setf",
+
+	Spawn:      "spawn",
+	Yield:      "yield",
+	ChannelNew: "chan_new",
+	Send:       "send",
+	Receive:    "recv",
+
+	Include: "include",
+	Export:  "export",
+
+	Const:    "const",
+	Macro:    "macro",
+	EndMacro: "endmacro",
 }
 
 func (t *Token) DetectMyKind() {
@@ -110,9 +257,27 @@ func (t *Token) DetectMyString() string {
 		return fmt.Sprint(t.IntegerValue)
 	}
 
+	if t.Kind == Comment {
+		return t.StringValue
+	}
+
+	if t.Kind == String {
+		return Quote(t.StringValue)
+	}
+
+	if t.Kind == Operator {
+		return t.Name
+	}
+
 	return ""
 }
 
+// Quote writes a string the way the lexer reads it back: in double quotes,
+// with a backslash before every quote and backslash.
+func Quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
 func IsStartOfIdentifier(c rune) bool {
 	if unicode.IsLetter(c) {
 		return true
@@ -149,6 +314,10 @@ func IsPartOfFloat(c rune) bool {
 	return unicode.IsDigit(c) || c == '.'
 }
 
+func IsOperator(c rune) bool {
+	return strings.ContainsRune("=(),+-*/", c)
+}
+
 func IsWhitespace(c rune) bool {
 	return unicode.IsSpace(c)
 }
@@ -0,0 +1,344 @@
+package vm
+
+import "github.com/jejikeh/ambient/token"
+
+// The code of a verified program also has blocks: a block runs the
+// instructions from an address up to the first jump, call or return, or
+// up to one which does input or output or touches the entities. Since
+// Verify showed the stack holds what they take, a block runs them in one
+// go, on the stack held in a local, instead of going back to the loop of
+// the VM after each of them.
+//
+// A block counts for as many steps as it has instructions. Before an
+// instruction which would fail, the block stops and leaves it to its own
+// op, so errors are the same as when they run one at a time. Near the end
+// of the budget, or with the profiler or the coverage, the instructions
+// run one at a time as usual.
+
+// blockKind is the instruction a blockStep runs.
+type blockKind uint8
+
+const (
+	blockPush blockKind = iota
+	blockDuplicate
+	blockDuplicatePair
+	blockPop
+	blockSum
+	blockSubtract
+	blockMultiply
+	blockDivide
+	blockAddImmediate
+	blockEqual
+	blockLess
+	blockGreater
+	blockLoad
+	blockStore
+	blockJump
+	blockJumpIfTrue
+	blockJumpIfEqual
+	blockCall
+	blockReturn
+
+	// The instructions below stand for `psh K` and the one after it.
+	blockMultiplyImmediate
+	blockDivideImmediate
+	blockEqualImmediate
+	blockLessImmediate
+	blockGreaterImmediate
+)
+
+// immediates maps the instructions which can take the value pushed before
+// them as an operand to the step doing both.
+var immediates = map[blockKind]blockKind{
+	blockSum:      blockAddImmediate,
+	blockMultiply: blockMultiplyImmediate,
+	blockDivide:   blockDivideImmediate,
+	blockEqual:    blockEqualImmediate,
+	blockLess:     blockLessImmediate,
+	blockGreater:  blockGreaterImmediate,
+}
+
+var blockKinds = map[token.Kind]blockKind{
+	token.Push:          blockPush,
+	token.Duplicate:     blockDuplicate,
+	token.DuplicatePair: blockDuplicatePair,
+	token.Pop:           blockPop,
+	token.Sum:           blockSum,
+	token.Subtract:      blockSubtract,
+	token.Multiply:      blockMultiply,
+	token.Divide:        blockDivide,
+	token.AddImmediate:  blockAddImmediate,
+	token.Equal:         blockEqual,
+	token.Less:          blockLess,
+	token.Greater:       blockGreater,
+	token.Load:          blockLoad,
+	token.Store:         blockStore,
+	token.Jump:          blockJump,
+	token.JumpIfTrue:    blockJumpIfTrue,
+	token.JumpIfEqual:   blockJumpIfEqual,
+	token.Call:          blockCall,
+	token.Return:        blockReturn,
+}
+
+// blockStep is the instruction at address in a block, with its operand,
+// or its target for jumps and calls. left counts the instructions from it
+// to the end of the block.
+type blockStep struct {
+	kind    blockKind
+	operand int
+	address int
+	left    int
+}
+
+func isJump(kind blockKind) bool {
+	return kind == blockJump || kind == blockJumpIfTrue || kind == blockJumpIfEqual || kind == blockCall
+}
+
+// canFail reports whether the instruction can fail although the program
+// is verified.
+func canFail(kind blockKind) bool {
+	return kind == blockDivide || kind == blockCall || kind == blockReturn
+}
+
+// compileBlocks returns the block starting at every address of a
+// verified program which has one, with the number of instructions it
+// runs. Blocks of a single instruction, or starting with one which can
+// fail, are left out.
+func compileBlocks(instructions []token.Token, heights []int) ([]op, []int) {
+	blocks := make([]op, len(instructions))
+	sizes := make([]int, len(instructions))
+
+	for address := range instructions {
+		if heights[address] == unreached {
+			continue
+		}
+
+		steps, next := blockAt(instructions, address)
+		if len(steps) < 2 || canFail(steps[0].kind) {
+			continue
+		}
+
+		sizes[address] = len(steps)
+		blocks[address] = runBlock(fuseImmediates(steps), next)
+	}
+
+	return blocks, sizes
+}
+
+// blockAt returns the steps of the block at address, and the address
+// after it: where it goes on when it does not jump, or where a call it
+// ends with returns to.
+func blockAt(instructions []token.Token, address int) ([]blockStep, int) {
+	steps := []blockStep{}
+
+	for address < len(instructions) {
+		kind, ok := blockKinds[instructions[address].Kind]
+		if !ok || address+1 >= len(instructions) && needsOperand(instructions[address].Kind) {
+			break
+		}
+
+		operand := 0
+		if address+1 < len(instructions) {
+			operand = instructions[address+1].IntegerValue
+		}
+
+		if isJump(kind) {
+			operand = skipLabels(instructions, operand)
+		}
+
+		steps = append(steps, blockStep{kind: kind, operand: operand, address: address})
+		address = following(instructions, address)
+
+		if isJump(kind) || kind == blockReturn {
+			break
+		}
+	}
+
+	return steps, address
+}
+
+// fuseImmediates sets how many instructions are left from every step,
+// and merges `psh K` with the instruction after it when it can take K as
+// an operand. A division by 0 is left to fail on its own.
+func fuseImmediates(steps []blockStep) []blockStep {
+	fused := make([]blockStep, 0, len(steps))
+
+	for i := 0; i < len(steps); i++ {
+		step := steps[i]
+		step.left = len(steps) - i
+
+		if step.kind == blockPush && i+1 < len(steps) {
+			next := steps[i+1]
+			kind, ok := immediates[next.kind]
+
+			if next.kind == blockSubtract {
+				kind, ok, step.operand = blockAddImmediate, true, -step.operand
+			}
+
+			if ok && !(kind == blockDivideImmediate && step.operand == 0) {
+				step.kind = kind
+				i++
+			}
+		}
+
+		fused = append(fused, step)
+	}
+
+	return fused
+}
+
+// stopBlock leaves the step at i of a block and the ones after it to run
+// one at a time, with s the stack before it.
+func (a *VirtualMachine) stopBlock(steps []blockStep, i int, s []int) Error {
+	a.steps -= steps[i].left
+	a.Stack = s
+	a.InstructionPointer = steps[i].address
+	return Ok
+}
+
+func runBlock(steps []blockStep, next int) op {
+	return func(a *VirtualMachine) Error {
+		s := a.Stack
+
+		for i, step := range steps {
+			n := len(s)
+
+			switch step.kind {
+			case blockPush:
+				s = append(s, step.operand)
+
+			case blockDuplicate:
+				s = append(s, s[n-1-step.operand])
+
+			case blockDuplicatePair:
+				s = append(s, s[n-2], s[n-1])
+
+			case blockPop:
+				s = s[:n-1]
+
+			case blockSum:
+				s[n-2] += s[n-1]
+				s = s[:n-1]
+
+			case blockSubtract:
+				s[n-2] -= s[n-1]
+				s = s[:n-1]
+
+			case blockMultiply:
+				s[n-2] *= s[n-1]
+				s = s[:n-1]
+
+			case blockDivide:
+				if s[n-1] == 0 {
+					return a.stopBlock(steps, i, s)
+				}
+
+				s[n-2] /= s[n-1]
+				s = s[:n-1]
+
+			case blockAddImmediate:
+				s[n-1] += step.operand
+
+			case blockMultiplyImmediate:
+				s[n-1] *= step.operand
+
+			case blockDivideImmediate:
+				s[n-1] /= step.operand
+
+			case blockEqualImmediate:
+				s[n-1] = boolToInt(s[n-1] == step.operand)
+
+			case blockLessImmediate:
+				s[n-1] = boolToInt(s[n-1] < step.operand)
+
+			case blockGreaterImmediate:
+				s[n-1] = boolToInt(s[n-1] > step.operand)
+
+			case blockEqual:
+				s[n-2] = boolToInt(s[n-2] == s[n-1])
+				s = s[:n-1]
+
+			case blockLess:
+				s[n-2] = boolToInt(s[n-2] < s[n-1])
+				s = s[:n-1]
+
+			case blockGreater:
+				s[n-2] = boolToInt(s[n-2] > s[n-1])
+				s = s[:n-1]
+
+			case blockLoad:
+				value := 0
+				if step.operand < len(a.Memory) {
+					value = a.Memory[step.operand]
+				}
+
+				s = append(s, value)
+
+			case blockStore:
+				if step.operand >= len(a.Memory) {
+					a.Memory = append(a.Memory, make([]int, step.operand+1-len(a.Memory))...)
+				}
+
+				a.Memory[step.operand] = s[n-1]
+				if a.stored != nil {
+					a.stored[step.operand] = true
+				}
+
+				s = s[:n-1]
+
+			case blockJump:
+				a.Stack = s
+				a.InstructionPointer = step.operand
+				return Ok
+
+			case blockJumpIfTrue:
+				a.Stack = s
+				if s[n-1] == 1 {
+					a.InstructionPointer = step.operand
+				} else {
+					a.InstructionPointer = next
+				}
+
+				return Ok
+
+			case blockJumpIfEqual:
+				equal := s[n-2] == s[n-1]
+				s[n-2] = boolToInt(equal)
+				a.Stack = s[:n-1]
+
+				if equal {
+					a.InstructionPointer = step.operand
+				} else {
+					a.InstructionPointer = next
+				}
+
+				return Ok
+
+			case blockCall:
+				if len(a.CallStack) >= CallStackLimit {
+					return a.stopBlock(steps, i, s)
+				}
+
+				a.Stack = s
+				a.CallStack = append(a.CallStack, next)
+				a.InstructionPointer = step.operand
+				return Ok
+
+			case blockReturn:
+				// Fibers end by returning with an empty call stack.
+				if len(a.CallStack) < 1 {
+					return a.stopBlock(steps, i, s)
+				}
+
+				a.Stack = s
+				a.InstructionPointer = a.CallStack[len(a.CallStack)-1]
+				a.CallStack = a.CallStack[:len(a.CallStack)-1]
+				return Ok
+			}
+		}
+
+		a.Stack = s
+		a.InstructionPointer = next
+		return Ok
+	}
+}
@@ -0,0 +1,990 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// op runs the instruction it was compiled from. Operands, jump targets and
+// the address of the next instruction are bound when it is compiled, so
+// running it does not look at the tokens.
+type op func(a *VirtualMachine) Error
+
+func compile(instructions []token.Token) []op {
+	code := make([]op, len(instructions))
+	for address := range instructions {
+		code[address] = compileInstruction(instructions, address)
+	}
+
+	return code
+}
+
+// following returns the address of the instruction after the one at
+// address, past its operand and the labels declared after it.
+func following(instructions []token.Token, address int) int {
+	next := address + 1
+
+	effect, _ := token.EffectOf(instructions[address].Kind)
+	if effect.Operand != "" && next < len(instructions) && isOperand(instructions[next]) {
+		next++
+	}
+
+	return skipLabels(instructions, next)
+}
+
+// skipLabels returns the address of the first instruction from address
+// on which is not a label declaration.
+func skipLabels(instructions []token.Token, address int) int {
+	for address >= 0 && address < len(instructions) && instructions[address].Kind == token.Label {
+		address++
+	}
+
+	return address
+}
+
+func isOperand(t token.Token) bool {
+	return t.Kind == token.Number || t.Kind == token.Identifier
+}
+
+// missingOperand is the op of an instruction whose operand is cut off by
+// the end of the program.
+func missingOperand(a *VirtualMachine) Error {
+	return UnknownOperand
+}
+
+// illegalTarget is the op of a jump or call out of the program.
+func illegalTarget(a *VirtualMachine) Error {
+	return IllegalInstructionAccess
+}
+
+func compileInstruction(instructions []token.Token, address int) op {
+	instruction := instructions[address]
+	next := following(instructions, address)
+
+	if needsOperand(instruction.Kind) && address+1 >= len(instructions) {
+		return missingOperand
+	}
+
+	operand, hasOperand := 0, address+1 < len(instructions)
+	if hasOperand {
+		operand = instructions[address+1].IntegerValue
+	}
+
+	validTarget := operand >= 0 && operand < len(instructions)
+	target := skipLabels(instructions, operand)
+
+	switch instruction.Kind {
+	case token.EndOfLine:
+		return nil
+
+	case token.Push:
+		// Push a value onto the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 1
+		//		2. PRINT_STACK: [0, 1, 1]
+
+		return func(a *VirtualMachine) Error {
+			a.Stack = append(a.Stack, operand)
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Duplicate:
+		// Duplicate the top of the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. DPLC 0
+		//		2. PRINT_STACK: [0, 1, 0]
+
+		if operand < 0 {
+			return func(a *VirtualMachine) Error {
+				return IllegalInstruction
+			}
+		}
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack)-operand <= 0 {
+				return StackUnderflow
+			}
+
+			a.Stack = append(a.Stack, a.Stack[len(a.Stack)-1-operand])
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Sum:
+		// Add the top two values on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 1
+		// 		2. PSH 1
+		// 		3. SUM
+		//		4. PRINT_STACK: [0, 1, 2]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] += a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Subtract:
+		// Subtract the top two values on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 2
+		// 		2. PSH 1
+		// 		3. SUB
+		// 		4. PRINT_STACK: [0, 1, 1]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] -= a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Multiply:
+		// Multiply the top two values on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 2
+		// 		2. PSH 2
+		// 		3. MUL
+		// 		4. PRINT_STACK: [0, 1, 4]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] *= a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Divide:
+		// Divide the top two values on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 4
+		// 		2. PSH 2
+		// 		3. DIV
+		// 		4. PRINT_STACK: [0, 1, 2]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			if a.Stack[n-1] == 0 {
+				return DivisionByZero
+			}
+
+			a.Stack[n-2] /= a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Jump:
+		// Jump to a new instruction.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. JMP 2
+		// 		2. PRINT_STACK: [0, 1]
+
+		if !validTarget {
+			return illegalTarget
+		}
+
+		return func(a *VirtualMachine) Error {
+			a.InstructionPointer = target
+			return Ok
+		}
+
+	case token.JumpIfTrue:
+		// Jump to a new instruction if the top of the stack is true (1).
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 0
+		// 		2. PSH 1
+		// 		3. JMPIF 4
+		// 		4. PRINT_STACK: [0, 1]
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			if a.Stack[len(a.Stack)-1] != 1 {
+				a.InstructionPointer = next
+				return Ok
+			}
+
+			if !hasOperand {
+				return UnknownOperand
+			}
+
+			if !validTarget {
+				return IllegalInstructionAccess
+			}
+
+			a.InstructionPointer = target
+			return Ok
+		}
+
+	case token.AddImmediate:
+		// Add the operand to the top of the stack, like `psh N sum`.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. ADDI 2
+		//		2. PRINT_STACK: [0, 3]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 1 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-1] += operand
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.JumpIfEqual:
+		// Compare the top two values and jump if they are equal, like
+		// `eq jif label`. The result stays on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [2, 2]
+		// 		1. JEQ 3
+		// 		2. ...
+		// 		3. PRINT_STACK: [1]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			equal := a.Stack[n-2] == a.Stack[n-1]
+			a.Stack[n-2] = boolToInt(equal)
+			a.Stack = a.Stack[:n-1]
+
+			if !equal {
+				a.InstructionPointer = next
+				return Ok
+			}
+
+			if !hasOperand {
+				return UnknownOperand
+			}
+
+			if !validTarget {
+				return IllegalInstructionAccess
+			}
+
+			a.InstructionPointer = target
+			return Ok
+		}
+
+	case token.DuplicatePair:
+		// Duplicate the top two values, like `dupl 1 dupl 1`.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. DUP2
+		//		2. PRINT_STACK: [0, 1, 0, 1]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack = append(a.Stack, a.Stack[n-2], a.Stack[n-1])
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Equal:
+		// instruction if the top of the stack is equal.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 1
+		// 		2. PSH 1
+		// 		3. EQ
+		// 		4. PRINT_STACK: [0, 1, 1]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] == a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Assert:
+		// Pop the top of the stack and fail if it is false (0).
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. ASSERT
+		// 		2. PRINT_STACK: [0]
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			value := a.Stack[len(a.Stack)-1]
+			a.Stack = a.Stack[:len(a.Stack)-1]
+
+			if value == 0 {
+				return a.failAssertion(instruction, "expected true, got 0")
+			}
+
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.AssertEqual:
+		// Pop the top two values on the stack and fail if they differ.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. PSH 1
+		// 		2. ASSERT_EQ
+		// 		3. PRINT_STACK: [0]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			expected, actual := a.Stack[n-1], a.Stack[n-2]
+			a.Stack = a.Stack[:n-2]
+
+			if expected != actual {
+				return a.failAssertion(instruction, fmt.Sprintf("expected %d, got %d", expected, actual))
+			}
+
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Pop:
+		// Remove the top of the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. POP
+		// 		2. PRINT_STACK: [0]
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Less:
+		// Compare the top two values on the stack.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 1]
+		// 		1. LT
+		// 		2. PRINT_STACK: [1]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] < a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Greater:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] > a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Load:
+		// Push the value of a memory cell onto the stack.
+		// EXAMPLE:
+		// 		0. PRINT_MEMORY: [7]
+		// 		1. LOAD 0
+		// 		2. PRINT_STACK: [7]
+
+		if operand < 0 || operand >= MemorySize {
+			return func(a *VirtualMachine) Error {
+				return IllegalMemoryAccess
+			}
+		}
+
+		return func(a *VirtualMachine) Error {
+			value := 0
+			if operand < len(a.Memory) {
+				value = a.Memory[operand]
+			}
+
+			a.Stack = append(a.Stack, value)
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Store:
+		// Pop the top of the stack into a memory cell.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [7]
+		// 		1. STORE 0
+		// 		2. PRINT_MEMORY: [7]
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			if err := a.store(operand, a.Stack[len(a.Stack)-1]); err != Ok {
+				return err
+			}
+
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Call:
+		// Jump to a label, remembering where to come back on `ret`.
+		// EXAMPLE:
+		// 		0. CALL 4
+		// 		1. ...
+		// 		4. RET
+		//		5. -> continues at 2
+
+		if !validTarget {
+			return illegalTarget
+		}
+
+		back := next
+
+		return func(a *VirtualMachine) Error {
+			if len(a.CallStack) >= CallStackLimit {
+				return CallStackOverflow
+			}
+
+			a.CallStack = append(a.CallStack, back)
+			a.InstructionPointer = target
+			return Ok
+		}
+
+	case token.Return:
+		// Jump back after the last `call`.
+
+		return func(a *VirtualMachine) Error {
+			if len(a.CallStack) < 1 {
+				// A fiber ends by returning from the routine it started
+				// at.
+				if a.endsFiber() {
+					return a.endFiber()
+				}
+
+				return CallStackUnderflow
+			}
+
+			a.InstructionPointer = a.CallStack[len(a.CallStack)-1]
+			a.CallStack = a.CallStack[:len(a.CallStack)-1]
+			return Ok
+		}
+
+	case token.Output, token.OutputCharacter:
+		// Pop the top of the stack and write it to the output, as a
+		// decimal number for `out` and as a character for `outc`.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [42]
+		// 		1. OUT
+		// 		2. OUTPUT: 42
+
+		character := instruction.Kind == token.OutputCharacter
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			value := a.Stack[len(a.Stack)-1]
+			a.Stack = a.Stack[:len(a.Stack)-1]
+
+			if character {
+				io.WriteString(a.Output, string(rune(value)))
+			} else {
+				io.WriteString(a.Output, strconv.Itoa(value))
+			}
+
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.OutputString:
+		// Pop an address and write the string stored there. Strings are
+		// stored as their length followed by one character per cell.
+		// EXAMPLE:
+		// 		0. PRINT_MEMORY: [2, 104, 105]
+		// 		1. PSH 0
+		// 		2. OUTS
+		// 		3. OUTPUT: hi
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			s, err := a.loadString(a.Stack[len(a.Stack)-1])
+			if err != Ok {
+				return err
+			}
+
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			io.WriteString(a.Output, s)
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.InputCharacter:
+		// Push the next byte of the input, or -1 at its end.
+		// EXAMPLE:
+		// 		0. INPUT: hi
+		// 		1. INC
+		// 		2. PRINT_STACK: [104]
+
+		return func(a *VirtualMachine) Error {
+			value := -1
+			if a.Input != nil {
+				var b [1]byte
+				if _, err := io.ReadFull(a.Input, b[:]); err == nil {
+					value = int(b[0])
+				}
+			}
+
+			a.Stack = append(a.Stack, value)
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Component, token.Entity, token.Attach, token.System:
+		// Declare a component, an entity or a system named by a label.
+		// EXAMPLE:
+		// 		0. PSH 2
+		// 		1. COMP c_position
+		// 		2. SPAWN e_cat
+		// 		3. ATTACH c_position
+		// 		4. PSH c_position
+		// 		5. PSH 1
+		// 		6. SYSTEM s_move
+
+		declare := map[token.Kind]func(*VirtualMachine, int) Error{
+			token.Component: (*VirtualMachine).registerComponent,
+			token.Entity:    (*VirtualMachine).spawnEntity,
+			token.Attach:    (*VirtualMachine).attach,
+			token.System:    (*VirtualMachine).registerSystem,
+		}[instruction.Kind]
+
+		return func(a *VirtualMachine) Error {
+			if err := declare(a, operand); err != Ok {
+				return err
+			}
+
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Tick:
+		// Run every system once over the entities matching its query.
+
+		return func(a *VirtualMachine) Error {
+			if err := a.tick(); err != Ok {
+				return err
+			}
+
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Spawn:
+		// Pop an argument and start a fiber at a label with it. The fiber
+		// runs once the running one yields or waits.
+		// EXAMPLE:
+		// 		0. PSH 7
+		// 		1. FIBER worker
+		// 		2. PRINT_STACK: []
+
+		if !validTarget {
+			return illegalTarget
+		}
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			if err := a.startFiber(operand, a.Stack[len(a.Stack)-1]); err != Ok {
+				return err
+			}
+
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Yield:
+		// Let the next fiber run, this one runs again after the others.
+
+		return func(a *VirtualMachine) Error {
+			a.InstructionPointer = next
+			return a.yield()
+		}
+
+	case token.ChannelNew:
+		// Pop a capacity and push a new channel buffering that many values.
+		// EXAMPLE:
+		// 		0. PSH 0
+		// 		1. CHAN_NEW
+		// 		2. PRINT_STACK: [0]
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			id, err := a.newChannel(a.Stack[len(a.Stack)-1])
+			if err != Ok {
+				return err
+			}
+
+			a.Stack[len(a.Stack)-1] = id
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Send:
+		// Pop a value and a channel and send the value on it. When the
+		// buffer of the channel is full, the fiber waits for a `recv`.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0, 42]
+		// 		1. SEND
+		// 		2. PRINT_STACK: []
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 2 {
+				return StackUnderflow
+			}
+
+			id, value := a.Stack[n-2], a.Stack[n-1]
+			a.Stack = a.Stack[:n-2]
+			a.InstructionPointer = next
+
+			if err := a.send(address, id, value); err != Ok {
+				a.Stack = append(a.Stack, id, value)
+				a.InstructionPointer = address
+				return err
+			}
+
+			return Ok
+		}
+
+	case token.Receive:
+		// Pop a channel and push the next value received from it. When
+		// there is none, the fiber waits for a `send`.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [0]
+		// 		1. RECV
+		// 		2. PRINT_STACK: [42]
+
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if n < 1 {
+				return StackUnderflow
+			}
+
+			id := a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+
+			if err := a.receive(address, id); err != Ok {
+				a.Stack = append(a.Stack, id)
+				a.InstructionPointer = address
+				return err
+			}
+
+			return Ok
+		}
+
+	case token.GetField:
+		// Push a field of a component of the current entity.
+		// EXAMPLE:
+		// 		0. GETF 0
+		// 		1. PRINT_STACK: [7]
+
+		return func(a *VirtualMachine) Error {
+			value, err := a.getField(operand)
+			if err != Ok {
+				return err
+			}
+
+			a.Stack = append(a.Stack, value)
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.SetField:
+		// Pop the top of the stack into a field of the current entity.
+		// EXAMPLE:
+		// 		0. PRINT_STACK: [7]
+		// 		1. SETF 0
+		// 		2. PRINT_STACK: []
+
+		return func(a *VirtualMachine) Error {
+			if len(a.Stack) < 1 {
+				return StackUnderflow
+			}
+
+			if err := a.setField(operand, a.Stack[len(a.Stack)-1]); err != Ok {
+				return err
+			}
+
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Number, token.Identifier, token.Label:
+		// Instructions go past operands and labels, they only run when a
+		// run starts at them.
+
+		return func(a *VirtualMachine) Error {
+			a.InstructionPointer = next
+			return Ok
+		}
+	}
+
+	return func(a *VirtualMachine) Error {
+		log.Printf("Unknown instruction: [%s]\n", instruction.Kind)
+		a.InstructionPointer = next
+		return Ok
+	}
+}
+
+// compileVerified compiles a program Verify accepted. The instructions a
+// path reaches leave out the checks Verify made: the stack holds the
+// values they take, and their operands and jump targets are there.
+func compileVerified(instructions []token.Token, heights []int) []op {
+	code := compile(instructions)
+	for address, height := range heights {
+		if height == unreached {
+			continue
+		}
+
+		if fast := compileUnchecked(instructions, address); fast != nil {
+			code[address] = fast
+		}
+	}
+
+	return code
+}
+
+// compileUnchecked compiles the instructions which run in the hot loops
+// without their checks, or returns nil for the others.
+func compileUnchecked(instructions []token.Token, address int) op {
+	next := following(instructions, address)
+
+	operand := 0
+	if address+1 < len(instructions) {
+		operand = instructions[address+1].IntegerValue
+	}
+
+	target := skipLabels(instructions, operand)
+
+	switch instructions[address].Kind {
+	case token.Duplicate:
+		return func(a *VirtualMachine) Error {
+			a.Stack = append(a.Stack, a.Stack[len(a.Stack)-1-operand])
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.DuplicatePair:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack = append(a.Stack, a.Stack[n-2], a.Stack[n-1])
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Sum:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] += a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Subtract:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] -= a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Multiply:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] *= a.Stack[n-1]
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.AddImmediate:
+		return func(a *VirtualMachine) Error {
+			a.Stack[len(a.Stack)-1] += operand
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Equal:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] == a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Less:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] < a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Greater:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			a.Stack[n-2] = boolToInt(a.Stack[n-2] > a.Stack[n-1])
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.JumpIfTrue:
+		return func(a *VirtualMachine) Error {
+			if a.Stack[len(a.Stack)-1] == 1 {
+				a.InstructionPointer = target
+			} else {
+				a.InstructionPointer = next
+			}
+
+			return Ok
+		}
+
+	case token.JumpIfEqual:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			equal := a.Stack[n-2] == a.Stack[n-1]
+			a.Stack[n-2] = boolToInt(equal)
+			a.Stack = a.Stack[:n-1]
+
+			if equal {
+				a.InstructionPointer = target
+			} else {
+				a.InstructionPointer = next
+			}
+
+			return Ok
+		}
+
+	case token.Pop:
+		return func(a *VirtualMachine) Error {
+			a.Stack = a.Stack[:len(a.Stack)-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+
+	case token.Store:
+		return func(a *VirtualMachine) Error {
+			n := len(a.Stack)
+			if operand >= len(a.Memory) {
+				a.Memory = append(a.Memory, make([]int, operand+1-len(a.Memory))...)
+			}
+
+			a.Memory[operand] = a.Stack[n-1]
+			if a.stored != nil {
+				a.stored[operand] = true
+			}
+
+			a.Stack = a.Stack[:n-1]
+			a.InstructionPointer = next
+			return Ok
+		}
+	}
+
+	return nil
+}
+
+// needsOperand reports whether an instruction reads the token after it.
+func needsOperand(kind token.Kind) bool {
+	switch kind {
+	case token.Push, token.Duplicate, token.AddImmediate, token.Jump, token.Load, token.Store, token.Call,
+		token.Component, token.Entity, token.Attach, token.System, token.GetField, token.SetField, token.Spawn:
+		return true
+	}
+
+	return false
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fibSource = `psh 20
+call fib
+jmp end
+
+// fib replaces n on the stack by the nth Fibonacci number.
+:fib
+dupl 0 psh 2 lt
+jif base
+pop
+dupl 0 psh 1 sub call fib
+dupl 1 psh 2 sub call fib
+sum
+store 0 pop load 0
+ret
+:base
+pop
+ret
+:end`
+
+const arithmeticSource = `psh 0 store 0
+psh 100000
+psh 1
+:loop
+pop
+load 0 psh 31 mul psh 7 sum psh 65521 div
+load 0 psh 3 mul sum
+psh 1000003 dupl 1 dupl 1 div mul sub
+store 0
+psh 1 sub
+dupl 0 psh 0 gt
+jif loop
+pop pop`
+
+// arithmeticFusedSource is arithmeticSource with its superinstructions
+// selected, like at -O1.
+const arithmeticFusedSource = `const DOWN = -1
+psh 0 store 0
+psh 100000
+psh 1
+:loop
+pop
+load 0 psh 31 mul addi 7 psh 65521 div
+load 0 psh 3 mul sum
+psh 1000003 dup2 div mul sub
+store 0
+addi DOWN
+dupl 0 psh 0 gt
+jif loop
+pop pop`
+
+// tokenize lexes a source the test expects to be valid.
+func tokenize(t testing.TB, source string) []token.Token {
+	t.Helper()
+
+	program, err := lexer.NewLexer(source).Lex()
+	require.NoError(t, err)
+
+	return program
+}
+
+// run runs a program on a new VM.
+func run(program []token.Token, budget int) (*VirtualMachine, string, Error) {
+	var out bytes.Buffer
+
+	v := NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(program)
+
+	err := v.ExecuteFrom(0, budget, nil)
+
+	return v, out.String(), err
+}
+
+func TestCompile_Results(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := map[string]struct {
+		source string
+		// withoutEndOfFile drops the end of file token, as in binaries.
+		withoutEndOfFile bool
+
+		expected Error
+		out      string
+		stack    []int
+		ip       int
+		steps    int
+	}{
+		"Missing operand":                {source: "psh", withoutEndOfFile: true, expected: UnknownOperand, stack: []int{}, ip: 0, steps: 1},
+		"Operand is end of file":         {source: "psh", expected: Ok, stack: []int{0}, ip: 1, steps: 1},
+		"Missing jump target":            {source: "psh 1 jif", withoutEndOfFile: true, expected: UnknownOperand, stack: []int{1}, ip: 2, steps: 2},
+		"Jump out of program":            {source: "jmp 100", expected: IllegalInstructionAccess, stack: []int{}, ip: 0, steps: 1},
+		"Negative duplicate":             {source: "const N = -1\npsh 1 dupl N", expected: IllegalInstruction, stack: []int{1}, ip: 2, steps: 2},
+		"Division by zero":               {source: "psh 1 psh 0 div", expected: DivisionByZero, stack: []int{1, 0}, ip: 4, steps: 3},
+		"Assertion":                      {source: "psh 1 psh 2 assert_eq", expected: AssertionFailed, stack: []int{}, ip: 4, steps: 3},
+		"Output":                         {source: "psh 104 outc psh 7 out", expected: Ok, out: "h7", stack: []int{}, ip: 6, steps: 4},
+		"Labels are not stepped":         {source: "psh 1 :a :b jmp c :c :d psh 2", expected: Ok, stack: []int{1, 2}, ip: 10, steps: 3},
+		"Budget":                         {source: ":l jmp l", expected: BudgetExceeded, stack: []int{}, ip: 1, steps: fuzzBudget},
+		"Systems":                        {source: "psh 1 comp c entity e attach c psh 2 setf 0 getf 0 :c :e", expected: Ok, stack: []int{2}, ip: 16, steps: 7},
+		"Superinstructions":              {source: "psh 2 addi 3 psh 7 dup2 jeq l psh 1 :l", expected: Ok, stack: []int{5, 7, 0, 1}, ip: 12, steps: 6},
+		"Jump if equal taken":            {source: "psh 2 dupl 0 jeq l psh 1 :l", expected: Ok, stack: []int{1}, ip: 9, steps: 3},
+		"Add immediate underflow":        {source: "addi 1", expected: StackUnderflow, stack: []int{}, ip: 0, steps: 1},
+		"Jump if equal underflow":        {source: "psh 1 jeq l :l", expected: StackUnderflow, stack: []int{1}, ip: 2, steps: 2},
+		"Jump if equal without target":   {source: "psh 1 dupl 0 jeq", withoutEndOfFile: true, expected: UnknownOperand, stack: []int{1}, ip: 4, steps: 3},
+		"Duplicate pair underflow":       {source: "psh 1 dup2", expected: StackUnderflow, stack: []int{1}, ip: 2, steps: 2},
+		"Call returns after its operand": {source: "call f psh 2 jmp end :f psh 1 ret :end", expected: Ok, stack: []int{1, 2}, ip: 11, steps: 5},
+		"Return without call":            {source: "psh 1 ret", expected: CallStackUnderflow, stack: []int{1}, ip: 2, steps: 2},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			program, err := lexer.NewLexer(tc.source).Lex()
+			require.NoError(t, err)
+
+			if tc.withoutEndOfFile {
+				program = program[:len(program)-1]
+			}
+
+			v, out, runErr := run(program, fuzzBudget)
+			assert.Equal(t, tc.expected, runErr)
+			assert.Equal(t, tc.out, out)
+			assert.Equal(t, tc.stack, append([]int{}, v.Stack...))
+			assert.Equal(t, tc.ip, v.InstructionPointer)
+			assert.Equal(t, tc.steps, v.Steps())
+		})
+	}
+}
+
+func TestCompile_Fib(t *testing.T) {
+	v, _, err := run(tokenize(t, fibSource), math.MaxInt)
+	require.Equal(t, Error(Ok), err)
+	assert.Equal(t, []int{6765}, v.Stack)
+}
+
+func TestCompile_Arithmetic(t *testing.T) {
+	for source, steps := range map[string]int{arithmeticSource: 2500006, arithmeticFusedSource: 2200006} {
+		v, _, err := run(tokenize(t, source), math.MaxInt)
+		require.Equal(t, Error(Ok), err)
+
+		assert.Empty(t, v.Stack)
+		assert.Equal(t, []int{0}, v.Memory)
+		assert.Equal(t, steps, v.Steps())
+	}
+}
+
+func TestCompile_Superinstructions(t *testing.T) {
+	v, _, err := run(tokenize(t, "psh 2 addi 3 psh 7 dup2 jeq l psh 1 :l"), 100)
+	require.Equal(t, Error(Ok), err)
+	assert.Equal(t, []int{5, 7, 0, 1}, v.Stack)
+
+	v, _, err = run(tokenize(t, "psh 2 dupl 0 jeq l psh 1 :l"), 100)
+	require.Equal(t, Error(Ok), err)
+	assert.Equal(t, []int{1}, v.Stack)
+
+	_, _, err = run(tokenize(t, "psh 2 dup2"), 100)
+	assert.Equal(t, Error(StackUnderflow), err)
+}
+
+func TestCompile_NewProgram(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1"))
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 10, nil))
+
+	// The compiled program follows the loaded one.
+	v.LoadProgram(tokenize(t, "psh 2 psh 3"))
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 10, nil))
+	assert.Equal(t, []int{1, 2, 3}, v.Stack)
+}
+
+func benchmarkExecute(b *testing.B, source string) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	program := tokenize(b, source)
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := run(program, math.MaxInt); err != Ok {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecute_Fib(b *testing.B) {
+	benchmarkExecute(b, fibSource)
+}
+
+func BenchmarkExecute_Arithmetic(b *testing.B) {
+	benchmarkExecute(b, arithmeticSource)
+}
+
+func BenchmarkExecute_ArithmeticFused(b *testing.B) {
+	benchmarkExecute(b, arithmeticFusedSource)
+}
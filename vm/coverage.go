@@ -0,0 +1,256 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+type BranchCoverage struct {
+	Taken    int
+	NotTaken int
+}
+
+type Coverage struct {
+	Hits     map[int]int
+	Branches map[int]*BranchCoverage
+}
+
+type CoverageSummary struct {
+	Instructions        int
+	CoveredInstructions int
+
+	Lines        int
+	CoveredLines int
+
+	// Every `jif` has two branches: taken and not taken.
+	Branches        int
+	CoveredBranches int
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{
+		Hits:     make(map[int]int),
+		Branches: make(map[int]*BranchCoverage),
+	}
+}
+
+func (a *VirtualMachine) EnableCoverage() {
+	a.Coverage = NewCoverage()
+}
+
+// Record accounts a single execution of the instruction at address.
+// For `jif` and `jeq` taken tells which way it went.
+func (c *Coverage) Record(address int, kind token.Kind, taken bool) {
+	c.Hits[address]++
+
+	if !isBranch(kind) {
+		return
+	}
+
+	branch, ok := c.Branches[address]
+	if !ok {
+		branch = &BranchCoverage{}
+		c.Branches[address] = branch
+	}
+
+	if taken {
+		branch.Taken++
+	} else {
+		branch.NotTaken++
+	}
+}
+
+// isBranch reports whether an instruction goes one of two ways.
+func isBranch(kind token.Kind) bool {
+	return kind == token.JumpIfTrue || kind == token.JumpIfEqual
+}
+
+// Merge adds everything other recorded to c.
+func (c *Coverage) Merge(other *Coverage) {
+	for address, hits := range other.Hits {
+		c.Hits[address] += hits
+	}
+
+	for address, branch := range other.Branches {
+		mine, ok := c.Branches[address]
+		if !ok {
+			mine = &BranchCoverage{}
+			c.Branches[address] = mine
+		}
+
+		mine.Taken += branch.Taken
+		mine.NotTaken += branch.NotTaken
+	}
+}
+
+func (c *Coverage) Summary(instructions []token.Token) CoverageSummary {
+	s := CoverageSummary{}
+	lines := coverageLines(instructions, c.Hits)
+
+	for address, t := range instructions {
+		if !isCoverable(t) {
+			continue
+		}
+
+		s.Instructions++
+		if c.Hits[address] > 0 {
+			s.CoveredInstructions++
+		}
+
+		if isBranch(t.Kind) {
+			s.Branches += 2
+			if b, ok := c.Branches[address]; ok {
+				s.CoveredBranches += countIfPositive(b.Taken) + countIfPositive(b.NotTaken)
+			}
+		}
+	}
+
+	for _, hits := range lines {
+		s.Lines++
+		if hits > 0 {
+			s.CoveredLines++
+		}
+	}
+
+	return s
+}
+
+func (c *Coverage) WriteSummary(w io.Writer, instructions []token.Token) {
+	s := c.Summary(instructions)
+
+	fmt.Fprintf(w, "coverage: %s of instructions (%d/%d), %s of lines (%d/%d), %s of branches (%d/%d)\n",
+		percent(s.CoveredInstructions, s.Instructions), s.CoveredInstructions, s.Instructions,
+		percent(s.CoveredLines, s.Lines), s.CoveredLines, s.Lines,
+		percent(s.CoveredBranches, s.Branches), s.CoveredBranches, s.Branches)
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format, with a
+// record for every file of the program, so it can be fed into genhtml or
+// editor plugins. Instructions of the main file, which carry no file, are
+// keyed on sourcePath.
+func (c *Coverage) WriteLCOV(w io.Writer, instructions []token.Token, sourcePath string) error {
+	lines := coverageLines(instructions, c.Hits)
+
+	// bufio keeps the first error of the writes, which Flush returns.
+	bw := bufio.NewWriter(w)
+
+	for _, file := range coverageFiles(instructions) {
+		name := file
+		if name == "" {
+			name = sourcePath
+		}
+
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", name)
+
+		branchesFound, branchesHit := 0, 0
+		for address, t := range instructions {
+			if !isBranch(t.Kind) || t.File != file {
+				continue
+			}
+
+			taken, notTaken := "-", "-"
+			if b, ok := c.Branches[address]; ok {
+				taken, notTaken = fmt.Sprint(b.Taken), fmt.Sprint(b.NotTaken)
+				branchesHit += countIfPositive(b.Taken) + countIfPositive(b.NotTaken)
+			}
+
+			branchesFound += 2
+			fmt.Fprintf(bw, "BRDA:%d,%d,0,%s\n", t.LineStart+1, address, taken)
+			fmt.Fprintf(bw, "BRDA:%d,%d,1,%s\n", t.LineStart+1, address, notTaken)
+		}
+
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", branchesFound, branchesHit)
+
+		numbers := []int{}
+		for line := range lines {
+			if line.file == file {
+				numbers = append(numbers, line.line)
+			}
+		}
+
+		sort.Ints(numbers)
+
+		linesHit := 0
+		for _, number := range numbers {
+			hits := lines[sourceLine{file, number}]
+			fmt.Fprintf(bw, "DA:%d,%d\n", number, hits)
+			if hits > 0 {
+				linesHit++
+			}
+		}
+
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(numbers), linesHit)
+	}
+
+	return bw.Flush()
+}
+
+// coverageFiles returns the files holding instructions, in the order
+// they come in the program.
+func coverageFiles(instructions []token.Token) []string {
+	files := []string{}
+	seen := make(map[string]bool)
+
+	for _, t := range instructions {
+		if isCoverable(t) && !seen[t.File] {
+			seen[t.File] = true
+			files = append(files, t.File)
+		}
+	}
+
+	return files
+}
+
+// sourceLine is a 1-based line of a file of the program. The main file
+// has no name.
+type sourceLine struct {
+	file string
+	line int
+}
+
+// coverageLines maps every source line holding an instruction to the
+// number of times it was executed.
+func coverageLines(instructions []token.Token, hits map[int]int) map[sourceLine]int {
+	lines := make(map[sourceLine]int)
+
+	for address, t := range instructions {
+		if !isCoverable(t) {
+			continue
+		}
+
+		line := sourceLine{t.File, t.LineStart + 1}
+		if hits[address] > lines[line] {
+			lines[line] = hits[address]
+			continue
+		}
+
+		if _, ok := lines[line]; !ok {
+			lines[line] = 0
+		}
+	}
+
+	return lines
+}
+
+// isCoverable reports whether the token is an instruction. Operands,
+// labels and the end of file are executed as part of their neighbours.
+func isCoverable(t token.Token) bool {
+	switch t.Kind {
+	case token.Number, token.Identifier, token.Label, token.EndOfLine:
+		return false
+	}
+
+	return true
+}
+
+func countIfPositive(n int) int {
+	if n > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jejikeh/ambient/lexer"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const coverageSource = `psh 1
+jif hello
+psh 2
+:hello
+psh 3`
+
+func TestCoverage_Summary(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, coverageSource))
+	v.EnableCoverage()
+
+	v.Execute(100, false)
+
+	s := v.Coverage.Summary(v.Instructions)
+	assert.Equal(t, CoverageSummary{
+		Instructions:        4,
+		CoveredInstructions: 3,
+		Lines:               4,
+		CoveredLines:        3,
+		Branches:            2,
+		CoveredBranches:     1,
+	}, s)
+
+	require.Contains(t, v.Coverage.Branches, 2)
+	assert.Equal(t, BranchCoverage{Taken: 1}, *v.Coverage.Branches[2])
+}
+
+func TestCoverage_WriteLCOV(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, coverageSource))
+	v.EnableCoverage()
+	v.Execute(100, false)
+
+	var b strings.Builder
+	err := v.Coverage.WriteLCOV(&b, v.Instructions, "cover.naive")
+	require.NoError(t, err)
+
+	expected := `TN:
+SF:cover.naive
+BRDA:2,2,0,1
+BRDA:2,2,1,0
+BRF:2
+BRH:1
+DA:1,1
+DA:2,1
+DA:3,0
+DA:5,1
+LF:4
+LH:3
+end_of_record
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestCoverage_WriteLCOVIncludes(t *testing.T) {
+	program, err := lexer.LoadFS(fstest.MapFS{
+		"main.naive": {Data: []byte("include \"lib.naive\"\npsh 1\ncall one")},
+		"lib.naive":  {Data: []byte("export one\n:one\npsh 2\nret")},
+	}, "main.naive")
+	require.NoError(t, err)
+
+	v := NewVirtualMachine()
+	v.LoadProgram(program)
+	v.EnableCoverage()
+	v.Execute(100, false)
+
+	var b strings.Builder
+	require.NoError(t, v.Coverage.WriteLCOV(&b, v.Instructions, "main.naive"))
+
+	expected := `TN:
+SF:main.naive
+BRF:0
+BRH:0
+DA:2,1
+DA:3,1
+LF:2
+LH:2
+end_of_record
+TN:
+SF:lib.naive
+BRF:0
+BRH:0
+DA:3,1
+DA:4,1
+LF:2
+LH:2
+end_of_record
+`
+	assert.Equal(t, expected, b.String())
+
+	assert.ErrorIs(t, v.Coverage.WriteLCOV(failingWriter{}, v.Instructions, "main.naive"), errClosed)
+}
+
+var errClosed = errors.New("closed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errClosed
+}
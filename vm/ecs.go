@@ -0,0 +1,248 @@
+package vm
+
+import (
+	"github.com/jejikeh/ambient/ecs"
+	"github.com/jejikeh/ambient/token"
+)
+
+// Components and systems are referred to by labels: the name of the
+// label is the name given to the ecs.World, and its address identifies
+// the component in `attach` and in system queries.
+
+type fieldRef struct {
+	Component ecs.ComponentID
+	Index     int
+}
+
+// labelName returns the name of the label declared at address.
+func (a *VirtualMachine) labelName(address int) (string, Error) {
+	if address < 0 || address >= len(a.Instructions) || a.Instructions[address].Kind != token.Label {
+		return "", IllegalInstructionAccess
+	}
+
+	return a.Instructions[address].Name, Ok
+}
+
+func (a *VirtualMachine) componentAt(address int) (ecs.ComponentID, Error) {
+	id, ok := a.components[address]
+	if !ok {
+		return 0, UnknownComponent
+	}
+
+	return id, Ok
+}
+
+// registerComponent runs `comp`: it registers the component named by the
+// label at address, with the number of fields on top of the stack. The
+// fields get the next free field ids.
+func (a *VirtualMachine) registerComponent(address int) Error {
+	name, err := a.labelName(address)
+	if err != Ok {
+		return err
+	}
+
+	if len(a.Stack) < 1 {
+		return StackUnderflow
+	}
+
+	fields := a.Stack[len(a.Stack)-1]
+	if fields < 0 || fields > MemorySize {
+		return IllegalInstruction
+	}
+
+	id, werr := a.World.RegisterComponent(name, fields)
+	if werr != nil {
+		return IllegalInstruction
+	}
+
+	a.Stack = a.Stack[:len(a.Stack)-1]
+
+	if _, ok := a.components[address]; !ok {
+		a.components[address] = id
+		for i := 0; i < fields; i++ {
+			a.fields = append(a.fields, fieldRef{Component: id, Index: i})
+		}
+	}
+
+	return Ok
+}
+
+func (a *VirtualMachine) spawnEntity(address int) Error {
+	name, err := a.labelName(address)
+	if err != Ok {
+		return err
+	}
+
+	e, werr := a.World.Spawn(name)
+	if werr != nil {
+		return IllegalInstruction
+	}
+
+	a.Entity = e
+
+	return Ok
+}
+
+func (a *VirtualMachine) attach(address int) Error {
+	id, err := a.componentAt(address)
+	if err != Ok {
+		return err
+	}
+
+	if a.World.Add(a.Entity, id) != nil {
+		return MissingComponent
+	}
+
+	return Ok
+}
+
+// registerSystem runs `system`: the routine at address runs for every
+// entity which has the components whose label addresses are on the
+// stack, under their count.
+func (a *VirtualMachine) registerSystem(address int) Error {
+	name, err := a.labelName(address)
+	if err != Ok {
+		return err
+	}
+
+	if len(a.Stack) < 1 {
+		return StackUnderflow
+	}
+
+	count := a.Stack[len(a.Stack)-1]
+	if count < 0 || count > len(a.Stack)-1 {
+		return StackUnderflow
+	}
+
+	query := make([]ecs.ComponentID, 0, count)
+	for _, componentAddress := range a.Stack[len(a.Stack)-1-count : len(a.Stack)-1] {
+		id, err := a.componentAt(componentAddress)
+		if err != Ok {
+			return err
+		}
+
+		query = append(query, id)
+	}
+
+	a.Stack = a.Stack[:len(a.Stack)-1-count]
+
+	system := &ecs.System{
+		Name:   name,
+		Query:  query,
+		Access: a.access(address),
+		Run:    a.systemRun(address),
+	}
+
+	if a.World.AddSystem(system) != nil {
+		return UnknownComponent
+	}
+
+	a.routines[system] = address
+
+	return Ok
+}
+
+// systemRun returns the Run function of a system running the routine at
+// address on this VM.
+func (a *VirtualMachine) systemRun(address int) func(e ecs.Entity) error {
+	return func(e ecs.Entity) error {
+		current := a.Entity
+		a.Entity = e
+		defer func() { a.Entity = current }()
+
+		if err := a.callRoutine(address); err != Ok {
+			return err
+		}
+
+		return nil
+	}
+}
+
+func (a *VirtualMachine) field(id int) (fieldRef, Error) {
+	if id < 0 || id >= len(a.fields) {
+		return fieldRef{}, UnknownComponent
+	}
+
+	return a.fields[id], Ok
+}
+
+func (a *VirtualMachine) getField(id int) (int, Error) {
+	f, err := a.field(id)
+	if err != Ok {
+		return 0, err
+	}
+
+	value, werr := a.World.Get(a.Entity, f.Component, f.Index)
+	if werr != nil {
+		return 0, MissingComponent
+	}
+
+	return value, Ok
+}
+
+func (a *VirtualMachine) setField(id int, value int) Error {
+	f, err := a.field(id)
+	if err != Ok {
+		return err
+	}
+
+	if a.changed != nil {
+		cell := fieldCell{a.Entity, f.Component, f.Index}
+		if _, ok := a.changed[cell]; !ok {
+			old, werr := a.World.Get(a.Entity, f.Component, f.Index)
+			if werr != nil {
+				return MissingComponent
+			}
+
+			a.changed[cell] = old
+		}
+	}
+
+	if a.World.Set(a.Entity, f.Component, f.Index, value) != nil {
+		return MissingComponent
+	}
+
+	return Ok
+}
+
+// callRoutine runs the routine at address until it returns, as if it was
+// called by `call`, then drops the value it left on the stack.
+func (a *VirtualMachine) callRoutine(address int) Error {
+	if len(a.CallStack) >= CallStackLimit {
+		return CallStackOverflow
+	}
+
+	returnAddress := a.InstructionPointer
+	depth := len(a.CallStack)
+
+	a.systemDepth++
+	defer func() { a.systemDepth-- }()
+
+	a.CallStack = append(a.CallStack, returnAddress)
+	a.InstructionPointer = address
+
+	for len(a.CallStack) > depth {
+		if a.stepLimit > 0 && a.steps >= a.stepLimit {
+			return BudgetExceeded
+		}
+
+		// A routine which runs off the end of the program never returns.
+		if a.reachedEndOfFile() {
+			return IllegalInstructionAccess
+		}
+
+		if err := a.step(); err != Ok {
+			return err
+		}
+	}
+
+	a.InstructionPointer = returnAddress
+
+	if len(a.Stack) < 1 {
+		return StackUnderflow
+	}
+
+	a.Stack = a.Stack[:len(a.Stack)-1]
+
+	return Ok
+}
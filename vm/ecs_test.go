@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jejikeh/ambient/ecs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_EntitiesAndSystems(t *testing.T) {
+	source := `psh 1 comp c_position
+entity e_cat attach c_position psh 3 setf 0
+entity e_dog attach c_position psh 5 setf 0
+psh c_position psh 1 system move
+tick tick
+jmp end
+:c_position
+:e_cat
+:e_dog
+:move
+getf 0 psh 1 sum dupl 0 setf 0 out
+psh 0 ret
+:end`
+
+	var out bytes.Buffer
+	v := NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(tokenize(t, source))
+
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 1000, nil))
+	assert.Equal(t, "4657", out.String())
+	assert.Empty(t, v.Stack)
+	assert.Empty(t, v.CallStack)
+
+	position, ok := v.World.ComponentByName("c_position")
+	require.True(t, ok)
+
+	entities, err := v.World.Query(position)
+	require.NoError(t, err)
+	require.Len(t, entities, 2)
+	assert.Equal(t, "e_dog", v.World.Name(entities[1]))
+
+	x, err := v.World.Get(entities[1], position, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 7, x)
+}
+
+func TestRun_SystemsOfEntitiesSpawnedFromGo(t *testing.T) {
+	source := `psh 1 comp c_health
+psh c_health psh 1 system print
+tick
+jmp end
+:c_health
+:print
+getf 0 out
+psh 0 ret
+:end`
+
+	var out bytes.Buffer
+	v := NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(tokenize(t, source))
+
+	// Run until the component is registered, then spawn from the host.
+	require.Equal(t, Error(BudgetExceeded), v.ExecuteFrom(0, 3, nil))
+
+	health, ok := v.World.ComponentByName("c_health")
+	require.True(t, ok)
+
+	e, err := v.World.Spawn("e_host", health)
+	require.NoError(t, err)
+	require.NoError(t, v.World.Set(e, health, 0, 42))
+
+	require.Equal(t, Error(Ok), v.ExecuteFrom(v.InstructionPointer, 1000, nil))
+	assert.Equal(t, "42", out.String())
+	assert.Equal(t, ecs.NoEntity, v.Entity)
+}
+
+func TestRun_EntityErrors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected Error
+	}{
+		"Component without label":  {source: "psh 1 comp 0", expected: IllegalInstructionAccess},
+		"Attach unknown component": {source: "entity e attach e :e", expected: UnknownComponent},
+		"Unknown field":            {source: "getf 0", expected: UnknownComponent},
+		"Field without entity":     {source: "psh 1 comp c getf 0 :c", expected: MissingComponent},
+		"System without count":     {source: "system s :s", expected: StackUnderflow},
+		"System over budget":       {source: "psh 0 system s tick :s jmp s", expected: BudgetExceeded},
+		"System without return":    {source: "psh 0 system s tick jmp end :s psh 1 :end", expected: IllegalInstructionAccess},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.LoadProgram(tokenize(t, tc.source))
+
+			assert.Equal(t, tc.expected, v.ExecuteFrom(0, 1000, nil))
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// Fibers are green threads of a VM. Each has its own stack, call stack and
+// instruction pointer, and they share the memory and the entities. Only
+// one fiber runs at a time: the others wait until it yields, waits on a
+// channel or ends, then the next one in line runs. The program starts as
+// fiber 0. The others end by returning from the routine they started at,
+// and the program ends when any fiber runs off its end, whatever the
+// others are doing.
+//
+// The fibers are only set up by the first fiber instruction, so programs
+// without any do not pay for them. Systems run outside of the fibers:
+// fiber instructions fail in them.
+
+// fiber is the saved state of a fiber which is not running.
+type fiber struct {
+	id        int
+	stack     []int
+	callStack []int
+	ip        int
+
+	// waiting is the channel the fiber waits on, with the address of the
+	// `send` or `recv` waiting, and the value a `send` waits to hand over.
+	waiting *channel
+	at      int
+	value   int
+}
+
+type channel struct {
+	id       int
+	capacity int
+	buffer   []int
+
+	// senders and receivers are the fibers waiting on the channel, in
+	// the order they came.
+	senders   []*fiber
+	receivers []*fiber
+}
+
+// fibers is the state of the fibers of a VM.
+type fibers struct {
+	// current is the running fiber. Its state is the one of the VM, the
+	// fiber itself is only up to date while it is not running.
+	current *fiber
+	// ready holds the fibers which can run, in the order they will.
+	ready []*fiber
+	// waiting holds the fibers waiting on channels.
+	waiting  []*fiber
+	channels []*channel
+	nextID   int
+}
+
+// BlockedFiber is a fiber a DeadlockError found waiting. Line and Column
+// are 1-based, File is only set for instructions of included files.
+type BlockedFiber struct {
+	Fiber     int
+	Operation string
+	Channel   int
+	Address   int
+	File      string
+	Line      int
+	Column    int
+}
+
+// DeadlockError describes the fibers waiting on each other when Run
+// returns Deadlock.
+type DeadlockError struct {
+	Fibers []BlockedFiber
+}
+
+func (e *DeadlockError) Error() string {
+	blocked := make([]string, 0, len(e.Fibers))
+	for _, f := range e.Fibers {
+		position := fmt.Sprintf("%d:%d", f.Line, f.Column)
+		if f.File != "" {
+			position = f.File + ":" + position
+		}
+
+		blocked = append(blocked, fmt.Sprintf("fiber %d waits in %s on channel %d at %s", f.Fiber, f.Operation, f.Channel, position))
+	}
+
+	return fmt.Sprintf("%s: %s", Deadlock, strings.Join(blocked, ", "))
+}
+
+// fiberState returns the state of the fibers, setting it up on first use with
+// the running program as fiber 0.
+func (a *VirtualMachine) fiberState() (*fibers, Error) {
+	if a.systemDepth > 0 {
+		return nil, IllegalInstruction
+	}
+
+	if a.fibers == nil {
+		a.fibers = &fibers{current: &fiber{id: 0}, nextID: 1}
+	}
+
+	return a.fibers, Ok
+}
+
+// startFiber runs `spawn`: it starts a fiber at address, with the
+// argument on its stack.
+func (a *VirtualMachine) startFiber(address int, argument int) Error {
+	f, err := a.fiberState()
+	if err != Ok {
+		return err
+	}
+
+	f.ready = append(f.ready, &fiber{id: f.nextID, stack: []int{argument}, callStack: []int{}, ip: address})
+	f.nextID++
+
+	return Ok
+}
+
+// yield runs `yield`: the running fiber goes last in line, and the first
+// one runs. The instruction pointer is already past the `yield`.
+func (a *VirtualMachine) yield() Error {
+	f, err := a.fiberState()
+	if err != Ok || len(f.ready) == 0 {
+		return err
+	}
+
+	f.ready = append(f.ready, a.saveFiber())
+	a.runNextFiber()
+
+	return Ok
+}
+
+// endFiber ends the running fiber, which is not fiber 0, and runs the
+// next one.
+func (a *VirtualMachine) endFiber() Error {
+	f := a.fibers
+	if len(f.ready) == 0 {
+		return a.deadlock()
+	}
+
+	a.runNextFiber()
+
+	return Ok
+}
+
+// endsFiber reports whether a `ret` with nothing to return to ends a
+// fiber rather than failing.
+func (a *VirtualMachine) endsFiber() bool {
+	return a.fibers != nil && a.systemDepth == 0 && a.fibers.current.id != 0
+}
+
+func (a *VirtualMachine) saveFiber() *fiber {
+	current := a.fibers.current
+	current.stack, current.callStack, current.ip = a.Stack, a.CallStack, a.InstructionPointer
+
+	return current
+}
+
+func (a *VirtualMachine) runNextFiber() {
+	f := a.fibers
+
+	next := f.ready[0]
+	f.ready = f.ready[1:]
+
+	f.current = next
+	a.Stack, a.CallStack, a.InstructionPointer = next.stack, next.callStack, next.ip
+}
+
+// wait makes the running fiber wait on a channel from the instruction at
+// address, and runs the next one.
+func (a *VirtualMachine) wait(ch *channel, address int, value int) Error {
+	f := a.fibers
+
+	current := a.saveFiber()
+	current.waiting, current.at, current.value = ch, address, value
+	f.waiting = append(f.waiting, current)
+
+	if len(f.ready) == 0 {
+		return a.deadlock()
+	}
+
+	a.runNextFiber()
+
+	return Ok
+}
+
+// wake makes a fiber waiting on a channel ready.
+func (f *fibers) wake(w *fiber) {
+	for i, other := range f.waiting {
+		if other == w {
+			f.waiting = append(f.waiting[:i], f.waiting[i+1:]...)
+			break
+		}
+	}
+
+	w.waiting = nil
+	f.ready = append(f.ready, w)
+}
+
+func (a *VirtualMachine) deadlock() Error {
+	e := &DeadlockError{}
+	for _, w := range a.fibers.waiting {
+		operation := "recv"
+		if a.Instructions[w.at].Kind == token.Send {
+			operation = "send"
+		}
+
+		instruction := a.Instructions[w.at]
+		e.Fibers = append(e.Fibers, BlockedFiber{
+			Fiber:     w.id,
+			Operation: operation,
+			Channel:   w.waiting.id,
+			Address:   w.at,
+			File:      instruction.File,
+			Line:      instruction.LineStart + 1,
+			Column:    instruction.CollumnStart + 1,
+		})
+	}
+
+	a.LastDeadlock = e
+
+	return Deadlock
+}
+
+// newChannel runs `chan_new`.
+func (a *VirtualMachine) newChannel(capacity int) (int, Error) {
+	f, err := a.fiberState()
+	if err != Ok {
+		return 0, err
+	}
+
+	if capacity < 0 || capacity > MemorySize {
+		return 0, IllegalInstruction
+	}
+
+	ch := &channel{id: len(f.channels), capacity: capacity}
+	f.channels = append(f.channels, ch)
+
+	return ch.id, Ok
+}
+
+func (a *VirtualMachine) channel(id int) (*channel, Error) {
+	f, err := a.fiberState()
+	if err != Ok {
+		return nil, err
+	}
+
+	if id < 0 || id >= len(f.channels) {
+		return nil, UnknownChannel
+	}
+
+	return f.channels[id], Ok
+}
+
+// send runs the `send` at address. The instruction pointer is already
+// past it.
+func (a *VirtualMachine) send(address int, id int, value int) Error {
+	ch, err := a.channel(id)
+	if err != Ok {
+		return err
+	}
+
+	f := a.fibers
+
+	if len(ch.receivers) > 0 {
+		r := ch.receivers[0]
+		ch.receivers = ch.receivers[1:]
+
+		r.stack = append(r.stack, value)
+		f.wake(r)
+
+		return Ok
+	}
+
+	if len(ch.buffer) < ch.capacity {
+		ch.buffer = append(ch.buffer, value)
+		return Ok
+	}
+
+	ch.senders = append(ch.senders, f.current)
+
+	return a.wait(ch, address, value)
+}
+
+// receive runs the `recv` at address. The instruction pointer is already
+// past it.
+func (a *VirtualMachine) receive(address int, id int) Error {
+	ch, err := a.channel(id)
+	if err != Ok {
+		return err
+	}
+
+	f := a.fibers
+
+	if len(ch.buffer) > 0 {
+		value := ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+
+		// A sender waiting for room gets it.
+		if len(ch.senders) > 0 {
+			s := ch.senders[0]
+			ch.senders = ch.senders[1:]
+
+			ch.buffer = append(ch.buffer, s.value)
+			f.wake(s)
+		}
+
+		a.Stack = append(a.Stack, value)
+
+		return Ok
+	}
+
+	if len(ch.senders) > 0 {
+		s := ch.senders[0]
+		ch.senders = ch.senders[1:]
+
+		a.Stack = append(a.Stack, s.value)
+		f.wake(s)
+
+		return Ok
+	}
+
+	ch.receivers = append(ch.receivers, f.current)
+
+	return a.wait(ch, address, 0)
+}
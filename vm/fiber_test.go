@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiber_Pipeline(t *testing.T) {
+	source, err := os.ReadFile("../examples/pipeline.naive")
+	require.NoError(t, err)
+
+	program, err := lexer.NewLexer(string(source)).Lex()
+	require.NoError(t, err)
+
+	v, out, runErr := run(program, fuzzBudget)
+	require.Equal(t, Error(Ok), runErr)
+
+	assert.Equal(t, "2 4 6 8 10 ", out)
+	assert.Empty(t, v.Stack)
+}
+
+func TestFiber_YieldTakesTurns(t *testing.T) {
+	// Both fibers print their argument three times, yielding after each.
+	source := `psh 97 spawn letter
+psh 98 spawn letter
+psh 3
+:main
+yield
+psh 1 sub
+dupl 0 psh 0 gt jif next
+pop pop jmp end
+:next
+pop jmp main
+:letter
+psh 3
+:again
+dupl 1 outc
+yield
+psh 1 sub
+dupl 0 psh 0 gt jif more
+pop pop pop ret
+:more
+pop jmp again
+:end`
+
+	v, out, err := run(tokenize(t, source), fuzzBudget)
+	require.Equal(t, Error(Ok), err)
+
+	assert.Equal(t, "ababab", out)
+	assert.Empty(t, v.Stack)
+}
+
+func TestFiber_UnbufferedSendWaitsForReceive(t *testing.T) {
+	// The sender runs first, and waits in `send` until the main fiber
+	// receives.
+	source := `psh 0 chan_new store 0
+psh 0 spawn sender
+yield
+psh 49 outc
+load 0 recv out
+yield
+psh 51 outc
+jmp end
+:sender
+pop
+psh 48 outc
+load 0 psh 7 send
+psh 50 outc
+ret
+:end`
+
+	v, out, err := run(tokenize(t, source), fuzzBudget)
+	require.Equal(t, Error(Ok), err)
+
+	assert.Equal(t, "01723", out)
+	assert.Empty(t, v.Stack)
+}
+
+func TestFiber_BufferedChannel(t *testing.T) {
+	// Two values fit in the buffer, the third waits for a `recv`.
+	source := `psh 2 chan_new store 0
+load 0 psh 1 send
+load 0 psh 2 send
+psh 0 spawn third
+load 0 recv
+load 0 recv
+load 0 recv
+jmp end
+:third
+pop load 0 psh 3 send ret
+:end`
+
+	v, _, err := run(tokenize(t, source), fuzzBudget)
+	require.Equal(t, Error(Ok), err)
+
+	assert.Equal(t, []int{1, 2, 3}, v.Stack)
+}
+
+func TestFiber_Deadlock(t *testing.T) {
+	source := `psh 0 chan_new store 0
+psh 0 chan_new store 1
+psh 0 spawn other
+load 0 recv
+jmp end
+:other
+pop
+load 1 recv
+ret
+:end`
+
+	v, _, err := run(tokenize(t, source), fuzzBudget)
+	require.Equal(t, Error(Deadlock), err)
+
+	require.NotNil(t, v.LastDeadlock)
+	assert.Equal(t, []BlockedFiber{
+		{Fiber: 0, Operation: "recv", Channel: 0, Address: 16, Line: 4, Column: 8},
+		{Fiber: 1, Operation: "recv", Channel: 1, Address: 23, Line: 8, Column: 8},
+	}, v.LastDeadlock.Fibers)
+	assert.EqualError(t, v.LastDeadlock, "Deadlock: fiber 0 waits in recv on channel 0 at 4:8, fiber 1 waits in recv on channel 1 at 8:8")
+
+	// The run stops at the instruction which waited last.
+	assert.Equal(t, 23, v.InstructionPointer)
+}
+
+func TestFiber_Errors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected Error
+	}{
+		"Unknown channel":       {source: "psh 3 psh 1 send", expected: UnknownChannel},
+		"Negative capacity":     {source: "psh 1 psh 2 sub chan_new", expected: IllegalInstruction},
+		"Fiber without value":   {source: "spawn f :f ret", expected: StackUnderflow},
+		"Fiber out of program":  {source: "psh 0 spawn 100", expected: IllegalInstructionAccess},
+		"Main fiber returns":    {source: "psh 0 spawn f :f ret", expected: CallStackUnderflow},
+		"Last fiber ends":       {source: "psh 0 chan_new psh 0 spawn f recv :f pop ret", expected: Deadlock},
+		"Fiber in a system":     {source: "psh 0 system s tick jmp end :s yield psh 0 ret :end", expected: IllegalInstruction},
+		"Channel in a system":   {source: "psh 0 system s tick jmp end :s psh 0 chan_new ret :end", expected: IllegalInstruction},
+		"Receive without value": {source: "recv", expected: StackUnderflow},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			program := tokenize(t, tc.source)
+
+			_, _, err := run(program, 1000)
+			assert.Equal(t, tc.expected, err)
+		})
+	}
+}
+
+func TestFiber_Verify(t *testing.T) {
+	heights, err := Verify(tokenize(t, "psh 0 spawn f jmp end :f pop ret :end"))
+	require.NoError(t, err)
+
+	// The fiber starts with its argument on the stack.
+	assert.Equal(t, 1, heights[6])
+
+	_, err = Verify(tokenize(t, "psh 0 spawn f jmp end :f pop pop ret :end"))
+	assert.EqualError(t, err, "1:30: stack can underflow: pop takes 1, the stack can have 0")
+}
+
+func BenchmarkFiber_Pipeline(b *testing.B) {
+	source, err := os.ReadFile("../examples/pipeline.naive")
+	require.NoError(b, err)
+
+	program := tokenize(b, string(source))
+
+	v := NewVirtualMachine()
+	v.LoadProgram(program)
+
+	var out bytes.Buffer
+	v.Output = &out
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v.Stack, v.Memory, v.fibers = v.Stack[:0], v.Memory[:0], nil
+		out.Reset()
+
+		if err := v.ExecuteFrom(0, fuzzBudget, nil); err != Ok {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+)
+
+const fuzzBudget = 1000
+
+// addExamples adds every naive example as a seed.
+func addExamples(f *testing.F) {
+	err := filepath.WalkDir("../examples", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".naive" {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		f.Add(string(content))
+		return nil
+	})
+
+	if err != nil {
+		f.Fatal(err)
+	}
+}
+
+func FuzzExecute(f *testing.F) {
+	log.SetOutput(io.Discard)
+	addExamples(f)
+
+	f.Add("psh")
+	f.Add("psh 1 dupl")
+	f.Add("dupl 0")
+	f.Add("psh 1 dupl 5")
+	f.Add(":l jmp")
+	f.Add("psh 1 comp c entity e attach c psh 2 setf 0 getf 0 :c :e")
+	f.Add("psh 0 system s tick :s tick")
+
+	f.Fuzz(func(t *testing.T, source string) {
+		program, err := lexer.NewLexer(source).Lex()
+		if err != nil {
+			return
+		}
+
+		v := NewVirtualMachine()
+		v.LoadProgram(program)
+		v.ExecuteFrom(0, fuzzBudget, nil)
+
+		// The end of file token can be missing in programs which are
+		// loaded from binaries.
+		v = NewVirtualMachine()
+		v.LoadProgram(program[:len(program)-1])
+		v.ExecuteFrom(0, fuzzBudget, nil)
+	})
+}
+
+// FuzzVerify runs every program Verify accepts both checked and verified,
+// which must end the same way.
+func FuzzVerify(f *testing.F) {
+	log.SetOutput(io.Discard)
+	addExamples(f)
+
+	f.Add("psh 1 psh 0 div")
+	f.Add("psh 6 psh 2 div psh 0 div out")
+	f.Add("psh 3 :l psh 1 sub dupl 0 psh 0 jeq end psh 1 jif l :end pop")
+	f.Add("psh 5 spawn f yield jmp end :f psh 1 sum psh 2 mul ret :end")
+	f.Add(":l call l")
+
+	f.Fuzz(func(t *testing.T, source string) {
+		program, err := lexer.NewLexer(source).Lex()
+		if err != nil {
+			return
+		}
+
+		if _, err := Verify(program); err != nil {
+			return
+		}
+
+		want, wantOut, wantErr := run(program, fuzzBudget)
+
+		var out bytes.Buffer
+		v := NewVirtualMachine()
+		v.Output = &out
+		v.LoadProgram(program)
+		if err := v.Verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := v.ExecuteFrom(0, fuzzBudget, nil); err != wantErr {
+			t.Fatalf("verified run returned %s, checked run %s", err, wantErr)
+		}
+
+		if out.String() != wantOut {
+			t.Fatalf("verified run printed %q, checked run %q", out.String(), wantOut)
+		}
+
+		if !slices.Equal(v.Stack, want.Stack) {
+			t.Fatalf("verified run left %v, checked run %v", v.Stack, want.Stack)
+		}
+
+		if v.InstructionPointer != want.InstructionPointer || v.steps != want.steps {
+			t.Fatalf("verified run stopped at %d after %d steps, checked run at %d after %d", v.InstructionPointer, v.steps, want.InstructionPointer, want.steps)
+		}
+	})
+}
+
+func TestRun_MissingOperand(t *testing.T) {
+	for _, kind := range []token.Kind{token.Push, token.Duplicate, token.Jump, token.JumpIfTrue, token.Component, token.GetField} {
+		v := NewVirtualMachine()
+		v.Stack = []int{1}
+		v.LoadProgram([]token.Token{{Kind: kind}})
+
+		if err := v.Run(); err != UnknownOperand {
+			t.Errorf("%s: expected %s, got %s", kind, UnknownOperand, err)
+		}
+	}
+}
+
+func TestRun_DuplicateChecksOperand(t *testing.T) {
+	tests := map[string]struct {
+		stack    []int
+		offset   int
+		expected Error
+	}{
+		"Negative offset": {stack: []int{1, 2}, offset: -1, expected: IllegalInstruction},
+		"Offset too deep": {stack: []int{1, 2}, offset: 2, expected: StackUnderflow},
+		"Deepest offset":  {stack: []int{1, 2}, offset: 1, expected: Ok},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.Stack = tc.stack
+			v.LoadProgram([]token.Token{{Kind: token.Duplicate}, {Kind: token.Number, TokenValue: token.TokenValue{IntegerValue: tc.offset}}})
+
+			if err := v.Run(); err != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Pool runs one Program for many jobs at once. Every job runs on its own
+// VirtualMachine, sharing the program, from address 0 until the program
+// ends, fails or runs out of budget.
+type Pool struct {
+	Program *Program
+
+	// Workers is the number of jobs run at once, or 0 for GOMAXPROCS.
+	// The systems of a job run one after another.
+	Workers int
+	// Budget is the number of instructions a job may run, unless it sets
+	// its own, or 0 for no limit.
+	Budget int
+}
+
+// Job is the input of one run.
+type Job struct {
+	// Stack is the stack the run starts with, the top last.
+	Stack []int
+	// Input is what `inc` reads.
+	Input []byte
+	// Budget overrides the budget of the pool, unless it is 0.
+	Budget int
+}
+
+// Result is what a run of a job left.
+type Result struct {
+	Stack  []int
+	Memory []int
+	Output []byte
+	Steps  int
+	Err    Error
+	// Assertion is set when Err is AssertionFailed.
+	Assertion *AssertionError
+}
+
+// Summary aggregates the results of the jobs of a Run.
+type Summary struct {
+	Jobs   int
+	Failed int
+	Steps  int
+	// Errors counts the failed jobs by error.
+	Errors map[Error]int
+}
+
+// Run runs the jobs and returns their results, in the order of the jobs.
+func (p *Pool) Run(jobs []Job) ([]Result, Summary) {
+	results := make([]Result, len(jobs))
+
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < min(workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				results[i] = p.run(jobs[i])
+			}
+		}()
+	}
+
+	for i := range jobs {
+		next <- i
+	}
+
+	close(next)
+	wg.Wait()
+
+	summary := Summary{Jobs: len(jobs), Errors: make(map[Error]int)}
+	for _, r := range results {
+		summary.Steps += r.Steps
+
+		if r.Err != Ok {
+			summary.Failed++
+			summary.Errors[r.Err]++
+		}
+	}
+
+	return results, summary
+}
+
+func (p *Pool) run(job Job) Result {
+	budget := job.Budget
+	if budget == 0 {
+		budget = p.Budget
+	}
+
+	if budget == 0 {
+		budget = math.MaxInt
+	}
+
+	var output bytes.Buffer
+
+	v := NewVirtualMachine()
+	v.Program = p.Program
+	v.Stack = append(v.Stack, job.Stack...)
+	v.Output = &output
+	v.Input = bytes.NewReader(job.Input)
+	v.Workers = 1
+
+	err := v.ExecuteFrom(0, budget, nil)
+
+	return Result{
+		Stack:     v.Stack,
+		Memory:    v.Memory,
+		Output:    output.Bytes(),
+		Steps:     v.Steps(),
+		Err:       err,
+		Assertion: v.LastAssertion,
+	}
+}
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fibOfStack is fibSource for the n on the stack.
+var fibOfStack = strings.TrimPrefix(fibSource, "psh 20\n")
+
+func fib(n int) int {
+	a, b := 0, 1
+	for i := 0; i < n; i++ {
+		a, b = b, a+b
+	}
+
+	return a
+}
+
+func TestPool_Run(t *testing.T) {
+	// The input is n, so that the program starts with an empty stack and
+	// can be verified.
+	program := NewProgram(tokenize(t, "inc\n"+fibOfStack))
+	instructions := append([]token.Token(nil), program.Instructions...)
+
+	verified, err := program.Verify()
+	require.NoError(t, err)
+
+	for name, program := range map[string]*Program{"Checked": program, "Verified": verified} {
+		t.Run(name, func(t *testing.T) {
+			jobs := make([]Job, 500)
+			for i := range jobs {
+				jobs[i] = Job{Input: []byte{byte(i % 15)}}
+			}
+
+			pool := &Pool{Program: program, Workers: 8}
+			results, summary := pool.Run(jobs)
+
+			require.Len(t, results, len(jobs))
+			steps := 0
+			for i, r := range results {
+				require.Equal(t, Error(Ok), r.Err)
+				assert.Equal(t, []int{fib(i % 15)}, r.Stack, "job %d", i)
+				steps += r.Steps
+			}
+
+			assert.Equal(t, Summary{Jobs: len(jobs), Steps: steps, Errors: map[Error]int{}}, summary)
+			assert.Equal(t, instructions, program.Instructions, "the program is not changed")
+		})
+	}
+}
+
+func TestPool_Failures(t *testing.T) {
+	program := NewProgram(tokenize(t, fibOfStack))
+
+	pool := &Pool{Program: program, Budget: 1000}
+	results, summary := pool.Run([]Job{
+		{Stack: []int{5}},
+		{Stack: []int{20}},
+		{Stack: []int{20}, Budget: 1000000},
+		{},
+	})
+
+	assert.Equal(t, Error(Ok), results[0].Err)
+	assert.Equal(t, Error(BudgetExceeded), results[1].Err)
+	assert.Equal(t, 1000, results[1].Steps)
+	assert.Equal(t, Error(Ok), results[2].Err)
+	assert.Equal(t, []int{6765}, results[2].Stack)
+	assert.Equal(t, Error(StackUnderflow), results[3].Err)
+
+	assert.Equal(t, 4, summary.Jobs)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, map[Error]int{BudgetExceeded: 1, StackUnderflow: 1}, summary.Errors)
+}
+
+func TestPool_InputAndOutput(t *testing.T) {
+	program := NewProgram(tokenize(t, "const EOF = -1\n:l inc dupl 0 psh EOF eq jif end pop dupl 0 outc store 0 jmp l :end"))
+
+	results, _ := (&Pool{Program: program}).Run([]Job{{Input: []byte("hi")}, {Input: []byte("naive")}})
+
+	assert.Equal(t, "hi", string(results[0].Output))
+	assert.Equal(t, []int{'i'}, results[0].Memory)
+	assert.Equal(t, "naive", string(results[1].Output))
+}
+
+func BenchmarkPool_Fib(b *testing.B) {
+	program := NewProgram(tokenize(b, fibOfStack))
+	jobs := make([]Job, 64)
+	for i := range jobs {
+		jobs[i] = Job{Stack: []int{15}}
+	}
+
+	for i := 0; i < b.N; i++ {
+		(&Pool{Program: program}).Run(jobs)
+	}
+}
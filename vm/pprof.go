@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// WritePprof writes the recorded profile in the gzipped protobuf format
+// understood by `go tool pprof`. Every executed address becomes a
+// location, every label region becomes a function and sourceName is
+// reported as the file of the ones of the main file. The others are in the
+// file they were included from.
+func (p *Profiler) WritePprof(w io.Writer, instructions []token.Token, sourceName string) error {
+	b := &protoBuffer{}
+	strings := newStringTable()
+
+	// Profile.sample_type
+	b.message(1, valueType(strings.index("executions"), strings.index("count")))
+	b.message(1, valueType(strings.index("time"), strings.index("nanoseconds")))
+
+	regionOf := LabelRegions(instructions)
+	functionIDs := make(map[string]uint64)
+	functionLines := make(map[string]int)
+	functionFiles := make(map[string]string)
+	functionNames := []string{}
+
+	spots := p.HotSpots()
+	sort.Slice(spots, func(i, j int) bool { return spots[i].Address < spots[j].Address })
+
+	locations := &protoBuffer{}
+	samples := &protoBuffer{}
+
+	for _, ip := range spots {
+		region, line, file := EntryRegion, 0, sourceName
+		if ip.Address >= 0 && ip.Address < len(instructions) {
+			region = regionOf[ip.Address]
+			line = instructions[ip.Address].LineStart + 1
+
+			if instructions[ip.Address].File != "" {
+				file = instructions[ip.Address].File
+			}
+		}
+
+		id, ok := functionIDs[region]
+		if !ok {
+			id = uint64(len(functionIDs) + 1)
+			functionIDs[region] = id
+			functionLines[region] = line
+			functionFiles[region] = file
+			functionNames = append(functionNames, region)
+		}
+
+		locationID := uint64(ip.Address + 1)
+
+		// Location.line
+		l := &protoBuffer{}
+		l.uint(1, id)
+		l.uint(2, uint64(line))
+
+		// Profile.location
+		loc := &protoBuffer{}
+		loc.uint(1, locationID)
+		loc.uint(3, uint64(ip.Address))
+		loc.message(4, l)
+		locations.message(4, loc)
+
+		// Sample.label
+		label := &protoBuffer{}
+		label.uint(1, uint64(strings.index("opcode")))
+		label.uint(2, uint64(strings.index(string(ip.Kind))))
+
+		// Profile.sample
+		s := &protoBuffer{}
+		s.packed(1, locationID)
+		s.packed(2, uint64(ip.Count), uint64(ip.Duration.Nanoseconds()))
+		s.message(3, label)
+		samples.message(2, s)
+	}
+
+	b.raw(samples)
+	b.raw(locations)
+
+	for _, name := range functionNames {
+		// Profile.function
+		f := &protoBuffer{}
+		f.uint(1, functionIDs[name])
+		f.uint(2, uint64(strings.index(name)))
+		f.uint(3, uint64(strings.index(name)))
+		f.uint(4, uint64(strings.index(functionFiles[name])))
+		f.uint(5, uint64(functionLines[name]))
+		b.message(5, f)
+	}
+
+	// Profile.time_nanos, Profile.duration_nanos
+	b.uint(9, uint64(time.Now().UnixNano()))
+	b.uint(10, uint64(p.TotalDuration.Nanoseconds()))
+
+	// Profile.period_type, Profile.period
+	b.message(11, valueType(strings.index("executions"), strings.index("count")))
+	b.uint(12, 1)
+
+	// Profile.string_table has to be written last, since every index
+	// above adds to it.
+	for _, s := range strings.values {
+		b.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.data); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func valueType(kind, unit int) *protoBuffer {
+	v := &protoBuffer{}
+	v.uint(1, uint64(kind))
+	v.uint(2, uint64(unit))
+	return v
+}
+
+type stringTable struct {
+	values  []string
+	indexes map[string]int
+}
+
+func newStringTable() *stringTable {
+	// The first entry of a pprof string table must always be empty.
+	return &stringTable{
+		values:  []string{""},
+		indexes: map[string]int{"": 0},
+	}
+}
+
+func (s *stringTable) index(value string) int {
+	if i, ok := s.indexes[value]; ok {
+		return i
+	}
+
+	s.indexes[value] = len(s.values)
+	s.values = append(s.values, value)
+
+	return len(s.values) - 1
+}
+
+// protoBuffer is the smallest part of the protobuf wire format needed
+// to write a pprof profile.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	b.key(field, 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(v)))
+	b.data = append(b.data, v...)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.data)
+}
+
+func (b *protoBuffer) packed(field int, values ...uint64) {
+	p := &protoBuffer{}
+	for _, v := range values {
+		p.varint(v)
+	}
+
+	b.bytes(field, p.data)
+}
+
+func (b *protoBuffer) raw(m *protoBuffer) {
+	b.data = append(b.data, m.data...)
+}
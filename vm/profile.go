@@ -0,0 +1,236 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// EntryRegion is the name of the region before the first label.
+const EntryRegion = "_entry"
+
+type InstructionProfile struct {
+	Address  int
+	Kind     token.Kind
+	Count    int
+	Duration time.Duration
+}
+
+type Profiler struct {
+	Instructions map[int]*InstructionProfile
+	Opcodes      map[token.Kind]int
+
+	TotalCount    int
+	TotalDuration time.Duration
+}
+
+type RegionProfile struct {
+	Name     string
+	Count    int
+	Duration time.Duration
+}
+
+type OpcodeProfile struct {
+	Kind  token.Kind
+	Count int
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		Instructions: make(map[int]*InstructionProfile),
+		Opcodes:      make(map[token.Kind]int),
+	}
+}
+
+func (a *VirtualMachine) EnableProfiling() {
+	a.Profiler = NewProfiler()
+}
+
+// Record accounts a single execution of the instruction at address.
+func (p *Profiler) Record(address int, kind token.Kind, elapsed time.Duration) {
+	ip, ok := p.Instructions[address]
+	if !ok {
+		ip = &InstructionProfile{Address: address, Kind: kind}
+		p.Instructions[address] = ip
+	}
+
+	ip.Count++
+	ip.Duration += elapsed
+
+	p.Opcodes[kind]++
+	p.TotalCount++
+	p.TotalDuration += elapsed
+}
+
+// Merge adds everything other recorded to p.
+func (p *Profiler) Merge(other *Profiler) {
+	for address, ip := range other.Instructions {
+		mine, ok := p.Instructions[address]
+		if !ok {
+			mine = &InstructionProfile{Address: address, Kind: ip.Kind}
+			p.Instructions[address] = mine
+		}
+
+		mine.Count += ip.Count
+		mine.Duration += ip.Duration
+	}
+
+	for kind, count := range other.Opcodes {
+		p.Opcodes[kind] += count
+	}
+
+	p.TotalCount += other.TotalCount
+	p.TotalDuration += other.TotalDuration
+}
+
+// HotSpots returns the executed addresses sorted by execution count,
+// the most executed one first.
+func (p *Profiler) HotSpots() []InstructionProfile {
+	spots := make([]InstructionProfile, 0, len(p.Instructions))
+	for _, ip := range p.Instructions {
+		spots = append(spots, *ip)
+	}
+
+	sort.Slice(spots, func(i, j int) bool {
+		if spots[i].Count != spots[j].Count {
+			return spots[i].Count > spots[j].Count
+		}
+
+		return spots[i].Address < spots[j].Address
+	})
+
+	return spots
+}
+
+func (p *Profiler) OpcodeCounts() []OpcodeProfile {
+	opcodes := make([]OpcodeProfile, 0, len(p.Opcodes))
+	for kind, count := range p.Opcodes {
+		opcodes = append(opcodes, OpcodeProfile{Kind: kind, Count: count})
+	}
+
+	sort.Slice(opcodes, func(i, j int) bool {
+		if opcodes[i].Count != opcodes[j].Count {
+			return opcodes[i].Count > opcodes[j].Count
+		}
+
+		return opcodes[i].Kind < opcodes[j].Kind
+	})
+
+	return opcodes
+}
+
+// Regions groups the recorded executions by the label which precedes
+// each address in the program.
+func (p *Profiler) Regions(instructions []token.Token) []RegionProfile {
+	regionOf := LabelRegions(instructions)
+	byName := make(map[string]*RegionProfile)
+
+	for _, ip := range p.Instructions {
+		name := EntryRegion
+		if ip.Address >= 0 && ip.Address < len(regionOf) {
+			name = regionOf[ip.Address]
+		}
+
+		region, ok := byName[name]
+		if !ok {
+			region = &RegionProfile{Name: name}
+			byName[name] = region
+		}
+
+		region.Count += ip.Count
+		region.Duration += ip.Duration
+	}
+
+	regions := make([]RegionProfile, 0, len(byName))
+	for _, region := range byName {
+		regions = append(regions, *region)
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Duration != regions[j].Duration {
+			return regions[i].Duration > regions[j].Duration
+		}
+
+		return regions[i].Name < regions[j].Name
+	})
+
+	return regions
+}
+
+// LabelRegions maps every address of the program to the name of the
+// closest label declared at or before it in the same file. Regions of an
+// included file are named after it too, as `file:label`, since its labels
+// are private to it.
+func LabelRegions(instructions []token.Token) []string {
+	regions := make([]string, len(instructions))
+	current, file := EntryRegion, ""
+
+	for i, t := range instructions {
+		if t.File != file {
+			current, file = EntryRegion, t.File
+		}
+
+		if t.Kind == token.Label {
+			current = t.Name
+		}
+
+		regions[i] = current
+		if file != "" {
+			regions[i] = file + ":" + current
+		}
+	}
+
+	return regions
+}
+
+// sourcePosition formats the line of a token, after its file when it was
+// included.
+func sourcePosition(t token.Token) string {
+	if t.File == "" {
+		return fmt.Sprint(t.LineStart + 1)
+	}
+
+	return fmt.Sprintf("%s:%d", t.File, t.LineStart+1)
+}
+
+func (p *Profiler) WriteReport(w io.Writer, instructions []token.Token) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "Profile:")
+	fmt.Fprintf(tw, "	Executed %d instructions in %s\n\n", p.TotalCount, p.TotalDuration)
+
+	fmt.Fprintln(tw, "By opcode:")
+	for _, op := range p.OpcodeCounts() {
+		fmt.Fprintf(tw, "	%s\t%d\t%s\n", op.Kind, op.Count, percent(op.Count, p.TotalCount))
+	}
+
+	fmt.Fprintln(tw, "\nBy address:")
+	for _, ip := range p.HotSpots() {
+		line := "-"
+		if ip.Address >= 0 && ip.Address < len(instructions) {
+			line = sourcePosition(instructions[ip.Address])
+		}
+
+		fmt.Fprintf(tw, "	%d\t%s\tline %s\t%d\t%s\t%s\n", ip.Address, ip.Kind, line, ip.Count, percent(ip.Count, p.TotalCount), ip.Duration)
+	}
+
+	fmt.Fprintln(tw, "\nBy label region:")
+	for _, region := range p.Regions(instructions) {
+		fmt.Fprintf(tw, "	%s\t%d\t%s\t%s\n", region.Name, region.Count, percent(region.Count, p.TotalCount), region.Duration)
+	}
+
+	fmt.Fprintln(tw)
+}
+
+func percent(part, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiler_CountsExecutions(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1 :add psh 2 sum"))
+	v.EnableProfiling()
+
+	v.Execute(100, false)
+
+	assert.Equal(t, []int{3}, v.Stack)
+	assert.Equal(t, 3, v.Profiler.TotalCount)
+	assert.Equal(t, map[token.Kind]int{token.Push: 2, token.Sum: 1}, v.Profiler.Opcodes)
+
+	// Operands and labels are not instructions of their own.
+	spots := v.Profiler.HotSpots()
+	require.Len(t, spots, 3)
+	assert.Equal(t, 0, spots[0].Address)
+
+	regions := v.Profiler.Regions(v.Instructions)
+	counts := map[string]int{}
+	for _, r := range regions {
+		counts[r.Name] = r.Count
+	}
+
+	assert.Equal(t, map[string]int{EntryRegion: 1, "add": 2}, counts)
+}
+
+func TestProfiler_WritePprof(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1 psh 2 sum"))
+	v.EnableProfiling()
+	v.Execute(100, false)
+
+	var buff bytes.Buffer
+	err := v.Profiler.WritePprof(&buff, v.Instructions, "sum.naive")
+	require.NoError(t, err)
+
+	gz, err := gzip.NewReader(&buff)
+	require.NoError(t, err)
+
+	raw, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(raw), "sum.naive")
+	assert.Contains(t, string(raw), EntryRegion)
+	assert.Contains(t, string(raw), string(token.Sum))
+}
+
+func TestProfiler_Includes(t *testing.T) {
+	// Both files have a label named one, which is private to each.
+	program, err := lexer.LoadFS(fstest.MapFS{
+		"main.naive": {Data: []byte("include \"lib.naive\"\ncall lib\njmp one\n:one\npsh 1")},
+		"lib.naive":  {Data: []byte("export lib\n:lib\njmp one\n:one\npsh 2\nret")},
+	}, "main.naive")
+	require.NoError(t, err)
+
+	v := NewVirtualMachine()
+	v.LoadProgram(program)
+	v.EnableProfiling()
+	v.Execute(100, false)
+
+	counts := map[string]int{}
+	for _, r := range v.Profiler.Regions(v.Instructions) {
+		counts[r.Name] = r.Count
+	}
+
+	assert.Equal(t, map[string]int{EntryRegion: 2, "one": 1, "lib.naive:lib": 1, "lib.naive:one": 2}, counts)
+
+	var report strings.Builder
+	v.Profiler.WriteReport(&report, v.Instructions)
+	assert.Contains(t, report.String(), "line lib.naive:5")
+
+	var buff bytes.Buffer
+	require.NoError(t, v.Profiler.WritePprof(&buff, v.Instructions, "main.naive"))
+
+	gz, err := gzip.NewReader(&buff)
+	require.NoError(t, err)
+
+	raw, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(raw), "main.naive")
+	assert.Contains(t, string(raw), "lib.naive:one")
+}
@@ -0,0 +1,82 @@
+package vm
+
+import "github.com/jejikeh/ambient/token"
+
+// Program is a program ready to run: its instructions, the addresses of
+// its labels and the code compiled from them. A Program is not changed
+// once it is made, so any number of VMs can run it at once. Everything a
+// run changes, the stack, the instruction pointer, the memory, the call
+// stack and the entities, belongs to the VirtualMachine running it.
+//
+// Constants and macros are expanded when the program is assembled, so
+// they are part of the instructions.
+type Program struct {
+	// Instructions must not be changed, make a new Program instead.
+	Instructions []token.Token
+	// Labels maps the names of the labels to their address. A name
+	// declared in several files maps to the first one.
+	Labels map[string]int
+
+	code []op
+	// heights are the least stack heights Verify found, when code is
+	// compiled without the checks it made. checked is then the program
+	// compiled with them.
+	heights []int
+	checked *Program
+
+	// blocks and their sizes are the blocks of a verified program, see
+	// compileBlocks.
+	blocks []op
+	sizes  []int
+}
+
+// NewProgram compiles a program. The instructions are copied, so the
+// caller may reuse them.
+func NewProgram(instructions []token.Token) *Program {
+	p := &Program{
+		Instructions: append([]token.Token(nil), instructions...),
+		Labels:       make(map[string]int),
+	}
+
+	for address, t := range p.Instructions {
+		if _, ok := p.Labels[t.Name]; t.Kind == token.Label && !ok {
+			p.Labels[t.Name] = address
+		}
+	}
+
+	p.code = compile(p.Instructions)
+
+	return p
+}
+
+// Verify returns the program checked by Verify, compiled without the
+// checks the verifier made. See VirtualMachine.Verify for when they are
+// left out.
+func (p *Program) Verify() (*Program, error) {
+	if p.Verified() {
+		return p, nil
+	}
+
+	heights, err := Verify(p.Instructions)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, sizes := compileBlocks(p.Instructions, heights)
+
+	return &Program{
+		Instructions: p.Instructions,
+		Labels:       p.Labels,
+		code:         compileVerified(p.Instructions, heights),
+		heights:      heights,
+		checked:      p,
+		blocks:       blocks,
+		sizes:        sizes,
+	}, nil
+}
+
+// Verified reports whether the program runs without the checks Verify
+// made.
+func (p *Program) Verified() bool {
+	return p.heights != nil
+}
@@ -0,0 +1,300 @@
+package vm
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+
+	"github.com/jejikeh/ambient/ecs"
+	"github.com/jejikeh/ambient/token"
+)
+
+// `tick` runs the systems stage by stage, following the ecs.Schedule.
+// The systems of a stage run concurrently, each on a fork of the VM with
+// its own stack and a copy of the memory. Once the stage is done, the
+// cells every fork stored are copied back, and the output of every
+// system is written in the order the systems were registered, so the
+// result is the same for any number of workers.
+//
+// When a system fails, `tick` ends as if the systems had run one after
+// another: the systems of the stage after it are not started, and the
+// fields set by the ones which already ran are put back. The budget is
+// shared the same way. If the systems of a stage together run out of it,
+// the one which would have run out is run again with the steps left.
+// Systems added by the host can not be undone, they only are not started.
+
+// MemoryResource is the kind of the ecs.Resource of a memory cell.
+const MemoryResource = "memory"
+
+// access works out what the routine at address reads and writes, by
+// following every path from it. `outs` is assumed to read string data,
+// which does not change once written.
+func (a *VirtualMachine) access(address int) ecs.Access {
+	access := ecs.Access{}
+	visited := map[int]bool{}
+	pending := []int{address}
+
+	for len(pending) > 0 {
+		ip := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for ip >= 0 && ip < len(a.Instructions) && !visited[ip] {
+			visited[ip] = true
+
+			operand := 0
+			if ip+1 < len(a.Instructions) {
+				operand = a.Instructions[ip+1].IntegerValue
+			}
+
+			switch a.Instructions[ip].Kind {
+			case token.Return, token.EndOfLine:
+				ip = -1
+
+			case token.Jump:
+				ip = operand
+
+			case token.JumpIfTrue, token.JumpIfEqual:
+				pending = append(pending, operand)
+				ip++
+
+			case token.Call:
+				pending = append(pending, operand)
+				ip += 2
+
+			case token.Load:
+				access.Reads = append(access.Reads, ecs.Resource{Kind: MemoryResource, ID: operand})
+				ip++
+
+			case token.Store:
+				access.Writes = append(access.Writes, ecs.Resource{Kind: MemoryResource, ID: operand})
+				ip++
+
+			case token.GetField, token.SetField:
+				f, err := a.field(operand)
+				if err != Ok {
+					access.Exclusive = true
+				} else if a.Instructions[ip].Kind == token.GetField {
+					access.Reads = append(access.Reads, f.Component.Resource())
+				} else {
+					access.Writes = append(access.Writes, f.Component.Resource())
+				}
+
+				ip++
+
+			case token.Component, token.Entity, token.Attach, token.System, token.Tick, token.InputCharacter,
+				token.Spawn, token.Yield, token.ChannelNew, token.Send, token.Receive:
+				access.Exclusive = true
+				ip++
+
+			default:
+				ip++
+			}
+		}
+	}
+
+	return access
+}
+
+func (a *VirtualMachine) workers() int {
+	if a.Workers > 0 {
+		return a.Workers
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
+
+// fieldCell is a field of a component of an entity.
+type fieldCell struct {
+	entity    ecs.Entity
+	component ecs.ComponentID
+	index     int
+}
+
+// fork returns a VM sharing the program and the world of a, to run a
+// system of a stage.
+func (a *VirtualMachine) fork(output *bytes.Buffer) *VirtualMachine {
+	f := &VirtualMachine{
+		Program:    a.Program,
+		Stack:      make([]int, 0),
+		Memory:     append([]int(nil), a.Memory...),
+		stored:     make(map[int]bool),
+		changed:    make(map[fieldCell]int),
+		CallStack:  make([]int, 0),
+		Output:     output,
+		Input:      a.Input,
+		World:      a.World,
+		components: a.components,
+		fields:     a.fields,
+		routines:   a.routines,
+	}
+
+	if a.stepLimit > 0 {
+		f.stepLimit = max(a.stepLimit-a.steps, 1)
+	}
+
+	if a.Profiler != nil {
+		f.Profiler = NewProfiler()
+	}
+
+	if a.Coverage != nil {
+		f.Coverage = NewCoverage()
+	}
+
+	return f
+}
+
+// join copies back what a fork did. Only the cells the fork stored are
+// copied, the others may have been stored by a fork joined before.
+func (a *VirtualMachine) join(f *VirtualMachine) {
+	for address := range f.stored {
+		a.store(address, f.Memory[address])
+	}
+
+	a.steps += f.steps
+
+	if f.Profiler != nil {
+		a.Profiler.Merge(f.Profiler)
+	}
+
+	if f.Coverage != nil {
+		a.Coverage.Merge(f.Coverage)
+	}
+
+	if f.LastAssertion != nil {
+		a.LastAssertion = f.LastAssertion
+	}
+}
+
+// undo puts back the fields a fork set, which nothing else in its stage
+// uses.
+func (a *VirtualMachine) undo(f *VirtualMachine) {
+	for cell, value := range f.changed {
+		a.World.Set(cell.entity, cell.component, cell.index, value)
+	}
+}
+
+func (a *VirtualMachine) tick() Error {
+	schedule := a.World.Schedule()
+
+	outputs := make([]*bytes.Buffer, len(schedule.Systems))
+	for i := range outputs {
+		outputs[i] = &bytes.Buffer{}
+	}
+
+	failed, err := len(outputs)-1, Error(Ok)
+	for _, stage := range schedule.Stages {
+		if failed, err = a.runStage(schedule, stage, outputs); err != Ok {
+			break
+		}
+	}
+
+	for _, output := range outputs[:failed+1] {
+		a.Output.Write(output.Bytes())
+	}
+
+	return err
+}
+
+// runStage runs the systems of a stage and returns the first of them
+// which failed, with its error.
+func (a *VirtualMachine) runStage(schedule *ecs.Schedule, stage []int, outputs []*bytes.Buffer) (int, Error) {
+	// A system alone in its stage, which might change the world, runs on
+	// this VM.
+	if len(stage) == 1 {
+		i := stage[0]
+
+		output := a.Output
+		a.Output = outputs[i]
+		defer func() { a.Output = output }()
+
+		if err := a.World.RunSystem(schedule.Systems[i]); err != nil {
+			return i, asError(err)
+		}
+
+		return len(outputs) - 1, Ok
+	}
+
+	forks := make(map[int]*VirtualMachine, len(stage))
+	for _, i := range stage {
+		forks[i] = a.fork(outputs[i])
+	}
+
+	// stopped is the first system known to have failed, the ones after it
+	// are not started.
+	var mu sync.Mutex
+	stopped := len(outputs)
+
+	failed, err := schedule.RunStage(stage, a.workers(), func(i int) error {
+		mu.Lock()
+		skip := i > stopped
+		mu.Unlock()
+
+		if skip {
+			return nil
+		}
+
+		err := a.runFork(schedule, i, forks[i])
+		if err != nil {
+			mu.Lock()
+			stopped = min(stopped, i)
+			mu.Unlock()
+		}
+
+		return err
+	})
+
+	for k, i := range stage {
+		f := forks[i]
+
+		// Run one after another, this system would have run out of the
+		// budget.
+		if a.stepLimit > 0 && a.steps+f.steps > a.stepLimit && (err == nil || i <= failed) {
+			a.undo(f)
+			outputs[i].Reset()
+
+			f = a.fork(outputs[i])
+			failed, err = i, a.runFork(schedule, i, f)
+			if err == nil {
+				err = Error(BudgetExceeded)
+			}
+		}
+
+		if err != nil && i > failed {
+			for _, later := range stage[k:] {
+				a.undo(forks[later])
+			}
+
+			break
+		}
+
+		a.join(f)
+	}
+
+	if err != nil {
+		return failed, asError(err)
+	}
+
+	return len(outputs) - 1, Ok
+}
+
+// runFork runs the system i of a stage on the fork f.
+func (a *VirtualMachine) runFork(schedule *ecs.Schedule, i int, f *VirtualMachine) error {
+	// Systems added by the host run their own Run.
+	address, ok := a.routines[schedule.Systems[i]]
+	if !ok {
+		return a.World.RunSystem(schedule.Systems[i])
+	}
+
+	system := *schedule.Systems[i]
+	system.Run = f.systemRun(address)
+
+	return a.World.RunSystem(&system)
+}
+
+func asError(err error) Error {
+	if vmErr, ok := err.(Error); ok {
+		return vmErr
+	}
+
+	return MissingComponent
+}
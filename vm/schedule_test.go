@@ -0,0 +1,201 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/jejikeh/ambient/ecs"
+	"github.com/jejikeh/ambient/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scheduledSource = `psh 1 comp c_a
+psh 1 comp c_b
+entity e_1 attach c_a attach c_b
+entity e_2 attach c_a attach c_b psh 10 setf 0
+psh c_a psh 1 system inc_a
+psh c_a psh 1 system sum_a
+psh c_b psh 1 system inc_b
+psh 0 system print_sum
+tick tick
+jmp end
+:c_a :c_b :e_1 :e_2
+:inc_a getf 0 psh 1 sum setf 0 psh 97 outc psh 0 ret
+:sum_a load 100 getf 0 sum store 100 psh 115 outc psh 0 ret
+:inc_b getf 1 psh 2 sum setf 1 psh 98 outc psh 0 ret
+:print_sum load 100 out psh 32 outc psh 0 ret
+:end`
+
+func TestTick_Schedule(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, scheduledSource))
+
+	atTick := func(address int) bool { return v.Instructions[address].Kind == token.Tick }
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 1000, atTick))
+	require.Len(t, v.World.Systems(), 4)
+
+	schedule := v.World.Schedule()
+	assert.Equal(t, [][]int{{0, 2}, {1}, {3}}, schedule.Stages)
+
+	sumA := schedule.Systems[1].Access
+	assert.Contains(t, sumA.Writes, ecs.Resource{Kind: MemoryResource, ID: 100})
+	assert.False(t, sumA.Exclusive)
+}
+
+func TestTick_DeterministicForAnyWorkers(t *testing.T) {
+	for _, workers := range []int{1, 2, 8} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			var out bytes.Buffer
+			v := NewVirtualMachine()
+			v.Workers = workers
+			v.Output = &out
+			v.LoadProgram(tokenize(t, scheduledSource))
+
+			require.Equal(t, Error(Ok), v.ExecuteFrom(0, 1000, nil))
+
+			// The output is in the order the systems were registered,
+			// although inc_b runs before sum_a.
+			assert.Equal(t, "aassbb12 aassbb26 ", out.String())
+			assert.Equal(t, 26, v.Memory[100])
+			assert.Empty(t, v.Stack)
+
+			b, _ := v.World.ComponentByName("c_b")
+			for _, e := range v.World.Entities() {
+				value, err := v.World.Get(e, b, 0)
+				require.NoError(t, err)
+				assert.Equal(t, 4, value)
+			}
+		})
+	}
+}
+
+func TestTick_KeepsEveryForkStores(t *testing.T) {
+	// Both systems run in one stage, each storing its own cell.
+	source := `psh 0 system set_a
+psh 0 system set_b
+tick
+jmp end
+:set_a psh 1 store 100 psh 0 ret
+:set_b psh 2 store 101 psh 0 ret
+:end`
+
+	for _, workers := range []int{1, 2, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.Workers = workers
+			v.LoadProgram(tokenize(t, source))
+
+			require.Equal(t, Error(Ok), v.ExecuteFrom(0, 1000, nil))
+			require.Equal(t, [][]int{{0, 1}}, v.World.Schedule().Stages)
+
+			assert.Equal(t, 1, v.Memory[100])
+			assert.Equal(t, 2, v.Memory[101])
+		})
+	}
+}
+
+func TestTick_ReportsFirstFailingSystem(t *testing.T) {
+	source := `psh 0 system first psh 0 system second psh 0 system third
+tick
+jmp end
+:first psh 102 outc psh 0 ret
+:second psh 115 outc psh 1 psh 0 div ret
+:third load 1 pop ret
+:end`
+
+	for _, workers := range []int{1, 3} {
+		var out bytes.Buffer
+		v := NewVirtualMachine()
+		v.Workers = workers
+		v.Output = &out
+		v.LoadProgram(tokenize(t, source))
+
+		assert.Equal(t, Error(DivisionByZero), v.ExecuteFrom(0, 1000, nil))
+		assert.Equal(t, "fs", out.String())
+	}
+}
+
+func TestTick_FailureUndoesLaterSystems(t *testing.T) {
+	// The three systems run in one stage. Run one after another, set_b
+	// would never start.
+	source := `psh 1 comp c_a
+psh 1 comp c_b
+entity e attach c_a attach c_b
+psh c_a psh 1 system set_a
+psh 0 system fail
+psh c_b psh 1 system set_b
+tick
+jmp end
+:c_a :c_b :e
+:set_a psh 1 setf 0 psh 1 store 100 psh 0 ret
+:fail psh 1 psh 0 div ret
+:set_b psh 2 setf 1 psh 2 store 101 psh 0 ret
+:end`
+
+	for _, workers := range []int{1, 3} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.Workers = workers
+			v.LoadProgram(tokenize(t, source))
+
+			require.Equal(t, Error(DivisionByZero), v.ExecuteFrom(0, 1000, nil))
+			require.Equal(t, [][]int{{0, 1, 2}}, v.World.Schedule().Stages)
+
+			e := v.World.Entities()[0]
+			a, _ := v.World.ComponentByName("c_a")
+			b, _ := v.World.ComponentByName("c_b")
+
+			value, err := v.World.Get(e, a, 0)
+			require.NoError(t, err)
+			assert.Equal(t, 1, value)
+
+			value, err = v.World.Get(e, b, 0)
+			require.NoError(t, err)
+			assert.Equal(t, 0, value)
+
+			assert.Equal(t, []int{1}, v.Memory[100:])
+		})
+	}
+}
+
+func TestTick_SharesTheBudget(t *testing.T) {
+	// The three systems run in one stage, and together need more than
+	// the budget. Run one after another, count would run out of it.
+	source := `psh 0 system first
+psh 0 system count
+psh 0 system last
+tick
+jmp end
+:first psh 1 store 100 psh 0 ret
+:count psh 20 psh 1 :loop pop psh 1 sub dupl 0 psh 0 gt jif loop pop pop psh 2 store 101 psh 0 ret
+:last psh 3 store 102 psh 0 ret
+:end`
+
+	for _, workers := range []int{1, 3} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.Workers = workers
+			v.LoadProgram(tokenize(t, source))
+
+			require.Equal(t, Error(BudgetExceeded), v.ExecuteFrom(0, 60, nil))
+			require.Equal(t, [][]int{{0, 1, 2}}, v.World.Schedule().Stages)
+
+			assert.Equal(t, 60, v.Steps())
+			assert.Equal(t, []int{1}, v.Memory[100:])
+		})
+	}
+}
+
+func TestAccess_ExclusiveRoutines(t *testing.T) {
+	source := `:spawner entity spawner psh 0 ret
+:caller call helper ret
+:helper psh 0 jif spawner ret`
+
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, source))
+
+	assert.True(t, v.access(v.Labels["spawner"]).Exclusive)
+	assert.True(t, v.access(0).Exclusive)
+}
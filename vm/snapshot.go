@@ -0,0 +1,279 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// A snapshot holds the state of a run between two instructions: the
+// stack, the instruction pointer, the call stack, the memory and the
+// fibers, with a hash of the program. Restoring it on a VM running the
+// same program continues the run where it was taken.
+//
+// Entities are not part of a snapshot, so runs which made components,
+// entities or systems can not be saved.
+
+// snapshotVersion changes when the layout of snapshot does.
+const snapshotVersion = 1
+
+// ErrOtherProgram is returned by Restore for a snapshot of another
+// program than the one loaded.
+var ErrOtherProgram = errors.New("snapshot was taken from another program")
+
+type snapshot struct {
+	Version int
+	Program [sha256.Size]byte
+
+	Stack              []int
+	InstructionPointer int
+	CallStack          []int
+	Memory             []int
+
+	// Fibers is nil when the run did not use fibers.
+	Fibers *fibersSnapshot
+}
+
+type fibersSnapshot struct {
+	// Current is the running fiber, its state is the one of the run.
+	Current int
+	// Ready and Waiting are fiber ids, in the order of the queues.
+	Ready    []int
+	Waiting  []int
+	Fibers   []fiberSnapshot
+	Channels []channelSnapshot
+	NextID   int
+}
+
+type fiberSnapshot struct {
+	ID        int
+	Stack     []int
+	CallStack []int
+	IP        int
+
+	// Channel is the channel the fiber waits on, or -1.
+	Channel int
+	At      int
+	Value   int
+}
+
+type channelSnapshot struct {
+	Capacity  int
+	Buffer    []int
+	Senders   []int
+	Receivers []int
+}
+
+// Hash returns a hash of the instructions of the program, which tells
+// whether a snapshot was taken from it.
+func (p *Program) Hash() [sha256.Size]byte {
+	h := sha256.New()
+	for _, t := range p.Instructions {
+		fmt.Fprintf(h, "%s %q %d\n", t.Kind, t.Name, t.IntegerValue)
+	}
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	return sum
+}
+
+// Snapshot serializes the state of the run, for Restore to continue it
+// later.
+func (a *VirtualMachine) Snapshot() ([]byte, error) {
+	if a.systemDepth > 0 {
+		return nil, errors.New("can not snapshot a run inside a system")
+	}
+
+	if len(a.World.Components()) > 0 || len(a.World.Entities()) > 0 || len(a.World.Systems()) > 0 {
+		return nil, errors.New("can not snapshot a run with entities")
+	}
+
+	s := snapshot{
+		Version:            snapshotVersion,
+		Program:            a.Hash(),
+		Stack:              a.Stack,
+		InstructionPointer: a.InstructionPointer,
+		CallStack:          a.CallStack,
+		Memory:             a.Memory,
+	}
+
+	if a.fibers != nil {
+		s.Fibers = a.fibers.snapshot()
+	}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(s); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Restore restores the state of a run from a Snapshot of the loaded
+// program. Execute then continues the run.
+func (a *VirtualMachine) Restore(content []byte) error {
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&s); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported", s.Version)
+	}
+
+	if s.Program != a.Hash() {
+		return ErrOtherProgram
+	}
+
+	if len(s.Memory) > MemorySize {
+		return fmt.Errorf("snapshot has %d memory cells", len(s.Memory))
+	}
+
+	var f *fibers
+	if s.Fibers != nil {
+		var err error
+		if f, err = s.Fibers.restore(len(a.Instructions)); err != nil {
+			return err
+		}
+	}
+
+	a.Stack = append(make([]int, 0, len(s.Stack)), s.Stack...)
+	a.InstructionPointer = s.InstructionPointer
+	a.CallStack = append(make([]int, 0, len(s.CallStack)), s.CallStack...)
+	a.Memory = append(make([]int, 0, len(s.Memory)), s.Memory...)
+	a.fibers = f
+
+	// The fibers which do not run first were not checked against the
+	// heights the verifier found.
+	if f != nil && a.Verified() {
+		a.Program = a.checked
+	}
+
+	return nil
+}
+
+func (f *fibers) snapshot() *fibersSnapshot {
+	s := &fibersSnapshot{Current: f.current.id, NextID: f.nextID}
+
+	for _, r := range f.ready {
+		s.Ready = append(s.Ready, r.id)
+	}
+
+	for _, w := range f.waiting {
+		s.Waiting = append(s.Waiting, w.id)
+	}
+
+	for _, fb := range append(append([]*fiber{f.current}, f.ready...), f.waiting...) {
+		fs := fiberSnapshot{ID: fb.id, Channel: -1}
+		if fb != f.current {
+			fs.Stack, fs.CallStack, fs.IP = fb.stack, fb.callStack, fb.ip
+		}
+
+		if fb.waiting != nil {
+			fs.Channel, fs.At, fs.Value = fb.waiting.id, fb.at, fb.value
+		}
+
+		s.Fibers = append(s.Fibers, fs)
+	}
+
+	for _, ch := range f.channels {
+		cs := channelSnapshot{Capacity: ch.capacity, Buffer: ch.buffer}
+		for _, sender := range ch.senders {
+			cs.Senders = append(cs.Senders, sender.id)
+		}
+
+		for _, receiver := range ch.receivers {
+			cs.Receivers = append(cs.Receivers, receiver.id)
+		}
+
+		s.Channels = append(s.Channels, cs)
+	}
+
+	return s
+}
+
+// restore rebuilds the fibers of a snapshot of a program of size
+// instructions.
+func (s *fibersSnapshot) restore(size int) (*fibers, error) {
+	f := &fibers{nextID: s.NextID}
+
+	for i, cs := range s.Channels {
+		if cs.Capacity < 0 || len(cs.Buffer) > cs.Capacity {
+			return nil, fmt.Errorf("snapshot channel %d holds %d values out of %d", i, len(cs.Buffer), cs.Capacity)
+		}
+
+		f.channels = append(f.channels, &channel{id: i, capacity: cs.Capacity, buffer: append([]int(nil), cs.Buffer...)})
+	}
+
+	byID := make(map[int]*fiber, len(s.Fibers))
+	for _, fs := range s.Fibers {
+		if _, ok := byID[fs.ID]; ok || fs.ID < 0 || fs.ID >= s.NextID {
+			return nil, fmt.Errorf("snapshot fiber %d is not valid", fs.ID)
+		}
+
+		fb := &fiber{
+			id:        fs.ID,
+			stack:     append([]int{}, fs.Stack...),
+			callStack: append([]int{}, fs.CallStack...),
+			ip:        fs.IP,
+			at:        fs.At,
+			value:     fs.Value,
+		}
+
+		if fs.Channel != -1 {
+			if fs.Channel < 0 || fs.Channel >= len(f.channels) {
+				return nil, fmt.Errorf("snapshot fiber %d waits on unknown channel %d", fs.ID, fs.Channel)
+			}
+
+			if fs.At < 0 || fs.At >= size {
+				return nil, fmt.Errorf("snapshot fiber %d waits at address %d, out of the program", fs.ID, fs.At)
+			}
+
+			fb.waiting = f.channels[fs.Channel]
+		}
+
+		byID[fs.ID] = fb
+	}
+
+	lookup := func(ids []int) ([]*fiber, error) {
+		fibers := make([]*fiber, 0, len(ids))
+		for _, id := range ids {
+			fb, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("snapshot refers to unknown fiber %d", id)
+			}
+
+			fibers = append(fibers, fb)
+		}
+
+		return fibers, nil
+	}
+
+	var err error
+	if f.current = byID[s.Current]; f.current == nil {
+		return nil, fmt.Errorf("snapshot refers to unknown fiber %d", s.Current)
+	}
+
+	if f.ready, err = lookup(s.Ready); err != nil {
+		return nil, err
+	}
+
+	if f.waiting, err = lookup(s.Waiting); err != nil {
+		return nil, err
+	}
+
+	for i, cs := range s.Channels {
+		if f.channels[i].senders, err = lookup(cs.Senders); err != nil {
+			return nil, err
+		}
+
+		if f.channels[i].receivers, err = lookup(cs.Receivers); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot_Resume(t *testing.T) {
+	pipeline, err := os.ReadFile("../examples/pipeline.naive")
+	require.NoError(t, err)
+
+	sources := map[string]string{
+		"Fib":      "psh 10\n" + fibOfStack,
+		"Calls":    "psh 2 store 10 call f call f load 10 out jmp end :f load 10 psh 3 mul store 10 ret :end",
+		"Pipeline": string(pipeline),
+	}
+
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			program := tokenize(t, source)
+			want, wantOut, wantErr := run(program, math.MaxInt)
+			require.Equal(t, Error(Ok), wantErr)
+
+			// Stop the run every few instructions and go on from a
+			// snapshot on a new VM.
+			var out bytes.Buffer
+			v := NewVirtualMachine()
+			v.Output = &out
+			v.LoadProgram(program)
+
+			err := v.ExecuteFrom(0, 7, nil)
+			for err == BudgetExceeded {
+				content, serr := v.Snapshot()
+				require.NoError(t, serr)
+
+				v = NewVirtualMachine()
+				v.Output = &out
+				v.LoadProgram(program)
+				require.NoError(t, v.Restore(content))
+
+				err = v.ExecuteFrom(v.InstructionPointer, 7, nil)
+			}
+
+			require.Equal(t, Error(Ok), err)
+			assert.Equal(t, wantOut, out.String())
+			assert.Equal(t, want.Stack, v.Stack)
+			assert.Equal(t, want.Memory, v.Memory)
+		})
+	}
+}
+
+func TestSnapshot_Verified(t *testing.T) {
+	program := tokenize(t, fibSource)
+	want, _, _ := run(program, math.MaxInt)
+
+	v := NewVirtualMachine()
+	v.LoadProgram(program)
+	require.NoError(t, v.Verify())
+	require.Equal(t, Error(BudgetExceeded), v.ExecuteFrom(0, 50, nil))
+
+	content, err := v.Snapshot()
+	require.NoError(t, err)
+
+	resumed := NewVirtualMachine()
+	resumed.LoadProgram(program)
+	require.NoError(t, resumed.Verify())
+	require.NoError(t, resumed.Restore(content))
+
+	require.Equal(t, Error(Ok), resumed.ExecuteFrom(resumed.InstructionPointer, math.MaxInt, nil))
+	assert.Equal(t, want.Stack, resumed.Stack)
+}
+
+func TestRestore_Rejects(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1 psh 2 sum"))
+	require.Equal(t, Error(BudgetExceeded), v.ExecuteFrom(0, 2, nil))
+
+	content, err := v.Snapshot()
+	require.NoError(t, err)
+
+	other := NewVirtualMachine()
+	other.LoadProgram(tokenize(t, "psh 1 psh 3 sum"))
+	assert.ErrorIs(t, other.Restore(content), ErrOtherProgram)
+
+	// A failed restore leaves the VM as it was.
+	assert.Empty(t, other.Stack)
+
+	assert.Error(t, v.Restore(content[:len(content)/2]))
+	assert.Error(t, v.Restore([]byte("not a snapshot")))
+}
+
+func TestSnapshot_Entities(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1 comp c :c"))
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 10, nil))
+
+	_, err := v.Snapshot()
+	assert.EqualError(t, err, "can not snapshot a run with entities")
+}
@@ -1,5 +1,7 @@
 package vm
 
+import "fmt"
+
 type Error string
 
 const (
@@ -10,4 +12,44 @@ const (
 	IllegalInstructionAccess = "Access to illegal instruction"
 	DivisionByZero           = "Division by zero"
 	UnknownOperand           = "Unknown operand"
+	AssertionFailed          = "Assertion failed"
+	BudgetExceeded           = "Execution budget exceeded"
+	IllegalMemoryAccess      = "Access to illegal memory"
+	CallStackOverflow        = "Call stack overflow"
+	CallStackUnderflow       = "Call stack underflow"
+	UnknownComponent         = "Unknown component"
+	MissingComponent         = "Entity has no such component"
+	UnknownChannel           = "Unknown channel"
+	Deadlock                 = "Deadlock"
 )
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	// MemorySize is the number of cells `load` and `store` can address.
+	MemorySize = 1 << 16
+
+	// CallStackLimit is the deepest `call` nesting before CallStackOverflow.
+	CallStackLimit = 1 << 12
+)
+
+// AssertionError describes where and why an `assert` or `assert_eq`
+// instruction failed. Line and Column are 1-based. File is only set for
+// instructions of included files.
+type AssertionError struct {
+	Address int
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *AssertionError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s at %s:%d:%d: %s", AssertionFailed, e.File, e.Line, e.Column, e.Message)
+	}
+
+	return fmt.Sprintf("%s at %d:%d: %s", AssertionFailed, e.Line, e.Column, e.Message)
+}
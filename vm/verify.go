@@ -0,0 +1,392 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/jejikeh/ambient/token"
+)
+
+// unreached is the height of an address no path of the program reaches.
+const unreached = -1
+
+// VerifyError is why Verify rejects a program, at the instruction at
+// Address.
+type VerifyError struct {
+	Address int
+	Token   token.Token
+	Message string
+}
+
+func (e *VerifyError) Error() string {
+	position := fmt.Sprintf("%d:%d", e.Token.LineStart+1, e.Token.CollumnStart+1)
+	if e.Token.File != "" {
+		position = e.Token.File + ":" + position
+	}
+
+	return fmt.Sprintf("%s: %s", position, e.Message)
+}
+
+// Verify checks a program once, before it runs, for the errors the VM
+// otherwise checks at every step. It computes the least height the stack
+// can have at every address by abstract interpretation, starting from an
+// empty stack at address 0 and at the routines registered by `system`.
+// It rejects the program if an instruction can run with fewer values on
+// the stack than it takes, if it jumps or calls out of the program, or if
+// it misses its operand. Paths are followed both ways at every branch,
+// so code the program never takes is checked too.
+//
+// The heights are returned by address, -1 for the addresses no path
+// reaches. A `call` continues with the height its routine returns with,
+// for the lowest stack it is called with.
+func Verify(program []token.Token) ([]int, error) {
+	v := newVerifier(program)
+
+	err := v.run()
+	if err != nil {
+		return nil, err
+	}
+
+	// A system which does not leave a value lets `tick` take the values
+	// under it, so without systems that do, the stack after `tick` is only
+	// known to be there.
+	if v.ticks && !v.systemsLeaveValue() {
+		v = newVerifier(program)
+		v.tickEmpties = true
+
+		if err := v.run(); err != nil {
+			return nil, err
+		}
+	}
+
+	return v.heights, nil
+}
+
+type verifier struct {
+	program []token.Token
+	heights []int
+	pending []int
+
+	// targeted holds the addresses reached other than by falling through
+	// from the address before.
+	targeted map[int]bool
+	// systems holds the routines registered by `system`.
+	systems []int
+	// callers maps routines to the calls of them, returns maps them to
+	// the returns ending them.
+	callers map[int][]int
+	returns map[int][]int
+	// routines maps returns to the routines they end.
+	routines map[int][]int
+
+	ticks       bool
+	tickEmpties bool
+}
+
+func newVerifier(program []token.Token) *verifier {
+	v := &verifier{
+		program:  program,
+		heights:  make([]int, len(program)),
+		targeted: make(map[int]bool),
+		callers:  make(map[int][]int),
+		returns:  make(map[int][]int),
+		routines: make(map[int][]int),
+	}
+
+	for i := range v.heights {
+		v.heights[i] = unreached
+	}
+
+	for i, t := range program {
+		effect, ok := token.EffectOf(t.Kind)
+		if !ok || effect.Operand != "label" || i+1 >= len(program) {
+			continue
+		}
+
+		target := program[i+1].IntegerValue
+		v.targeted[target] = true
+
+		switch t.Kind {
+		case token.Call:
+			v.targeted[i+2] = true
+		case token.System:
+			v.systems = append(v.systems, target)
+		}
+	}
+
+	return v
+}
+
+func (v *verifier) errorf(address int, format string, args ...any) error {
+	return &VerifyError{Address: address, Token: v.program[address], Message: fmt.Sprintf(format, args...)}
+}
+
+// lower records that the stack can be height high at address.
+func (v *verifier) lower(address int, height int) {
+	if address >= len(v.program) {
+		return
+	}
+
+	if v.heights[address] == unreached || height < v.heights[address] {
+		v.heights[address] = height
+		v.pending = append(v.pending, address)
+	}
+}
+
+// run computes the heights until they settle. Heights only go down and
+// never below 0, so they do.
+func (v *verifier) run() error {
+	if len(v.program) == 0 {
+		return nil
+	}
+
+	v.lower(0, 0)
+	for _, system := range v.systems {
+		if system >= 0 && system < len(v.program) {
+			v.lower(system, 0)
+		}
+	}
+
+	for len(v.pending) > 0 {
+		address := v.pending[len(v.pending)-1]
+		v.pending = v.pending[:len(v.pending)-1]
+
+		if err := v.visit(address); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) visit(address int) error {
+	t := v.program[address]
+	height := v.heights[address]
+	next := address + 1
+
+	switch t.Kind {
+	case token.EndOfLine:
+		return nil
+
+	case token.Number, token.Identifier, token.Label:
+		v.lower(next, height)
+		return nil
+
+	case token.Include, token.Export, token.Const, token.Macro, token.EndMacro:
+		return v.errorf(address, "%s is not an instruction", t.DetectMyString())
+	}
+
+	effect, ok := token.EffectOf(t.Kind)
+	if !ok {
+		return v.errorf(address, "%s is not an instruction", t.DetectMyString())
+	}
+
+	operand := 0
+	if effect.Operand != "" {
+		if next >= len(v.program) || v.program[next].Kind == token.EndOfLine {
+			return v.errorf(address, "%s misses its %s", t.Name, effect.Operand)
+		}
+
+		o := v.program[next]
+		if o.Kind != token.Number && o.Kind != token.Identifier {
+			return v.errorf(address, "%s expects a %s, got %s", t.Name, effect.Operand, o.DetectMyString())
+		}
+
+		operand = o.IntegerValue
+
+		if effect.Operand == "label" && (operand < 0 || operand >= len(v.program)) {
+			return v.errorf(address, "%s %s is out of the program", t.Name, o.Name)
+		}
+	}
+
+	pops := effect.Pops
+	needs := pops
+
+	switch t.Kind {
+	case token.Duplicate:
+		if operand < 0 {
+			return v.errorf(address, "%s offset %d is negative", t.Name, operand)
+		}
+
+		needs = operand + 1
+
+	case token.Load, token.Store:
+		if operand < 0 || operand >= MemorySize {
+			return v.errorf(address, "%s address %d is out of memory", t.Name, operand)
+		}
+
+	case token.System:
+		count, ok := v.pushedBefore(address)
+		if !ok {
+			// The count is not known, so any value under it may be
+			// taken.
+			pops = height
+			break
+		}
+
+		if count < 0 {
+			return v.errorf(address, "%s takes %d components", t.Name, count)
+		}
+
+		pops = count + 1
+		needs = pops
+	}
+
+	if height < needs {
+		return v.errorf(address, "stack can underflow: %s takes %d, the stack can have %d", t.Name, needs, height)
+	}
+
+	after := height - pops + effect.Pushes
+
+	switch t.Kind {
+	case token.Jump:
+		v.lower(operand, after)
+
+	case token.JumpIfTrue, token.JumpIfEqual:
+		v.lower(operand, after)
+		v.lower(next, after)
+
+	case token.Call:
+		v.addCall(address, operand)
+		v.lower(operand, after)
+		v.continueCalls(operand)
+
+	case token.Return:
+		for _, routine := range v.routines[address] {
+			v.continueCalls(routine)
+		}
+
+	case token.Spawn:
+		// A fiber starts with its argument alone on its stack.
+		v.lower(operand, 1)
+		v.lower(next, after)
+
+	case token.Tick:
+		v.ticks = true
+		if v.tickEmpties {
+			after = 0
+		}
+
+		v.lower(next, after)
+
+	default:
+		v.lower(next, after)
+	}
+
+	return nil
+}
+
+// pushedBefore returns the value pushed right before address, when the
+// only way to address is after `psh value`.
+func (v *verifier) pushedBefore(address int) (int, bool) {
+	if address < 2 || v.targeted[address] || v.targeted[address-1] {
+		return 0, false
+	}
+
+	push, value := v.program[address-2], v.program[address-1]
+	if push.Kind != token.Push || value.Kind != token.Number {
+		return 0, false
+	}
+
+	return value.IntegerValue, true
+}
+
+// addCall records a call of routine, and finds the returns ending it the
+// first time it is called.
+func (v *verifier) addCall(address int, routine int) {
+	for _, c := range v.callers[routine] {
+		if c == address {
+			return
+		}
+	}
+
+	v.callers[routine] = append(v.callers[routine], address)
+	if len(v.callers[routine]) > 1 {
+		return
+	}
+
+	v.returns[routine] = v.returnsOf(routine)
+	for _, r := range v.returns[routine] {
+		v.routines[r] = append(v.routines[r], routine)
+	}
+}
+
+// returnsOf finds the returns a routine reaches, stepping over the calls
+// it makes.
+func (v *verifier) returnsOf(routine int) []int {
+	returns := []int{}
+	seen := make(map[int]bool)
+	pending := []int{routine}
+
+	for len(pending) > 0 {
+		address := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if address < 0 || address >= len(v.program) || seen[address] {
+			continue
+		}
+
+		seen[address] = true
+		t := v.program[address]
+		operand := 0
+		if address+1 < len(v.program) {
+			operand = v.program[address+1].IntegerValue
+		}
+
+		switch t.Kind {
+		case token.EndOfLine:
+		case token.Return:
+			returns = append(returns, address)
+		case token.Jump:
+			pending = append(pending, operand)
+		case token.JumpIfTrue, token.JumpIfEqual:
+			pending = append(pending, operand, address+1)
+		case token.Call:
+			pending = append(pending, address+2)
+		default:
+			pending = append(pending, address+1)
+		}
+	}
+
+	return returns
+}
+
+// continueCalls continues the calls of a routine with the height it
+// returns with. The routine is verified for the lowest height it is
+// called with, so a call made with a higher one returns that much higher.
+func (v *verifier) continueCalls(routine int) {
+	entry := v.heights[routine]
+	if entry == unreached {
+		return
+	}
+
+	for _, r := range v.returns[routine] {
+		returned := v.heights[r]
+		if returned == unreached {
+			continue
+		}
+
+		for _, c := range v.callers[routine] {
+			if v.heights[c] != unreached {
+				v.lower(c+2, v.heights[c]+returned-entry)
+			}
+		}
+	}
+}
+
+// systemsLeaveValue reports whether every system returns with a value
+// above the stack it runs on, the one `tick` takes off.
+func (v *verifier) systemsLeaveValue() bool {
+	for _, system := range v.systems {
+		if system < 0 || system >= len(v.program) {
+			continue
+		}
+
+		for _, r := range v.returnsOf(system) {
+			if v.heights[r] != unreached && v.heights[r]-v.heights[system] < 1 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify_Heights(t *testing.T) {
+	program := tokenize(t, "psh 1 psh 2 sum out")
+
+	heights, err := Verify(program)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 1, 2, 2, 1, 0}, heights)
+}
+
+func TestVerify_Branches(t *testing.T) {
+	// The label is reached with 1 value from the jump and 2 from the push
+	// before it, the least one counts.
+	program := tokenize(t, "psh 1 jif a psh 2 :a pop")
+
+	heights, err := Verify(program)
+	require.NoError(t, err)
+	assert.Equal(t, 1, heights[6])
+	assert.Equal(t, 0, heights[8])
+
+	// Code after a jump is not reached.
+	heights, err = Verify(tokenize(t, "jmp a pop :a"))
+	require.NoError(t, err)
+	assert.Equal(t, unreached, heights[2])
+}
+
+func TestVerify_Calls(t *testing.T) {
+	// The routine takes one value and leaves two, whatever the stack it
+	// is called with.
+	program := tokenize(t, "psh 1 call f psh 2 psh 3 call f pop pop pop pop pop jmp end :f dupl 0 ret :end")
+
+	_, err := Verify(program)
+	require.NoError(t, err)
+
+	// One more pop takes the value under the first push.
+	program = tokenize(t, "psh 1 call f pop pop pop jmp end :f dupl 0 ret :end")
+
+	_, err = Verify(program)
+	var verifyErr *VerifyError
+	require.ErrorAs(t, err, &verifyErr)
+	assert.Equal(t, 6, verifyErr.Address)
+
+	_, err = Verify(tokenize(t, fibSource))
+	assert.NoError(t, err)
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"Underflow", "psh 1 sum", "1:7: stack can underflow: sum takes 2, the stack can have 1"},
+		{"Underflow on one branch", "psh 1 jif a psh 2 :a pop pop", "1:26: stack can underflow: pop takes 1, the stack can have 0"},
+		{"Underflow in a loop", "psh 1 :l pop jmp l", "1:10: stack can underflow: pop takes 1, the stack can have 0"},
+		{"Duplicate too deep", "psh 1 dupl 1", "1:7: stack can underflow: dupl takes 2, the stack can have 1"},
+		{"Jump out of the program", "jmp 100", "1:1: jmp 100 is out of the program"},
+		{"Undeclared label", "call nowhere", "1:1: call nowhere is out of the program"},
+		{"Missing operand", "psh", "1:1: psh misses its value"},
+		{"Missing jump target", "psh 1 jif", "1:7: jif misses its label"},
+		{"Operand is an instruction", "psh pop", "1:1: psh expects a value, got pop"},
+		{"Store out of memory", "psh 1 store 70000", "1:7: store address 70000 is out of memory"},
+		{"Routine underflows", "call f jmp end :f pop ret :end", "1:19: stack can underflow: pop takes 1, the stack can have 0"},
+		{"System underflows", "psh 0 system s jmp end :s pop psh 1 ret :end", "1:27: stack can underflow: pop takes 1, the stack can have 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program := tokenize(t, test.source)
+
+			_, err := Verify(program)
+			assert.EqualError(t, err, test.want)
+		})
+	}
+}
+
+func TestVerify_Tick(t *testing.T) {
+	// The system leaves the value `tick` takes.
+	program := tokenize(t, "psh 7 psh 0 system s tick pop jmp end :s psh 1 ret :end")
+	_, err := Verify(program)
+	assert.NoError(t, err)
+
+	// This one does not, so `tick` may take the 7.
+	program = tokenize(t, "psh 7 psh 0 system s tick pop jmp end :s ret :end")
+	_, err = Verify(program)
+	assert.EqualError(t, err, "1:27: stack can underflow: pop takes 1, the stack can have 0")
+}
+
+func TestVirtualMachine_Verify(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	sources := map[string]string{
+		"Fib":               fibSource,
+		"Arithmetic":        arithmeticSource,
+		"Fused arithmetic":  arithmeticFusedSource,
+		"Memory":            "psh 4 store 3 load 3 load 9 sum out",
+		"Branches":          "psh 3 :l psh 1 sub dupl 0 psh 0 jeq end psh 1 jif l :end pop",
+		"Division by zero":  "psh 1 psh 0 div",
+		"Division in block": "psh 6 psh 2 div psh 0 div out",
+		"Fiber returns":     "psh 5 spawn f yield jmp end :f psh 1 sum psh 2 mul ret :end",
+		"Call stack":        ":l call l",
+	}
+
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			program, err := lexer.NewLexer(source).Lex()
+			require.NoError(t, err)
+
+			want, wantOut, wantErr := run(program, fuzzBudget)
+
+			var out bytes.Buffer
+			v := NewVirtualMachine()
+			v.Output = &out
+			v.LoadProgram(program)
+			require.NoError(t, v.Verify())
+			require.True(t, v.Verified())
+
+			err = v.ExecuteFrom(0, fuzzBudget, nil)
+			assert.True(t, v.Verified())
+
+			assert.Equal(t, wantErr, err)
+			assert.Equal(t, want.Stack, v.Stack)
+			assert.Equal(t, want.Memory, v.Memory)
+			assert.Equal(t, want.steps, v.steps)
+			assert.Equal(t, wantOut, out.String())
+		})
+	}
+}
+
+func TestVirtualMachine_VerifyBudget(t *testing.T) {
+	// Budgets running out in the middle of a block stop where the checked
+	// program does.
+	for _, source := range []string{fibSource, "psh 6 psh 2 div psh 0 div out"} {
+		program := tokenize(t, source)
+
+		for budget := 1; budget < 60; budget++ {
+			want, _, wantErr := run(program, budget)
+
+			v := NewVirtualMachine()
+			v.Output = io.Discard
+			v.LoadProgram(program)
+			require.NoError(t, v.Verify())
+
+			assert.Equal(t, wantErr, v.ExecuteFrom(0, budget, nil), budget)
+			assert.Equal(t, want.Stack, v.Stack, budget)
+			assert.Equal(t, want.InstructionPointer, v.InstructionPointer, budget)
+			assert.Equal(t, want.steps, v.steps, budget)
+		}
+	}
+}
+
+func TestVirtualMachine_ExecuteVerified(t *testing.T) {
+	program := tokenize(t, fibSource)
+	want, _, _ := run(program, math.MaxInt)
+
+	v := NewVirtualMachine()
+	v.LoadProgram(program)
+	require.NoError(t, v.Verify())
+
+	v.Execute(-1, false)
+	assert.True(t, v.Verified())
+	assert.Equal(t, want.Stack, v.Stack)
+	assert.Equal(t, want.steps, v.steps)
+}
+
+func TestVirtualMachine_VerifyChecksOtherRuns(t *testing.T) {
+	v := NewVirtualMachine()
+	v.LoadProgram(tokenize(t, "psh 1 :l pop"))
+	require.NoError(t, v.Verify())
+
+	// The label needs a value on the stack, so the run from it is checked.
+	assert.Equal(t, Error(StackUnderflow), v.ExecuteFrom(3, 10, nil))
+	assert.False(t, v.Verified())
+
+	// A new program is not verified.
+	require.NoError(t, v.Verify())
+	v.LoadProgram(tokenize(t, "pop"))
+	assert.False(t, v.Verified())
+	assert.Equal(t, Error(StackUnderflow), v.ExecuteFrom(0, 10, nil))
+}
+
+func BenchmarkExecute_Verified(b *testing.B) {
+	for name, source := range map[string]string{"Fib": fibSource, "Arithmetic": arithmeticFusedSource} {
+		program := tokenize(b, source)
+
+		for _, verified := range []bool{false, true} {
+			mode := "Checked"
+			if verified {
+				mode = "Verified"
+			}
+
+			b.Run(name+"/"+mode, func(b *testing.B) {
+				v := NewVirtualMachine()
+				v.LoadProgram(program)
+				if verified {
+					require.NoError(b, v.Verify())
+				}
+
+				for i := 0; i < b.N; i++ {
+					v.Stack, v.Memory = v.Stack[:0], v.Memory[:0]
+					if err := v.ExecuteFrom(0, math.MaxInt, nil); err != Ok {
+						b.Fatal(err)
+					}
+				}
+
+				require.Equal(b, verified, v.Verified())
+			})
+		}
+	}
+}
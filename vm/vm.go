@@ -2,234 +2,557 @@ package vm
 
 import (
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"os"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/jejikeh/ambient/ecs"
 	"github.com/jejikeh/ambient/lexer"
 	"github.com/jejikeh/ambient/token"
 )
 
+// VirtualMachine runs a Program. It holds the state of the run, the
+// program itself can be shared with other VMs, running at once or not:
+// set Program to run one, or load a new one with LoadProgram.
 type VirtualMachine struct {
+	*Program
+
 	Stack              []int
-	Instructions       []token.Token
-	Labels             map[string]int
-	NotResolvedLabels  map[string]int
 	InstructionPointer int
+
+	// Memory holds the cells addressed by `load` and `store`. It grows on
+	// demand up to MemorySize.
+	Memory []int
+	// CallStack holds the return addresses of `call`.
+	CallStack []int
+
+	// Output receives everything written by `out`, `outc` and `outs`.
+	Output io.Writer
+	// Input is read by `inc`. A nil Input is empty.
+	Input io.Reader
+
+	Profiler *Profiler
+	Coverage *Coverage
+
+	// LastAssertion is set when Run returns AssertionFailed.
+	LastAssertion *AssertionError
+	// LastDeadlock is set when Run returns Deadlock.
+	LastDeadlock *DeadlockError
+
+	// World holds the entities and components of `comp`, `entity` and
+	// `attach`, and runs the systems registered by `system` on `tick`.
+	World *ecs.World
+	// Entity is the entity `getf`, `setf` and `attach` work on: the last
+	// spawned one, or the one a system is running for.
+	Entity ecs.Entity
+
+	// Workers is the number of systems `tick` runs at once, or 0 for
+	// GOMAXPROCS. It does not change what the systems do.
+	Workers int
+
+	components map[int]ecs.ComponentID
+	fields     []fieldRef
+	// routines maps the systems registered by `system` to their routine.
+	routines map[*ecs.System]int
+	// systemDepth counts the systems running, fibers can not be used in
+	// them.
+	systemDepth int
+
+	// fibers is nil until the program uses fibers or channels.
+	fibers *fibers
+
+	// stored is the set of cells a fork stored, which join copies back.
+	// changed holds the fields a fork set, with the value they had before,
+	// which undo puts back. Both are nil on VMs which are not forks.
+	stored  map[int]bool
+	changed map[fieldCell]int
+
+	// steps counts executed instructions, including the ones run by
+	// systems during `tick`, so that they are limited by the budget too.
+	steps     int
+	stepLimit int
 }
 
 func NewVirtualMachine() *VirtualMachine {
 	return &VirtualMachine{
+		Program:            NewProgram(nil),
 		Stack:              make([]int, 0),
-		Instructions:       make([]token.Token, 0),
-		Labels:             make(map[string]int),
-		NotResolvedLabels:  make(map[string]int),
 		InstructionPointer: 0,
+		Memory:             make([]int, 0),
+		CallStack:          make([]int, 0),
+		Output:             os.Stdout,
+		World:              ecs.NewWorld(),
+		components:         make(map[int]ecs.ComponentID),
+		routines:           make(map[*ecs.System]int),
+	}
+}
+
+// LoadNaiveFromSourceFile loads the naive source file at sourcePath with
+// the files it includes.
+func (a *VirtualMachine) LoadNaiveFromSourceFile(sourcePath string) error {
+	program, err := lexer.LoadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	a.LoadProgram(program)
+
+	return nil
+}
+
+// LoadNaiveFromSourceBinary loads the binary program at sourcePath.
+func (a *VirtualMachine) LoadNaiveFromSourceBinary(sourcePath string) error {
+	content, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	return a.LoadNaiveBinary(content)
+}
+
+// LoadNaive loads naive source held in memory. The source can not include
+// files, use LoadNaiveFS for that.
+func (a *VirtualMachine) LoadNaive(source []byte) error {
+	program, err := lexer.LoadSource(source)
+	if err != nil {
+		return err
+	}
+
+	a.LoadProgram(program)
+
+	return nil
+}
+
+// LoadNaiveFromReader loads the naive source read from r.
+func (a *VirtualMachine) LoadNaiveFromReader(r io.Reader) error {
+	program, err := lexer.LoadReader(r)
+	if err != nil {
+		return err
 	}
+
+	a.LoadProgram(program)
+
+	return nil
 }
 
-func (a *VirtualMachine) LoadNaiveFromSourceFile(sourcePath string) {
-	// TODO(jejikeh): fix this allocation
-	l := lexer.NewLexerFromSource(sourcePath)
-	a.LoadProgram(l.Tokenize())
+// LoadNaiveFS loads a naive source file of fsys, such as an embed.FS, and
+// the files it includes.
+func (a *VirtualMachine) LoadNaiveFS(fsys fs.FS, name string) error {
+	program, err := lexer.LoadFS(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	a.LoadProgram(program)
+
+	return nil
 }
 
-func (a *VirtualMachine) LoadNaiveFromSourceBinary(sourcePath string) {
-	// TODO(jejikeh): fix this allocation
-	l := lexer.NewLexerFromBinary(sourcePath)
-	a.LoadProgram(l.Tokens)
+// LoadNaiveBinary loads a program built with -build held in memory.
+func (a *VirtualMachine) LoadNaiveBinary(content []byte) error {
+	program, err := lexer.DecodeTokens(content)
+	if err != nil {
+		return err
+	}
+
+	a.LoadProgram(program)
+
+	return nil
 }
 
+// LoadNaiveBinaryFromReader loads a program built with -build from r.
+func (a *VirtualMachine) LoadNaiveBinaryFromReader(r io.Reader) error {
+	program, err := lexer.ReadTokens(r)
+	if err != nil {
+		return err
+	}
+
+	a.LoadProgram(program)
+
+	return nil
+}
+
+// LoadProgram compiles a program and makes it the one the VM runs.
 func (a *VirtualMachine) LoadProgram(program []token.Token) {
-	a.Instructions = program
+	a.Program = NewProgram(program)
 }
 
+// Verify verifies the loaded program with Verify. A verified program runs
+// without the checks the verifier made, until another one is loaded, and
+// runs the instructions between jumps in blocks, see compileBlocks.
+//
+// The checks are only left out for runs starting at an address the
+// verifier reached, with at least as many values on the stack as it found
+// there and no call to return from. Execute and ExecuteFrom go back to
+// the checked program for other runs.
+func (a *VirtualMachine) Verify() error {
+	verified, err := a.Program.Verify()
+	if err != nil {
+		return err
+	}
+
+	a.Program = verified
+
+	return nil
+}
+
+// checkVerified goes back to the checked program if a run from address
+// would leave the paths the verifier followed.
+func (a *VirtualMachine) checkVerified(address int) {
+	if !a.Verified() || address < 0 || address >= len(a.Instructions) {
+		return
+	}
+
+	height := a.heights[address]
+	if height == unreached || len(a.Stack) < height || len(a.CallStack) > 0 {
+		a.Program = a.checked
+	}
+}
+
+// Run runs the instruction at the instruction pointer.
 func (a *VirtualMachine) Run() Error {
-	if a.InstructionPointer < 0 || a.InstructionPointer >= len(a.Instructions) {
+	if a.InstructionPointer < 0 || a.InstructionPointer >= len(a.code) {
 		return IllegalInstruction
 	}
 
-	instruction := a.Instructions[a.InstructionPointer]
+	run := a.code[a.InstructionPointer]
+	if run == nil {
+		log.Printf("Unknown instruction: [%s]\n", a.Instructions[a.InstructionPointer].Kind)
+		a.InstructionPointer++
+		return Ok
+	}
 
-	switch instruction.Kind {
-	case token.Push:
-		// Push a value onto the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 1
-		//		2. PRINT_STACK: [0, 1, 1]
+	return run(a)
+}
 
-		a.Stack = append(a.Stack, a.Instructions[a.InstructionPointer+1].IntegerValue)
-		a.InstructionPointer++
+// Execute runs the program from the instruction pointer for at most
+// executingLimit instructions, or until it ends when executingLimit is
+// negative, and panics on runtime errors. Unless it prints every
+// instruction, it runs like Continue, so verified programs run in blocks.
+func (a *VirtualMachine) Execute(executingLimit int, printCurrentInstruction bool) {
+	if executingLimit < 0 {
+		executingLimit = math.MaxInt
+	}
 
-	case token.Duplicate:
-		// Duplicate the top of the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. DPLC 0
-		//		2. PRINT_STACK: [0, 1, 0]
+	a.Start(a.InstructionPointer, executingLimit)
+
+	err := Error(Ok)
+	if printCurrentInstruction {
+		err = a.executePrinting(executingLimit)
+	} else {
+		err = a.Continue(executingLimit)
+	}
+
+	if err == Ok || err == BudgetExceeded {
+		return
+	}
+
+	color.Set(color.FgHiRed)
+	defer color.Unset()
+
+	if err == Deadlock && a.LastDeadlock != nil {
+		log.Printf("Error: %s\n", a.LastDeadlock)
+	} else {
+		log.Printf("Error: %s\n", err)
+	}
+
+	a.PrintStack()
+	panic(1)
+}
 
-		if len(a.Stack)-a.Instructions[a.InstructionPointer+1].IntegerValue <= 0 {
-			return StackUnderflow
+// executePrinting runs the program one instruction at a time, logging
+// where the instruction pointer goes.
+func (a *VirtualMachine) executePrinting(budget int) Error {
+	for i := 0; !a.reachedEndOfFile(); i++ {
+		if a.steps >= budget {
+			return BudgetExceeded
 		}
 
-		if instruction.IntegerValue < 0 {
-			return IllegalInstruction
+		if err := a.step(); err != Ok {
+			return err
 		}
 
-		a.Stack = append(a.Stack, a.Stack[len(a.Stack)-1-a.Instructions[a.InstructionPointer+1].IntegerValue])
-		a.InstructionPointer++
+		if a.InstructionPointer >= 0 && a.InstructionPointer < len(a.Instructions) {
+			log.Printf("[%d] Current pointer -> [%d: %s]\n", i, a.InstructionPointer, a.Instructions[a.InstructionPointer].Kind)
+		}
+	}
+
+	return Ok
+}
+
+// reachedEndOfFile reports whether there is nothing left to execute. An
+// out of range instruction pointer is not the end of file, Run reports it.
+func (a *VirtualMachine) reachedEndOfFile() bool {
+	if a.InstructionPointer < 0 || a.InstructionPointer > len(a.Instructions) {
+		return false
+	}
 
-	case token.Sum:
-		// Add the top two values on the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 1
-		// 		2. PSH 1
-		// 		3. SUM
-		//		4. PRINT_STACK: [0, 1, 2]
+	return a.InstructionPointer == len(a.Instructions) || a.Instructions[a.InstructionPointer].Kind == token.EndOfLine
+}
 
-		if len(a.Stack) < 2 {
-			return StackUnderflow
+func (a *VirtualMachine) load(address int) (int, Error) {
+	if address < 0 || address >= MemorySize {
+		return 0, IllegalMemoryAccess
+	}
+
+	if address >= len(a.Memory) {
+		return 0, Ok
+	}
+
+	return a.Memory[address], Ok
+}
+
+func (a *VirtualMachine) store(address int, value int) Error {
+	if address < 0 || address >= MemorySize {
+		return IllegalMemoryAccess
+	}
+
+	if address >= len(a.Memory) {
+		a.Memory = append(a.Memory, make([]int, address+1-len(a.Memory))...)
+	}
+
+	a.Memory[address] = value
+	if a.stored != nil {
+		a.stored[address] = true
+	}
+
+	return Ok
+}
+
+func (a *VirtualMachine) loadString(address int) (string, Error) {
+	length, err := a.load(address)
+	if err != Ok {
+		return "", err
+	}
+
+	if length < 0 || length >= MemorySize {
+		return "", IllegalMemoryAccess
+	}
+
+	runes := make([]rune, 0, length)
+	for i := 1; i <= length; i++ {
+		c, err := a.load(address + i)
+		if err != Ok {
+			return "", err
 		}
 
-		a.Stack[len(a.Stack)-2] = a.Stack[len(a.Stack)-2] + a.Stack[len(a.Stack)-1]
-		a.Stack = a.Stack[:len(a.Stack)-1]
-		a.InstructionPointer++
+		runes = append(runes, rune(c))
+	}
 
-	case token.Subtract:
-		// Subtract the top two values on the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 2
-		// 		2. PSH 1
-		// 		3. SUB
-		// 		4. PRINT_STACK: [0, 1, 1]
+	return string(runes), Ok
+}
+
+// operand returns the value of the token following the current
+// instruction.
+func (a *VirtualMachine) operand() (int, Error) {
+	if a.InstructionPointer+1 >= len(a.Instructions) {
+		return 0, UnknownOperand
+	}
 
-		if len(a.Stack) < 2 {
-			return StackUnderflow
+	return a.Instructions[a.InstructionPointer+1].IntegerValue, Ok
+}
+
+func (a *VirtualMachine) failAssertion(instruction token.Token, message string) Error {
+	a.LastAssertion = &AssertionError{
+		Address: a.InstructionPointer,
+		File:    instruction.File,
+		Line:    instruction.LineStart + 1,
+		Column:  instruction.CollumnStart + 1,
+		Message: message,
+	}
+
+	return AssertionFailed
+}
+
+// ExecuteFrom runs the program starting at address until it reaches the
+// end of file or an address for which stop returns true. Unlike Execute
+// it reports runtime errors instead of panicking, and returns
+// BudgetExceeded after budget instructions.
+func (a *VirtualMachine) ExecuteFrom(address int, budget int, stop func(address int) bool) Error {
+	a.Start(address, budget)
+
+	if stop == nil {
+		return a.Continue(budget)
+	}
+
+	for i := 0; ; i++ {
+		if a.reachedEndOfFile() {
+			return Ok
 		}
 
-		a.Stack[len(a.Stack)-2] = a.Stack[len(a.Stack)-2] - a.Stack[len(a.Stack)-1]
-		a.Stack = a.Stack[:len(a.Stack)-1]
-		a.InstructionPointer++
+		if i > 0 && stop(a.InstructionPointer) {
+			return Ok
+		}
 
-	case token.Multiply:
-		// Multiply the top two values on the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 2
-		// 		2. PSH 2
-		// 		3. MUL
-		// 		4. PRINT_STACK: [0, 1, 4]
+		if a.steps >= budget {
+			return BudgetExceeded
+		}
 
-		if len(a.Stack) < 2 {
-			return StackUnderflow
+		if err := a.step(); err != Ok {
+			return err
 		}
+	}
+}
 
-		a.Stack[len(a.Stack)-2] = a.Stack[len(a.Stack)-2] * a.Stack[len(a.Stack)-1]
-		a.Stack = a.Stack[:len(a.Stack)-1]
-		a.InstructionPointer++
+// Start starts a run at address with a budget of instructions, which
+// Continue runs.
+func (a *VirtualMachine) Start(address int, budget int) {
+	a.InstructionPointer = address
+	a.steps, a.stepLimit = 0, budget
+	a.checkVerified(address)
+}
+
+// Continue runs the run Start started until it ends, fails, or has run
+// steps more instructions. It returns BudgetExceeded both once the steps
+// are run and once the budget is used up, Steps tells them apart. Runs
+// without the profiler and the coverage use the compiled loop.
+func (a *VirtualMachine) Continue(steps int) Error {
+	limit := a.stepLimit
+	if steps < limit-a.steps {
+		limit = a.steps + steps
+	}
+
+	if a.Profiler == nil && a.Coverage == nil {
+		return a.executeCompiled(limit)
+	}
 
-	case token.Divide:
-		// Divide the top two values on the stack.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 4
-		// 		2. PSH 2
-		// 		3. DIV
-		// 		4. PRINT_STACK: [0, 1, 2]
+	for {
+		if a.reachedEndOfFile() {
+			return Ok
+		}
 
-		if len(a.Stack) < 2 {
-			return StackUnderflow
+		if a.steps >= limit {
+			return BudgetExceeded
 		}
 
-		if a.Stack[len(a.Stack)-1] == 0 {
-			return DivisionByZero
+		if err := a.step(); err != Ok {
+			return err
 		}
+	}
+}
 
-		a.Stack[len(a.Stack)-2] = a.Stack[len(a.Stack)-2] / a.Stack[len(a.Stack)-1]
-		a.Stack = a.Stack[:len(a.Stack)-1]
-		a.InstructionPointer++
+// executeCompiled is Continue without the profiler or the coverage,
+// running the compiled program in a tight loop.
+func (a *VirtualMachine) executeCompiled(budget int) Error {
+	if a.blocks != nil {
+		return a.executeBlocks(budget)
+	}
+
+	code := a.code
+
+	for {
+		ip := a.InstructionPointer
+		if ip < 0 || ip >= len(code) {
+			if ip == len(code) {
+				return Ok
+			}
 
-	case token.Jump:
-		// Jump to a new instruction.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. JMP 2
-		// 		2. PRINT_STACK: [0, 1]
-		if a.Instructions[a.InstructionPointer+1].IntegerValue < 0 || a.Instructions[a.InstructionPointer+1].IntegerValue >= len(a.Instructions) {
-			return IllegalInstructionAccess
+			if a.steps >= budget {
+				return BudgetExceeded
+			}
+
+			a.steps++
+			return IllegalInstruction
 		}
 
-		a.InstructionPointer = a.Instructions[a.InstructionPointer+1].IntegerValue
+		run := code[ip]
+		if run == nil {
+			return Ok
+		}
 
-	case token.JumpIfTrue:
-		// Jump to a new instruction if the top of the stack is true (1).
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 0
-		// 		2. PSH 1
-		// 		3. JMPIF 4
-		// 		4. PRINT_STACK: [0, 1]
+		if a.steps >= budget {
+			return BudgetExceeded
+		}
 
-		if len(a.Stack) < 1 {
-			return StackUnderflow
+		a.steps++
+		if err := run(a); err != Ok {
+			return err
 		}
+	}
+}
+
+// executeBlocks is executeCompiled for verified programs, running a block
+// where one starts when the budget has room for all of it.
+func (a *VirtualMachine) executeBlocks(budget int) Error {
+	code, blocks, sizes := a.code, a.blocks, a.sizes
 
-		if a.Stack[len(a.Stack)-1] != 1 {
-			a.InstructionPointer++
-			break
+	for {
+		ip := a.InstructionPointer
+		if ip < 0 || ip >= len(code) {
+			if ip == len(code) {
+				return Ok
+			}
+
+			if a.steps >= budget {
+				return BudgetExceeded
+			}
+
+			a.steps++
+			return IllegalInstruction
 		}
 
-		a.InstructionPointer = a.Instructions[a.InstructionPointer+1].IntegerValue
+		run := code[ip]
+		if run == nil {
+			return Ok
+		}
 
-	case token.Equal:
-		// instruction if the top of the stack is equal.
-		// EXAMPLE:
-		// 		0. PRINT_STACK: [0, 1]
-		// 		1. PSH 1
-		// 		2. PSH 1
-		// 		3. EQ
-		// 		4. PRINT_STACK: [0, 1, 1]
-		if len(a.Stack) < 2 {
-			return StackUnderflow
+		if a.steps >= budget {
+			return BudgetExceeded
 		}
 
-		eq := (a.Stack[len(a.Stack)-2] == a.Stack[len(a.Stack)-1])
-		if eq {
-			a.Stack[len(a.Stack)-2] = 1
+		if size := sizes[ip]; size > 0 && size <= budget-a.steps {
+			a.steps += size
+			run = blocks[ip]
 		} else {
-			a.Stack[len(a.Stack)-2] = 0
+			a.steps++
 		}
 
-		a.Stack = a.Stack[:len(a.Stack)-1]
-		a.InstructionPointer++
-
-	default:
-		log.Printf("Unknown instruction: [%s]\n", instruction.Kind)
-		a.InstructionPointer++
+		if err := run(a); err != Ok {
+			return err
+		}
 	}
+}
 
-	return Ok
+// Steps returns the number of instructions the last run executed.
+func (a *VirtualMachine) Steps() int {
+	return a.steps
 }
 
-func (a *VirtualMachine) Execute(executingLimit int, printCurrentInstruction bool) {
-	isInfinite := executingLimit < 0
-	for i := 0; (i < executingLimit && (a.Instructions[a.InstructionPointer].Kind != token.EndOfLine)) || isInfinite; i++ {
-		err := a.Run()
-		if err != Ok {
-			color.Set(color.FgHiRed)
-			defer color.Unset()
+// step runs one instruction, accounting it in the profiler and the
+// coverage when they are enabled.
+func (a *VirtualMachine) step() Error {
+	a.steps++
 
-			log.Printf("Error: %s\n", err)
-			a.PrintStack()
-			panic(1)
-		}
+	if a.Profiler == nil && a.Coverage == nil {
+		return a.Run()
+	}
 
-		if printCurrentInstruction {
-			log.Printf("[%d] Current pointer -> [%d: %s]\n", i, a.InstructionPointer, a.Instructions[a.InstructionPointer].Kind)
-		}
+	address := a.InstructionPointer
+	instruction := token.Token{}
+	if address >= 0 && address < len(a.Instructions) {
+		instruction = a.Instructions[address]
 	}
+
+	start := time.Now()
+	err := a.Run()
+	elapsed := time.Since(start)
+
+	// A run started at a label steps over it, it is not an instruction
+	// to profile.
+	if a.Profiler != nil && isCoverable(instruction) {
+		a.Profiler.Record(address, instruction.Kind, elapsed)
+	}
+
+	if a.Coverage != nil && err == Ok {
+		taken := a.InstructionPointer != following(a.Instructions, address)
+		a.Coverage.Record(address, instruction.Kind, taken)
+	}
+
+	return err
 }
 
 func (a *VirtualMachine) PrintStack() {
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jejikeh/ambient/lexer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_MemoryCallsAndOutput(t *testing.T) {
+	source := `psh 2 store 10
+psh 104 store 11
+psh 105 store 12
+psh 7 store 3
+call greet
+pop
+jmp end
+:greet
+psh 10 outs
+psh 32 outc
+load 3 out
+psh 3 psh 2 lt
+psh 3 psh 2 gt
+ret
+:end`
+
+	var out bytes.Buffer
+	v := NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(tokenize(t, source))
+
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 1000, nil))
+	assert.Equal(t, "hi 7", out.String())
+	assert.Equal(t, []int{0}, v.Stack)
+	assert.Empty(t, v.CallStack)
+}
+
+func TestRun_MemoryAndCallErrors(t *testing.T) {
+	tests := map[string]struct {
+		source   string
+		expected Error
+	}{
+		"Load outside memory":   {source: "load 65536", expected: IllegalMemoryAccess},
+		"Store without value":   {source: "store 0", expected: StackUnderflow},
+		"Return without call":   {source: "ret", expected: CallStackUnderflow},
+		"Endless recursion":     {source: ":f call f", expected: CallStackOverflow},
+		"String outside memory": {source: "psh 100 store 65530 psh 65530 outs", expected: IllegalMemoryAccess},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := NewVirtualMachine()
+			v.LoadProgram(tokenize(t, tc.source))
+
+			assert.Equal(t, tc.expected, v.ExecuteFrom(0, 100000, nil))
+		})
+	}
+}
+
+func TestContinue(t *testing.T) {
+	program := tokenize(t, scheduledSource)
+
+	var want bytes.Buffer
+	whole := NewVirtualMachine()
+	whole.Output = &want
+	whole.LoadProgram(program)
+	require.Equal(t, Error(Ok), whole.ExecuteFrom(0, 1000, nil))
+
+	// The systems of a tick run to the end, even past the steps asked for.
+	var out bytes.Buffer
+	v := NewVirtualMachine()
+	v.Output = &out
+	v.LoadProgram(program)
+	v.Start(0, 1000)
+
+	err := v.Continue(3)
+	for err == BudgetExceeded && v.Steps() < 1000 {
+		err = v.Continue(3)
+	}
+
+	require.Equal(t, Error(Ok), err)
+	assert.Equal(t, want.String(), out.String())
+	assert.Equal(t, whole.Steps(), v.Steps())
+
+	v.Start(0, 10)
+	assert.Equal(t, Error(BudgetExceeded), v.Continue(4))
+	assert.Equal(t, 4, v.Steps())
+	assert.Equal(t, Error(BudgetExceeded), v.Continue(100))
+	assert.Equal(t, 10, v.Steps())
+}
+
+func TestLoadNaive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.naive": {Data: []byte("include \"lib.naive\"\npsh 21\ncall double")},
+		"lib.naive":  {Data: []byte("export double\n:double psh 2 mul ret")},
+	}
+
+	v := NewVirtualMachine()
+	require.NoError(t, v.LoadNaiveFS(fsys, "main.naive"))
+	require.Equal(t, Error(Ok), v.ExecuteFrom(0, 100, nil))
+	assert.Equal(t, []int{42}, v.Stack)
+
+	var binary bytes.Buffer
+	require.NoError(t, lexer.WriteTokens(&binary, v.Instructions))
+
+	fromBinary := NewVirtualMachine()
+	require.NoError(t, fromBinary.LoadNaiveBinary(binary.Bytes()))
+	assert.Equal(t, v.Instructions, fromBinary.Instructions)
+
+	fromReader := NewVirtualMachine()
+	require.NoError(t, fromReader.LoadNaiveBinaryFromReader(&binary))
+	assert.Equal(t, v.Instructions, fromReader.Instructions)
+
+	fromSource := NewVirtualMachine()
+	require.NoError(t, fromSource.LoadNaiveFromReader(strings.NewReader("psh 1 psh 2 sum")))
+	require.Equal(t, Error(Ok), fromSource.ExecuteFrom(0, 100, nil))
+	assert.Equal(t, []int{3}, fromSource.Stack)
+
+	assert.Error(t, NewVirtualMachine().LoadNaive([]byte("psh 1 /* never closed")))
+	assert.Error(t, NewVirtualMachine().LoadNaiveBinary([]byte("psh 1")))
+}